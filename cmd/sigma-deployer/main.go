@@ -4,11 +4,14 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"slices"
 	"time"
 
 	"github.com/grafana/sigma-rule-deployment/internal/deploy"
 	"github.com/grafana/sigma-rule-deployment/internal/integrate"
+	"github.com/grafana/sigma-rule-deployment/internal/model"
 	"github.com/grafana/sigma-rule-deployment/internal/querytest"
+	"github.com/grafana/sigma-rule-deployment/shared"
 )
 
 func main() {
@@ -27,40 +30,60 @@ func main() {
 		integrator := integrate.NewIntegrator()
 		if err := integrator.LoadConfig(); err != nil {
 			fmt.Printf("Error loading configuration: %v\n", err)
+			reportAnnotations(integrator.Warnings(), err)
 			os.Exit(1)
 		}
 
-		// Run integrator (conversions and cleanup)
-		if err := integrator.Run(); err != nil {
-			fmt.Printf("Error running integrator: %v\n", err)
-			os.Exit(1)
-		}
-
-		// Run query testing if enabled
 		config := integrator.Config()
+		var queryTester *querytest.QueryTester
 		if config.IntegratorConfig.TestQueries {
 			// Parse timeout from configuration
 			timeoutDuration := 10 * time.Second // Default timeout
 			if config.DeployerConfig.Timeout != "" {
 				parsedTimeout, err := time.ParseDuration(config.DeployerConfig.Timeout)
 				if err != nil {
-					fmt.Printf("Warning: Invalid timeout format in config, using default: %v\n", err)
+					integrator.Warnings().Add("Invalid timeout format in config, using default: %v", err)
 				} else {
 					timeoutDuration = parsedTimeout
 				}
 			}
 
-			queryTester := querytest.NewQueryTester(
+			queryTester = querytest.NewQueryTester(
 				config,
 				integrator.TestFiles(),
 				timeoutDuration,
+				integrator.Warnings(),
 			)
-			if err := queryTester.Run(); err != nil {
-				if !config.IntegratorConfig.ContinueOnQueryTestingErrors {
-					fmt.Printf("Error running query tests: %v\n", err)
-					os.Exit(1)
-				}
-			}
+		}
+
+		// When rules must match during testing, or are annotated with their test results, queries are tested
+		// before integration so that rules without any matches are never written, and the rest carry their baseline
+		testFirst := queryTester != nil && (config.IntegratorConfig.RequireTestMatches || config.IntegratorConfig.AnnotateBaseline)
+		if testFirst {
+			runQueryTests(queryTester, config)
+			integrator.SkipFiles(queryTester.NoMatchFiles(), integrate.SkipReasonNoTestMatches)
+			integrator.SetTestResults(queryTester.Results())
+		}
+
+		// Run integrator (conversions and cleanup)
+		if err := integrator.Run(); err != nil {
+			fmt.Printf("Error running integrator: %v\n", err)
+			reportAnnotations(integrator.Warnings(), err)
+			os.Exit(1)
+		}
+
+		// Run query testing if enabled
+		if queryTester != nil && !testFirst {
+			runQueryTests(queryTester, config)
+		}
+
+		printOutputs()
+		reportAnnotations(integrator.Warnings(), nil)
+
+		// In strict mode, any warning fails the integration once outputs have been written
+		if err := integrator.CheckWarnings(); err != nil {
+			fmt.Printf("Error running integrator: %v\n", err)
+			os.Exit(1)
 		}
 	case "deploy":
 		ctx := context.Background()
@@ -73,6 +96,16 @@ func main() {
 
 		deployer.SetClient()
 
+		if err := deployer.CheckOrg(ctx); err != nil {
+			fmt.Printf("Error checking organization: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := deployer.VerifyLockFile(); err != nil {
+			fmt.Printf("Error verifying lock file: %v\n", err)
+			os.Exit(1)
+		}
+
 		var err error
 		if deployer.IsFreshDeploy() {
 			err = deployer.ConfigFreshDeployment(ctx)
@@ -92,6 +125,7 @@ func main() {
 			fmt.Printf("Error writing output: %v\n", err)
 			os.Exit(1)
 		}
+		printOutputs()
 
 		// We only check the deployment error AFTER writing the output so that
 		// we still report the alerts that were created, updated and deleted before the error
@@ -108,3 +142,33 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// runQueryTests runs the query tester, exiting unless query testing errors may be ignored
+func runQueryTests(queryTester *querytest.QueryTester, config model.Configuration) {
+	if err := queryTester.Run(); err != nil {
+		if !config.IntegratorConfig.ContinueOnQueryTestingErrors {
+			fmt.Printf("Error running query tests: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// reportAnnotations reports the warnings located in a file, along with the error if it was caused by a file,
+// as annotations of the offending files
+func reportAnnotations(warnings *shared.Warnings, err error) {
+	annotations := slices.Clone(warnings.Annotations())
+	if annotation, ok := shared.ErrorAnnotation(err); ok {
+		annotations = append(annotations, annotation)
+	}
+	if err := shared.WriteAnnotations(os.Stdout, annotations); err != nil {
+		fmt.Printf("Error writing annotations: %v\n", err)
+	}
+}
+
+// printOutputs prints the outputs as a single JSON object when OUTPUT_FORMAT is json
+func printOutputs() {
+	if err := shared.PrintOutputs(os.Stdout); err != nil {
+		fmt.Printf("Error printing outputs: %v\n", err)
+		os.Exit(1)
+	}
+}
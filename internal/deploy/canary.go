@@ -0,0 +1,41 @@
+package deploy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+
+	"github.com/grafana/sigma-rule-deployment/shared"
+)
+
+// inCanary reports whether an alert is part of the canary subset of a deployment. The selection only depends on
+// the seed and the alert UID, so deploying the same commit again selects the same alerts.
+func inCanary(seed, uid string, percent int) bool {
+	sum := sha256.Sum256([]byte(seed + "/" + uid))
+	return binary.BigEndian.Uint64(sum[:8])%100 < uint64(percent) //nolint:gosec // G115: percent is validated to be between 0 and 100
+}
+
+// selectCanary restricts the alerts to deploy, update and delete to the canary subset, deferring the others
+// to a later deployment. Deferred alerts are left untouched in Grafana, including the ones due for deletion.
+func (d *Deployer) selectCanary() {
+	if d.config.canaryPercent == 0 {
+		return
+	}
+	selected := func(alertFiles []string) []string {
+		canary := []string{}
+		for _, alertFile := range alertFiles {
+			uid := shared.AlertUIDFromFileName(d.config.alertFileNameTemplate, alertFile)
+			// Invalid alert filenames are kept, for the deployment to report them
+			if uid == "" || inCanary(d.config.canarySeed, uid, d.config.canaryPercent) {
+				canary = append(canary, alertFile)
+			} else {
+				d.alertsDeferred = append(d.alertsDeferred, uid)
+			}
+		}
+		return canary
+	}
+	d.config.alertsToRemove = selected(d.config.alertsToRemove)
+	d.config.alertsToAdd = selected(d.config.alertsToAdd)
+	d.config.alertsToUpdate = selected(d.config.alertsToUpdate)
+	log.Printf("Canary deployment of %d%% of the alerts, deferring %d alert(s)", d.config.canaryPercent, len(d.alertsDeferred))
+}
@@ -3,17 +3,23 @@ package deploy
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/grafana/sigma-rule-deployment/internal/model"
 	"github.com/grafana/sigma-rule-deployment/shared"
+	prommodel "github.com/prometheus/common/model"
 )
 
 // sanitizeForLog removes characters that could be used for log injection (e.g. newlines).
@@ -21,12 +27,42 @@ func sanitizeForLog(s string) string {
 	return strings.NewReplacer("\n", " ", "\r", " ").Replace(s)
 }
 
-// Regex to parse the alert UID from the filename
-var regexAlertFilename = regexp.MustCompile(`alert_rule_(?:.*)_([^\.]+)\.json`)
-
 // Timeout for the HTTP requests
 var defaultRequestTimeout = 10 * time.Second
 
+// Minimum alert rule group evaluation interval, matching Grafana's default base interval
+var defaultMinGroupInterval = 10 * time.Second
+
+// Maximum number of alert rule groups whose interval is updated concurrently
+const groupUpdateConcurrency = 4
+
+// Number of attempts at updating the interval of an alert rule group modified by another request in the meantime
+const groupUpdateAttempts = 3
+
+// errGroupConflict is returned when Grafana rejects an alert rule group update as conflicting
+var errGroupConflict = errors.New("alert rule group modified concurrently")
+
+// Base path of the Grafana alerting provisioning API
+const defaultAPIBasePath = "api/v1/provisioning"
+
+// sleep pauses between batches of alert rules, unless the context is cancelled first
+var sleep = func(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Modes of the read-after-write verification of the deployed alerts
+const (
+	verifyWarn = "warn"
+	verifyFail = "fail"
+)
+
 // Structure to store the deployment config
 type deploymentConfig struct {
 	endpoint        string
@@ -40,6 +76,29 @@ type deploymentConfig struct {
 	alertsToUpdate  []string
 	groupsIntervals map[string]int64
 	timeout         time.Duration
+	failOnConflict  bool
+	verifyMode      string
+	// send X-Disable-Provenance so the deployed alerts remain editable in the Grafana UI
+	disableProvenance bool
+	// skip the alert rules whose live source digest matches the digest of their alert file
+	skipUnchanged bool
+	// number of alert rules deleted or created before pausing for batchDelay, zero to disable batching
+	batchSize  int
+	batchDelay time.Duration
+	// template of the alert file names, from which the alert UIDs are recovered
+	alertFileNameTemplate string
+	// don't check the organization of the service account token against orgID
+	skipOrgCheck bool
+	// percentage of the alerts deployed as a canary, zero to deploy all the alerts
+	canaryPercent int
+	// seed of the canary selection, the commit being deployed
+	canarySeed string
+	// only delete the alerts carrying the managed_by annotation
+	requireManagedAnnotation bool
+	// base path of the provisioning API, defaultAPIBasePath if empty
+	apiBasePath string
+	// lock file the deployment folder is checked against, empty to skip the check
+	lockFile string
 }
 
 // Structures to unmarshal the YAML config file
@@ -48,6 +107,10 @@ type Deployer struct {
 	config         deploymentConfig
 	client         *shared.GrafanaClient
 	groupsToUpdate map[string]bool
+	// alert rules left untouched as they were already deployed from the same alert file
+	alertsSkipped []string
+	// alert rules left untouched as they are not part of the canary deployment
+	alertsDeferred []string
 }
 
 func NewDeployer() *Deployer {
@@ -56,6 +119,11 @@ func NewDeployer() *Deployer {
 	}
 }
 
+// apiPath returns the path of an endpoint of the provisioning API, relative to the Grafana instance
+func (d *Deployer) apiPath(endpoint string) string {
+	return strings.Trim(shared.GetConfigValue(d.config.apiBasePath, defaultAPIBasePath, ""), "/") + "/" + endpoint
+}
+
 func (d *Deployer) SetClient() {
 	d.client = shared.NewGrafanaClient(
 		d.config.endpoint,
@@ -63,6 +131,39 @@ func (d *Deployer) SetClient() {
 		"sigma-rule-deployment/deployer",
 		d.config.timeout,
 	)
+	// Keep the deployed alert rules editable in the Grafana UI
+	if d.config.disableProvenance {
+		d.client.SetHeader("X-Disable-Provenance", "true")
+	}
+}
+
+// CheckOrg makes sure the service account token belongs to the organization the alert rules are deployed to,
+// as the alert rules of another organization are invisible to the token and deployments would fail confusingly
+func (d *Deployer) CheckOrg(ctx context.Context) error {
+	if d.config.skipOrgCheck || d.config.orgID == 0 {
+		return nil
+	}
+	res, err := d.client.Get(ctx, "api/org")
+	if err != nil {
+		return fmt.Errorf("error getting the organization of the service account token: %w", err)
+	}
+	defer res.Body.Close()
+
+	if err := shared.CheckStatusCode(res, http.StatusOK); err != nil {
+		return fmt.Errorf("error getting the organization of the service account token: %w", err)
+	}
+	org := struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	}{}
+	if err := shared.ReadJSONResponse(res, &org); err != nil {
+		return err
+	}
+	if org.ID != d.config.orgID {
+		return fmt.Errorf("the service account token belongs to organization %d (%s) but integration.org_id is %d: use a token of organization %d, or set deployment.skip_org_check for tokens with access to several organizations",
+			org.ID, org.Name, d.config.orgID, d.config.orgID)
+	}
+	return nil
 }
 
 func (d *Deployer) IsFreshDeploy() bool {
@@ -70,10 +171,14 @@ func (d *Deployer) IsFreshDeploy() bool {
 }
 
 func (d *Deployer) Deploy(ctx context.Context) ([]string, []string, []string, error) {
+	d.selectCanary()
+
 	// Lists to store the alerts that were created, updated and deleted at any point during the deployment
 	alertsCreated := make([]string, len(d.config.alertsToAdd))
 	alertsUpdated := make([]string, len(d.config.alertsToUpdate))
 	alertsDeleted := make([]string, len(d.config.alertsToRemove))
+	// Alerts created or updated during the deployment, to be verified afterwards
+	alertsDeployed := []model.Alert{}
 
 	log.Printf("Preparing to deploy %d alerts, update %d alerts and delete %d alerts",
 		len(d.config.alertsToAdd), len(d.config.alertsToUpdate), len(d.config.alertsToRemove))
@@ -82,12 +187,25 @@ func (d *Deployer) Deploy(ctx context.Context) ([]string, []string, []string, er
 	// It is important to do this first for the case where an alert
 	// is recreated in a different file (with a different UID), to avoid conflicts on the alert title
 	// By deleting the old one first, we can then create the new one without issues
-	for _, alertFile := range d.config.alertsToRemove {
-		alertUID := getAlertUIDFromFilename(filepath.Base(alertFile))
+	for index, alertFile := range d.config.alertsToRemove {
+		if err := d.endOfBatch(ctx, "deletion", index, len(d.config.alertsToRemove)); err != nil {
+			return alertsCreated, alertsUpdated, alertsDeleted, err
+		}
+		alertUID := shared.AlertUIDFromFileName(d.config.alertFileNameTemplate, alertFile)
 		if alertUID == "" {
 			err := fmt.Errorf("invalid alert filename: %s", alertFile)
 			return alertsCreated, alertsUpdated, alertsDeleted, err
 		}
+		if d.config.requireManagedAnnotation {
+			managed, err := d.isManagedAlert(ctx, alertUID)
+			if err != nil {
+				return alertsCreated, alertsUpdated, alertsDeleted, err
+			}
+			if !managed {
+				log.Printf("Warning: alert %s doesn't have the %s: %s annotation, skipping its deletion", sanitizeForLog(alertUID), shared.ManagedByAnnotation, shared.ManagedByValue) //nolint:gosec // G706: alertUID sanitized with sanitizeForLog before logging
+				continue
+			}
+		}
 		uid, err := d.deleteAlert(ctx, alertUID)
 		if err != nil {
 			return alertsCreated, alertsUpdated, alertsDeleted, err
@@ -98,17 +216,33 @@ func (d *Deployer) Deploy(ctx context.Context) ([]string, []string, []string, er
 			alertsDeleted = append(alertsDeleted, uid)
 		}
 	}
+	if err := d.endOfBatch(ctx, "deletion", len(d.config.alertsToRemove), len(d.config.alertsToRemove)); err != nil {
+		return alertsCreated, alertsUpdated, alertsDeleted, err
+	}
 	// Process alert CREATIONS
-	for _, alertFile := range d.config.alertsToAdd {
-		content, err := shared.ReadLocalFile(alertFile)
+	for index, alertFile := range d.config.alertsToAdd {
+		if err := d.endOfBatch(ctx, "creation", index, len(d.config.alertsToAdd)); err != nil {
+			return alertsCreated, alertsUpdated, alertsDeleted, err
+		}
+		content, err := readAlertFile(alertFile)
 		if err != nil {
 			log.Printf("Can't read file %s: %v", alertFile, err)
 			return alertsCreated, alertsUpdated, alertsDeleted, err
 		}
+		content, skipped, err := d.skipUnchangedAlert(ctx, content)
+		if err != nil {
+			return alertsCreated, alertsUpdated, alertsDeleted, err
+		}
+		if skipped {
+			continue
+		}
 		uid, updated, err := d.createAlert(ctx, content, true)
 		if err != nil {
 			return alertsCreated, alertsUpdated, alertsDeleted, err
 		}
+		if alertsDeployed, err = d.appendAlertToVerify(alertsDeployed, content); err != nil {
+			return alertsCreated, alertsUpdated, alertsDeleted, err
+		}
 		if updated {
 			// If the alert was updated, we need to add it to the list of updated alerts
 			alertsUpdated = append(alertsUpdated, uid)
@@ -117,17 +251,30 @@ func (d *Deployer) Deploy(ctx context.Context) ([]string, []string, []string, er
 			alertsCreated = append(alertsCreated, uid)
 		}
 	}
+	if err := d.endOfBatch(ctx, "creation", len(d.config.alertsToAdd), len(d.config.alertsToAdd)); err != nil {
+		return alertsCreated, alertsUpdated, alertsDeleted, err
+	}
 	// Process alert UPDATES
 	for _, alertFile := range d.config.alertsToUpdate {
-		content, err := shared.ReadLocalFile(alertFile)
+		content, err := readAlertFile(alertFile)
 		if err != nil {
 			log.Printf("Can't read file %s: %v", alertFile, err)
 			return alertsCreated, alertsUpdated, alertsDeleted, err
 		}
+		content, skipped, err := d.skipUnchangedAlert(ctx, content)
+		if err != nil {
+			return alertsCreated, alertsUpdated, alertsDeleted, err
+		}
+		if skipped {
+			continue
+		}
 		uid, created, err := d.updateAlert(ctx, content, true)
 		if err != nil {
 			return alertsCreated, alertsUpdated, alertsDeleted, err
 		}
+		if alertsDeployed, err = d.appendAlertToVerify(alertsDeployed, content); err != nil {
+			return alertsCreated, alertsUpdated, alertsDeleted, err
+		}
 		// Sometimes the alert to update doesn't exist anymore (e.g. it was deleted manually)
 		// In this case, we re-create it instead of updating it
 		// So we take this into account for the reporting
@@ -142,16 +289,111 @@ func (d *Deployer) Deploy(ctx context.Context) ([]string, []string, []string, er
 
 	// Process alert group interval updates
 	if len(d.groupsToUpdate) > 0 {
-		for group := range d.groupsToUpdate {
-			if err := d.updateAlertGroupInterval(ctx, d.config.folderUID, group, d.config.groupsIntervals[group]); err != nil {
-				return alertsCreated, alertsUpdated, alertsDeleted, err
-			}
+		if err := d.updateAlertGroupIntervals(ctx, d.config.folderUID, slices.Collect(maps.Keys(d.groupsToUpdate))); err != nil {
+			return alertsCreated, alertsUpdated, alertsDeleted, err
 		}
 	}
 
+	// Read back the deployed alerts to make sure they are actually present and correct
+	if err := d.verifyDeployedAlerts(ctx, alertsDeployed); err != nil {
+		return alertsCreated, alertsUpdated, alertsDeleted, err
+	}
+
 	return alertsCreated, alertsUpdated, alertsDeleted, nil
 }
 
+// endOfBatch logs the progress of the alert rules processed in batches once a batch is complete,
+// and pauses before the next batch
+func (d *Deployer) endOfBatch(ctx context.Context, operation string, processed, total int) error {
+	size := d.config.batchSize
+	if size <= 0 || processed == 0 || (processed%size != 0 && processed != total) {
+		return nil
+	}
+	log.Printf("Processed batch %d/%d of alert %ss (%d/%d alerts)", (processed+size-1)/size, (total+size-1)/size, operation, processed, total)
+	if processed == total || d.config.batchDelay <= 0 {
+		return nil
+	}
+	return sleep(ctx, d.config.batchDelay)
+}
+
+// skipUnchangedAlert stamps the content of an alert file with its source digest when unchanged alert rules are
+// skipped, and reports whether the live alert rule was already deployed from the same alert file, in which case
+// deploying it again would be a no-op
+func (d *Deployer) skipUnchangedAlert(ctx context.Context, content string) (string, bool, error) {
+	if !d.config.skipUnchanged {
+		return content, false, nil
+	}
+	alert, err := parseAlert(content)
+	if err != nil {
+		return "", false, err
+	}
+	stamped, digest, err := withSourceDigest(content)
+	if err != nil {
+		return "", false, err
+	}
+	// The alert rule may not exist yet, in which case it's deployed as usual
+	liveAlert, err := d.getAlert(ctx, alert.UID)
+	if err != nil || liveAlert.Annotations[SourceDigestAnnotation] != digest || !d.checkAlertsMatch(liveAlert, alert) {
+		return stamped, false, nil
+	}
+	// Keep the interval of the rule group aligned with the config
+	d.groupsToUpdate[alert.RuleGroup] = true
+	d.alertsSkipped = append(d.alertsSkipped, alert.UID)
+	log.Printf("Alert %s (%s) unchanged, skipping it", alert.UID, alert.Title)
+	return stamped, true, nil
+}
+
+// appendAlertToVerify adds a deployed alert to the list of alerts to read back,
+// if the read-after-write verification is enabled
+func (d *Deployer) appendAlertToVerify(alerts []model.Alert, content string) ([]model.Alert, error) {
+	if d.config.verifyMode == "" {
+		return alerts, nil
+	}
+	alert, err := parseAlert(content)
+	if err != nil {
+		return alerts, err
+	}
+	return append(alerts, alert), nil
+}
+
+// verifyDeployedAlerts retrieves each deployed alert from Grafana and compares it to the alert
+// that was sent. Depending on the verification mode, mismatches are either logged or returned as an error.
+func (d *Deployer) verifyDeployedAlerts(ctx context.Context, alerts []model.Alert) error {
+	if d.config.verifyMode == "" || len(alerts) == 0 {
+		return nil
+	}
+	log.Printf("Verifying %d deployed alerts", len(alerts))
+
+	mismatches := []string{}
+	for _, alert := range alerts {
+		deployedAlert, err := d.getAlert(ctx, alert.UID)
+		if err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("alert %s (%s) could not be read back: %v", alert.UID, alert.Title, err))
+			continue
+		}
+		if !d.checkAlertsMatch(deployedAlert, alert) {
+			mismatches = append(mismatches, fmt.Sprintf("alert %s (%s) does not match the deployed alert %s (%s) in folder %s, organization %d and rule group %s",
+				alert.UID, alert.Title, deployedAlert.UID, deployedAlert.Title, deployedAlert.FolderUID, deployedAlert.OrgID, deployedAlert.RuleGroup))
+			continue
+		}
+		if field := alertBodyMismatch(deployedAlert, alert); field != "" {
+			mismatches = append(mismatches, fmt.Sprintf("alert %s (%s) was deployed with a different %s", alert.UID, alert.Title, field))
+		}
+	}
+	if len(mismatches) == 0 {
+		log.Printf("All %d deployed alerts verified", len(alerts))
+		return nil
+	}
+
+	if d.config.verifyMode == verifyFail {
+		return fmt.Errorf("verification of the deployed alerts failed:\n%s", strings.Join(mismatches, "\n"))
+	}
+	for _, mismatch := range mismatches {
+		log.Printf("Warning: %s", sanitizeForLog(mismatch)) //nolint:gosec // G706: mismatch sanitized with sanitizeForLog before logging
+	}
+	return nil
+}
+
 func (d *Deployer) WriteOutput(alertsCreated []string, alertsUpdated []string, alertsDeleted []string) error {
 	alertsCreatedStr := strings.Join(alertsCreated, " ")
 	alertsUpdatedStr := strings.Join(alertsUpdated, " ")
@@ -166,6 +408,12 @@ func (d *Deployer) WriteOutput(alertsCreated []string, alertsUpdated []string, a
 	if err := shared.SetOutput("alerts_deleted", alertsDeletedStr); err != nil {
 		return err
 	}
+	if err := shared.SetOutput("alerts_skipped", strings.Join(d.alertsSkipped, " ")); err != nil {
+		return err
+	}
+	if err := shared.SetOutput("alerts_deferred", strings.Join(d.alertsDeferred, " ")); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -180,6 +428,9 @@ func (d *Deployer) LoadConfig(_ context.Context) error {
 	if err != nil {
 		return err
 	}
+	if err := shared.ApplyEnvOverrides(&configYAML); err != nil {
+		return err
+	}
 	d.config = deploymentConfig{
 		endpoint:        configYAML.DeployerConfig.GrafanaInstance,
 		alertPath:       filepath.Clean(configYAML.Folders.DeploymentPath),
@@ -187,6 +438,27 @@ func (d *Deployer) LoadConfig(_ context.Context) error {
 		folderUID:       configYAML.IntegratorConfig.FolderID,
 		groupsIntervals: make(map[string]int64),
 		timeout:         defaultRequestTimeout,
+		failOnConflict:  configYAML.DeployerConfig.FailOnConflict,
+		verifyMode:      configYAML.DeployerConfig.VerifyAfterDeploy,
+
+		alertFileNameTemplate:    configYAML.IntegratorConfig.AlertFileNameTemplate,
+		disableProvenance:        configYAML.DeployerConfig.DisableProvenance,
+		skipUnchanged:            configYAML.DeployerConfig.SkipUnchanged,
+		batchSize:                configYAML.DeployerConfig.BatchSize,
+		skipOrgCheck:             configYAML.DeployerConfig.SkipOrgCheck,
+		canaryPercent:            configYAML.DeployerConfig.CanaryPercent,
+		requireManagedAnnotation: configYAML.DeployerConfig.RequireManagedAnnotation,
+		apiBasePath:              configYAML.DeployerConfig.APIBasePath,
+		canarySeed:               shared.GetConfigValue(os.Getenv("DEPLOYER_CANARY_SEED"), os.Getenv("GITHUB_SHA"), ""),
+	}
+	if err := shared.ValidateAlertFileNameTemplate(d.config.alertFileNameTemplate); err != nil {
+		return err
+	}
+
+	switch d.config.verifyMode {
+	case "", verifyWarn, verifyFail:
+	default:
+		return fmt.Errorf("invalid verify_after_deploy mode %s: must be one of %s or %s", d.config.verifyMode, verifyWarn, verifyFail)
 	}
 
 	// Parse timeout if provided
@@ -199,6 +471,25 @@ func (d *Deployer) LoadConfig(_ context.Context) error {
 		}
 	}
 
+	if d.config.batchSize < 0 {
+		return fmt.Errorf("invalid batch size %d: must be zero or positive", d.config.batchSize)
+	}
+	if d.config.canaryPercent < 0 || d.config.canaryPercent > 100 {
+		return fmt.Errorf("invalid canary percent %d: must be between 0 and 100", d.config.canaryPercent)
+	}
+	if configYAML.DeployerConfig.VerifyLockFile {
+		if configYAML.IntegratorConfig.LockFile == "" {
+			return fmt.Errorf("verify_lock_file requires integration.lock_file to be set")
+		}
+		d.config.lockFile = configYAML.IntegratorConfig.LockFile
+	}
+	if configYAML.DeployerConfig.BatchDelay != "" {
+		d.config.batchDelay, err = time.ParseDuration(configYAML.DeployerConfig.BatchDelay)
+		if err != nil || d.config.batchDelay < 0 {
+			return fmt.Errorf("invalid batch delay %s: must be a positive duration", configYAML.DeployerConfig.BatchDelay)
+		}
+	}
+
 	// Makes sure the endpoint URL ends with a slash
 	if !strings.HasSuffix(d.config.endpoint, "/") {
 		d.config.endpoint += "/"
@@ -210,6 +501,33 @@ func (d *Deployer) LoadConfig(_ context.Context) error {
 		return fmt.Errorf("the Grafana SA token is not set or empty")
 	}
 
+	minGroupInterval := defaultMinGroupInterval
+	if configYAML.DeployerConfig.MinGroupInterval != "" {
+		minGroupInterval, err = time.ParseDuration(configYAML.DeployerConfig.MinGroupInterval)
+		if err != nil || minGroupInterval < time.Second {
+			return fmt.Errorf("invalid minimum group interval %s: must be a duration of at least 1s", configYAML.DeployerConfig.MinGroupInterval)
+		}
+	}
+
+	// Explicitly configured group intervals take precedence over the ones derived from the time windows
+	pinnedGroups := map[string]bool{}
+	for _, group := range configYAML.RuleGroups {
+		if group.Name == "" {
+			return fmt.Errorf("rule group without a name in rule_groups")
+		}
+		if pinnedGroups[group.Name] {
+			return fmt.Errorf("rule group %s is configured more than once in rule_groups", group.Name)
+		}
+		intervalDuration, err := time.ParseDuration(group.Interval)
+		if err != nil || int64(intervalDuration.Seconds()) <= 0 {
+			return fmt.Errorf("invalid interval %s for rule group %s: must be a duration of at least 1s", group.Interval, group.Name)
+		}
+		intervalDuration = alignGroupInterval(group.Name, intervalDuration, minGroupInterval)
+		d.config.groupsIntervals[group.Name] = int64(intervalDuration.Seconds())
+		pinnedGroups[group.Name] = true
+		log.Printf("Setting interval for rule group %s to %d from rule_groups", sanitizeForLog(group.Name), d.config.groupsIntervals[group.Name]) //nolint:gosec // G706: group.Name sanitized with sanitizeForLog before logging
+	}
+
 	// Extract the groups intervals from the conversion config
 	defaultInterval := "5m"
 	if configYAML.ConversionDefaults.TimeWindow != "" {
@@ -225,6 +543,10 @@ func (d *Deployer) LoadConfig(_ context.Context) error {
 		if err != nil || int64(intervalDuration.Seconds()) <= 0 {
 			return fmt.Errorf("error parsing time window %s: %v", interval, err)
 		}
+		if pinnedGroups[config.RuleGroup] {
+			continue
+		}
+		intervalDuration = alignGroupInterval(config.RuleGroup, intervalDuration, minGroupInterval)
 		if _, ok := d.config.groupsIntervals[config.RuleGroup]; !ok {
 			d.config.groupsIntervals[config.RuleGroup] = int64(intervalDuration.Seconds())
 			log.Printf("Setting interval for rule group %s to %d", sanitizeForLog(config.RuleGroup), d.config.groupsIntervals[config.RuleGroup]) //nolint:gosec // G706: config.RuleGroup sanitized with sanitizeForLog before logging
@@ -236,11 +558,56 @@ func (d *Deployer) LoadConfig(_ context.Context) error {
 	// Retrieve the fresh deploy flag
 	freshDeploy := strings.ToLower(os.Getenv("DEPLOYER_FRESH_DEPLOY")) == "true"
 	d.config.freshDeploy = freshDeploy
+	if freshDeploy {
+		if err := checkFreshDeployInputs(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
+// normalModeInputs lists the environment variables selecting the alert files of a normal deployment
+var normalModeInputs = []string{"ADDED_FILES", "MODIFIED_FILES", "DELETED_FILES", "COPIED_FILES", "DEPLOYER_PLAN", "DEPLOYER_MANIFEST"}
+
+// checkFreshDeployInputs refuses a fresh deployment when the alert files of a normal deployment are also set,
+// as running both modes in one invocation would delete the alert rules and then add or remove a subset of
+// them inconsistently
+func checkFreshDeployInputs() error {
+	var set []string
+	for _, name := range normalModeInputs {
+		if strings.TrimSpace(os.Getenv(name)) != "" {
+			set = append(set, name)
+		}
+	}
+	if len(set) > 0 {
+		return fmt.Errorf("DEPLOYER_FRESH_DEPLOY can't be combined with a normal deployment, unset %s", strings.Join(set, ", "))
+	}
 	return nil
 }
 
+// alignGroupInterval rounds a rule group interval up to the nearest multiple of the minimum interval,
+// as Grafana rejects group intervals below its minimum or not aligned to it
+func alignGroupInterval(group string, interval, minInterval time.Duration) time.Duration {
+	aligned := ((interval + minInterval - 1) / minInterval) * minInterval
+	switch {
+	case interval < minInterval:
+		log.Printf("Warning: time window %s for rule group %s is below the minimum group interval of %s, using %s instead", interval, sanitizeForLog(group), minInterval, aligned) //nolint:gosec // G706: group sanitized with sanitizeForLog before logging
+	case aligned != interval:
+		log.Printf("Warning: time window %s for rule group %s is not a multiple of the minimum group interval of %s, rounding up to %s", interval, sanitizeForLog(group), minInterval, aligned) //nolint:gosec // G706: group sanitized with sanitizeForLog before logging
+	}
+	return aligned
+}
+
 func (d *Deployer) ConfigNormalMode() error {
+	// If a plan or manifest is provided, it takes precedence over the changed files from the environment
+	if planFile := os.Getenv("DEPLOYER_PLAN"); planFile != "" {
+		return d.configFromPlan(planFile)
+	}
+	if manifestFile := os.Getenv("DEPLOYER_MANIFEST"); manifestFile != "" {
+		return d.configFromManifest(manifestFile)
+	}
+
 	// For a normal deployment, we look at the changes in the alert folder
 	alertsToAdd := []string{}
 	alertsToDelete := []string{}
@@ -281,6 +648,93 @@ func (d *Deployer) ConfigNormalMode() error {
 	return nil
 }
 
+// configFromManifest reads the alert files to deploy from a manifest file, for deployments
+// which are not driven by the changed files of a Git push. Each non-empty line of the manifest
+// holds an operation (add, update or delete) followed by the path of an alert file, e.g.
+//
+//	add deployments/alert_rule_conversion_rule_abcd123.json
+//
+// Lines starting with # are ignored.
+func (d *Deployer) configFromManifest(manifestFile string) error {
+	log.Printf("Reading the alert files to deploy from manifest %s", sanitizeForLog(manifestFile)) //nolint:gosec // G706: manifestFile sanitized with sanitizeForLog before logging
+	manifest, err := shared.ReadLocalFile(manifestFile)
+	if err != nil {
+		return fmt.Errorf("error reading deployment manifest %s: %v", manifestFile, err)
+	}
+
+	alertsToAdd := []string{}
+	alertsToDelete := []string{}
+	alertsToUpdate := []string{}
+	for lineNumber, line := range strings.Split(manifest, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid line %d in deployment manifest %s: expected an operation and a file path", lineNumber+1, manifestFile)
+		}
+		filePath := filepath.Clean(fields[1])
+		switch strings.ToLower(fields[0]) {
+		case "add":
+			alertsToAdd = addToAlertList(alertsToAdd, filePath, d.config.alertPath)
+		case "update":
+			alertsToUpdate = addToAlertList(alertsToUpdate, filePath, d.config.alertPath)
+		case "delete":
+			alertsToDelete = addToAlertList(alertsToDelete, filePath, d.config.alertPath)
+		default:
+			return fmt.Errorf("invalid operation %s on line %d in deployment manifest %s: must be one of add, update or delete", fields[0], lineNumber+1, manifestFile)
+		}
+	}
+
+	d.config.alertsToAdd = alertsToAdd
+	d.config.alertsToRemove = alertsToDelete
+	d.config.alertsToUpdate = alertsToUpdate
+
+	return nil
+}
+
+// configFromPlan reads the alert files to deploy from the deployment plan written by the integrator,
+// rather than discovering the changed alert files from Git
+func (d *Deployer) configFromPlan(planFile string) error {
+	log.Printf("Reading the alert files to deploy from plan %s", sanitizeForLog(planFile)) //nolint:gosec // G706: planFile sanitized with sanitizeForLog before logging
+	planJSON, err := shared.ReadLocalFile(planFile)
+	if err != nil {
+		return fmt.Errorf("error reading deployment plan %s: %v", planFile, err)
+	}
+	plan := model.DeploymentPlan{}
+	if err := json.Unmarshal([]byte(planJSON), &plan); err != nil {
+		return fmt.Errorf("error parsing deployment plan %s: %v", planFile, err)
+	}
+
+	alertsToAdd := []string{}
+	alertsToDelete := []string{}
+	alertsToUpdate := []string{}
+	for _, alert := range plan.Alerts {
+		filePath := filepath.Clean(alert.File)
+		// The plan may have been written for another folder or organization than the ones deployed to
+		if (alert.FolderUID != "" && alert.FolderUID != d.config.folderUID) || (alert.OrgID != 0 && alert.OrgID != d.config.orgID) {
+			log.Printf("Warning: alert file %s was planned for folder %s in organization %d, deploying to folder %s in organization %d", sanitizeForLog(filePath), sanitizeForLog(alert.FolderUID), alert.OrgID, sanitizeForLog(d.config.folderUID), d.config.orgID) //nolint:gosec // G706: values sanitized with sanitizeForLog before logging
+		}
+		switch alert.Operation {
+		case model.PlanAdd:
+			alertsToAdd = addToAlertList(alertsToAdd, filePath, d.config.alertPath)
+		case model.PlanUpdate:
+			alertsToUpdate = addToAlertList(alertsToUpdate, filePath, d.config.alertPath)
+		case model.PlanDelete:
+			alertsToDelete = addToAlertList(alertsToDelete, filePath, d.config.alertPath)
+		default:
+			return fmt.Errorf("invalid operation %s for %s in deployment plan %s: must be one of %s, %s or %s", alert.Operation, alert.File, planFile, model.PlanAdd, model.PlanUpdate, model.PlanDelete)
+		}
+	}
+
+	d.config.alertsToAdd = alertsToAdd
+	d.config.alertsToRemove = alertsToDelete
+	d.config.alertsToUpdate = alertsToUpdate
+
+	return nil
+}
+
 func (d *Deployer) ConfigFreshDeployment(ctx context.Context) error {
 	log.Println("Running in fresh deployment mode.")
 	// For a fresh deployment, we'll deploy every alert in the deploment folder, regardless of the changes
@@ -297,6 +751,9 @@ func (d *Deployer) ConfigFreshDeployment(ctx context.Context) error {
 		// We give a fake alert filename so that we can delete it later
 		alertsToRemove[i] = d.fakeAlertFilename(alert)
 	}
+	if len(alertsToAdd) == 0 && len(alertsToRemove) > 0 {
+		log.Printf("Warning: the deployment folder has no alert files, the fresh deployment deletes all the %d alerts of folder %s without creating any", len(alertsToRemove), sanitizeForLog(d.config.folderUID)) //nolint:gosec // G706: folderUID sanitized with sanitizeForLog before logging
+	}
 	d.config.alertsToAdd = alertsToAdd
 	d.config.alertsToRemove = alertsToRemove
 	d.config.alertsToUpdate = []string{}
@@ -337,7 +794,7 @@ func (d *Deployer) createAlert(ctx context.Context, content string, updateIfExis
 	d.groupsToUpdate[alert.RuleGroup] = true
 
 	// Prepare the request
-	res, err := d.client.PostRaw(ctx, "api/v1/provisioning/alert-rules", []byte(content))
+	res, err := d.client.PostRaw(ctx, d.apiPath("alert-rules"), []byte(content))
 	if err != nil {
 		return "", false, err
 	}
@@ -357,7 +814,7 @@ func (d *Deployer) createAlert(ctx context.Context, content string, updateIfExis
 	case http.StatusConflict:
 		// Another alert with the same UID exists
 		// If the alert already exists and we don't want to update it, we return an error
-		if !updateIfExists {
+		if !updateIfExists || d.config.failOnConflict {
 			log.Printf("Alert %s (%s) conflicts with another alert", alert.UID, alert.Title)
 			return "", false, fmt.Errorf("error creating alert: returned status %s", res.Status)
 		}
@@ -386,8 +843,8 @@ func (d *Deployer) tryToUpdateConflictingAlert(ctx context.Context, alert model.
 	// Otherwise, it's an actual conflict
 	if !d.checkAlertsMatch(existingAlert, alert) {
 		// The alert already exists, but with different parameters
-		log.Printf("Alert %s (%s) is conflicting with another alert having the same UID", alert.UID, alert.Title)
-		return "", fmt.Errorf("error creating alert: %v", err)
+		log.Printf("Alert %s (%s) is conflicting with another alert having the same UID (%s)", alert.UID, alert.Title, existingAlert.Title)
+		return "", fmt.Errorf("error creating alert: alert %s conflicts with an existing alert having the same UID", alert.UID)
 	}
 	// The alert already exists, but with the same parameters
 	// In this case, we can proceed to update it
@@ -414,7 +871,7 @@ func (d *Deployer) updateAlert(ctx context.Context, content string, createIfNotF
 	d.groupsToUpdate[alert.RuleGroup] = true
 
 	// Prepare the request
-	path := fmt.Sprintf("api/v1/provisioning/alert-rules/%s", alert.UID)
+	path := d.apiPath("alert-rules/" + alert.UID)
 	res, err := d.client.PutRaw(ctx, path, []byte(content))
 	if err != nil {
 		return "", false, err
@@ -442,9 +899,46 @@ func (d *Deployer) updateAlert(ctx context.Context, content string, createIfNotF
 	return alert.UID, false, nil
 }
 
+// updateAlertGroupIntervals updates the intervals of the alert rule groups, up to groupUpdateConcurrency at a
+// time as the provisioning API updates a single group per request. All the groups are updated even when some
+// fail, and their errors are returned in the order of the group names.
+func (d *Deployer) updateAlertGroupIntervals(ctx context.Context, folderUID string, groups []string) error {
+	slices.Sort(groups)
+	errs := make([]error, len(groups))
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+	for range min(groupUpdateConcurrency, len(groups)) {
+		wg.Go(func() {
+			for index := range indexes {
+				errs[index] = d.updateAlertGroupInterval(ctx, folderUID, groups[index], d.config.groupsIntervals[groups[index]])
+			}
+		})
+	}
+	for index := range groups {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// updateAlertGroupInterval updates the interval of an alert rule group if it differs, reading the group again
+// and retrying when the update conflicts with another modification of the group
 func (d *Deployer) updateAlertGroupInterval(ctx context.Context, folderUID string, group string, interval int64) error {
+	var err error
+	for attempt := 1; attempt <= groupUpdateAttempts; attempt++ {
+		if err = d.tryUpdateAlertGroupInterval(ctx, folderUID, group, interval); !errors.Is(err, errGroupConflict) {
+			return err
+		}
+		log.Printf("Alert group %s/%s was modified while updating its interval (attempt %d/%d)", folderUID, group, attempt, groupUpdateAttempts)
+	}
+	return err
+}
+
+func (d *Deployer) tryUpdateAlertGroupInterval(ctx context.Context, folderUID string, group string, interval int64) error {
 	log.Printf("Checking alert group interval for %s/%s to %d", folderUID, group, interval)
-	path := fmt.Sprintf("api/v1/provisioning/folder/%s/rule-groups/%s", folderUID, group)
+	// Folder UIDs and group names may contain spaces or slashes, which must not change the path
+	path := d.apiPath(fmt.Sprintf("folder/%s/rule-groups/%s", url.PathEscape(folderUID), url.PathEscape(group)))
 
 	// Get the current alert group content
 	res, err := d.client.Get(ctx, path)
@@ -476,6 +970,9 @@ func (d *Deployer) updateAlertGroupInterval(ctx context.Context, folderUID strin
 		}
 		defer updateRes.Body.Close()
 
+		if updateRes.StatusCode == http.StatusConflict {
+			return fmt.Errorf("error updating alert group interval %s/%s: %w", folderUID, group, errGroupConflict)
+		}
 		if err := shared.CheckStatusCode(updateRes, http.StatusOK); err != nil {
 			log.Printf("Can't update alert group interval. Status: %d", updateRes.StatusCode)
 			return fmt.Errorf("error updating alert group interval %s/%s: %w", folderUID, group, err)
@@ -487,7 +984,7 @@ func (d *Deployer) updateAlertGroupInterval(ctx context.Context, folderUID strin
 
 func (d *Deployer) deleteAlert(ctx context.Context, uid string) (string, error) {
 	// Prepare the request
-	path := fmt.Sprintf("api/v1/provisioning/alert-rules/%s", uid)
+	path := d.apiPath("alert-rules/" + uid)
 	res, err := d.client.Delete(ctx, path)
 	if err != nil {
 		return "", err
@@ -508,6 +1005,29 @@ func (d *Deployer) deleteAlert(ctx context.Context, uid string) (string, error)
 	return uid, nil
 }
 
+// isManagedAlert reports whether a live alert carries the managed_by annotation set by the integrator. Missing
+// alerts are reported as managed, leaving it to the deletion to ignore them.
+func (d *Deployer) isManagedAlert(ctx context.Context, uid string) (bool, error) {
+	path := d.apiPath("alert-rules/" + uid)
+	res, err := d.client.Get(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return true, nil
+	}
+	if err := shared.CheckStatusCode(res, http.StatusOK); err != nil {
+		return false, fmt.Errorf("error getting alert %s to check it is managed: %w", uid, err)
+	}
+	alert := model.Alert{}
+	if err := shared.ReadJSONResponse(res, &alert); err != nil {
+		return false, err
+	}
+	return alert.Annotations[shared.ManagedByAnnotation] == shared.ManagedByValue, nil
+}
+
 func (d *Deployer) checkAlertsMatch(a, b model.Alert) bool {
 	if a.UID != b.UID {
 		return false
@@ -518,13 +1038,89 @@ func (d *Deployer) checkAlertsMatch(a, b model.Alert) bool {
 	if a.OrgID != b.OrgID {
 		return false
 	}
+	// Two different rules may collide on the hashed UID, so the title and rule group
+	// must also match for the conflict to be considered a re-creation of the same alert
+	if a.Title != b.Title {
+		return false
+	}
+	if a.RuleGroup != b.RuleGroup {
+		return false
+	}
+
+	return true
+}
+
+// alertBodyMismatch returns the first part of the rule body of a deployed alert rule which differs from the alert
+// rule sent, or an empty string if they match: its queries, condition, pending period or annotations. Grafana may
+// add defaults to the deployed alert rule, e.g. annotations or fields of the query models, so only the values
+// sent are compared.
+func alertBodyMismatch(deployed, sent model.Alert) string {
+	if deployed.Condition != sent.Condition {
+		return "condition"
+	}
+	if !equalDurations(deployed.For, sent.For) {
+		return "pending period"
+	}
+	for key, value := range sent.Annotations {
+		if deployed.Annotations[key] != value {
+			return "annotation " + key
+		}
+	}
+	if len(deployed.Data) != len(sent.Data) {
+		return "number of queries"
+	}
+	for index, query := range sent.Data {
+		deployedQuery := deployed.Data[index]
+		if deployedQuery.RefID != query.RefID || deployedQuery.DatasourceUID != query.DatasourceUID || deployedQuery.RelativeTimeRange != query.RelativeTimeRange {
+			return "query " + query.RefID
+		}
+		if !modelContains(deployedQuery.Model, query.Model) {
+			return "model of query " + query.RefID
+		}
+	}
+	return ""
+}
 
+// equalDurations reports whether two durations of alert rules, e.g. 5m and 300s, are equal. Unset durations are zero.
+func equalDurations(a, b string) bool {
+	parse := func(duration string) (prommodel.Duration, error) {
+		if duration == "" {
+			return 0, nil
+		}
+		return prommodel.ParseDuration(duration)
+	}
+	durationA, errA := parse(a)
+	durationB, errB := parse(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return durationA == durationB
+}
+
+// modelContains reports whether the deployed query model holds all the fields of the query model sent
+func modelContains(deployed, sent json.RawMessage) bool {
+	if len(sent) == 0 {
+		return true
+	}
+	deployedFields := map[string]any{}
+	sentFields := map[string]any{}
+	if err := json.Unmarshal(deployed, &deployedFields); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(sent, &sentFields); err != nil {
+		return false
+	}
+	for key, value := range sentFields {
+		if !reflect.DeepEqual(deployedFields[key], value) {
+			return false
+		}
+	}
 	return true
 }
 
 func (d *Deployer) getAlert(ctx context.Context, uid string) (model.Alert, error) {
 	// Prepare the request
-	path := fmt.Sprintf("api/v1/provisioning/alert-rules/%s", uid)
+	path := d.apiPath("alert-rules/" + uid)
 	res, err := d.client.Get(ctx, path)
 	if err != nil {
 		return model.Alert{}, err
@@ -552,7 +1148,7 @@ func (d *Deployer) listAlerts(ctx context.Context) ([]string, error) {
 
 	alertList := []string{}
 	// Prepare the request
-	res, err := d.client.Get(ctx, "api/v1/provisioning/alert-rules")
+	res, err := d.client.Get(ctx, d.apiPath("alert-rules"))
 	if err != nil {
 		return []string{}, err
 	}
@@ -582,6 +1178,19 @@ func (d *Deployer) listAlerts(ctx context.Context) ([]string, error) {
 	return alertList, nil
 }
 
+// readAlertFile reads an alert file and makes sure it holds an alert, so that errors parsing a
+// hand-edited file point to the file and the location of the error
+func readAlertFile(alertFile string) (string, error) {
+	content, err := shared.ReadLocalFile(alertFile)
+	if err != nil {
+		return "", err
+	}
+	if _, err := parseAlert(content); err != nil {
+		return "", shared.DescribeJSONError(alertFile, []byte(content), err)
+	}
+	return content, nil
+}
+
 func parseAlert(content string) (model.Alert, error) {
 	alert := model.Alert{}
 	if err := json.Unmarshal([]byte(content), &alert); err != nil {
@@ -597,6 +1206,11 @@ func parseAlert(content string) (model.Alert, error) {
 
 func (d *Deployer) listAlertsInDeploymentFolder() ([]string, error) {
 	folderContent, err := os.ReadDir(d.config.alertPath)
+	if os.IsNotExist(err) {
+		// Treated as an empty deployment folder, e.g. when all the alert rules were removed along with the folder
+		log.Printf("Warning: deployment folder %s doesn't exist, there are no alerts to deploy", sanitizeForLog(d.config.alertPath)) //nolint:gosec // G706: alertPath sanitized with sanitizeForLog before logging
+		return []string{}, nil
+	}
 	if err != nil {
 		return []string{}, fmt.Errorf("error reading deployment folder: %v", err)
 	}
@@ -614,14 +1228,10 @@ func (d *Deployer) listAlertsInDeploymentFolder() ([]string, error) {
 }
 
 func (d *Deployer) fakeAlertFilename(uid string) string {
-	filename := fmt.Sprintf("alert_rule_conversion_%s.json", uid)
-	return filepath.Join(d.config.alertPath, filename)
-}
-
-func getAlertUIDFromFilename(filename string) string {
-	matches := regexAlertFilename.FindStringSubmatch(filename)
-	if len(matches) != 2 {
-		return ""
+	filename, err := shared.AlertFileName(d.config.alertFileNameTemplate, "conversion", "grafana", uid)
+	if err != nil {
+		// The template is validated when loading the config
+		filename = fmt.Sprintf("alert_rule_conversion_grafana_%s.json", uid)
 	}
-	return matches[1]
+	return filepath.Join(d.config.alertPath, filename)
 }
@@ -3,16 +3,21 @@ package deploy
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/grafana/sigma-rule-deployment/internal/model"
 	"github.com/grafana/sigma-rule-deployment/shared"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -23,9 +28,9 @@ const (
 )
 
 func TestGetAlertUidFromFileName(t *testing.T) {
-	assert.Equal(t, "abcd123", getAlertUIDFromFilename("alert_rule_conversion_test_file_1_abcd123.json"))
-	assert.Equal(t, "abcd123", getAlertUIDFromFilename("alert_rule_conversion_name_test_file_2_abcd123.json"))
-	assert.Equal(t, "uAaCwL1wlmA", getAlertUIDFromFilename("alert_rule_conversion_test_file_3_uAaCwL1wlmA.json"))
+	assert.Equal(t, "abcd123", shared.AlertUIDFromFileName("", "alert_rule_conversion_test_file_1_abcd123.json"))
+	assert.Equal(t, "abcd123", shared.AlertUIDFromFileName("", "alert_rule_conversion_name_test_file_2_abcd123.json"))
+	assert.Equal(t, "uAaCwL1wlmA", shared.AlertUIDFromFileName("", "alert_rule_conversion_test_file_3_uAaCwL1wlmA.json"))
 }
 
 func TestParseAlert(t *testing.T) {
@@ -110,6 +115,56 @@ func TestParseAlert(t *testing.T) {
 	}
 }
 
+func TestReadAlertFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	tests := []struct {
+		name      string
+		content   string
+		wantError []string
+	}{
+		{
+			name:    "valid alert",
+			content: `{"uid":"abcd123","title":"Test alert","folderUID":"efgh456","orgID":23}`,
+		},
+		{
+			name:      "trailing comma",
+			content:   "{\n  \"uid\": \"abcd123\",\n  \"title\": \"Test alert\",\n  \"folderUID\": \"efgh456\",\n}",
+			wantError: []string{"trailing_comma.json", "line 5, column 1", `efgh456`},
+		},
+		{
+			name:      "comment",
+			content:   "{\n  // edited by hand\n  \"uid\": \"abcd123\"\n}",
+			wantError: []string{"comment.json", "line 2, column 3", "byte offset 4", "edited by hand"},
+		},
+		{
+			name:      "wrong type",
+			content:   `{"uid":"abcd123","title":"Test alert","folderUID":"efgh456","orgID":"23"}`,
+			wantError: []string{"wrong_type.json", "line 1", "orgID", "Alert.orgID of type int64"},
+		},
+		{
+			name:      "not an alert",
+			content:   `{"uid":"abcd123"}`,
+			wantError: []string{"not_an_alert.json", "invalid alert file"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := strings.ReplaceAll(tt.name, " ", "_") + ".json"
+			assert.NoError(t, os.WriteFile(file, []byte(tt.content), 0o600))
+			content, err := readAlertFile(file)
+			if tt.wantError == nil {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.content, content)
+				return
+			}
+			assert.Error(t, err)
+			for _, want := range tt.wantError {
+				assert.Contains(t, err.Error(), want)
+			}
+		})
+	}
+}
+
 func TestAddAlertToList(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -301,6 +356,400 @@ func TestCreateAlert(t *testing.T) {
 	// Simulate a conflict (same alert UID but different org)
 	_, _, err = d.createAlert(ctx, `{"uid":"xyz123","title":"Test alert", "folderUID": "efgh456", "orgID": 45}`, true)
 	assert.NotNil(t, err)
+
+	// Simulate a UID collision between two different rules (same alert UID but different title)
+	_, _, err = d.createAlert(ctx, `{"uid":"xyz123","title":"Another alert", "folderUID": "efgh456", "orgID": 23}`, true)
+	assert.NotNil(t, err)
+
+	// Simulate a UID collision between two different rules (same alert UID but different rule group)
+	_, _, err = d.createAlert(ctx, `{"uid":"xyz123","title":"Test alert", "folderUID": "efgh456", "orgID": 23, "ruleGroup": "Every Hour"}`, true)
+	assert.NotNil(t, err)
+}
+
+func TestCreateAlertFailOnConflict(t *testing.T) {
+	ctx := context.Background()
+
+	server := mockServerCreation(t, []string{
+		`{"uid":"xyz123","title":"Test alert", "folderUID": "efgh456", "orgID": 23}`,
+	})
+	defer server.Close()
+
+	d := Deployer{
+		config: deploymentConfig{
+			endpoint:       server.URL + "/",
+			saToken:        "my-test-token",
+			failOnConflict: true,
+		},
+		client:         shared.NewGrafanaClient(server.URL+"/", "my-test-token", "sigma-rule-deployment/deployer", defaultRequestTimeout),
+		groupsToUpdate: map[string]bool{},
+	}
+
+	// New alerts are still created
+	uid, updated, err := d.createAlert(ctx, `{"uid":"abcd123","title":"Test alert", "folderUID": "efgh456", "orgID": 23}`, true)
+	assert.NoError(t, err)
+	assert.Equal(t, false, updated)
+	assert.Equal(t, "abcd123", uid)
+
+	// A re-creation of a matching alert is not turned into an update
+	_, updated, err = d.createAlert(ctx, `{"uid":"xyz123","title":"Test alert", "folderUID": "efgh456", "orgID": 23}`, true)
+	assert.NotNil(t, err)
+	assert.Equal(t, false, updated)
+}
+
+func TestDisableProvenance(t *testing.T) {
+	for _, disableProvenance := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disable provenance %t", disableProvenance), func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if disableProvenance {
+					assert.Equal(t, "true", r.Header.Get("X-Disable-Provenance"), "%s %s", r.Method, r.URL.Path)
+				} else {
+					assert.Empty(t, r.Header.Values("X-Disable-Provenance"), "%s %s", r.Method, r.URL.Path)
+				}
+				body, err := io.ReadAll(r.Body)
+				assert.NoError(t, err)
+				switch r.Method {
+				case http.MethodPost:
+					w.WriteHeader(http.StatusCreated)
+				case http.MethodPut:
+					w.WriteHeader(http.StatusOK)
+				default:
+					t.Errorf("Unexpected method: %s", r.Method)
+					return
+				}
+				if _, err := w.Write(body); err != nil {
+					t.Errorf("failed to write response body: %v", err)
+				}
+			}))
+			defer server.Close()
+
+			d := NewDeployer()
+			d.config = deploymentConfig{
+				endpoint:          server.URL + "/",
+				saToken:           "my-test-token",
+				timeout:           defaultRequestTimeout,
+				disableProvenance: disableProvenance,
+			}
+			d.SetClient()
+
+			ctx := context.Background()
+			_, _, err := d.createAlert(ctx, `{"uid":"abcd123","title":"Test alert","folderUID":"efgh456","orgID":23}`, false)
+			assert.NoError(t, err)
+			_, _, err = d.updateAlert(ctx, `{"uid":"abcd123","title":"Test alert","folderUID":"efgh456","orgID":23}`, false)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, requests)
+		})
+	}
+}
+
+func TestWithSourceDigest(t *testing.T) {
+	content := `{"uid":"abcd123","title":"Test alert","folderUID":"efgh456","orgID":23,"annotations":{"Query":"{job=\"a\"}"}}`
+	stamped, digest, err := withSourceDigest(content)
+	assert.NoError(t, err)
+	assert.Len(t, digest, 64)
+	alert, err := parseAlert(stamped)
+	assert.NoError(t, err)
+	assert.Equal(t, digest, alert.Annotations[SourceDigestAnnotation])
+
+	// Reformatting the file or stamping it again doesn't change the digest
+	_, reformattedDigest, err := withSourceDigest("{\n  \"orgID\": 23,\n  \"uid\": \"abcd123\", \"title\": \"Test alert\", \"folderUID\": \"efgh456\",\n  \"annotations\": {\"Query\": \"{job=\\\"a\\\"}\"}\n}")
+	assert.NoError(t, err)
+	assert.Equal(t, digest, reformattedDigest)
+	_, stampedDigest, err := withSourceDigest(stamped)
+	assert.NoError(t, err)
+	assert.Equal(t, digest, stampedDigest)
+
+	// Any other change does
+	_, changedDigest, err := withSourceDigest(strings.Replace(content, "Test alert", "Other alert", 1))
+	assert.NoError(t, err)
+	assert.NotEqual(t, digest, changedDigest)
+
+	_, _, err = withSourceDigest("not json")
+	assert.Error(t, err)
+}
+
+func TestDeploySkipUnchanged(t *testing.T) {
+	content := `{"uid":"abcd123","title":"Test alert","folderUID":"efgh456","ruleGroup":"group1","orgID":23}`
+	stamped, digest, err := withSourceDigest(content)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		liveAlert     string
+		expectPut     bool
+		expectUpdated []string
+		expectSkipped []string
+	}{
+		{
+			name:          "matching digest skips the update",
+			liveAlert:     stamped,
+			expectPut:     false,
+			expectSkipped: []string{"abcd123"},
+		},
+		{
+			name:          "differing digest triggers the update",
+			liveAlert:     `{"uid":"abcd123","title":"Test alert","folderUID":"efgh456","ruleGroup":"group1","orgID":23,"annotations":{"SourceDigest":"0123abcd"}}`,
+			expectPut:     true,
+			expectUpdated: []string{"abcd123"},
+		},
+		{
+			name:          "missing digest triggers the update",
+			liveAlert:     content,
+			expectPut:     true,
+			expectUpdated: []string{"abcd123"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			assert.NoError(t, os.WriteFile("alert_rule_conversion_test_abcd123.json", []byte(content), 0o600))
+
+			puts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodGet && r.URL.Path == alertingAPIPrefix+"/abcd123":
+					_, _ = w.Write([]byte(tc.liveAlert))
+				case r.Method == http.MethodPut && r.URL.Path == alertingAPIPrefix+"/abcd123":
+					puts++
+					body, err := io.ReadAll(r.Body)
+					assert.NoError(t, err)
+					// The deployed alert rule is stamped with the digest of its alert file
+					alert, err := parseAlert(string(body))
+					assert.NoError(t, err)
+					assert.Equal(t, digest, alert.Annotations[SourceDigestAnnotation])
+					_, _ = w.Write(body)
+				case r.Method == http.MethodGet && r.URL.Path == "/api/v1/provisioning/folder/efgh456/rule-groups/group1":
+					_, _ = w.Write([]byte(`{"folderUID":"efgh456","interval":300,"rules":[],"title":"group1"}`))
+				default:
+					t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+			}))
+			defer server.Close()
+
+			d := NewDeployer()
+			d.config = deploymentConfig{
+				endpoint:        server.URL + "/",
+				saToken:         "my-test-token",
+				timeout:         defaultRequestTimeout,
+				folderUID:       "efgh456",
+				orgID:           23,
+				skipUnchanged:   true,
+				alertsToUpdate:  []string{"alert_rule_conversion_test_abcd123.json"},
+				groupsIntervals: map[string]int64{"group1": 300},
+			}
+			d.SetClient()
+
+			_, updated, _, err := d.Deploy(context.Background())
+			assert.NoError(t, err)
+			if tc.expectPut {
+				assert.Equal(t, 1, puts)
+			} else {
+				assert.Zero(t, puts)
+			}
+			assert.ElementsMatch(t, tc.expectUpdated, nonEmpty(updated))
+			assert.ElementsMatch(t, tc.expectSkipped, d.alertsSkipped)
+		})
+	}
+}
+
+func TestDeployBatches(t *testing.T) {
+	testCases := []struct {
+		name         string
+		batchSize    int
+		expectPauses [][2]int
+	}{
+		{
+			name:         "batches of 2",
+			batchSize:    2,
+			expectPauses: [][2]int{{2, 0}, {4, 0}, {5, 2}, {5, 4}},
+		},
+		{
+			name:      "single batch",
+			batchSize: 5,
+		},
+		{
+			name: "batching disabled",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			deletions, creations := 0, 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodDelete:
+					deletions++
+					w.WriteHeader(http.StatusNoContent)
+				case r.Method == http.MethodPost:
+					creations++
+					w.WriteHeader(http.StatusCreated)
+					_, _ = w.Write([]byte(`{}`))
+				case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/api/v1/provisioning/folder/"):
+					_, _ = w.Write([]byte(`{"folderUID":"efgh456","interval":300,"rules":[],"title":"group1"}`))
+				default:
+					t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+			}))
+			defer server.Close()
+
+			// Record the progress of the deployment at every pause between batches
+			pauses := [][2]int{}
+			defer func(original func(context.Context, time.Duration) error) { sleep = original }(sleep)
+			sleep = func(_ context.Context, delay time.Duration) error {
+				assert.Equal(t, time.Second, delay)
+				pauses = append(pauses, [2]int{deletions, creations})
+				return nil
+			}
+
+			d := NewDeployer()
+			d.config = deploymentConfig{
+				endpoint:        server.URL + "/",
+				saToken:         "my-test-token",
+				timeout:         defaultRequestTimeout,
+				folderUID:       "efgh456",
+				groupsIntervals: map[string]int64{"group1": 300},
+				batchSize:       tc.batchSize,
+				batchDelay:      time.Second,
+			}
+			d.SetClient()
+			for index := range 5 {
+				d.config.alertsToRemove = append(d.config.alertsToRemove, d.fakeAlertFilename(fmt.Sprintf("old%d", index)))
+				file := fmt.Sprintf("alert_rule_conversion_test_new%d.json", index)
+				content := fmt.Sprintf(`{"uid":"new%d","title":"Alert %d","folderUID":"efgh456","ruleGroup":"group1","orgID":1}`, index, index)
+				assert.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+				d.config.alertsToAdd = append(d.config.alertsToAdd, file)
+			}
+
+			created, _, deleted, err := d.Deploy(context.Background())
+			assert.NoError(t, err)
+			// All the alerts are still processed, deletions first
+			assert.Equal(t, 5, deletions)
+			assert.Equal(t, 5, creations)
+			assert.Len(t, nonEmpty(created), 5)
+			assert.Len(t, nonEmpty(deleted), 5)
+			if tc.expectPauses == nil {
+				assert.Empty(t, pauses)
+			} else {
+				assert.Equal(t, tc.expectPauses, pauses)
+			}
+		})
+	}
+}
+
+func TestInCanary(t *testing.T) {
+	selected := 0
+	for index := range 1000 {
+		uid := fmt.Sprintf("alert%d", index)
+		canary := inCanary("0a1b2c3d", uid, 10)
+		// The selection is deterministic for a given seed
+		assert.Equal(t, canary, inCanary("0a1b2c3d", uid, 10))
+		// Growing the canary keeps the alerts already selected
+		if canary {
+			selected++
+			assert.True(t, inCanary("0a1b2c3d", uid, 50))
+		}
+		assert.False(t, inCanary("0a1b2c3d", uid, 0))
+		assert.True(t, inCanary("0a1b2c3d", uid, 100))
+	}
+	assert.InDelta(t, 100, selected, 30)
+
+	// Another commit selects other alerts
+	differs := false
+	for index := range 100 {
+		uid := fmt.Sprintf("alert%d", index)
+		differs = differs || inCanary("0a1b2c3d", uid, 10) != inCanary("4e5f6a7b", uid, 10)
+	}
+	assert.True(t, differs)
+}
+
+func TestDeployCanary(t *testing.T) {
+	t.Chdir(t.TempDir())
+	touched := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodDelete:
+			touched = append(touched, strings.TrimPrefix(r.URL.Path, alertingAPIPrefix+"/"))
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodPost:
+			alert := model.Alert{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&alert))
+			touched = append(touched, alert.UID)
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{}`))
+		case http.MethodGet:
+			_, _ = w.Write([]byte(`{"folderUID":"efgh456","interval":300,"rules":[],"title":"group1"}`))
+		case http.MethodPut:
+			touched = append(touched, strings.TrimPrefix(r.URL.Path, alertingAPIPrefix+"/"))
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	d := NewDeployer()
+	d.config = deploymentConfig{
+		endpoint:        server.URL + "/",
+		saToken:         "my-test-token",
+		timeout:         defaultRequestTimeout,
+		folderUID:       "efgh456",
+		groupsIntervals: map[string]int64{"group1": 300},
+		canaryPercent:   30,
+		canarySeed:      "0a1b2c3d",
+	}
+	d.SetClient()
+	wantCanary, wantDeferred := []string{}, []string{}
+	for index := range 10 {
+		for _, operation := range []string{"old", "new", "changed"} {
+			uid := fmt.Sprintf("%s%d", operation, index)
+			if inCanary(d.config.canarySeed, uid, d.config.canaryPercent) {
+				wantCanary = append(wantCanary, uid)
+			} else {
+				wantDeferred = append(wantDeferred, uid)
+			}
+			if operation == "old" {
+				d.config.alertsToRemove = append(d.config.alertsToRemove, d.fakeAlertFilename(uid))
+				continue
+			}
+			file := fmt.Sprintf("alert_rule_conversion_test_%s.json", uid)
+			content := fmt.Sprintf(`{"uid":"%s","title":"Alert %s","folderUID":"efgh456","ruleGroup":"group1","orgID":1}`, uid, uid)
+			assert.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+			if operation == "new" {
+				d.config.alertsToAdd = append(d.config.alertsToAdd, file)
+			} else {
+				d.config.alertsToUpdate = append(d.config.alertsToUpdate, file)
+			}
+		}
+	}
+	require.NotEmpty(t, wantCanary)
+	require.NotEmpty(t, wantDeferred)
+
+	created, updated, deleted, err := d.Deploy(context.Background())
+	require.NoError(t, err)
+	// Only the canary alerts are deployed or deleted, the deferred ones are left untouched
+	assert.ElementsMatch(t, wantCanary, touched)
+	assert.ElementsMatch(t, wantCanary, append(append(nonEmpty(created), nonEmpty(updated)...), nonEmpty(deleted)...))
+	assert.ElementsMatch(t, wantDeferred, d.alertsDeferred)
+
+	t.Setenv("GITHUB_OUTPUT", "output")
+	require.NoError(t, d.WriteOutput(created, updated, deleted))
+	output, err := os.ReadFile("output")
+	require.NoError(t, err)
+	assert.Contains(t, string(output), "alerts_deferred="+strings.Join(d.alertsDeferred, " ")+"\n")
+}
+
+// nonEmpty filters out the empty UIDs the alert lists returned by Deploy are pre-allocated with
+func nonEmpty(uids []string) []string {
+	result := []string{}
+	for _, uid := range uids {
+		if uid != "" {
+			result = append(result, uid)
+		}
+	}
+	return result
 }
 
 func mockServerCreation(t *testing.T, existingAlerts []string) *httptest.Server {
@@ -410,6 +859,233 @@ func mockServerCreation(t *testing.T, existingAlerts []string) *httptest.Server
 	return server
 }
 
+func TestVerifyDeployedAlerts(t *testing.T) {
+	deployed := []model.Alert{
+		{UID: "abcd123", Title: "Test alert", FolderUID: "efgh456", RuleGroup: "group1", OrgID: 23},
+	}
+	var deployedWithBody []model.Alert
+	require.NoError(t, json.Unmarshal([]byte(`[{"uid":"abcd123","title":"Test alert","folderUID":"efgh456","ruleGroup":"group1","orgID":23,`+
+		`"condition":"C","for":"5m","annotations":{"Query":"{job=\"a\"}"},`+
+		`"data":[{"refId":"A0","datasourceUid":"loki","relativeTimeRange":{"from":300,"to":0},"model":{"refId":"A0","expr":"sum(count_over_time({job=\"a\"}[5m]))"}}]}]`), &deployedWithBody))
+	readbackWithBody := func(condition, forDuration, query, expr string) string {
+		return `{"uid":"abcd123","title":"Test alert","folderUID":"efgh456","ruleGroup":"group1","orgID":23,` +
+			`"condition":"` + condition + `","for":"` + forDuration + `","annotations":{"Query":"` + query + `","SourceDigest":"digest"},` +
+			`"data":[{"refId":"A0","datasourceUid":"loki","relativeTimeRange":{"from":300,"to":0},"model":{"refId":"A0","expr":"` + expr + `","intervalMs":1000}}]}`
+	}
+	tests := []struct {
+		name       string
+		verifyMode string
+		sent       []model.Alert
+		readback   string
+		status     int
+		wantError  bool
+	}{
+		{
+			name:       "readback body matches with defaults added by Grafana",
+			verifyMode: verifyFail,
+			sent:       deployedWithBody,
+			readback:   readbackWithBody("C", "300s", `{job=\"a\"}`, `sum(count_over_time({job=\"a\"}[5m]))`),
+			status:     http.StatusOK,
+		},
+		{
+			name:       "readback query model diverges",
+			verifyMode: verifyFail,
+			sent:       deployedWithBody,
+			readback:   readbackWithBody("C", "5m", `{job=\"a\"}`, `sum(count_over_time({job=\"b\"}[5m]))`),
+			status:     http.StatusOK,
+			wantError:  true,
+		},
+		{
+			name:       "readback annotation diverges",
+			verifyMode: verifyFail,
+			sent:       deployedWithBody,
+			readback:   readbackWithBody("C", "5m", `{job=\"b\"}`, `sum(count_over_time({job=\"a\"}[5m]))`),
+			status:     http.StatusOK,
+			wantError:  true,
+		},
+		{
+			name:       "readback condition diverges",
+			verifyMode: verifyFail,
+			sent:       deployedWithBody,
+			readback:   readbackWithBody("B", "5m", `{job=\"a\"}`, `sum(count_over_time({job=\"a\"}[5m]))`),
+			status:     http.StatusOK,
+			wantError:  true,
+		},
+		{
+			name:       "readback pending period diverges",
+			verifyMode: verifyFail,
+			sent:       deployedWithBody,
+			readback:   readbackWithBody("C", "1m", `{job=\"a\"}`, `sum(count_over_time({job=\"a\"}[5m]))`),
+			status:     http.StatusOK,
+			wantError:  true,
+		},
+		{
+			name:       "readback matches",
+			verifyMode: verifyFail,
+			readback:   `{"uid":"abcd123","title":"Test alert","folderUID":"efgh456","ruleGroup":"group1","orgID":23}`,
+			status:     http.StatusOK,
+		},
+		{
+			name:       "readback diverges in fail mode",
+			verifyMode: verifyFail,
+			readback:   `{"uid":"abcd123","title":"Other alert","folderUID":"efgh456","ruleGroup":"group1","orgID":23}`,
+			status:     http.StatusOK,
+			wantError:  true,
+		},
+		{
+			name:       "readback diverges in warn mode",
+			verifyMode: verifyWarn,
+			readback:   `{"uid":"abcd123","title":"Test alert","folderUID":"other","ruleGroup":"group1","orgID":23}`,
+			status:     http.StatusOK,
+		},
+		{
+			name:       "alert missing in fail mode",
+			verifyMode: verifyFail,
+			readback:   `{"message":"not found"}`,
+			status:     http.StatusNotFound,
+			wantError:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet || r.URL.Path != alertingAPIPrefix+"/abcd123" {
+					t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+					return
+				}
+				w.WriteHeader(tt.status)
+				if _, err := w.Write([]byte(tt.readback)); err != nil {
+					t.Errorf("failed to write response body: %v", err)
+				}
+			}))
+			defer server.Close()
+
+			d := Deployer{
+				config: deploymentConfig{
+					endpoint:   server.URL + "/",
+					saToken:    "my-test-token",
+					verifyMode: tt.verifyMode,
+				},
+				client:         shared.NewGrafanaClient(server.URL+"/", "my-test-token", "sigma-rule-deployment/deployer", defaultRequestTimeout),
+				groupsToUpdate: map[string]bool{},
+			}
+			sent := deployed
+			if tt.sent != nil {
+				sent = tt.sent
+			}
+			err := d.verifyDeployedAlerts(context.Background(), sent)
+			if tt.wantError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckOrg(t *testing.T) {
+	tests := []struct {
+		name         string
+		orgID        int64
+		skipOrgCheck bool
+		wantRequest  bool
+		wantErr      string
+	}{
+		{
+			name:        "token of the configured organization",
+			orgID:       23,
+			wantRequest: true,
+		},
+		{
+			name:        "token of another organization",
+			orgID:       1,
+			wantRequest: true,
+			wantErr:     "the service account token belongs to organization 23 (Security) but integration.org_id is 1",
+		},
+		{
+			name:         "check skipped for multi-org tokens",
+			orgID:        1,
+			skipOrgCheck: true,
+		},
+		{
+			name:  "no organization configured",
+			orgID: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requested := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/api/org", r.URL.Path)
+				assert.Equal(t, http.MethodGet, r.Method)
+				assert.Equal(t, authToken, r.Header.Get("Authorization"))
+				requested = true
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"id":23,"name":"Security"}`))
+			}))
+			defer server.Close()
+
+			d := Deployer{
+				config: deploymentConfig{
+					orgID:        tt.orgID,
+					skipOrgCheck: tt.skipOrgCheck,
+				},
+				client: shared.NewGrafanaClient(server.URL+"/", "my-test-token", "sigma-rule-deployment/deployer", defaultRequestTimeout),
+			}
+			err := d.CheckOrg(context.Background())
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantRequest, requested)
+		})
+	}
+}
+
+func TestVerifyLockFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll("deploy", 0o755))
+	alertFile := filepath.Join("deploy", "alert_rule_conv_rule_abcd123.json")
+	content := `{"uid":"abcd123","title":"Test alert","folderUID":"efgh456","ruleGroup":"group1","annotations":{}}`
+	require.NoError(t, os.WriteFile(alertFile, []byte(content), 0o600))
+
+	lock, err := shared.LockAlerts("deploy", "")
+	require.NoError(t, err)
+	lockBytes, err := json.Marshal(lock)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile("srd.lock", lockBytes, 0o600))
+
+	d := NewDeployer()
+	d.config = deploymentConfig{alertPath: "deploy"}
+
+	// Without a lock file, nothing is checked
+	assert.NoError(t, d.VerifyLockFile())
+
+	// The deployment folder matches the lock file
+	d.config.lockFile = "srd.lock"
+	assert.NoError(t, d.VerifyLockFile())
+
+	// Reformatting an alert file doesn't change its digest
+	require.NoError(t, os.WriteFile(alertFile, []byte(strings.ReplaceAll(content, ",", ",\n  ")), 0o600))
+	assert.NoError(t, d.VerifyLockFile())
+
+	// A changed alert file doesn't match
+	require.NoError(t, os.WriteFile(alertFile, []byte(strings.Replace(content, "group1", "group2", 1)), 0o600))
+	assert.ErrorContains(t, d.VerifyLockFile(), "doesn't match the lock file srd.lock: 1 difference(s)")
+
+	// Neither does an alert file missing from the lock file
+	require.NoError(t, os.WriteFile(alertFile, []byte(content), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join("deploy", "alert_rule_conv_other_ijkl456.json"), []byte(`{"uid":"ijkl456","title":"Other alert"}`), 0o600))
+	assert.ErrorContains(t, d.VerifyLockFile(), "1 difference(s)")
+
+	// Nor a missing locked alert file
+	require.NoError(t, os.Remove(alertFile))
+	assert.ErrorContains(t, d.VerifyLockFile(), "2 difference(s)")
+}
+
 func TestDeleteAlert(t *testing.T) {
 	ctx := context.Background()
 
@@ -445,6 +1121,153 @@ func TestDeleteAlert(t *testing.T) {
 	assert.Equal(t, "abcd123", uid)
 }
 
+func TestAPIBasePath(t *testing.T) {
+	testCases := []struct {
+		name         string
+		apiBasePath  string
+		expectedBase string
+	}{
+		{
+			name:         "default base path",
+			apiBasePath:  "",
+			expectedBase: "/api/v1/provisioning",
+		},
+		{
+			name:         "configured base path",
+			apiBasePath:  "api/v2/provisioning",
+			expectedBase: "/api/v2/provisioning",
+		},
+		{
+			name:         "configured base path with slashes",
+			apiBasePath:  "/grafana/api/v2/provisioning/",
+			expectedBase: "/grafana/api/v2/provisioning",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			requests := []string{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests = append(requests, r.Method+" "+r.URL.Path)
+				switch r.Method {
+				case http.MethodDelete:
+					w.WriteHeader(http.StatusNoContent)
+				case http.MethodGet:
+					w.WriteHeader(http.StatusOK)
+					if strings.Contains(r.URL.Path, "/rule-groups/") {
+						_, _ = w.Write([]byte(`{"folderUID":"efgh456","interval":300,"rules":[],"title":"group1"}`))
+					} else {
+						_, _ = w.Write([]byte(`[]`))
+					}
+				default:
+					t.Errorf("Unexpected method: %s", r.Method)
+				}
+			}))
+			defer server.Close()
+
+			d := NewDeployer()
+			d.config = deploymentConfig{
+				endpoint:    server.URL + "/",
+				saToken:     "my-test-token",
+				folderUID:   "efgh456",
+				apiBasePath: tc.apiBasePath,
+				timeout:     defaultRequestTimeout,
+			}
+			d.SetClient()
+
+			_, err := d.deleteAlert(ctx, "abcd123")
+			require.NoError(t, err)
+			_, err = d.listAlerts(ctx)
+			require.NoError(t, err)
+			require.NoError(t, d.updateAlertGroupInterval(ctx, "efgh456", "group1", 300))
+
+			assert.Equal(t, []string{
+				"DELETE " + tc.expectedBase + "/alert-rules/abcd123",
+				"GET " + tc.expectedBase + "/alert-rules",
+				"GET " + tc.expectedBase + "/folder/efgh456/rule-groups/group1",
+			}, requests)
+		})
+	}
+}
+
+func TestDeployRequireManagedAnnotation(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations string
+		status      int
+		wantDeleted bool
+	}{
+		{
+			name:        "managed alert is deleted",
+			annotations: `{"managed_by":"srd","Query":"{job=\"a\"}"}`,
+			status:      http.StatusOK,
+			wantDeleted: true,
+		},
+		{
+			name:        "unmanaged alert is kept",
+			annotations: `{"Query":"{job=\"a\"}"}`,
+			status:      http.StatusOK,
+		},
+		{
+			name:        "alert managed by another tool is kept",
+			annotations: `{"managed_by":"terraform"}`,
+			status:      http.StatusOK,
+		},
+		{
+			name:   "missing alert is ignored",
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			deleteRequested := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, alertingAPIPrefix+"/abcd123", r.URL.Path)
+				switch r.Method {
+				case http.MethodGet:
+					w.WriteHeader(tc.status)
+					if tc.status == http.StatusOK {
+						_, _ = fmt.Fprintf(w, `{"uid":"abcd123","title":"Test alert","folderUID":"efgh456","annotations":%s}`, tc.annotations)
+					}
+				case http.MethodDelete:
+					deleteRequested = true
+					if tc.status == http.StatusNotFound {
+						w.WriteHeader(http.StatusNotFound)
+					} else {
+						w.WriteHeader(http.StatusNoContent)
+					}
+				default:
+					t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+				}
+			}))
+			defer server.Close()
+
+			d := NewDeployer()
+			d.config = deploymentConfig{
+				endpoint:                 server.URL + "/",
+				saToken:                  "my-test-token",
+				timeout:                  defaultRequestTimeout,
+				folderUID:                "efgh456",
+				requireManagedAnnotation: true,
+				alertsToRemove:           []string{d.fakeAlertFilename("abcd123")},
+			}
+			d.SetClient()
+
+			_, _, deleted, err := d.Deploy(context.Background())
+			require.NoError(t, err)
+			if tc.wantDeleted {
+				assert.Equal(t, []string{"abcd123"}, nonEmpty(deleted))
+			} else {
+				assert.Empty(t, nonEmpty(deleted))
+			}
+			// Deleting a missing alert is left to the deletion, which ignores it
+			assert.Equal(t, tc.wantDeleted || tc.status == http.StatusNotFound, deleteRequested)
+		})
+	}
+}
+
 func TestListAlerts(t *testing.T) {
 	ctx := context.Background()
 
@@ -575,11 +1398,295 @@ func TestLoadConfig(t *testing.T) {
 		"group1": 600,   // 10m in seconds
 		"group2": 3600,  // 1h in seconds
 		"group3": 21600, // 6h (default) in seconds
+		"group4": 50,    // 45s rounded up to a multiple of 10s
 	}
 
 	assert.Equal(t, expectedIntervals, d.config.groupsIntervals)
 }
 
+func TestLoadConfigEnvOverrides(t *testing.T) {
+	t.Setenv("CONFIG_PATH", "test_config.yml")
+	t.Setenv("DEPLOYER_GRAFANA_SA_TOKEN", "my-test-token")
+	t.Setenv("GRAFANA_INSTANCE", "https://staging.grafana.net")
+	t.Setenv("FOLDER_ID", "staging-folder")
+	t.Setenv("ORG_ID", "42")
+
+	d := NewDeployer()
+	assert.NoError(t, d.LoadConfig(context.Background()))
+	assert.Equal(t, "https://staging.grafana.net/", d.config.endpoint)
+	assert.Equal(t, "staging-folder", d.config.folderUID)
+	assert.Equal(t, int64(42), d.config.orgID)
+
+	t.Setenv("ORG_ID", "not-a-number")
+	assert.Error(t, NewDeployer().LoadConfig(context.Background()))
+}
+
+func TestLoadConfigFreshDeployGuard(t *testing.T) {
+	t.Setenv("CONFIG_PATH", "test_config.yml")
+	t.Setenv("DEPLOYER_GRAFANA_SA_TOKEN", "my-test-token")
+	t.Setenv("DEPLOYER_FRESH_DEPLOY", "true")
+	for _, name := range normalModeInputs {
+		t.Setenv(name, "")
+	}
+
+	// A fresh deployment without changed files is allowed, blank lists are ignored
+	t.Setenv("ADDED_FILES", " ")
+	d := NewDeployer()
+	require.NoError(t, d.LoadConfig(context.Background()))
+	assert.True(t, d.IsFreshDeploy())
+
+	// Changed files, a plan or a manifest select a normal deployment, which can't run alongside it
+	t.Setenv("ADDED_FILES", "deployments/alert_rule_conversion_test_file_1_abcd123.json")
+	t.Setenv("DEPLOYER_MANIFEST", "manifest.txt")
+	err := NewDeployer().LoadConfig(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ADDED_FILES, DEPLOYER_MANIFEST")
+
+	t.Setenv("ADDED_FILES", "")
+	t.Setenv("DEPLOYER_MANIFEST", "")
+	t.Setenv("DELETED_FILES", "deployments/alert_rule_conversion_test_file_5_opqr123.json")
+	assert.ErrorContains(t, NewDeployer().LoadConfig(context.Background()), "DELETED_FILES")
+
+	// Without the fresh deploy flag, the changed files are deployed normally
+	t.Setenv("DEPLOYER_FRESH_DEPLOY", "false")
+	d = NewDeployer()
+	require.NoError(t, d.LoadConfig(context.Background()))
+	assert.False(t, d.IsFreshDeploy())
+}
+
+func TestLoadConfigRuleGroups(t *testing.T) {
+	baseConfig := `folders:
+  deployment_path: deployments
+conversions:
+  - rule_group: group1
+    time_window: 10m
+  - rule_group: group1
+    # Conflicting time windows are fine in a group with an explicit interval
+    time_window: 20m
+  - rule_group: group2
+    time_window: 1h
+integration:
+  folder_id: abcdef123
+  org_id: 23
+deployment:
+  grafana_instance: https://myinstance.grafana.com
+`
+	tests := []struct {
+		name          string
+		ruleGroups    string
+		wantIntervals map[string]int64
+		wantError     bool
+	}{
+		{
+			name: "explicit intervals override the derived ones",
+			ruleGroups: `rule_groups:
+  - name: group1
+    interval: 30m
+  - name: shared
+    interval: 45s
+`,
+			wantIntervals: map[string]int64{
+				"group1": 1800,
+				"group2": 3600,
+				"shared": 50, // rounded up to a multiple of 10s
+			},
+		},
+		{
+			name: "invalid interval",
+			ruleGroups: `rule_groups:
+  - name: group1
+    interval: often
+`,
+			wantError: true,
+		},
+		{
+			name: "duplicate group",
+			ruleGroups: `rule_groups:
+  - name: group1
+    interval: 30m
+  - name: group1
+    interval: 1h
+`,
+			wantError: true,
+		},
+		{
+			name:      "conflicting time windows without an explicit interval",
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			assert.NoError(t, os.WriteFile("config.yml", []byte(baseConfig+tt.ruleGroups), 0o600))
+			t.Setenv("CONFIG_PATH", "config.yml")
+			t.Setenv("DEPLOYER_GRAFANA_SA_TOKEN", "my-test-token")
+
+			d := NewDeployer()
+			err := d.LoadConfig(context.Background())
+			if tt.wantError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantIntervals, d.config.groupsIntervals)
+		})
+	}
+}
+
+func TestConfigNormalModeManifest(t *testing.T) {
+	tests := []struct {
+		name       string
+		manifest   string
+		wantAdd    []string
+		wantUpdate []string
+		wantRemove []string
+		wantError  bool
+	}{
+		{
+			name: "add, update and delete operations",
+			manifest: `# Alerts to deploy
+add deployments/alert_rule_conversion_test_file_1_abcd123.json
+ADD deployments/alert_rule_conversion_test_file_2_def3456789.json
+
+update deployments/alert_rule_conversion_test_file_3_ghij123.json
+delete deployments/alert_rule_conversion_test_file_4_klmn123.json
+add other/alert_rule_conversion_test_file_5_opqr123.json
+`,
+			wantAdd: []string{
+				"deployments/alert_rule_conversion_test_file_1_abcd123.json",
+				"deployments/alert_rule_conversion_test_file_2_def3456789.json",
+			},
+			wantUpdate: []string{"deployments/alert_rule_conversion_test_file_3_ghij123.json"},
+			wantRemove: []string{"deployments/alert_rule_conversion_test_file_4_klmn123.json"},
+		},
+		{
+			name:       "empty manifest",
+			manifest:   "",
+			wantAdd:    []string{},
+			wantUpdate: []string{},
+			wantRemove: []string{},
+		},
+		{
+			name:      "unknown operation",
+			manifest:  "rename deployments/alert_rule_conversion_test_file_1_abcd123.json\n",
+			wantError: true,
+		},
+		{
+			name:      "missing file path",
+			manifest:  "add\n",
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			assert.NoError(t, os.WriteFile("manifest.txt", []byte(tt.manifest), 0o600))
+			t.Setenv("DEPLOYER_MANIFEST", "manifest.txt")
+			// The changed files from the environment are ignored when a manifest is provided
+			t.Setenv("ADDED_FILES", "deployments/alert_rule_conversion_test_file_6_stuv123.json")
+
+			d := NewDeployer()
+			d.config.alertPath = "deployments"
+			err := d.ConfigNormalMode()
+			if tt.wantError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantAdd, d.config.alertsToAdd)
+			assert.Equal(t, tt.wantUpdate, d.config.alertsToUpdate)
+			assert.Equal(t, tt.wantRemove, d.config.alertsToRemove)
+		})
+	}
+
+	t.Run("missing manifest", func(t *testing.T) {
+		t.Chdir(t.TempDir())
+		t.Setenv("DEPLOYER_MANIFEST", "missing.txt")
+		d := NewDeployer()
+		d.config.alertPath = "deployments"
+		assert.Error(t, d.ConfigNormalMode())
+	})
+}
+
+func TestConfigNormalModePlan(t *testing.T) {
+	t.Chdir(t.TempDir())
+	plan := model.DeploymentPlan{Alerts: []model.PlannedAlert{
+		{Operation: model.PlanAdd, File: "deployments/alert_rule_conversion_test_file_1_abcd123.json", UID: "abcd123", FolderUID: "abcdef123", RuleGroup: "group1", OrgID: 23},
+		{Operation: model.PlanUpdate, File: "deployments/alert_rule_conversion_test_file_2_def3456789.json", UID: "def3456789", FolderUID: "abcdef123", RuleGroup: "group1", OrgID: 23},
+		{Operation: model.PlanDelete, File: "deployments/alert_rule_conversion_test_file_3_ghij123.json", UID: "ghij123"},
+		// Files outside the deployment folder are ignored
+		{Operation: model.PlanAdd, File: "other/alert_rule_conversion_test_file_4_klmn123.json"},
+	}}
+	planBytes, err := json.Marshal(plan)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile("plan.json", planBytes, 0o600))
+	t.Setenv("DEPLOYER_PLAN", "plan.json")
+	// The changed files from the environment are ignored when a plan is provided
+	t.Setenv("ADDED_FILES", "deployments/alert_rule_conversion_test_file_6_stuv123.json")
+
+	d := NewDeployer()
+	d.config.alertPath = "deployments"
+	d.config.folderUID = "abcdef123"
+	d.config.orgID = 23
+	assert.NoError(t, d.ConfigNormalMode())
+	assert.Equal(t, []string{"deployments/alert_rule_conversion_test_file_1_abcd123.json"}, d.config.alertsToAdd)
+	assert.Equal(t, []string{"deployments/alert_rule_conversion_test_file_2_def3456789.json"}, d.config.alertsToUpdate)
+	assert.Equal(t, []string{"deployments/alert_rule_conversion_test_file_3_ghij123.json"}, d.config.alertsToRemove)
+
+	// Invalid plans are rejected
+	assert.NoError(t, os.WriteFile("plan.json", []byte(`{"alerts":[{"operation":"rename","file":"deployments/alert_rule_a_b_c.json"}]}`), 0o600))
+	assert.Error(t, d.ConfigNormalMode())
+	assert.NoError(t, os.WriteFile("plan.json", []byte(`not json`), 0o600))
+	assert.Error(t, d.ConfigNormalMode())
+}
+
+func TestAlignGroupInterval(t *testing.T) {
+	tests := []struct {
+		name        string
+		interval    time.Duration
+		minInterval time.Duration
+		want        time.Duration
+	}{
+		{
+			name:        "valid window is unchanged",
+			interval:    30 * time.Second,
+			minInterval: defaultMinGroupInterval,
+			want:        30 * time.Second,
+		},
+		{
+			name:        "window equal to the minimum is unchanged",
+			interval:    10 * time.Second,
+			minInterval: defaultMinGroupInterval,
+			want:        10 * time.Second,
+		},
+		{
+			name:        "sub-minimum window is raised to the minimum",
+			interval:    5 * time.Second,
+			minInterval: defaultMinGroupInterval,
+			want:        10 * time.Second,
+		},
+		{
+			name:        "unaligned window is rounded up",
+			interval:    45 * time.Second,
+			minInterval: defaultMinGroupInterval,
+			want:        50 * time.Second,
+		},
+		{
+			name:        "custom minimum",
+			interval:    90 * time.Second,
+			minInterval: time.Minute,
+			want:        2 * time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, alignGroupInterval("group", tt.interval, tt.minInterval))
+		})
+	}
+}
+
 func TestFakeAlertFilename(t *testing.T) {
 	d := Deployer{
 		config: deploymentConfig{
@@ -587,7 +1694,7 @@ func TestFakeAlertFilename(t *testing.T) {
 		},
 		client: shared.NewGrafanaClient("", "", "sigma-rule-deployment/deployer", defaultRequestTimeout),
 	}
-	assert.Equal(t, "abcd123", getAlertUIDFromFilename(d.fakeAlertFilename("abcd123")))
+	assert.Equal(t, "abcd123", shared.AlertUIDFromFileName("", d.fakeAlertFilename("abcd123")))
 }
 
 func TestListAlertsInDeploymentFolder(t *testing.T) {
@@ -683,6 +1790,19 @@ func TestUpdateAlertGroupInterval(t *testing.T) {
 			responseBody:       `{"folderUID":"folder-with_special.chars","interval":600,"rules":[],"title":"group-with_special.chars"}`,
 			expectedRequestURL: "/api/v1/provisioning/folder/folder-with_special.chars/rule-groups/group-with_special.chars",
 		},
+		{
+			name:               "space and slash in group",
+			folderUID:          "folder123",
+			group:              "Okta logins/5m",
+			interval:           300,
+			currentInterval:    300,
+			getStatusCode:      http.StatusOK,
+			putStatusCode:      http.StatusOK,
+			expectError:        false,
+			expectPutRequest:   false,
+			responseBody:       `{"folderUID":"folder123","interval":300,"rules":[],"title":"Okta logins/5m"}`,
+			expectedRequestURL: "/api/v1/provisioning/folder/folder123/rule-groups/Okta%20logins%2F5m",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -691,8 +1811,8 @@ func TestUpdateAlertGroupInterval(t *testing.T) {
 
 			// Create a test server that validates our requests
 			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				// Check the URL is what we expect
-				assert.Equal(t, tc.expectedRequestURL, r.URL.Path)
+				// Check the URL is what we expect, with the folder and group escaped
+				assert.Equal(t, tc.expectedRequestURL, r.URL.EscapedPath())
 
 				// Validate authorization header
 				assert.Equal(t, authToken, r.Header.Get("Authorization"))
@@ -752,3 +1872,97 @@ func TestUpdateAlertGroupInterval(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateAlertGroupIntervals(t *testing.T) {
+	// Current intervals of the groups in Grafana
+	current := map[string]int64{"group1": 300, "group2": 600, "group3": 60, "Okta logins/5m": 60, "broken": 60}
+	var (
+		mu        sync.Mutex
+		updated   = map[string]int64{}
+		conflicts = 0
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group := strings.TrimPrefix(r.URL.Path, "/api/v1/provisioning/folder/folder123/rule-groups/")
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			w.WriteHeader(http.StatusOK)
+			assert.NoError(t, json.NewEncoder(w).Encode(model.AlertRuleGroup{Title: group, FolderUID: "folder123", Interval: current[group]}))
+		case http.MethodPut:
+			var body model.AlertRuleGroup
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			switch {
+			case group == "broken":
+				w.WriteHeader(http.StatusBadRequest)
+			case group == "group3" && conflicts == 0:
+				// The first update of group3 conflicts with another modification of the group
+				conflicts++
+				w.WriteHeader(http.StatusConflict)
+			default:
+				updated[group] = body.Interval
+				w.WriteHeader(http.StatusOK)
+			}
+		}
+	}))
+	defer server.Close()
+
+	d := Deployer{
+		config: deploymentConfig{
+			endpoint:        server.URL + "/",
+			saToken:         "my-test-token",
+			groupsIntervals: map[string]int64{"group1": 600, "group2": 600, "group3": 120, "Okta logins/5m": 300, "broken": 120},
+		},
+		client: shared.NewGrafanaClient(server.URL+"/", "my-test-token", "sigma-rule-deployment/deployer", defaultRequestTimeout),
+	}
+
+	// The other groups are updated despite the failure of one group
+	err := d.updateAlertGroupIntervals(context.Background(), "folder123", []string{"group1", "group2", "group3", "Okta logins/5m", "broken"})
+	assert.ErrorContains(t, err, "error updating alert group interval folder123/broken")
+	assert.Equal(t, map[string]int64{"group1": 600, "group3": 120, "Okta logins/5m": 300}, updated)
+	assert.Equal(t, 1, conflicts)
+
+	// Groups which keep conflicting fail after the last attempt
+	conflicts = 0
+	d.config.groupsIntervals["group3"] = 180
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			conflicts++
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"folderUID":"folder123","interval":60,"rules":[],"title":"group3"}`))
+	})
+	err = d.updateAlertGroupIntervals(context.Background(), "folder123", []string{"group3"})
+	assert.ErrorIs(t, err, errGroupConflict)
+	assert.Equal(t, groupUpdateAttempts, conflicts)
+}
+
+func TestConfigFreshDeploymentMissingFolder(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != alertingAPIPrefix {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`[{"uid":"abcd123","title":"Test alert","folderUID":"efgh456","orgID":23}]`))
+	}))
+	defer server.Close()
+
+	d := NewDeployer()
+	d.config = deploymentConfig{
+		endpoint:    server.URL + "/",
+		saToken:     "my-test-token",
+		alertPath:   filepath.Join(t.TempDir(), "missing"),
+		folderUID:   "efgh456",
+		orgID:       23,
+		freshDeploy: true,
+		timeout:     defaultRequestTimeout,
+	}
+	d.SetClient()
+
+	require.NoError(t, d.ConfigFreshDeployment(ctx))
+	assert.Empty(t, d.config.alertsToAdd)
+	assert.Equal(t, []string{d.fakeAlertFilename("abcd123")}, d.config.alertsToRemove)
+}
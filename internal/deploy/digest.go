@@ -0,0 +1,66 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/grafana/sigma-rule-deployment/shared"
+)
+
+// SourceDigestAnnotation is the annotation holding the digest of the alert file an alert rule was deployed from
+const SourceDigestAnnotation = shared.SourceDigestAnnotation
+
+// withSourceDigest returns the content of an alert file with the SourceDigest annotation set, along with the digest.
+// The digest is computed over the canonical JSON of the rest of the file, so reformatting the file or editing the
+// annotation by hand doesn't change it.
+func withSourceDigest(content string) (string, string, error) {
+	digest, err := shared.AlertFileDigest(content)
+	if err != nil {
+		return "", "", err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(content)))
+	decoder.UseNumber()
+	rule := map[string]any{}
+	if err := decoder.Decode(&rule); err != nil {
+		return "", "", fmt.Errorf("error parsing alert file: %v", err)
+	}
+	annotations, ok := rule["annotations"].(map[string]any)
+	if !ok {
+		annotations = map[string]any{}
+		rule["annotations"] = annotations
+	}
+	annotations[SourceDigestAnnotation] = digest
+	stamped, err := json.Marshal(rule)
+	if err != nil {
+		return "", "", fmt.Errorf("error marshalling alert file: %v", err)
+	}
+	return string(stamped), digest, nil
+}
+
+// VerifyLockFile checks that the alert files of the deployment folder match the lock file written by the
+// integrator, so that the deployed alert rules are exactly the locked ones
+func (d *Deployer) VerifyLockFile() error {
+	if d.config.lockFile == "" {
+		return nil
+	}
+	locked, err := shared.ReadAlertLock(d.config.lockFile)
+	if err != nil {
+		return err
+	}
+	current, err := shared.LockAlerts(d.config.alertPath, "")
+	if err != nil {
+		return err
+	}
+	diffs := shared.CompareAlertLocks(locked, current)
+	for _, diff := range diffs {
+		log.Printf("Warning: %s", sanitizeForLog(diff)) //nolint:gosec // G706: diff sanitized with sanitizeForLog before logging
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("the deployment folder doesn't match the lock file %s: %d difference(s)", d.config.lockFile, len(diffs))
+	}
+	log.Printf("Deployment folder matches the lock file %s", sanitizeForLog(d.config.lockFile)) //nolint:gosec // G706: lockFile sanitized with sanitizeForLog before logging
+	return nil
+}
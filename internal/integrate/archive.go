@@ -0,0 +1,175 @@
+package integrate
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ArchiveManifestName is the name of the file in the conversion path listing the conversion files extracted
+// from conversion archives, which the conversion files of later archives may overwrite
+const ArchiveManifestName = ".srdarchive"
+
+// maxArchiveEntrySize is the maximum size in bytes of a conversion file extracted from an archive,
+// guarding against decompression bombs
+const maxArchiveEntrySize = 64 << 20
+
+// archiveEntry is a regular file of a conversion archive
+type archiveEntry struct {
+	name string
+	open func() (io.ReadCloser, error)
+}
+
+// extractConversionArchive extracts the conversion files of a .zip, .tar.gz, .tgz or .tar archive into dir,
+// for them to be integrated like changed conversion files. The entries are flattened into dir, and entries
+// other than JSON files are skipped. Entries with paths escaping the archive are rejected, so an archive can't
+// write outside dir, as are entries which would overwrite a conversion file not extracted from an archive, as
+// listed in the archive manifest. The archive is read in full before any file is written, so an invalid archive
+// leaves dir untouched. The extracted files are recorded in the manifest and returned sorted.
+func extractConversionArchive(archive, dir string) ([]string, error) {
+	fromArchives, err := readArchiveManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	var extracted []string
+	contents := map[string][]byte{}
+	extract := func(entry archiveEntry) error {
+		name := filepath.FromSlash(entry.name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid entry %s in conversion archive %s: path is not local", entry.name, archive)
+		}
+		if !strings.HasSuffix(name, ".json") {
+			return nil
+		}
+		file := filepath.Join(dir, filepath.Base(name))
+		if slices.Contains(extracted, file) {
+			return fmt.Errorf("invalid entry %s in conversion archive %s: another entry is also named %s", entry.name, archive, filepath.Base(name))
+		}
+		reader, err := entry.open()
+		if err != nil {
+			return fmt.Errorf("error reading %s from conversion archive %s: %v", entry.name, archive, err)
+		}
+		defer reader.Close()
+		content, err := io.ReadAll(io.LimitReader(reader, maxArchiveEntrySize+1))
+		if err != nil {
+			return fmt.Errorf("error reading %s from conversion archive %s: %v", entry.name, archive, err)
+		}
+		if len(content) > maxArchiveEntrySize {
+			return fmt.Errorf("invalid entry %s in conversion archive %s: larger than %d bytes", entry.name, archive, maxArchiveEntrySize)
+		}
+		if _, err := os.Stat(file); err == nil && !slices.Contains(fromArchives, filepath.Base(file)) {
+			return fmt.Errorf("invalid entry %s in conversion archive %s: it would overwrite the conversion file %s", entry.name, archive, file)
+		}
+		contents[file] = content
+		extracted = append(extracted, file)
+		return nil
+	}
+
+	switch {
+	case strings.HasSuffix(archive, ".zip"):
+		err = walkZipArchive(archive, extract)
+	case strings.HasSuffix(archive, ".tar.gz"), strings.HasSuffix(archive, ".tgz"), strings.HasSuffix(archive, ".tar"):
+		err = walkTarArchive(archive, extract)
+	default:
+		err = fmt.Errorf("unsupported conversion archive %s: must be a .zip, .tar.gz, .tgz or .tar file", archive)
+	}
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(extracted)
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating conversion directory: %v", err)
+	}
+	for _, file := range extracted {
+		if err := os.WriteFile(file, contents[file], 0o644); err != nil { //nolint:gosec // G306: the extracted conversion files are committed, so the runner user must be able to read them
+			return nil, fmt.Errorf("error extracting %s from conversion archive %s: %v", filepath.Base(file), archive, err)
+		}
+		if !slices.Contains(fromArchives, filepath.Base(file)) {
+			fromArchives = append(fromArchives, filepath.Base(file))
+		}
+	}
+	slices.Sort(fromArchives)
+	manifest := filepath.Join(dir, ArchiveManifestName)
+	if err := os.WriteFile(manifest, []byte(strings.Join(fromArchives, "\n")+"\n"), 0o644); err != nil { //nolint:gosec // G306: the manifest is committed along with the conversion files
+		return nil, fmt.Errorf("error writing archive manifest %s: %v", manifest, err)
+	}
+	return extracted, nil
+}
+
+// readArchiveManifest returns the names of the conversion files of dir extracted from conversion archives,
+// listed one per line in its archive manifest, if any
+func readArchiveManifest(dir string) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(dir, ArchiveManifestName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading archive manifest: %v", err)
+	}
+	var names []string
+	for line := range strings.Lines(string(content)) {
+		if name := strings.TrimSpace(line); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// walkZipArchive calls fn with each regular file of a zip archive
+func walkZipArchive(archive string, fn func(archiveEntry) error) error {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return fmt.Errorf("error opening conversion archive %s: %v", archive, err)
+	}
+	defer reader.Close()
+	for _, file := range reader.File {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		if err := fn(archiveEntry{name: file.Name, open: file.Open}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkTarArchive calls fn with each regular file of a tar archive, gzip compressed unless it has the .tar extension
+func walkTarArchive(archive string, fn func(archiveEntry) error) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return fmt.Errorf("error opening conversion archive %s: %v", archive, err)
+	}
+	defer file.Close()
+	var stream io.Reader = file
+	if !strings.HasSuffix(archive, ".tar") {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("error opening conversion archive %s: %v", archive, err)
+		}
+		defer gzipReader.Close()
+		stream = gzipReader
+	}
+	reader := tar.NewReader(stream)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading conversion archive %s: %v", archive, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(archiveEntry{name: header.Name, open: func() (io.ReadCloser, error) { return io.NopCloser(reader), nil }}); err != nil {
+			return err
+		}
+	}
+}
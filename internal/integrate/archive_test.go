@@ -0,0 +1,228 @@
+package integrate
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeZipArchive writes a zip archive of the files, keyed by entry name
+func writeZipArchive(t *testing.T, archive string, files map[string]string) {
+	out, err := os.Create(archive)
+	require.NoError(t, err)
+	defer out.Close()
+	writer := zip.NewWriter(out)
+	for name, content := range files {
+		entry, err := writer.Create(name)
+		require.NoError(t, err)
+		_, err = entry.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+}
+
+// writeTarGzArchive writes a gzip compressed tar archive of the files, keyed by entry name
+func writeTarGzArchive(t *testing.T, archive string, files map[string]string) {
+	out, err := os.Create(archive)
+	require.NoError(t, err)
+	defer out.Close()
+	gzipWriter := gzip.NewWriter(out)
+	writer := tar.NewWriter(gzipWriter)
+	for name, content := range files {
+		require.NoError(t, writer.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := writer.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	require.NoError(t, gzipWriter.Close())
+}
+
+func TestExtractConversionArchive(t *testing.T) {
+	tests := []struct {
+		name      string
+		archive   string
+		files     map[string]string
+		existing  []string
+		manifest  string
+		want      []string
+		wantError string
+	}{
+		{
+			name:    "zip",
+			archive: "conversions.zip",
+			files:   map[string]string{"out/conv_a.json": `{"a":1}`, "out/conv_b.json": `{"b":2}`, "out/README.md": "skipped"},
+			want:    []string{filepath.Join("conv", "conv_a.json"), filepath.Join("conv", "conv_b.json")},
+		},
+		{
+			name:    "tar.gz",
+			archive: "conversions.tar.gz",
+			files:   map[string]string{"conv_a.json": `{"a":1}`},
+			want:    []string{filepath.Join("conv", "conv_a.json")},
+		},
+		{
+			name:      "zip slip",
+			archive:   "conversions.zip",
+			files:     map[string]string{"../../evil.json": `{}`},
+			wantError: "path is not local",
+		},
+		{
+			name:      "tar slip",
+			archive:   "conversions.tgz",
+			files:     map[string]string{"/etc/evil.json": `{}`},
+			wantError: "path is not local",
+		},
+		{
+			name:      "duplicate names",
+			archive:   "conversions.zip",
+			files:     map[string]string{"a/conv_a.json": `{}`, "b/conv_a.json": `{}`},
+			wantError: "another entry is also named conv_a.json",
+		},
+		{
+			name:      "existing conversion file",
+			archive:   "conversions.zip",
+			files:     map[string]string{"out/conv_a.json": `{"a":1}`, "out/conv_b.json": `{"b":2}`},
+			existing:  []string{"conv_b.json"},
+			wantError: "it would overwrite the conversion file " + filepath.Join("conv", "conv_b.json"),
+		},
+		{
+			name:     "conversion file of an earlier archive",
+			archive:  "conversions.zip",
+			files:    map[string]string{"out/conv_a.json": `{"a":1}`, "out/conv_b.json": `{"b":2}`},
+			existing: []string{"conv_b.json"},
+			manifest: "conv_b.json\nconv_c.json\n",
+			want:     []string{filepath.Join("conv", "conv_a.json"), filepath.Join("conv", "conv_b.json")},
+		},
+		{
+			name:      "unsupported format",
+			archive:   "conversions.rar",
+			wantError: "unsupported conversion archive",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			switch filepath.Ext(tt.archive) {
+			case ".zip":
+				writeZipArchive(t, tt.archive, tt.files)
+			case ".gz", ".tgz":
+				writeTarGzArchive(t, tt.archive, tt.files)
+			}
+			for _, name := range tt.existing {
+				require.NoError(t, os.MkdirAll("conv", 0o755))
+				require.NoError(t, os.WriteFile(filepath.Join("conv", name), []byte(`{"existing":true}`), 0o600))
+			}
+			if tt.manifest != "" {
+				require.NoError(t, os.WriteFile(filepath.Join("conv", ArchiveManifestName), []byte(tt.manifest), 0o600))
+			}
+
+			extracted, err := extractConversionArchive(tt.archive, "conv")
+			if tt.wantError != "" {
+				assert.ErrorContains(t, err, tt.wantError)
+				_, statErr := os.Stat(filepath.Join("..", "evil.json"))
+				assert.True(t, os.IsNotExist(statErr))
+				// Nothing is extracted from an invalid archive
+				converted, err := filepath.Glob(filepath.Join("conv", "*.json"))
+				require.NoError(t, err)
+				assert.Len(t, converted, len(tt.existing))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, extracted)
+			for _, file := range extracted {
+				content, err := os.ReadFile(file)
+				require.NoError(t, err)
+				assert.Equal(t, tt.files["out/"+filepath.Base(file)]+tt.files[filepath.Base(file)], string(content))
+			}
+			// The extracted files are added to the archive manifest, for later archives to overwrite them
+			manifest, err := readArchiveManifest("conv")
+			require.NoError(t, err)
+			for _, file := range extracted {
+				assert.Contains(t, manifest, filepath.Base(file))
+			}
+		})
+	}
+}
+
+func TestRunConversionArchive(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("GITHUB_OUTPUT", "github-output")
+	config := "folders:\n  conversion_path: conv\n  deployment_path: deploy\n" +
+		"conversion_defaults:\n  target: loki\n  data_source: test-datasource\n" +
+		"conversions:\n  - name: test_conv\n    rule_group: Test Rules\n    time_window: 5m\n"
+	require.NoError(t, os.WriteFile("config.yml", []byte(config), 0o600))
+
+	files := map[string]string{}
+	for name, ruleID := range map[string]string{"test_conv_a.json": "996f8884-9144-40e7-ac63-29090ccde9a0", "test_conv_b.json": "dcb63bd5-2a1e-4ac7-9e61-aa5c2a4e1c3a"} {
+		convBytes, err := json.Marshal(model.ConversionOutput{
+			ConversionName: "test_conv",
+			Queries:        []string{"{job=`test`} | json"},
+			Rules:          []model.SigmaRule{{ID: ruleID, Title: "Test Rule " + name}},
+		})
+		require.NoError(t, err)
+		files["conversions/"+name] = string(convBytes)
+	}
+	writeTarGzArchive(t, "conversions.tar.gz", files)
+
+	t.Setenv("INTEGRATOR_CONFIG_PATH", "config.yml")
+	t.Setenv("CONVERSION_ARCHIVE", "conversions.tar.gz")
+	t.Setenv("CHANGED_FILES", "")
+	t.Setenv("DELETED_FILES", "")
+	t.Setenv("ALL_RULES", "")
+	i := NewIntegrator()
+	require.NoError(t, i.LoadConfig())
+	require.NoError(t, i.Run())
+
+	// Each conversion file of the archive is integrated into an alert rule file
+	deployed, err := filepath.Glob(filepath.Join("deploy", "*.json"))
+	require.NoError(t, err)
+	require.Len(t, deployed, 2)
+	assert.Contains(t, deployed[0], "alert_rule_test_conv_a_")
+	assert.Contains(t, deployed[1], "alert_rule_test_conv_b_")
+	rule := &model.ProvisionedAlertRule{}
+	require.NoError(t, readRuleFromFile(rule, deployed[0]))
+	assert.Equal(t, filepath.Join("conv", "test_conv_a.json"), rule.Annotations["ConversionFile"])
+
+	// The conversion files of a later version of the archive overwrite those extracted before
+	i = NewIntegrator()
+	require.NoError(t, i.LoadConfig())
+	require.NoError(t, i.Run())
+	deployed, err = filepath.Glob(filepath.Join("deploy", "*.json"))
+	require.NoError(t, err)
+	assert.Len(t, deployed, 2)
+}
+
+func TestRunConversionArchiveDryRun(t *testing.T) {
+	t.Chdir(t.TempDir())
+	config := "folders:\n  conversion_path: conv\n  deployment_path: deploy\n" +
+		"conversion_defaults:\n  target: loki\n  data_source: test-datasource\n" +
+		"conversions:\n  - name: test_conv\n    rule_group: Test Rules\n    time_window: 5m\n"
+	require.NoError(t, os.WriteFile("config.yml", []byte(config), 0o600))
+	writeTarGzArchive(t, "conversions.tar.gz", map[string]string{"test_conv_a.json": `{"conversion_name":"test_conv"}`})
+
+	t.Setenv("INTEGRATOR_CONFIG_PATH", "config.yml")
+	t.Setenv("CONVERSION_ARCHIVE", "conversions.tar.gz")
+	t.Setenv("INTEGRATOR_DRY_RUN", "true")
+	t.Setenv("CHANGED_FILES", "")
+	t.Setenv("DELETED_FILES", "")
+	t.Setenv("ALL_RULES", "")
+	i := NewIntegrator()
+	assert.ErrorContains(t, i.LoadConfig(), "can't be integrated in a dry run")
+
+	// The dry run writes nothing, not even the extracted conversion files
+	entries, err := os.ReadDir(".")
+	require.NoError(t, err)
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.ElementsMatch(t, []string{"config.yml", "conversions.tar.gz"}, names)
+}
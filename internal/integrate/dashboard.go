@@ -0,0 +1,154 @@
+package integrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/grafana/sigma-rule-deployment/shared"
+)
+
+const (
+	// DashboardFolder is the subfolder of the deployment folder the dashboard is written to, so that the
+	// deployer and the other readers of the deployment folder don't mistake it for an alert rule file
+	DashboardFolder = "dashboards"
+	// DashboardFile is the name of the dashboard file of the deployed detections
+	DashboardFile = "sigma_detections.json"
+	// DashboardUID is the UID of the dashboard of the deployed detections
+	DashboardUID = "sigma-detections"
+)
+
+// Panel sizes on Grafana's 24 column grid, two panels per row
+const (
+	dashboardPanelWidth  = 12
+	dashboardPanelHeight = 8
+)
+
+// Dashboard is the subset of a Grafana dashboard model written by the integrator
+type Dashboard struct {
+	UID           string           `json:"uid"`
+	Title         string           `json:"title"`
+	Tags          []string         `json:"tags"`
+	Editable      bool             `json:"editable"`
+	SchemaVersion int              `json:"schemaVersion"`
+	Time          DashboardTime    `json:"time"`
+	Panels        []DashboardPanel `json:"panels"`
+}
+
+// DashboardTime is the default time range of a dashboard
+type DashboardTime struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DashboardPanel is a panel showing the results of the queries of an alert rule
+type DashboardPanel struct {
+	ID          int                 `json:"id"`
+	Type        string              `json:"type"`
+	Title       string              `json:"title"`
+	Description string              `json:"description,omitempty"`
+	GridPos     DashboardGridPos    `json:"gridPos"`
+	Datasource  DashboardDatasource `json:"datasource"`
+	Targets     []json.RawMessage   `json:"targets"`
+}
+
+// DashboardGridPos is the position of a panel on the dashboard grid
+type DashboardGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// DashboardDatasource references the data source of a panel
+type DashboardDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+// dashboardPanel returns the panel of an alert rule, with its data source queries as targets. False is returned
+// for alert rules without data source queries, such as placeholders of conversions without queries.
+func dashboardPanel(rule *model.ProvisionedAlertRule) (DashboardPanel, bool) {
+	panel := DashboardPanel{Title: rule.Title, Description: "Alert rule " + rule.UID}
+	for _, query := range rule.Data {
+		if query.DatasourceUID == "__expr__" {
+			continue
+		}
+		var queryModel struct {
+			Datasource DashboardDatasource `json:"datasource"`
+		}
+		if err := json.Unmarshal(query.Model, &queryModel); err != nil {
+			continue
+		}
+		if panel.Datasource.UID == "" {
+			panel.Datasource = DashboardDatasource{Type: queryModel.Datasource.Type, UID: query.DatasourceUID}
+		}
+		panel.Targets = append(panel.Targets, query.Model)
+	}
+	if len(panel.Targets) == 0 {
+		return DashboardPanel{}, false
+	}
+	// Log queries are best shown as log lines, the results of the others as a table
+	panel.Type = "table"
+	if panel.Datasource.Type == shared.Loki {
+		panel.Type = "logs"
+	}
+	return panel, true
+}
+
+// GenerateDashboard writes a Grafana dashboard with a panel per alert rule of the deployment folder, each
+// running the queries of the alert rule, to the dashboard file of the deployment folder
+func (i *Integrator) GenerateDashboard() error {
+	files, err := i.deploymentFiles()
+	if err != nil {
+		return err
+	}
+	dashboard := Dashboard{
+		UID:           DashboardUID,
+		Title:         "Sigma detections",
+		Tags:          []string{"sigma"},
+		Editable:      true,
+		SchemaVersion: 39,
+		Time:          DashboardTime{From: "now-1h", To: "now"},
+		Panels:        []DashboardPanel{},
+	}
+	for _, file := range files {
+		rule := &model.ProvisionedAlertRule{}
+		if err := i.readRule(rule, file); err != nil {
+			i.warnings.Add("Could not add %s to the dashboard: %v", file, err)
+			continue
+		}
+		panel, ok := dashboardPanel(rule)
+		if !ok {
+			continue
+		}
+		index := len(dashboard.Panels)
+		panel.ID = index + 1
+		panel.GridPos = DashboardGridPos{
+			H: dashboardPanelHeight,
+			W: dashboardPanelWidth,
+			X: (index % 2) * dashboardPanelWidth,
+			Y: (index / 2) * dashboardPanelHeight,
+		}
+		dashboard.Panels = append(dashboard.Panels, panel)
+	}
+
+	dashboardBytes, err := marshalJSON(dashboard, i.prettyPrint)
+	if err != nil {
+		return fmt.Errorf("error marshalling dashboard: %v", err)
+	}
+	dashboardPath := filepath.Join(i.config.Folders.DeploymentPath, DashboardFolder)
+	if !i.dryRun {
+		if err := os.MkdirAll(dashboardPath, 0o755); err != nil {
+			return fmt.Errorf("error creating dashboard folder %s: %v", dashboardPath, err)
+		}
+	}
+	dashboardFile := filepath.Join(dashboardPath, DashboardFile)
+	if err := i.writeFile(dashboardFile, dashboardBytes); err != nil {
+		return fmt.Errorf("error writing dashboard %s: %v", dashboardFile, err)
+	}
+	fmt.Printf("Dashboard written to %s: %d panel(s)\n", dashboardFile, len(dashboard.Panels))
+	return nil
+}
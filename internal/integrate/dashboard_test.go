@@ -0,0 +1,101 @@
+package integrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunGenerateDashboard(t *testing.T) {
+	tests := []struct {
+		name          string
+		generate      bool
+		dryRun        bool
+		wantDashboard bool
+	}{
+		{
+			name: "disabled by default",
+		},
+		{
+			name:          "enabled",
+			generate:      true,
+			wantDashboard: true,
+		},
+		{
+			name:     "not written in a dry run",
+			generate: true,
+			dryRun:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			t.Setenv("GITHUB_OUTPUT", "github-output")
+			config := "folders:\n  conversion_path: conv\n  deployment_path: deploy\n" +
+				"conversion_defaults:\n  target: loki\n  data_source: test-datasource\n" +
+				"conversions:\n  - name: test_conv\n    rule_group: Test Rules\n    time_window: 5m\n" +
+				fmt.Sprintf("integration:\n  generate_dashboard: %t\n", tt.generate)
+			require.NoError(t, os.WriteFile("config.yml", []byte(config), 0o600))
+			require.NoError(t, os.MkdirAll("conv", 0o755))
+			convFiles := []string{}
+			ruleIDs := map[string]string{"a": "996f8884-9144-40e7-ac63-29090ccde9a0", "b": "1e8df5b7-1b7c-4f1e-9c8e-2f1e0c5b6a7d"}
+			for _, name := range []string{"a", "b"} {
+				convFile := filepath.Join("conv", "test_conv_"+name+".json")
+				convBytes, err := json.Marshal(model.ConversionOutput{
+					ConversionName: "test_conv",
+					Queries:        []string{"{job=`" + name + "`} | json"},
+					Rules:          []model.SigmaRule{{ID: ruleIDs[name], Title: "Rule " + name}},
+				})
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+				convFiles = append(convFiles, convFile)
+			}
+
+			t.Setenv("INTEGRATOR_CONFIG_PATH", "config.yml")
+			t.Setenv("CHANGED_FILES", strings.Join(convFiles, " "))
+			t.Setenv("DELETED_FILES", "")
+			t.Setenv("ALL_RULES", "")
+			t.Setenv("INTEGRATOR_DRY_RUN", fmt.Sprintf("%t", tt.dryRun))
+			i := NewIntegrator()
+			require.NoError(t, i.LoadConfig())
+			require.NoError(t, i.Run())
+
+			dashboardFile := filepath.Join("deploy", DashboardFolder, DashboardFile)
+			if !tt.wantDashboard {
+				assert.NoFileExists(t, dashboardFile)
+				return
+			}
+			dashboardBytes, err := os.ReadFile(dashboardFile)
+			require.NoError(t, err)
+			var dashboard Dashboard
+			require.NoError(t, json.Unmarshal(dashboardBytes, &dashboard))
+			assert.Equal(t, DashboardUID, dashboard.UID)
+
+			// Each alert rule has a panel running its query
+			deployed, err := filepath.Glob(filepath.Join("deploy", "*.json"))
+			require.NoError(t, err)
+			require.Len(t, deployed, 2)
+			require.Len(t, dashboard.Panels, 2)
+			for index, file := range deployed {
+				rule := &model.ProvisionedAlertRule{}
+				require.NoError(t, readRuleFromFile(rule, file))
+				panel := dashboard.Panels[index]
+				assert.Equal(t, rule.Title, panel.Title)
+				assert.Equal(t, "Alert rule "+rule.UID, panel.Description)
+				assert.Equal(t, "logs", panel.Type)
+				assert.Equal(t, DashboardDatasource{Type: "loki", UID: "test-datasource"}, panel.Datasource)
+				require.Len(t, panel.Targets, 1)
+				assert.JSONEq(t, string(rule.Data[0].Model), string(panel.Targets[0]))
+				assert.Equal(t, DashboardGridPos{H: 8, W: 12, X: index * 12, Y: 0}, panel.GridPos)
+			}
+		})
+	}
+}
@@ -3,9 +3,12 @@ package integrate
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/grafana/sigma-rule-deployment/shared"
@@ -13,6 +16,9 @@ import (
 
 const elasticsearchMetricTypeCount = "count"
 
+// DefaultQueryEndpoint is the path of the Grafana API endpoint data source queries are posted to
+const DefaultQueryEndpoint = "api/ds/query"
+
 // DatasourceQuery is an interface for executing Grafana datasource queries
 type DatasourceQuery interface {
 	GetDatasource(dsName, baseURL, apiKey string, timeout time.Duration) (*GrafanaDatasource, error)
@@ -20,7 +26,10 @@ type DatasourceQuery interface {
 }
 
 // HTTPDatasourceQuery is the default implementation of DatasourceQuery
-type HTTPDatasourceQuery struct{}
+type HTTPDatasourceQuery struct {
+	// QueryEndpoint is the path, relative to the Grafana URL, queries are posted to, DefaultQueryEndpoint if empty
+	QueryEndpoint string
+}
 
 // DefaultDatasourceQuery is the default implementation used throughout the application
 var DefaultDatasourceQuery DatasourceQuery = &HTTPDatasourceQuery{}
@@ -64,8 +73,9 @@ type Metric struct {
 
 type Query struct {
 	RefID         string            `json:"refId"`
-	Expr          string            `json:"expr,omitempty"`  // For Loki
-	Query         string            `json:"query,omitempty"` // For Elasticsearch
+	Expr          string            `json:"expr,omitempty"`   // For Loki and Prometheus
+	Query         string            `json:"query,omitempty"`  // For Elasticsearch
+	Target        string            `json:"target,omitempty"` // For Graphite
 	QueryType     string            `json:"queryType,omitempty"`
 	Datasource    GrafanaDatasource `json:"datasource"`
 	EditorMode    string            `json:"editorMode,omitempty"`
@@ -74,6 +84,9 @@ type Query struct {
 	IntervalMs    int               `json:"intervalMs,omitempty"`
 	MaxDataPoints int               `json:"maxDataPoints,omitempty"`
 
+	// Prometheus-specific fields
+	Instant bool `json:"instant,omitempty"`
+
 	// Elasticsearch-specific fields
 	Alias        string      `json:"alias,omitempty"`
 	Metrics      []Metric    `json:"metrics,omitempty"`
@@ -88,6 +101,23 @@ type Body struct {
 	To      string  `json:"to"`
 }
 
+// LookupDatasource gets a data source referenced either by UID or, failing that, by name, for data sources
+// referenced by name in some places and by UID in others to be matched
+func LookupDatasource(ref, baseURL, apiKey string, timeout time.Duration) (*GrafanaDatasource, error) {
+	datasource, err := GetDatasourceByName(ref, baseURL, apiKey, timeout)
+	if err == nil {
+		return datasource, nil
+	}
+	path, pathErr := url.JoinPath("api/datasources/name", url.PathEscape(ref))
+	if pathErr != nil {
+		return nil, fmt.Errorf("failed to construct API path: %v", pathErr)
+	}
+	if datasource, nameErr := getDatasource(path, baseURL, apiKey, timeout); nameErr == nil {
+		return datasource, nil
+	}
+	return nil, err
+}
+
 // TestQuery uses the default executor to query a datasource
 func TestQuery(
 	query, dsName, baseURL, apiKey, refID, from, to, customModel string,
@@ -98,6 +128,16 @@ func TestQuery(
 	)
 }
 
+// IsTimeoutError reports whether err was caused by a request exceeding its deadline or timeout,
+// as opposed to an error returned by Grafana or the datasource for the query itself
+func IsTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 // GetDatasourceByName uses the default executor to get datasource information
 func GetDatasourceByName(
 	dsName, baseURL, apiKey string, timeout time.Duration,
@@ -112,7 +152,7 @@ func (h *HTTPDatasourceQuery) ExecuteQuery(
 ) ([]byte, error) {
 	datasource, err := h.GetDatasource(dsName, baseURL, apiKey, timeout)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get datasource: %v", err)
+		return nil, fmt.Errorf("failed to get datasource: %w", err)
 	}
 
 	var queryObj json.RawMessage
@@ -178,6 +218,42 @@ func (h *HTTPDatasourceQuery) ExecuteQuery(
 			MaxDataPoints: 100,
 		}
 
+		queryBytes, err := json.Marshal(structQuery)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal query struct: %v", err)
+		}
+		queryObj = json.RawMessage(queryBytes)
+	case datasource.Type == shared.Prometheus:
+		// An instant query, matching the model of the alert rules
+		structQuery := Query{
+			RefID:   refID,
+			Expr:    query,
+			Instant: true,
+			Datasource: GrafanaDatasource{
+				Type: datasource.Type,
+				UID:  datasource.UID,
+			},
+			IntervalMs:    2000,
+			MaxDataPoints: 100,
+		}
+
+		queryBytes, err := json.Marshal(structQuery)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal query struct: %v", err)
+		}
+		queryObj = json.RawMessage(queryBytes)
+	case datasource.Type == shared.Graphite:
+		structQuery := Query{
+			RefID:  refID,
+			Target: query,
+			Datasource: GrafanaDatasource{
+				Type: datasource.Type,
+				UID:  datasource.UID,
+			},
+			IntervalMs:    2000,
+			MaxDataPoints: 100,
+		}
+
 		queryBytes, err := json.Marshal(structQuery)
 		if err != nil {
 			return nil, fmt.Errorf("failed to marshal query struct: %v", err)
@@ -204,20 +280,20 @@ func (h *HTTPDatasourceQuery) ExecuteQuery(
 	client := shared.NewGrafanaClient(baseURL, apiKey, "sigma-rule-deployment/integrator", timeout)
 
 	// Use url.JoinPath to construct the path relative to baseURL
-	queryPath, err := url.JoinPath("api/ds/query")
+	queryPath, err := url.JoinPath(strings.TrimPrefix(shared.GetConfigValue(h.QueryEndpoint, DefaultQueryEndpoint, ""), "/"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to construct API path: %v", err)
 	}
 
 	resp, err := client.PostRaw(context.Background(), queryPath, jsonBody)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %v", err)
+		return nil, fmt.Errorf("failed to execute request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	responseData, err := shared.ReadResponseBody(resp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
+		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 
 	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
@@ -248,18 +324,22 @@ func (h *HTTPDatasourceQuery) GetDatasource(
 func (h *HTTPDatasourceQuery) getDatasourceByUID(
 	uid, baseURL, apiKey string, timeout time.Duration,
 ) (*GrafanaDatasource, error) {
-	// Create Grafana client for the request
-	client := shared.NewGrafanaClient(baseURL, apiKey, "sigma-rule-deployment/integrator", timeout)
-
-	// Construct the path
-	path, err := url.JoinPath("api/datasources/uid", uid)
+	// Construct the path, escaping the UID so names containing spaces or slashes stay a single segment
+	path, err := url.JoinPath("api/datasources/uid", url.PathEscape(uid))
 	if err != nil {
 		return nil, fmt.Errorf("failed to construct API path: %v", err)
 	}
+	return getDatasource(path, baseURL, apiKey, timeout)
+}
+
+// getDatasource gets the data source returned by a path of the Grafana data source API
+func getDatasource(path, baseURL, apiKey string, timeout time.Duration) (*GrafanaDatasource, error) {
+	// Create Grafana client for the request
+	client := shared.NewGrafanaClient(baseURL, apiKey, "sigma-rule-deployment/integrator", timeout)
 
 	resp, err := client.Get(context.Background(), path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %v", err)
+		return nil, fmt.Errorf("failed to execute request: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -43,6 +43,20 @@ func TestGetDatasource(t *testing.T) {
 				"GET http://grafana:3000/api/datasources/uid/abc123": 1,
 			},
 		},
+		{
+			name:           "datasource with spaces and slashes is path-escaped",
+			dsNameOrUID:    "My Logs / Prod",
+			mockEndpoint:   "/api/datasources/uid/My%20Logs%20%2F%20Prod",
+			mockStatusCode: 200,
+			mockResponse:   `{"id":2,"uid":"My Logs / Prod","orgId":1,"name":"My Logs / Prod","type":"loki"}`,
+			expectedUID:    "My Logs / Prod",
+			expectedType:   shared.Loki,
+			expectedName:   "My Logs / Prod",
+			expectedError:  false,
+			expectedCallCount: map[string]int{
+				"GET http://grafana:3000/api/datasources/uid/My%20Logs%20%2F%20Prod": 1,
+			},
+		},
 		{
 			name:             "datasource not found",
 			dsNameOrUID:      "nonexistent-datasource",
@@ -215,23 +229,23 @@ func TestTestQuery(t *testing.T) {
 		},
 		{
 			name:   "unsupported datasource type",
-			dsName: "test-prometheus",
-			query:  "up",
+			dsName: "test-influxdb",
+			query:  "SELECT count(*) FROM logs",
 			from:   "now-1h",
 			to:     "now",
 			mockDatasource: &GrafanaDatasource{
 				ID:     1,
-				UID:    "prometheus123",
+				UID:    "influxdb123",
 				OrgID:  1,
-				Name:   "test-prometheus",
-				Type:   "prometheus", // Unsupported datasource type
+				Name:   "test-influxdb",
+				Type:   "influxdb", // Unsupported datasource type
 				Access: "proxy",
-				URL:    "http://prometheus:9090",
+				URL:    "http://influxdb:8086",
 			},
 			expectedError:    true,
-			expectedErrorMsg: "unsupported datasource type: prometheus",
+			expectedErrorMsg: "unsupported datasource type: influxdb",
 			expectedCallCount: map[string]int{
-				"GET http://grafana:3000/api/datasources/uid/test-prometheus": 1,
+				"GET http://grafana:3000/api/datasources/uid/test-influxdb": 1,
 			},
 		},
 		{
@@ -683,3 +697,152 @@ func TestLokiQueryStructure(t *testing.T) {
 	assert.Equal(t, 1, info["GET http://grafana:3000/api/datasources/uid/test-loki"])
 	assert.Equal(t, 1, info["POST http://grafana:3000/api/ds/query"])
 }
+
+func TestGraphiteQueryStructure(t *testing.T) {
+	httpmock.Activate(t)
+	defer httpmock.DeactivateAndReset()
+
+	baseURL := "http://grafana:3000"
+	dsName := "test-graphite"
+	query := `sumSeries(auth.failures.*.count)`
+
+	mockDatasource := &GrafanaDatasource{
+		ID:     3,
+		UID:    "graphite123",
+		OrgID:  1,
+		Name:   "test-graphite",
+		Type:   shared.Graphite,
+		Access: "proxy",
+		URL:    "http://graphite:8080",
+	}
+	datasourceJSON, err := json.Marshal(mockDatasource)
+	require.NoError(t, err)
+
+	httpmock.RegisterResponder("GET", fmt.Sprintf("%s/api/datasources/uid/%s", baseURL, dsName),
+		httpmock.NewStringResponder(200, string(datasourceJSON)))
+
+	// Capture the request body to verify the query structure
+	var capturedRequestBody []byte
+	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/api/ds/query", baseURL),
+		func(req *http.Request) (*http.Response, error) {
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			capturedRequestBody = body
+			return httpmock.NewStringResponse(200, `{"results":{"A":{"frames":[]}}}`), nil
+		})
+
+	result, err := TestQuery(query, dsName, baseURL, "test-api-key", "A", "now-1h", "now", "", 5*time.Second)
+	require.NoError(t, err)
+	assert.NotNil(t, result)
+
+	var requestBody struct {
+		Queries []map[string]any `json:"queries"`
+	}
+	require.NoError(t, json.Unmarshal(capturedRequestBody, &requestBody))
+	require.Len(t, requestBody.Queries, 1)
+	queryObj := requestBody.Queries[0]
+
+	// The target is sent as is, without being wrapped in a metric query
+	assert.Equal(t, "A", queryObj["refId"])
+	assert.Equal(t, query, queryObj["target"])
+	assert.Equal(t, map[string]any{"type": shared.Graphite, "uid": "graphite123"}, queryObj["datasource"])
+
+	// Verify Loki and Elasticsearch specific fields are NOT present
+	for _, field := range []string{"expr", "query", "queryType", "maxLines", "metrics", "bucketAggs", "timeField"} {
+		assert.NotContains(t, queryObj, field)
+	}
+}
+
+func TestPrometheusQueryStructure(t *testing.T) {
+	httpmock.Activate(t)
+	defer httpmock.DeactivateAndReset()
+
+	baseURL := "http://grafana:3000"
+	dsName := "test-mimir"
+	query := `sum(rate(auth_failures_total[5m])) > 10`
+
+	mockDatasource := &GrafanaDatasource{
+		ID:     4,
+		UID:    "mimir123",
+		OrgID:  1,
+		Name:   "test-mimir",
+		Type:   shared.Prometheus,
+		Access: "proxy",
+		URL:    "http://mimir:8080/prometheus",
+	}
+	datasourceJSON, err := json.Marshal(mockDatasource)
+	require.NoError(t, err)
+
+	httpmock.RegisterResponder("GET", fmt.Sprintf("%s/api/datasources/uid/%s", baseURL, dsName),
+		httpmock.NewStringResponder(200, string(datasourceJSON)))
+
+	// Capture the request body to verify the query structure
+	var capturedRequestBody []byte
+	httpmock.RegisterResponder("POST", fmt.Sprintf("%s/api/ds/query", baseURL),
+		func(req *http.Request) (*http.Response, error) {
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			capturedRequestBody = body
+			return httpmock.NewStringResponse(200, `{"results":{"A":{"frames":[]}}}`), nil
+		})
+
+	result, err := TestQuery(query, dsName, baseURL, "test-api-key", "A", "now-1h", "now", "", 5*time.Second)
+	require.NoError(t, err)
+	assert.NotNil(t, result)
+
+	var requestBody struct {
+		Queries []map[string]any `json:"queries"`
+	}
+	require.NoError(t, json.Unmarshal(capturedRequestBody, &requestBody))
+	require.Len(t, requestBody.Queries, 1)
+	queryObj := requestBody.Queries[0]
+
+	// Verify Prometheus-specific fields are present, the query being sent as an instant query
+	assert.Equal(t, "A", queryObj["refId"])
+	assert.Equal(t, query, queryObj["expr"])
+	assert.Equal(t, true, queryObj["instant"])
+	assert.Equal(t, float64(2000), queryObj["intervalMs"])
+	assert.Equal(t, float64(100), queryObj["maxDataPoints"])
+	assert.Equal(t, map[string]any{"type": shared.Prometheus, "uid": "mimir123"}, queryObj["datasource"])
+
+	// Verify Loki and Elasticsearch specific fields are NOT present
+	for _, field := range []string{"query", "target", "queryType", "maxLines", "format", "metrics", "bucketAggs", "timeField", "datasourceId"} {
+		assert.NotContains(t, queryObj, field)
+	}
+
+	info := httpmock.GetCallCountInfo()
+	assert.Equal(t, 1, info["GET http://grafana:3000/api/datasources/uid/test-mimir"])
+	assert.Equal(t, 1, info["POST http://grafana:3000/api/ds/query"])
+}
+
+func TestExecuteQueryEndpoint(t *testing.T) {
+	tests := []struct {
+		name          string
+		queryEndpoint string
+		wantURL       string
+	}{
+		{name: "default endpoint", wantURL: "http://grafana:3000/api/ds/query"},
+		{name: "custom endpoint", queryEndpoint: "api/tenants/security/ds/query", wantURL: "http://grafana:3000/api/tenants/security/ds/query"},
+		{name: "custom endpoint with a leading slash", queryEndpoint: "/api/v2/ds/query", wantURL: "http://grafana:3000/api/v2/ds/query"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpmock.Activate(t)
+			defer httpmock.DeactivateAndReset()
+
+			baseURL := "http://grafana:3000"
+			datasourceJSON, err := json.Marshal(&GrafanaDatasource{UID: "loki123", Name: "test-loki", Type: shared.Loki})
+			require.NoError(t, err)
+			httpmock.RegisterResponder("GET", baseURL+"/api/datasources/uid/test-loki",
+				httpmock.NewStringResponder(200, string(datasourceJSON)))
+			httpmock.RegisterResponder("POST", tt.wantURL, httpmock.NewStringResponder(200, `{"results":{"A":{"frames":[]}}}`))
+
+			executor := &HTTPDatasourceQuery{QueryEndpoint: tt.queryEndpoint}
+			_, err = executor.ExecuteQuery("{job=`okta`}", "test-loki", baseURL, "test-api-key", "A", "now-1h", "now", "", 5*time.Second)
+			require.NoError(t, err)
+
+			assert.Equal(t, 1, httpmock.GetCallCountInfo()["POST "+tt.wantURL])
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package integrate
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/grafana/sigma-rule-deployment/shared"
+	"gopkg.in/yaml.v3"
+)
+
+// Modes of adding the tags of the Sigma rules as labels, set by tags_label_mode
+const (
+	TagsLabelModeNone       = "none"
+	TagsLabelModeJoined     = "joined"
+	TagsLabelModeIndividual = "individual"
+)
+
+// TagsLabel is the label holding the comma separated tags of the Sigma rules, in the joined tags label mode
+const TagsLabel = "tags"
+
+var invalidLabelNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// loadEnrichmentFile reads the enrichment lookup from a YAML or JSON file. Lookup values are
+// lowercased, as they are matched case-insensitively against the logsource of the Sigma rules.
+func loadEnrichmentFile(path string) (*model.EnrichmentLookup, error) {
+	if !filepath.IsLocal(path) {
+		return nil, fmt.Errorf("enrichment file is not local: %s", path)
+	}
+	contents, err := shared.ReadLocalFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading enrichment file %s: %v", path, err)
+	}
+	lookup := &model.EnrichmentLookup{}
+	if err := yaml.Unmarshal([]byte(contents), lookup); err != nil {
+		return nil, fmt.Errorf("error parsing enrichment file %s: %v", path, err)
+	}
+	lookup.Category = lowercaseKeys(lookup.Category)
+	lookup.Product = lowercaseKeys(lookup.Product)
+	lookup.Service = lowercaseKeys(lookup.Service)
+	return lookup, nil
+}
+
+func lowercaseKeys(enrichments map[string]model.Enrichment) map[string]model.Enrichment {
+	lowercased := make(map[string]model.Enrichment, len(enrichments))
+	for key, enrichment := range enrichments {
+		lowercased[strings.ToLower(key)] = enrichment
+	}
+	return lowercased
+}
+
+// applyEnrichment adds the annotations and labels looked up from the logsource of each Sigma rule of the
+// conversion. More specific lookups take precedence: service over product over category. Logsource values
+// without an entry in the lookup are skipped.
+func (i *Integrator) applyEnrichment(rule *model.ProvisionedAlertRule, conversionObject model.ConversionOutput) {
+	if i.enrichment == nil {
+		return
+	}
+	for _, sigmaRule := range conversionObject.Rules {
+		logsource := sigmaRule.Logsource
+		for _, lookup := range []struct {
+			enrichments map[string]model.Enrichment
+			value       string
+		}{
+			{i.enrichment.Category, logsource.Category},
+			{i.enrichment.Product, logsource.Product},
+			{i.enrichment.Service, logsource.Service},
+		} {
+			if lookup.value == "" {
+				continue
+			}
+			enrichment, ok := lookup.enrichments[strings.ToLower(lookup.value)]
+			if !ok {
+				continue
+			}
+			for key, value := range enrichment.Annotations {
+				rule.Annotations[key] = value
+			}
+			for key, value := range enrichment.Labels {
+				rule.Labels[key] = value
+			}
+		}
+	}
+}
+
+// validateTagsLabelMode checks the tags label mode is one of the supported modes, an empty mode being none
+func validateTagsLabelMode(mode string) error {
+	switch mode {
+	case "", TagsLabelModeNone, TagsLabelModeJoined, TagsLabelModeIndividual:
+		return nil
+	}
+	return fmt.Errorf("invalid tags_label_mode %s: must be one of %s, %s or %s", mode, TagsLabelModeNone, TagsLabelModeJoined, TagsLabelModeIndividual)
+}
+
+// addTagLabels adds the union of the tags of the Sigma rules as labels, according to the tags label mode. Tags
+// are lowercased and trimmed. In the joined mode, they are sorted into a single comma separated tags label, which
+// is removed when the rules have no tags. In the individual mode, each tag is added as a "true" label, named
+// after the tag with the characters invalid in label names replaced by underscores, e.g. attack_t1059_001.
+func addTagLabels(labels map[string]string, rules []model.SigmaRule, mode string) error {
+	if err := validateTagsLabelMode(mode); err != nil {
+		return err
+	}
+	tags := []string{}
+	for _, rule := range rules {
+		for _, tag := range rule.Tags {
+			if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" && !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	slices.Sort(tags)
+
+	switch mode {
+	case TagsLabelModeJoined:
+		if len(tags) == 0 {
+			delete(labels, TagsLabel)
+		} else {
+			labels[TagsLabel] = strings.Join(tags, ",")
+		}
+	case TagsLabelModeIndividual:
+		for _, tag := range tags {
+			name := strings.TrimLeft(invalidLabelNameChars.ReplaceAllString(tag, "_"), "_")
+			if name == "" {
+				continue
+			}
+			if name[0] >= '0' && name[0] <= '9' {
+				name = "tag_" + name
+			}
+			labels[name] = TRUE
+		}
+	}
+	return nil
+}
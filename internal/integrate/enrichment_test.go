@@ -0,0 +1,201 @@
+package integrate
+
+import (
+	"os"
+	"testing"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadEnrichmentFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.WriteFile("enrichment.yml", []byte(`product:
+  Okta:
+    annotations:
+      owner: identity-team
+`), 0o600))
+	require.NoError(t, os.WriteFile("enrichment.json", []byte(`{"service": {"cloudtrail": {"labels": {"criticality": "high"}}}}`), 0o600))
+	require.NoError(t, os.WriteFile("invalid.yml", []byte("product: [okta"), 0o600))
+
+	lookup, err := loadEnrichmentFile("enrichment.yml")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "identity-team"}, lookup.Product["okta"].Annotations)
+
+	lookup, err = loadEnrichmentFile("enrichment.json")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"criticality": "high"}, lookup.Service["cloudtrail"].Labels)
+
+	_, err = loadEnrichmentFile("missing.yml")
+	assert.Error(t, err)
+	_, err = loadEnrichmentFile("invalid.yml")
+	assert.Error(t, err)
+	_, err = loadEnrichmentFile("/etc/enrichment.yml")
+	assert.Error(t, err)
+}
+
+func TestConvertToAlertEnrichment(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.WriteFile("enrichment.yml", []byte(`category:
+  authentication:
+    annotations:
+      owner: security-team
+    labels:
+      criticality: low
+product:
+  okta:
+    annotations:
+      owner: identity-team
+    labels:
+      criticality: high
+`), 0o600))
+	lookup, err := loadEnrichmentFile("enrichment.yml")
+	require.NoError(t, err)
+
+	convConfig := model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", TimeWindow: "5m"}
+	tests := []struct {
+		name            string
+		logsource       model.SigmaLogsource
+		templateLabels  map[string]string
+		wantAnnotations map[string]string
+		wantLabels      map[string]string
+	}{
+		{
+			name:            "okta product adds the owner annotation",
+			logsource:       model.SigmaLogsource{Product: "okta", Service: "okta"},
+			wantAnnotations: map[string]string{"owner": "identity-team"},
+			wantLabels:      map[string]string{"criticality": "high"},
+		},
+		{
+			name:            "product takes precedence over category",
+			logsource:       model.SigmaLogsource{Category: "authentication", Product: "okta"},
+			wantAnnotations: map[string]string{"owner": "identity-team"},
+			wantLabels:      map[string]string{"criticality": "high"},
+		},
+		{
+			name:            "falls back to the category",
+			logsource:       model.SigmaLogsource{Category: "authentication", Product: "azure"},
+			wantAnnotations: map[string]string{"owner": "security-team"},
+			wantLabels:      map[string]string{"criticality": "low"},
+		},
+		{
+			name:            "templated labels take precedence",
+			logsource:       model.SigmaLogsource{Product: "okta"},
+			templateLabels:  map[string]string{"criticality": "{{.Level}}"},
+			wantAnnotations: map[string]string{"owner": "identity-team"},
+			wantLabels:      map[string]string{"criticality": "medium"},
+		},
+		{
+			name:      "missing lookup adds nothing",
+			logsource: model.SigmaLogsource{Product: "github"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := NewIntegrator()
+			i.enrichment = lookup
+			i.config.IntegratorConfig.TemplateLabels = tt.templateLabels
+			convObject := model.ConversionOutput{
+				ConversionName: "conv",
+				Rules:          []model.SigmaRule{{Title: "Rule 1", Level: "medium", Logsource: tt.logsource}},
+			}
+
+			rule := &model.ProvisionedAlertRule{}
+			require.NoError(t, i.ConvertToAlert(rule, []string{"{job=`a`} | json"}, "Rule 1", convConfig, "test_conversion_file.json", convObject))
+			for key, value := range tt.wantAnnotations {
+				assert.Equal(t, value, rule.Annotations[key])
+			}
+			assert.Equal(t, len(tt.wantLabels), len(rule.Labels))
+			for key, value := range tt.wantLabels {
+				assert.Equal(t, value, rule.Labels[key])
+			}
+			if tt.wantAnnotations == nil {
+				assert.NotContains(t, rule.Annotations, "owner")
+			}
+		})
+	}
+}
+
+func TestConvertToAlertTagLabels(t *testing.T) {
+	convConfig := model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", TimeWindow: "5m"}
+	rules := []model.SigmaRule{
+		{Title: "Rule 1", Tags: []string{"attack.execution", "attack.t1059.001", " Detection.Threat-Hunting "}},
+		{Title: "Rule 2", Tags: []string{"attack.t1059.001", "cve.2021-44228"}},
+	}
+	tests := []struct {
+		name           string
+		mode           string
+		rules          []model.SigmaRule
+		labels         map[string]string
+		templateLabels map[string]string
+		wantLabels     map[string]string
+		wantError      string
+	}{
+		{
+			name:       "none by default",
+			rules:      rules,
+			wantLabels: map[string]string{},
+		},
+		{
+			name:       "none",
+			mode:       "none",
+			rules:      rules,
+			wantLabels: map[string]string{},
+		},
+		{
+			name:       "joined",
+			mode:       "joined",
+			rules:      rules,
+			wantLabels: map[string]string{"tags": "attack.execution,attack.t1059.001,cve.2021-44228,detection.threat-hunting"},
+		},
+		{
+			name:       "joined without tags",
+			mode:       "joined",
+			rules:      []model.SigmaRule{{Title: "Rule 1"}},
+			labels:     map[string]string{"tags": "attack.execution"},
+			wantLabels: map[string]string{},
+		},
+		{
+			name:  "individual",
+			mode:  "individual",
+			rules: append(rules, model.SigmaRule{Title: "Rule 3", Tags: []string{"2fa.bypass", "..."}}),
+			wantLabels: map[string]string{
+				"attack_execution":         "true",
+				"attack_t1059_001":         "true",
+				"cve_2021_44228":           "true",
+				"detection_threat_hunting": "true",
+				"tag_2fa_bypass":           "true",
+			},
+		},
+		{
+			name:           "templated labels take precedence",
+			mode:           "joined",
+			rules:          rules,
+			templateLabels: map[string]string{"tags": "{{.Title}}"},
+			wantLabels:     map[string]string{"tags": "Rule 1"},
+		},
+		{
+			name:      "invalid mode",
+			mode:      "split",
+			rules:     rules,
+			wantError: "invalid tags_label_mode split",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := NewIntegrator()
+			i.config.IntegratorConfig.TagsLabelMode = tt.mode
+			i.config.IntegratorConfig.TemplateLabels = tt.templateLabels
+			rule := &model.ProvisionedAlertRule{Labels: tt.labels}
+			err := i.ConvertToAlert(rule, []string{"{job=`a`} | json"}, "Rule 1", convConfig, "conversions/conv.json", model.ConversionOutput{ConversionName: "conv", Rules: tt.rules})
+			if tt.wantError != "" {
+				assert.ErrorContains(t, err, tt.wantError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantLabels, rule.Labels)
+		})
+	}
+}
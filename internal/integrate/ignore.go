@@ -0,0 +1,174 @@
+package integrate
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/sigma-rule-deployment/shared"
+)
+
+// IgnoreFileName is the name of the file in the conversion path listing the conversion files
+// the integrator skips, using gitignore-style patterns
+const IgnoreFileName = ".srdignore"
+
+type ignorePattern struct {
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreMatcher matches paths relative to the conversion path against the patterns of an ignore file.
+// A nil matcher ignores nothing.
+type ignoreMatcher struct {
+	patterns []ignorePattern
+}
+
+// loadIgnoreFile reads the ignore file of a directory, returning a nil matcher if there is none
+func loadIgnoreFile(dir string) (*ignoreMatcher, error) {
+	path := filepath.Join(dir, IgnoreFileName)
+	contents, err := shared.ReadLocalFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading ignore file %s: %v", path, err)
+	}
+	return parseIgnorePatterns(contents)
+}
+
+// parseIgnorePatterns parses gitignore-style patterns: blank lines and lines starting with # are skipped,
+// ! negates a pattern, a trailing / only matches directories, and a pattern containing a / is relative
+// to the conversion path while any other pattern matches a file or directory name at any depth
+func parseIgnorePatterns(contents string) (*ignoreMatcher, error) {
+	matcher := &ignoreMatcher{}
+	for line := range strings.Lines(contents) {
+		line = strings.TrimRight(line, " \t\r\n")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, `\`)
+		if strings.HasSuffix(line, "/") {
+			pattern.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		expr := globToRegex(line)
+		if !anchored {
+			expr = "(.*/)?" + expr
+		}
+		regex, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %s: %v", line, err)
+		}
+		pattern.regex = regex
+		matcher.patterns = append(matcher.patterns, pattern)
+	}
+	return matcher, nil
+}
+
+// globToRegex converts a gitignore glob into a regular expression, where * and ? don't match
+// a path separator and ** matches any number of directories
+func globToRegex(glob string) string {
+	var expr strings.Builder
+	for index := 0; index < len(glob); index++ {
+		switch char := glob[index]; char {
+		case '*':
+			if strings.HasPrefix(glob[index:], "**/") {
+				expr.WriteString("(.*/)?")
+				index += 2
+			} else if strings.HasPrefix(glob[index:], "**") {
+				expr.WriteString(".*")
+				index++
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[index+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := glob[index+1 : index+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			index += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	return expr.String()
+}
+
+// ignored reports whether a path relative to the conversion path is ignored, either by a pattern
+// matching it or by a pattern matching one of its parent directories. The last matching pattern wins.
+func (m *ignoreMatcher) ignored(relpath string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	relpath = filepath.ToSlash(filepath.Clean(relpath))
+	parts := strings.Split(relpath, "/")
+	for index := 1; index < len(parts); index++ {
+		if m.match(strings.Join(parts[:index], "/"), true) {
+			return true
+		}
+	}
+	return m.match(relpath, isDir)
+}
+
+func (m *ignoreMatcher) match(relpath string, isDir bool) bool {
+	ignored := false
+	for _, pattern := range m.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.regex.MatchString(relpath) {
+			ignored = !pattern.negate
+		}
+	}
+	return ignored
+}
+
+// isIgnoredConversionFile reports whether a file in the conversion path is the ignore file itself, the
+// archive manifest, or matches one of the patterns of the ignore file
+func (i *Integrator) isIgnoredConversionFile(path string) (bool, error) {
+	relpath, err := filepath.Rel(i.config.Folders.ConversionPath, path)
+	if err != nil {
+		return false, fmt.Errorf("error checking file path %s: %v", path, err)
+	}
+	return relpath == IgnoreFileName || relpath == ArchiveManifestName || i.ignore.ignored(relpath, false), nil
+}
+
+// filterIgnoredFiles removes the conversion files skipped by the ignore file
+func (i *Integrator) filterIgnoredFiles(paths []string) ([]string, error) {
+	filtered := make([]string, 0, len(paths))
+	for _, path := range paths {
+		ignored, err := i.isIgnoredConversionFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if ignored {
+			fmt.Printf("Skipping %s, ignored by %s\n", path, IgnoreFileName)
+			i.skipFile(path, SkipReasonIgnored)
+			continue
+		}
+		filtered = append(filtered, path)
+	}
+	return filtered, nil
+}
@@ -0,0 +1,114 @@
+package integrate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	matcher, err := parseIgnorePatterns(`# scratch files
+scratch_*.json
+!scratch_keep.json
+
+examples/
+/top_only.json
+nested/**/draft.json
+conv_?.json
+`)
+	require.NoError(t, err)
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{path: "conv_okta.json", ignored: false},
+		{path: "scratch_test.json", ignored: true},
+		{path: "sub/scratch_test.json", ignored: true},
+		{path: "scratch_keep.json", ignored: false},
+		{path: "examples", isDir: true, ignored: true},
+		{path: "examples/conv_okta.json", ignored: true},
+		{path: "examples.json", ignored: false},
+		{path: "top_only.json", ignored: true},
+		{path: "sub/top_only.json", ignored: false},
+		{path: "nested/draft.json", ignored: true},
+		{path: "nested/a/b/draft.json", ignored: true},
+		{path: "conv_a.json", ignored: true},
+		{path: "conv_ab.json", ignored: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.ignored, matcher.ignored(tt.path, tt.isDir))
+		})
+	}
+
+	// A nil matcher, when there is no ignore file, ignores nothing
+	var none *ignoreMatcher
+	assert.False(t, none.ignored("scratch_test.json", false))
+}
+
+func TestLoadConfigIgnoreFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll(filepath.Join("conversions", "examples"), 0o755))
+	require.NoError(t, os.WriteFile("config.yml", []byte(`folders:
+  conversion_path: conversions
+  deployment_path: deployments
+integration:
+  test_queries: true
+`), 0o600))
+	files := []string{
+		filepath.Join("conversions", "conv_okta.json"),
+		filepath.Join("conversions", "conv_github.json"),
+		filepath.Join("conversions", "scratch_okta.json"),
+		filepath.Join("conversions", "examples", "conv_example.json"),
+	}
+	for _, file := range files {
+		require.NoError(t, os.WriteFile(file, []byte("{}"), 0o600))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join("conversions", IgnoreFileName), []byte("scratch_*\nexamples/\n"), 0o600))
+
+	t.Setenv("INTEGRATOR_CONFIG_PATH", "config.yml")
+	t.Setenv("DELETED_FILES", "")
+	t.Setenv("MANUAL_FILES", "")
+
+	t.Run("all rules", func(t *testing.T) {
+		t.Setenv("ALL_RULES", "true")
+		t.Setenv("CHANGED_FILES", "")
+		t.Setenv("TEST_FILES", "")
+
+		i := NewIntegrator()
+		require.NoError(t, i.LoadConfig())
+		expected := []string{
+			filepath.Join("conversions", "conv_github.json"),
+			filepath.Join("conversions", "conv_okta.json"),
+		}
+		assert.Equal(t, expected, i.addedFiles)
+		assert.Equal(t, expected, i.testFiles)
+	})
+
+	t.Run("changed files", func(t *testing.T) {
+		t.Setenv("ALL_RULES", "false")
+		t.Setenv("CHANGED_FILES", "conversions/conv_okta.json conversions/scratch_okta.json conversions/"+IgnoreFileName)
+		t.Setenv("TEST_FILES", "conversions/scratch_okta.json conversions/conv_github.json")
+
+		i := NewIntegrator()
+		require.NoError(t, i.LoadConfig())
+		assert.Equal(t, []string{"conversions/conv_okta.json"}, i.addedFiles)
+		assert.Equal(t, []string{"conversions/conv_github.json"}, i.testFiles)
+	})
+
+	t.Run("no ignore file", func(t *testing.T) {
+		require.NoError(t, os.Remove(filepath.Join("conversions", IgnoreFileName)))
+		t.Setenv("ALL_RULES", "true")
+		t.Setenv("CHANGED_FILES", "")
+		t.Setenv("TEST_FILES", "")
+
+		i := NewIntegrator()
+		require.NoError(t, i.LoadConfig())
+		assert.Len(t, i.addedFiles, len(files))
+	})
+}
@@ -3,18 +3,25 @@ package integrate
 
 import (
 	"bytes"
+	"cmp"
 	"encoding/json"
 	"fmt"
 	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/grafana/sigma-rule-deployment/internal/model"
 	"github.com/grafana/sigma-rule-deployment/shared"
+	prommodel "github.com/prometheus/common/model"
 	"github.com/spaolacci/murmur3"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
@@ -27,6 +34,104 @@ const TRUE = "true"
 // neither overwritten nor deleted by the integrator.
 const ManualAnnotation = "manual"
 
+// PlaceholderAnnotation is the annotation key marking a paused alert rule generated for a conversion
+// without queries, when create_placeholder_for_empty_queries is enabled.
+const PlaceholderAnnotation = "Placeholder"
+
+// SigmaRuleIDsAnnotation is the annotation key listing the IDs of the Sigma rules
+// a deployment file was generated from, when annotate_rule_ids is enabled.
+const SigmaRuleIDsAnnotation = "SigmaRuleIDs"
+
+// RuleModifiedAnnotation is the annotation key holding the date the Sigma rules of a
+// deployment file were last modified, when annotate_rule_modified is enabled.
+const RuleModifiedAnnotation = "RuleModified"
+
+// RelatedRulesAnnotation is the annotation key listing the rules referenced by the related
+// field of the Sigma rules of a deployment file, when annotate_related_rules is enabled.
+const RelatedRulesAnnotation = "RelatedRules"
+
+// FalsePositivesAnnotation is the annotation key listing the known false positives of the Sigma
+// rules of a deployment file, when annotate_false_positives is enabled.
+const FalsePositivesAnnotation = "FalsePositives"
+
+// SourceLinkAnnotation is the annotation key linking to the Sigma rule file of a deployment file on GitHub,
+// at the commit it was integrated from, when annotate_source_link is enabled.
+const SourceLinkAnnotation = "SourceLink"
+
+// ExploreLinkAnnotation is the annotation key linking to the query of a deployment file in Grafana Explore,
+// when annotate_explore_link is enabled.
+const ExploreLinkAnnotation = "ExploreLink"
+
+// SigmaInputFileAnnotation is the annotation key with the path of the Sigma rule file a deployment file was
+// converted from, as recorded in its conversion file, when annotate_input_file is enabled.
+const SigmaInputFileAnnotation = "SigmaInputFile"
+
+// Reasons a conversion file was not integrated, or integrated without any change to its deployment files,
+// reported in the skipped_conversions output
+const (
+	SkipReasonNoConfig      = "no_config"
+	SkipReasonIgnored       = "ignored"
+	SkipReasonNoQueries     = "no_queries"
+	SkipReasonObsoleting    = "obsoleting"
+	SkipReasonNoTestMatches = "no_test_matches"
+	SkipReasonManual        = "manual"
+	SkipReasonUnchanged     = "unchanged"
+)
+
+// Interval and maximum number of data points of the queries of alert rules by data source type, when not configured:
+// those of Grafana Alerting for Loki and Prometheus, and those of the Elasticsearch data source plugin for Elasticsearch
+var defaultQueryIntervals = map[string]struct{ intervalMs, maxDataPoints int }{
+	shared.Loki:          {intervalMs: 1000, maxDataPoints: 43200},
+	shared.Prometheus:    {intervalMs: 1000, maxDataPoints: 43200},
+	shared.Elasticsearch: {intervalMs: 2000, maxDataPoints: 1354},
+}
+
+// refIDs of the expressions added after the queries of an alert rule: the combiner sums the queries'
+// results, and the threshold fires when the sum is above zero. The threshold is the default condition.
+const (
+	combinerRefID  = "B"
+	thresholdRefID = "C"
+	// prefix of the refIDs of the expressions reducing range queries, followed by the index of the query
+	reducerRefIDPrefix = "R"
+)
+
+// thresholdOperators are the evaluator types of Grafana's threshold expression a conversion output may set
+var thresholdOperators = []string{"gt", "lt", "gte", "lte", "eq", "ne"}
+
+// Handling of the conversion files listed as both changed and deleted, set by changed_and_deleted_files
+const (
+	ChangedAndDeletedDelete = "delete"
+	ChangedAndDeletedError  = "error"
+)
+
+// Handling of the Sigma rules sharing an ID within a conversion, set by duplicate_rule_ids
+const (
+	DuplicateRuleIDsError  = "error"
+	DuplicateRuleIDsDedupe = "dedupe"
+)
+
+// Handling of the results of a query response which failed although the response succeeded, set by result_errors:
+// they fail the query test, or are only reported as errors of its result
+const (
+	ResultErrorsFail   = "fail"
+	ResultErrorsReport = "report"
+)
+
+// MissingDataSource is the placeholder data source UID of the queries of conversions without a data source,
+// when allow_missing_data_source is enabled. It can also be configured explicitly, e.g. for testing.
+const MissingDataSource = "nil"
+
+// BaselineMatchesAnnotation and DetectedFieldsAnnotation are the annotation keys holding the number of
+// matches and the fields returned when testing the queries of a deployment file, when annotate_baseline
+// is enabled.
+const (
+	BaselineMatchesAnnotation = "BaselineMatches"
+	DetectedFieldsAnnotation  = "DetectedFields"
+)
+
+// builtinAnnotationKeys lists the annotations written by the integrator whose keys can be renamed with annotation_key_map
+var builtinAnnotationKeys = []string{"Query", "TimeWindow", "Lookback", "LogSourceUid", "LogSourceType", "ConversionFile", SigmaRuleIDsAnnotation, RuleModifiedAnnotation, RelatedRulesAnnotation, FalsePositivesAnnotation, BaselineMatchesAnnotation, DetectedFieldsAnnotation, SourceLinkAnnotation, ExploreLinkAnnotation, SigmaInputFileAnnotation}
+
 var FuncMap = template.FuncMap{
 	// Case conversion
 	"toUpper": strings.ToUpper,
@@ -86,10 +191,43 @@ type Integrator struct {
 	// commit. Any that lack the manual annotation are flagged before integration so
 	// the change is preserved on this and every future run.
 	manualFiles []string
+
+	// strictMode turns any warning raised during the run into a failure
+	strictMode bool
+	warnings   *shared.Warnings
+	// dryRun computes the changes to the deployment files without writing or removing any file
+	dryRun bool
+
+	// staleFiles are conversion files whose Sigma rules were not modified within stale_after_days
+	staleFiles []string
+	// dedupedFiles are deployment files removed as another alert rule has the same content
+	dedupedFiles []string
+	// skippedFiles are the reasons conversion files were skipped, by conversion file
+	skippedFiles map[string]string
+
+	// plannedRules holds the alert rules written in a dry run, or nil for the files removed, keyed by file, for the
+	// later passes over the deployment folder to see the changes of the dry run without them being written
+	plannedRules map[string]*model.ProvisionedAlertRule
+	// plan holds the changes to the deployment files, keyed by file, for the deployer to deploy
+	plan map[string]model.PlannedAlert
+	// planChanges counts the changes recorded in the plan, to tell whether integrating a file changed anything
+	planChanges int
+
+	// ignore holds the patterns of the conversion files to skip, read from the ignore file of the conversion path
+	ignore *ignoreMatcher
+
+	// enrichment holds the annotations and labels to add to alert rules based on their Sigma rules' logsource
+	enrichment *model.EnrichmentLookup
+	// shared queries referenced by the conversion outputs, by ID
+	queryLibrary map[string]string
+	// results of testing the queries of the conversion files before integrating them, by conversion file
+	testResults map[string][]model.QueryTestResult
+	// data sources of allowed_datasources looked up in Grafana, by reference
+	datasources map[string]*GrafanaDatasource
 }
 
 func NewIntegrator() *Integrator {
-	return &Integrator{}
+	return &Integrator{warnings: &shared.Warnings{}}
 }
 
 func (i *Integrator) LoadConfig() error {
@@ -103,24 +241,46 @@ func (i *Integrator) LoadConfig() error {
 	// Read and parse the YAML config file
 	config, err := shared.LoadConfigFromFile(configFile)
 	if err != nil {
+		return shared.NewFileError(configFile, err)
+	}
+	if err := shared.ApplyEnvOverrides(&config); err != nil {
 		return err
 	}
 	i.config = config
 	i.prettyPrint = strings.ToLower(os.Getenv("PRETTY_PRINT")) == TRUE
 	i.allRules = strings.ToLower(os.Getenv("ALL_RULES")) == TRUE
+	i.strictMode = strings.ToLower(os.Getenv("STRICT_MODE")) == TRUE
+	i.dryRun = strings.ToLower(os.Getenv("INTEGRATOR_DRY_RUN")) == TRUE
 
 	i.config.IntegratorConfig.ContinueOnQueryTestingErrors = strings.ToLower(os.Getenv("CONTINUE_ON_QUERY_TESTING_ERRORS")) == TRUE
 
-	if !filepath.IsLocal(i.config.Folders.ConversionPath) {
-		return fmt.Errorf("conversion path is not local: %s", i.config.Folders.ConversionPath)
+	// Validation errors are reported as annotations of the config file
+	if err := i.normalizeBoolFields(); err != nil {
+		return shared.NewFileError(configFile, err)
 	}
-	if !filepath.IsLocal(i.config.Folders.DeploymentPath) {
-		return fmt.Errorf("deployment path is not local: %s", i.config.Folders.DeploymentPath)
+	if err := i.validateConfig(); err != nil {
+		return shared.NewFileError(configFile, err)
+	}
+	if enrichmentFile := i.config.IntegratorConfig.EnrichmentFile; enrichmentFile != "" {
+		if i.enrichment, err = loadEnrichmentFile(enrichmentFile); err != nil {
+			return shared.NewFileError(enrichmentFile, err)
+		}
+	}
+	if queryLibrary := i.config.IntegratorConfig.QueryLibrary; queryLibrary != "" {
+		if i.queryLibrary, err = LoadQueryLibrary(queryLibrary); err != nil {
+			return shared.NewFileError(queryLibrary, err)
+		}
 	}
 
 	fmt.Printf("Conversion path: %s\nDeployment path: %s\n", i.config.Folders.ConversionPath, i.config.Folders.DeploymentPath)
 
-	if _, err = os.Stat(i.config.Folders.DeploymentPath); err != nil {
+	if i.dryRun {
+		fmt.Println("Dry run: the planned changes are reported without writing any file")
+		// The queries may still be tested, unless the data sources must not be queried either
+		if strings.ToLower(os.Getenv("INTEGRATOR_DRY_RUN_SKIP_QUERY_TESTS")) == TRUE {
+			i.config.IntegratorConfig.TestQueries = false
+		}
+	} else if _, err = os.Stat(i.config.Folders.DeploymentPath); err != nil {
 		err = os.MkdirAll(i.config.Folders.DeploymentPath, 0o755)
 		if err != nil {
 			return fmt.Errorf("error creating deployment directory: %v", err)
@@ -143,6 +303,26 @@ func (i *Integrator) LoadConfig() error {
 	// candidates for backfilling the manual annotation before integration runs.
 	manualFiles := strings.Split(os.Getenv("MANUAL_FILES"), " ")
 
+	if i.ignore, err = loadIgnoreFile(i.config.Folders.ConversionPath); err != nil {
+		return err
+	}
+
+	// Conversion files extracted from an archive are integrated and tested like changed conversion files.
+	// Extracting writes them to the conversion path, which a dry run must not do.
+	if archive := os.Getenv("CONVERSION_ARCHIVE"); archive != "" {
+		if i.dryRun {
+			return fmt.Errorf("conversion archive %s can't be integrated in a dry run, as its conversion files would be extracted into %s: "+
+				"extract it before the dry run, or unset CONVERSION_ARCHIVE", archive, i.config.Folders.ConversionPath)
+		}
+		extracted, err := extractConversionArchive(archive, i.config.Folders.ConversionPath)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Extracted %d conversion file(s) from %s\n", len(extracted), archive)
+		changedFiles = append(changedFiles, extracted...)
+		testFiles = append(testFiles, extracted...)
+	}
+
 	newUpdatedFiles := []string{}
 	filesToBeTested := []string{}
 	if i.allRules {
@@ -150,12 +330,20 @@ func (i *Integrator) LoadConfig() error {
 			if err != nil {
 				return fmt.Errorf("failed to walk directory: %w", err)
 			}
-			if !info.IsDir() {
-				newUpdatedFiles = append(newUpdatedFiles, path)
-				// If all files is true, test all files
-				if i.config.IntegratorConfig.TestQueries {
-					filesToBeTested = append(filesToBeTested, path)
+			if info.IsDir() {
+				// Skip the directories matched by the ignore file, along with everything in them
+				if relpath, err := filepath.Rel(i.config.Folders.ConversionPath, path); err == nil && relpath != "." && i.ignore.ignored(relpath, true) {
+					return filepath.SkipDir
 				}
+				return nil
+			}
+			if ignored, err := i.isIgnoredConversionFile(path); err != nil || ignored {
+				return err
+			}
+			newUpdatedFiles = append(newUpdatedFiles, path)
+			// If all files is true, test all files
+			if i.config.IntegratorConfig.TestQueries {
+				filesToBeTested = append(filesToBeTested, path)
 			}
 
 			return nil
@@ -163,20 +351,32 @@ func (i *Integrator) LoadConfig() error {
 			return fmt.Errorf("failed to walk directory: %w", err)
 		}
 	} else {
-		if newUpdatedFiles, err = filterFilesInDir(changedFiles, i.config.Folders.ConversionPath); err != nil {
+		if newUpdatedFiles, err = filterFilesUnderDir(changedFiles, i.config.Folders.ConversionPath); err != nil {
+			return err
+		}
+		if newUpdatedFiles, err = i.filterIgnoredFiles(newUpdatedFiles); err != nil {
 			return err
 		}
 		if i.config.IntegratorConfig.TestQueries {
-			if filesToBeTested, err = filterFilesInDir(testFiles, i.config.Folders.ConversionPath); err != nil {
+			if filesToBeTested, err = filterFilesUnderDir(testFiles, i.config.Folders.ConversionPath); err != nil {
+				return err
+			}
+			if filesToBeTested, err = i.filterIgnoredFiles(filesToBeTested); err != nil {
 				return err
 			}
 		}
+		if newUpdatedFiles, filesToBeTested, err = i.addLibraryConversions(changedFiles, testFiles, newUpdatedFiles, filesToBeTested); err != nil {
+			return err
+		}
 	}
 
-	removedFiles, err := filterFilesInDir(deletedFiles, i.config.Folders.ConversionPath)
+	removedFiles, err := filterFilesUnderDir(deletedFiles, i.config.Folders.ConversionPath)
 	if err != nil {
 		return err
 	}
+	if newUpdatedFiles, filesToBeTested, err = i.resolveChangedAndDeletedFiles(newUpdatedFiles, filesToBeTested, removedFiles); err != nil {
+		return err
+	}
 	humanModifiedFiles, err := filterFilesInDir(manualFiles, i.config.Folders.DeploymentPath)
 	if err != nil {
 		return err
@@ -191,6 +391,179 @@ func (i *Integrator) LoadConfig() error {
 	return nil
 }
 
+// resolveChangedAndDeletedFiles resolves the conversion files listed as both changed and deleted, e.g. with unusual
+// git states, whose alert rules would otherwise be both written and removed depending on the order of the operations.
+// Deletion wins by default: the files are no longer integrated nor tested. With changed_and_deleted_files set to
+// error, an error listing them is returned instead.
+func (i *Integrator) resolveChangedAndDeletedFiles(changedFiles, testFiles, removedFiles []string) ([]string, []string, error) {
+	overlapping := []string{}
+	for _, file := range changedFiles {
+		if slices.Contains(removedFiles, file) {
+			overlapping = append(overlapping, file)
+		}
+	}
+	if len(overlapping) == 0 {
+		return changedFiles, testFiles, nil
+	}
+	if i.config.IntegratorConfig.ChangedAndDeletedFiles == ChangedAndDeletedError {
+		return nil, nil, fmt.Errorf("conversion files are listed as both changed and deleted: %s", strings.Join(overlapping, ", "))
+	}
+	for _, file := range overlapping {
+		fmt.Printf("Conversion file %s is listed as both changed and deleted, removing its alert rule\n", file)
+	}
+	isOverlapping := func(file string) bool { return slices.Contains(overlapping, file) }
+	return slices.DeleteFunc(changedFiles, isOverlapping), slices.DeleteFunc(testFiles, isOverlapping), nil
+}
+
+// boolValues maps the spellings of booleans accepted in the string fields of the configuration to their value
+var boolValues = map[string]bool{
+	"true": true, "yes": true, "y": true, "on": true, "1": true,
+	"false": false, "no": false, "n": false, "off": false, "0": false,
+}
+
+// parseBool leniently parses a boolean written as a string, e.g. yes, True or 1
+func parseBool(value string) (bool, error) {
+	result, ok := boolValues[strings.ToLower(strings.TrimSpace(value))]
+	if !ok {
+		return false, fmt.Errorf("%q is not a boolean, use true or false", value)
+	}
+	return result, nil
+}
+
+// normalizeBoolFields rewrites the boolean string fields of the configuration as true or false.
+// skip_unsupported stays a string, shared with the converter, so that an unset value can still
+// fall back to the conversion defaults.
+func (i *Integrator) normalizeBoolFields() error {
+	normalize := func(value *string, field string) error {
+		if *value == "" {
+			return nil
+		}
+		result, err := parseBool(*value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", field, err)
+		}
+		*value = strconv.FormatBool(result)
+		return nil
+	}
+	if err := normalize(&i.config.ConversionDefaults.SkipUnsupported, "conversion_defaults.skip_unsupported"); err != nil {
+		return err
+	}
+	for index := range i.config.Conversions {
+		conversion := &i.config.Conversions[index]
+		if err := normalize(&conversion.SkipUnsupported, fmt.Sprintf("skip_unsupported of conversion %s", conversion.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateConfig checks the settings of the configuration which don't depend on other files
+func (i *Integrator) validateConfig() error {
+	if i.config.Folders.ConversionPath == "" {
+		return fmt.Errorf("folders.conversion_path is required")
+	}
+	if i.config.Folders.DeploymentPath == "" {
+		return fmt.Errorf("folders.deployment_path is required")
+	}
+	if !filepath.IsLocal(i.config.Folders.ConversionPath) {
+		return fmt.Errorf("conversion path is not local: %s", i.config.Folders.ConversionPath)
+	}
+	if !filepath.IsLocal(i.config.Folders.DeploymentPath) {
+		return fmt.Errorf("deployment path is not local: %s", i.config.Folders.DeploymentPath)
+	}
+
+	if err := validateAnnotationKeyMap(i.config.IntegratorConfig.AnnotationKeyMap); err != nil {
+		return err
+	}
+	if err := shared.ValidateAlertFileNameTemplate(i.config.IntegratorConfig.AlertFileNameTemplate); err != nil {
+		return err
+	}
+	if planFile := i.config.IntegratorConfig.PlanFile; planFile != "" && !filepath.IsLocal(planFile) {
+		return fmt.Errorf("plan file is not local: %s", planFile)
+	}
+	if _, err := time.LoadLocation(i.config.IntegratorConfig.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %s: %v", i.config.IntegratorConfig.Timezone, err)
+	}
+	if mode := i.config.IntegratorConfig.ChangedAndDeletedFiles; mode != "" && mode != ChangedAndDeletedDelete && mode != ChangedAndDeletedError {
+		return fmt.Errorf("invalid changed_and_deleted_files %s: must be %s or %s", mode, ChangedAndDeletedDelete, ChangedAndDeletedError)
+	}
+	if mode := i.config.IntegratorConfig.DuplicateRuleIDs; mode != "" && mode != DuplicateRuleIDsError && mode != DuplicateRuleIDsDedupe {
+		return fmt.Errorf("invalid duplicate_rule_ids %s: must be %s or %s", mode, DuplicateRuleIDsError, DuplicateRuleIDsDedupe)
+	}
+	if err := validateTagsLabelMode(i.config.IntegratorConfig.TagsLabelMode); err != nil {
+		return err
+	}
+	if i.config.IntegratorConfig.AnnotateExploreLink && i.config.DeployerConfig.GrafanaInstance == "" {
+		return fmt.Errorf("deployment.grafana_instance is required to annotate alert rules with explore links")
+	}
+	if i.config.IntegratorConfig.MaxQueriesPerRule < 0 {
+		return fmt.Errorf("invalid maximum queries per rule %d: must not be negative", i.config.IntegratorConfig.MaxQueriesPerRule)
+	}
+	if i.config.IntegratorConfig.PendingPeriodMultiplier < 0 {
+		return fmt.Errorf("invalid pending period multiplier %d: must not be negative", i.config.IntegratorConfig.PendingPeriodMultiplier)
+	}
+	if endpoint := i.config.IntegratorConfig.QueryEndpoint; strings.Contains(endpoint, "://") || strings.ContainsAny(endpoint, "?#") {
+		return fmt.Errorf("invalid query endpoint %s: must be a path relative to the Grafana URL", endpoint)
+	}
+	for _, datasourceType := range slices.Sorted(maps.Keys(i.config.IntegratorConfig.QueryTimeouts)) {
+		value := i.config.IntegratorConfig.QueryTimeouts[datasourceType]
+		if timeout, err := time.ParseDuration(value); err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid query timeout %s for data source type %s: must be a positive duration, e.g. 30s", value, datasourceType)
+		}
+	}
+	if i.config.IntegratorConfig.QueryTestConcurrency < 0 {
+		return fmt.Errorf("invalid query test concurrency %d: must not be negative", i.config.IntegratorConfig.QueryTestConcurrency)
+	}
+	for setting, fields := range map[string][]string{"test_value_fields": i.config.IntegratorConfig.TestValueFields, "test_label_fields": i.config.IntegratorConfig.TestLabelFields} {
+		if slices.Contains(fields, "") {
+			return fmt.Errorf("invalid integration.%s: field names must not be empty", setting)
+		}
+	}
+	if value := i.config.IntegratorConfig.TestSampleWindow; value != "" {
+		if window, err := time.ParseDuration(value); err != nil || window <= 0 {
+			return fmt.Errorf("invalid test sample window %s: must be a positive duration, e.g. 5m", value)
+		}
+	}
+	if mode := i.config.IntegratorConfig.ResultErrors; mode != "" && mode != ResultErrorsFail && mode != ResultErrorsReport {
+		return fmt.Errorf("invalid result_errors %s: must be %s or %s", mode, ResultErrorsFail, ResultErrorsReport)
+	}
+	if value := i.config.IntegratorConfig.DatasourceReadyTimeout; value != "" {
+		if timeout, err := time.ParseDuration(value); err != nil || timeout < 0 {
+			return fmt.Errorf("invalid data source ready timeout %s: must be a duration, e.g. 30s", value)
+		}
+	}
+	times := map[string]string{
+		"integration.from":         i.config.IntegratorConfig.From,
+		"integration.to":           i.config.IntegratorConfig.To,
+		"integration.explore_from": i.config.IntegratorConfig.ExploreFrom,
+		"integration.explore_to":   i.config.IntegratorConfig.ExploreTo,
+		"conversion_defaults.from": i.config.ConversionDefaults.From,
+		"conversion_defaults.to":   i.config.ConversionDefaults.To,
+	}
+	for _, conf := range i.config.Conversions {
+		times["from of conversion "+conf.Name] = conf.From
+		times["to of conversion "+conf.Name] = conf.To
+	}
+	for _, setting := range slices.Sorted(maps.Keys(times)) {
+		if err := shared.ValidateTimeExpression(setting, times[setting]); err != nil {
+			return err
+		}
+	}
+	for setting, value := range map[string]string{"title_prefix": i.config.IntegratorConfig.TitlePrefix, "title_suffix": i.config.IntegratorConfig.TitleSuffix} {
+		if _, err := template.New(setting).Funcs(FuncMap).Parse(value); err != nil {
+			return fmt.Errorf("error parsing template %s: %v", setting, err)
+		}
+	}
+	if _, err := compilePathLabelPattern(i.config.IntegratorConfig.PathLabelPattern); err != nil {
+		return err
+	}
+	if defaultConversion := i.config.IntegratorConfig.DefaultConversion; defaultConversion != "" &&
+		!slices.ContainsFunc(i.config.Conversions, func(conf model.ConversionConfig) bool { return conf.Name == defaultConversion }) {
+		return fmt.Errorf("default conversion %s is not configured in conversions", defaultConversion)
+	}
+	return nil
+}
+
 // filterFilesInDir keeps only the paths that sit directly inside dir, matching a
 // diff-derived file list to a known output directory. Empty entries (e.g. from
 // splitting an unset env var) are skipped.
@@ -211,6 +584,25 @@ func filterFilesInDir(paths []string, dir string) ([]string, error) {
 	return filtered, nil
 }
 
+// filterFilesUnderDir keeps only the paths inside dir or any of its subdirectories, matching a diff-derived
+// file list to the conversion files, which may be organised in subdirectories. Empty entries are skipped.
+func filterFilesUnderDir(paths []string, dir string) ([]string, error) {
+	filtered := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		relpath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil, fmt.Errorf("error checking file path %s: %v", path, err)
+		}
+		if relpath != "." && filepath.IsLocal(relpath) {
+			filtered = append(filtered, path)
+		}
+	}
+	return filtered, nil
+}
+
 // cleanupOrphanedFilesInPath removes orphaned files in the specified path
 func (i *Integrator) cleanupOrphanedFilesInPath(searchPath string, isOrphaned func(string) (bool, error)) error {
 	// Get all JSON files in the path
@@ -232,17 +624,21 @@ func (i *Integrator) cleanupOrphanedFilesInPath(searchPath string, isOrphaned fu
 	for _, file := range files {
 		orphaned, err := isOrphaned(file)
 		if err != nil {
-			fmt.Printf("Warning: Could not check file %s: %v\n", file, err)
+			i.warnings.Add("Could not check file %s: %v", file, err)
 			continue
 		}
 
 		if orphaned {
-			if keepAsManual(file, "orphaned") {
+			if keepAsManual(file, "orphaned", i.warnings) {
 				continue
 			}
 			fmt.Printf("Removing orphaned file: %s\n", file)
-			if err := os.Remove(file); err != nil {
-				fmt.Printf("Warning: Could not remove orphaned file %s: %v\n", file, err)
+			remove := i.removeFile
+			if searchPath == i.config.Folders.DeploymentPath {
+				remove = i.removeDeploymentFile
+			}
+			if err := remove(file); err != nil {
+				i.warnings.Add("Could not remove orphaned file %s: %v", file, err)
 			}
 		}
 	}
@@ -263,13 +659,30 @@ func (i *Integrator) isConversionFileOrphaned(file string) (bool, error) {
 	}
 
 	// Check if this conversion name has a matching configuration
-	for _, conf := range i.config.Conversions {
-		if conf.Name == conversionObject.ConversionName {
-			return false, nil
-		}
+	config, err := FindConversionConfig(i.config, conversionObject, file)
+	if err != nil {
+		return false, err
 	}
+	return config.Name == "", nil
+}
 
-	return true, nil
+// FindConversionConfig returns the configuration of the conversion which produced a conversion file, using the
+// default conversion for files without a conversion name. The returned config is empty if the conversion isn't
+// configured.
+func FindConversionConfig(config model.Configuration, conversionObject model.ConversionOutput, file string) (model.ConversionConfig, error) {
+	name := conversionObject.ConversionName
+	if name == "" {
+		if config.IntegratorConfig.DefaultConversion == "" {
+			return model.ConversionConfig{}, fmt.Errorf("conversion file %s has no conversion_name: set it, or set integration.default_conversion to the conversion to use", file)
+		}
+		name = config.IntegratorConfig.DefaultConversion
+	}
+	for _, conf := range config.Conversions {
+		if conf.Name == name {
+			return conf, nil
+		}
+	}
+	return model.ConversionConfig{}, nil
 }
 
 // isDeploymentFileOrphaned checks if a deployment file references a missing conversion file
@@ -285,7 +698,7 @@ func (i *Integrator) isDeploymentFileOrphaned(file string) (bool, error) {
 	}
 
 	// Check if the referenced conversion file still exists
-	if conversionFile := deploymentRule.Annotations["ConversionFile"]; conversionFile != "" {
+	if conversionFile := deploymentRule.Annotations[i.annotationKey("ConversionFile")]; conversionFile != "" {
 		if _, err := os.Stat(conversionFile); os.IsNotExist(err) {
 			return true, nil
 		}
@@ -294,6 +707,43 @@ func (i *Integrator) isDeploymentFileOrphaned(file string) (bool, error) {
 	return false, nil
 }
 
+// isDeploymentFileOfUnknownConversion checks if a deployment file was generated for a conversion which is
+// no longer configured, such as after the conversion was renamed. A file is only considered orphaned when
+// neither its filename nor the conversion file in its ConversionFile annotation match a configured conversion.
+func (i *Integrator) isDeploymentFileOfUnknownConversion(file string) (bool, error) {
+	filename := filepath.Base(file)
+	fileNameTemplate := i.config.IntegratorConfig.AlertFileNameTemplate
+	if len(i.config.Conversions) == 0 || shared.AlertUIDFromFileName(fileNameTemplate, filename) == "" {
+		return false, nil
+	}
+	for _, conf := range i.config.Conversions {
+		conversionGlob, err := shared.AlertFileGlob(fileNameTemplate, conf.Name, "")
+		if err != nil {
+			return false, err
+		}
+		if matched, _ := filepath.Match(conversionGlob, filename); matched {
+			return false, nil
+		}
+	}
+
+	deploymentRule := &model.ProvisionedAlertRule{}
+	if err := readRuleFromFile(deploymentRule, file); err != nil {
+		return false, err
+	}
+	// Files without the annotation weren't generated by the integrator
+	conversionFile := deploymentRule.Annotations[i.annotationKey("ConversionFile")]
+	if conversionFile == "" {
+		return false, nil
+	}
+	for _, conf := range i.config.Conversions {
+		if strings.HasPrefix(filepath.Base(conversionFile), conf.Name+"_") {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
 // manualValueSet reports whether a decoded JSON value marks a file as manual.
 // It accepts both the boolean `true` used by conversion files and the string
 // "true" used by deployment annotations, so the converter (Python) and the
@@ -346,10 +796,10 @@ func isManual(file string) (bool, error) {
 // keepAsManual reports whether a file slated for deletion must be preserved. It
 // fails closed: if the manual flag cannot be determined (unreadable/unparseable
 // file), the file is kept rather than deleted. kind labels the file in the log.
-func keepAsManual(file, kind string) bool {
+func keepAsManual(file, kind string, warnings *shared.Warnings) bool {
 	manual, err := isManual(file)
 	if err != nil {
-		fmt.Printf("Warning: could not check manual flag for %s, keeping it: %v\n", file, err)
+		warnings.Add("could not check manual flag for %s, keeping it: %v", file, err)
 		return true
 	}
 	if manual {
@@ -371,13 +821,13 @@ func (i *Integrator) BackfillManualFlags() error {
 	for _, file := range i.manualFiles {
 		content, err := shared.ReadLocalFile(file)
 		if err != nil {
-			fmt.Printf("Warning: could not read %s for manual backfill, leaving unchanged: %v\n", file, err)
+			i.warnings.Add("could not read %s for manual backfill, leaving unchanged: %v", file, err)
 			continue
 		}
 
 		var doc map[string]any
 		if err := json.Unmarshal([]byte(content), &doc); err != nil {
-			fmt.Printf("Warning: could not parse %s for manual backfill, leaving unchanged: %v\n", file, err)
+			i.warnings.Add("could not parse %s for manual backfill, leaving unchanged: %v", file, err)
 			continue
 		}
 
@@ -386,6 +836,7 @@ func (i *Integrator) BackfillManualFlags() error {
 		// human choice; do not overwrite it.
 		if annotations != nil {
 			if _, present := annotations[ManualAnnotation]; present {
+				i.addManualFileToPlan(file)
 				continue
 			}
 		} else {
@@ -396,15 +847,16 @@ func (i *Integrator) BackfillManualFlags() error {
 
 		out, err := marshalJSON(doc, i.prettyPrint)
 		if err != nil {
-			fmt.Printf("Warning: could not marshal manual backfill for %s, leaving unchanged: %v\n", file, err)
+			i.warnings.Add("could not marshal manual backfill for %s, leaving unchanged: %v", file, err)
 			continue
 		}
 
 		fmt.Printf("Marking manually-modified deployment file as manual: %s\n", file)
-		if err := os.WriteFile(file, out, 0o600); err != nil {
-			fmt.Printf("Warning: could not write manual backfill for %s, leaving unchanged: %v\n", file, err)
+		if err := i.writeFile(file, out); err != nil {
+			i.warnings.Add("could not write manual backfill for %s, leaving unchanged: %v", file, err)
 			continue
 		}
+		i.addManualFileToPlan(file)
 	}
 	return nil
 }
@@ -416,14 +868,60 @@ func (i *Integrator) Run() error {
 		return err
 	}
 
+	// Remove the deployment files of deleted conversion files before converting the updated ones, mirroring
+	// the deployer which deletes alert rules first: when a rule is renamed, the deployment file of the old
+	// name is gone by the time the new one is written, so the deployment folder never holds both at once
+	if err := i.DoRemovals(); err != nil {
+		return err
+	}
+
 	// Convert all files that have been updated from the last commit
 	if err := i.DoConversions(); err != nil {
 		return err
 	}
 
-	// Clean up any deleted files
-	if err := i.DoCleanup(); err != nil {
-		return err
+	// Clean up any orphaned files once the deployment files are up to date
+	i.DoOrphanCleanup()
+
+	// Remove the duplicated alert rules before disambiguating titles, as duplicates share their title
+	if i.config.IntegratorConfig.DedupeRules {
+		if err := i.DedupeRules(); err != nil {
+			return err
+		}
+	}
+
+	// Disambiguate alert rule titles once all the deployment files are up to date
+	if i.config.IntegratorConfig.DedupeTitles {
+		if err := i.DedupeTitles(); err != nil {
+			return err
+		}
+	}
+
+	// Generate the dashboard of the detections once all the deployment files are up to date
+	if i.config.IntegratorConfig.GenerateDashboard {
+		if err := i.GenerateDashboard(); err != nil {
+			return err
+		}
+	}
+
+	// A dry run reports the changes it would have made instead of writing the plan and lock files
+	if i.dryRun {
+		i.printPlan()
+		return i.SetOutputs()
+	}
+
+	// Write the deployment plan once all the deployment files are up to date
+	if i.config.IntegratorConfig.PlanFile != "" {
+		if err := i.WritePlan(); err != nil {
+			return err
+		}
+	}
+
+	// Lock the deployment folder once all the deployment files are up to date
+	if i.config.IntegratorConfig.LockFile != "" {
+		if err := i.WriteLockFile(); err != nil {
+			return err
+		}
 	}
 
 	// Write the output of rules integrated (updated and removed) to the GitHub Action outputs
@@ -432,268 +930,1453 @@ func (i *Integrator) Run() error {
 
 // DoConversions handles the conversion of Sigma rules to Grafana alert rules
 func (i *Integrator) DoConversions() error {
-	for _, inputFile := range i.addedFiles {
-		fmt.Printf("Integrating file: %s\n", inputFile)
-		conversionContent, err := shared.ReadLocalFile(inputFile)
-		if err != nil {
+	// Sigma rules deployed before this run, which may be obsoleted by the integrated ones
+	var deployedRuleIDs map[string]string
+	if i.config.IntegratorConfig.SkipObsoletingRules {
+		var err error
+		if deployedRuleIDs, err = i.deployedSigmaRuleIDs(); err != nil {
 			return err
 		}
+	}
 
-		var conversionObject model.ConversionOutput
-		err = json.Unmarshal([]byte(conversionContent), &conversionObject)
-		if err != nil {
-			return fmt.Errorf("error unmarshalling conversion output: %v", err)
+	for _, inputFile := range i.addedFiles {
+		// Errors integrating a conversion file are reported as annotations of the file
+		if err := i.integrateFile(inputFile, deployedRuleIDs); err != nil {
+			return shared.NewFileError(inputFile, err)
 		}
+	}
+	return nil
+}
 
-		// Find matching configuration using ConversionName
-		var config model.ConversionConfig
-		for _, conf := range i.config.Conversions {
-			if conf.Name == conversionObject.ConversionName {
-				config = conf
-				break
-			}
+// integrateFile writes the alert rules generated from a conversion file to the deployment folder
+func (i *Integrator) integrateFile(inputFile string, deployedRuleIDs map[string]string) error {
+	fmt.Printf("Integrating file: %s\n", inputFile)
+	conversionContent, err := shared.ReadLocalFile(inputFile)
+	if err != nil {
+		return err
+	}
+
+	var conversionObject model.ConversionOutput
+	err = json.Unmarshal([]byte(conversionContent), &conversionObject)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling conversion output: %v", err)
+	}
+
+	// Find matching configuration using ConversionName
+	config, err := FindConversionConfig(i.config, conversionObject, inputFile)
+	if err != nil {
+		return err
+	}
+	if config.Name == "" {
+		i.warnings.AddForFile(inputFile, "No configuration found for conversion name: %s, skipping file: %s", conversionObject.ConversionName, inputFile)
+		i.skipFile(inputFile, SkipReasonNoConfig)
+		return nil
+	}
+	config = BackendConfig(config, conversionObject.Backend)
+	if conversionObject.Queries, err = ResolveQueryRefs(conversionObject, i.queryLibrary); err != nil {
+		return fmt.Errorf("error resolving the queries of %s: %v", inputFile, err)
+	}
+
+	if i.config.IntegratorConfig.SkipObsoletingRules {
+		if sigmaRuleID, obsoletedID := obsoletedDeployedRule(conversionObject, inputFile, deployedRuleIDs); obsoletedID != "" {
+			fmt.Printf("Sigma rule %s obsoletes the deployed Sigma rule %s, skipping file: %s\n", sigmaRuleID, obsoletedID, inputFile)
+			i.skipFile(inputFile, SkipReasonObsoleting)
+			return nil
 		}
-		if config.Name == "" {
-			fmt.Printf("Warning: No configuration found for conversion name: %s, skipping file: %s\n", conversionObject.ConversionName, inputFile)
-			continue
+	}
+
+	if staleAfterDays := i.config.IntegratorConfig.StaleAfterDays; staleAfterDays > 0 {
+		if modified, ok := i.rulesLastModified(conversionObject); ok && timeNow().Sub(modified) > time.Duration(staleAfterDays)*24*time.Hour {
+			i.warnings.AddForFile(inputFile, "Sigma rules of %s were last modified on %s, more than %d days ago", inputFile, modified.Format(time.DateOnly), staleAfterDays)
+			i.staleFiles = append(i.staleFiles, inputFile)
 		}
+	}
 
-		queries := conversionObject.Queries
-		if len(queries) == 0 {
-			fmt.Printf("no queries found in conversion object")
-			continue
+	queries := conversionObject.Queries
+	if len(queries) == 0 {
+		if !i.config.IntegratorConfig.CreatePlaceholderForEmptyQueries {
+			fmt.Printf("No queries found in conversion object, skipping file: %s\n", inputFile)
+			i.skipFile(inputFile, SkipReasonNoQueries)
+			return nil
 		}
+		fmt.Printf("No queries found in conversion object, creating a paused placeholder alert rule\n")
+	}
 
-		conversionID, titles, err := summariseSigmaRules(conversionObject.Rules)
-		if err != nil {
-			return fmt.Errorf("error summarising sigma rules: %v", err)
+	// Duplicate rule IDs cancel out in the conversion ID, and indicate a bug of the converter
+	if deduped, duplicates := dedupeSigmaRules(conversionObject); len(duplicates) > 0 {
+		if i.config.IntegratorConfig.DuplicateRuleIDs != DuplicateRuleIDsDedupe {
+			return fmt.Errorf("conversion file %s has several Sigma rules with the ID %s: fix the conversion, or set integration.duplicate_rule_ids to dedupe",
+				inputFile, strings.Join(duplicates, ", "))
 		}
+		i.warnings.AddForFile(inputFile, "Conversion file %s has several Sigma rules with the ID %s, keeping the first of each", inputFile, strings.Join(duplicates, ", "))
+		conversionObject = deduped
+		queries = conversionObject.Queries
+	}
 
-		// Extract rule filename from input file name
-		ruleFilename := strings.TrimSuffix(filepath.Base(inputFile), ".json")
-		ruleFilename = strings.TrimPrefix(ruleFilename, config.Name+"_")
-		ruleUID := getRuleUID(conversionObject.ConversionName, conversionID)
-		file := fmt.Sprintf("%s%salert_rule_%s_%s_%s.json", i.config.Folders.DeploymentPath, string(filepath.Separator), config.Name, ruleFilename, ruleUID)
-		fmt.Printf("Working on alert rule file: %s\n", file)
-		rule := &model.ProvisionedAlertRule{UID: ruleUID}
+	// Extract rule filename from input file name
+	ruleFilename := strings.TrimSuffix(filepath.Base(inputFile), ".json")
+	ruleFilename = strings.TrimPrefix(ruleFilename, config.Name+"_")
 
-		err = readRuleFromFile(rule, file)
-		if err != nil {
-			return err
+	var conversionID uuid.UUID
+	var titles string
+	if len(conversionObject.Rules) == 0 && len(queries) > 0 {
+		if !i.config.IntegratorConfig.AllowMissingRules {
+			return fmt.Errorf("conversion file %s has queries but no Sigma rules: fix the conversion, or set integration.allow_missing_rules to derive its alert rule from the conversion name", inputFile)
 		}
-		if rule.Annotations[ManualAnnotation] == TRUE {
-			fmt.Printf("Skipping manually-maintained deployment file (not overwriting): %s\n", file)
-			continue
+		i.warnings.AddForFile(inputFile, "Conversion file %s has no Sigma rules, deriving its alert rule from the conversion name", inputFile)
+		conversionID, titles = summariseConversion(conversionObject.ConversionName, ruleFilename)
+	} else if conversionID, titles, err = summariseSigmaRules(conversionObject.Rules); err != nil {
+		return fmt.Errorf("error summarising sigma rules: %v", err)
+	}
+
+	alertRules := []alertRuleSpec{{
+		uid:              getRuleUID(conversionObject.ConversionName, conversionID),
+		title:            titles,
+		queries:          queries,
+		config:           config,
+		conversionObject: conversionObject,
+	}}
+	if (config.SplitQueries || i.config.ConversionDefaults.SplitQueries) && len(queries) > 0 {
+		alertRules = splitAlertRules(conversionObject, conversionID, titles, config)
+	}
+	// The limit applies to each alert rule once split, e.g. by split_queries, not to the whole conversion
+	ruleQueries := 0
+	for _, spec := range alertRules {
+		ruleQueries = max(ruleQueries, len(spec.queries))
+	}
+	if maxQueries := i.config.IntegratorConfig.MaxQueriesPerRule; maxQueries > 0 && ruleQueries > maxQueries {
+		if !i.config.IntegratorConfig.SplitOversizedRules {
+			return fmt.Errorf("conversion file %s has an alert rule with %d queries, more than the maximum of %d per alert rule: "+
+				"split its Sigma rules across several conversions, set split_queries for the conversion or enable integration.split_oversized_rules",
+				inputFile, ruleQueries, maxQueries)
+		}
+		alertRules = chunkAlertRules(alertRules, conversionID, maxQueries)
+	}
+
+	ruleFiles := make([]string, 0, len(alertRules))
+	planChanges := i.planChanges
+	// number of deployment files written rather than kept as manually maintained
+	written := 0
+	recordedMetricDatasource := shared.GetConfigValue(config.RecordedMetric.TargetDataSource, i.config.ConversionDefaults.RecordedMetric.TargetDataSource, "")
+	for _, spec := range alertRules {
+		// With a recorded metric, a recording rule records the matches of the queries, and the alert rule queries the metric
+		if recordedMetricDatasource != "" && len(spec.queries) > 0 {
+			recordingUID := getRuleUID(spec.uid+"_recording", conversionID)
+			metric := recordedMetricName(config.Name, spec.uid)
+			fileName, err := shared.AlertFileName(i.config.IntegratorConfig.AlertFileNameTemplate, config.Name, ruleFilename, recordingUID)
+			if err != nil {
+				return err
+			}
+			file := i.config.Folders.DeploymentPath + string(filepath.Separator) + fileName
+			ruleFiles = append(ruleFiles, file)
+			fmt.Printf("Working on recording rule file: %s\n", file)
+			ok, err := i.writeDeploymentFile(file, recordingUID, func(rule *model.ProvisionedAlertRule) error {
+				return i.ConvertToRecordingRule(rule, spec.queries, spec.title, metric, recordedMetricDatasource, spec.config, inputFile, spec.conversionObject)
+			})
+			if err != nil {
+				return err
+			}
+			if ok {
+				written++
+			}
+			spec.queries = []string{metric}
+			spec.config = recordedMetricConfig(spec.config, recordedMetricDatasource)
 		}
-		err = i.ConvertToAlert(rule, queries, titles, config, inputFile, conversionObject)
+
+		fileName, err := shared.AlertFileName(i.config.IntegratorConfig.AlertFileNameTemplate, config.Name, ruleFilename, spec.uid)
 		if err != nil {
 			return err
 		}
-		err = writeRuleToFile(rule, file, i.prettyPrint)
+		file := i.config.Folders.DeploymentPath + string(filepath.Separator) + fileName
+		ruleFiles = append(ruleFiles, file)
+		fmt.Printf("Working on alert rule file: %s\n", file)
+		ok, err := i.writeDeploymentFile(file, spec.uid, func(rule *model.ProvisionedAlertRule) error {
+			return i.ConvertToAlert(rule, spec.queries, spec.title, spec.config, inputFile, spec.conversionObject)
+		})
 		if err != nil {
 			return err
 		}
+		if ok {
+			written++
+		}
 	}
-	return nil
-}
 
-// DoCleanup handles the removal of deleted files and cleanup of orphaned files
-func (i *Integrator) DoCleanup() error {
-	for _, deletedFile := range i.removedFiles {
-		fmt.Printf("Deleting alert rule file: %s\n", deletedFile)
-		deploymentGlob := fmt.Sprintf("alert_rule_%s_*.json", strings.TrimSuffix(filepath.Base(deletedFile), ".json"))
+	// Switching split_queries on or off, or a change in the number of queries, leaves
+	// behind alert rule files for the same conversion file which are no longer generated
+	if err := i.removeStaleRuleFiles(inputFile, config.Name, ruleFilename, ruleFiles); err != nil {
+		return err
+	}
+
+	if i.planChanges == planChanges {
+		if written == 0 {
+			i.skipFile(inputFile, SkipReasonManual)
+		} else {
+			i.skipFile(inputFile, SkipReasonUnchanged)
+		}
+	}
+	return nil
+}
+
+// skipFile records the reason a conversion file was skipped, for the skipped_conversions output
+func (i *Integrator) skipFile(file, reason string) {
+	if i.skippedFiles == nil {
+		i.skippedFiles = make(map[string]string)
+	}
+	i.skippedFiles[file] = reason
+}
+
+// writeDeploymentFile generates the rule of a deployment file with convert and records the change in the
+// deployment plan. Manually-maintained deployment files are left untouched, and reported as not written.
+func (i *Integrator) writeDeploymentFile(file, uid string, convert func(rule *model.ProvisionedAlertRule) error) (bool, error) {
+	rule := &model.ProvisionedAlertRule{UID: uid}
+
+	_, statErr := os.Stat(file)
+	existed := statErr == nil
+	if planned, ok := i.plannedRules[file]; ok {
+		existed = planned != nil
+	}
+	if err := i.readRule(rule, file); err != nil {
+		return false, err
+	}
+	if rule.Annotations[ManualAnnotation] == TRUE {
+		fmt.Printf("Skipping manually-maintained deployment file (not overwriting): %s\n", file)
+		return false, nil
+	}
+	previousRule, err := json.Marshal(rule)
+	if err != nil {
+		return false, fmt.Errorf("error marshalling alert rule: %v", err)
+	}
+	if err := convert(rule); err != nil {
+		return false, err
+	}
+	// The whole generated rule is compared, so that any change to its queries, metadata, annotations
+	// or labels updates the deployment file
+	newRule, err := json.Marshal(rule)
+	if err != nil {
+		return false, fmt.Errorf("error marshalling alert rule: %v", err)
+	}
+	if existed && bytes.Equal(previousRule, newRule) {
+		fmt.Printf("No changes to the relevant alert rule, skipping\n")
+		return true, nil
+	}
+	if err := i.writeRule(rule, file); err != nil {
+		return false, err
+	}
+	if existed {
+		i.addToPlan(model.PlanUpdate, file, rule)
+	} else {
+		i.addToPlan(model.PlanAdd, file, rule)
+	}
+	return true, nil
+}
+
+// alertRuleSpec describes a single alert rule to generate from a conversion output
+type alertRuleSpec struct {
+	uid              string
+	title            string
+	queries          []string
+	config           model.ConversionConfig
+	conversionObject model.ConversionOutput
+}
+
+// splitAlertRules describes one alert rule per query of the conversion output. When the conversion
+// has one query per Sigma rule, each alert rule takes the title and metadata of its own Sigma rule,
+// otherwise the combined title is suffixed with the query's position.
+func splitAlertRules(conversionObject model.ConversionOutput, conversionID uuid.UUID, titles string, config model.ConversionConfig) []alertRuleSpec {
+	queries := conversionObject.Queries
+	perRule := len(queries) == len(conversionObject.Rules)
+	specs := make([]alertRuleSpec, len(queries))
+	for index, query := range queries {
+		spec := alertRuleSpec{
+			uid:              getRuleUID(fmt.Sprintf("%s_%d", conversionObject.ConversionName, index), conversionID),
+			title:            fmt.Sprintf("%s #%d", titles, index+1),
+			queries:          []string{query},
+			config:           config,
+			conversionObject: conversionObject,
+		}
+		if perRule {
+			spec.title = conversionObject.Rules[index].Title
+			spec.conversionObject.Rules = conversionObject.Rules[index : index+1]
+		}
+		spec.title = truncateTitle(spec.title, 190)
+		// The query is now the alert rule's only one, so keep just its data source override
+		if index < len(config.QueryDataSources) {
+			spec.config.QueryDataSources = config.QueryDataSources[index : index+1]
+		} else {
+			spec.config.QueryDataSources = nil
+		}
+		specs[index] = spec
+	}
+	return specs
+}
+
+// chunkAlertRules splits the alert rules with more than maxQueries queries into several alert rules of at
+// most maxQueries queries each, suffixing their title with the part number. When the alert rule has one
+// query per Sigma rule, each part keeps the metadata of its own Sigma rules.
+func chunkAlertRules(specs []alertRuleSpec, conversionID uuid.UUID, maxQueries int) []alertRuleSpec {
+	chunked := make([]alertRuleSpec, 0, len(specs))
+	for _, spec := range specs {
+		if len(spec.queries) <= maxQueries {
+			chunked = append(chunked, spec)
+			continue
+		}
+		perRule := len(spec.queries) == len(spec.conversionObject.Rules)
+		parts := (len(spec.queries) + maxQueries - 1) / maxQueries
+		for part := range parts {
+			start := part * maxQueries
+			end := min(start+maxQueries, len(spec.queries))
+			// Truncate the title before suffixing it, so the parts keep distinct titles
+			suffix := fmt.Sprintf(" (part %d of %d)", part+1, parts)
+			title := truncateTitle(spec.title, 190-len(suffix))
+			partSpec := alertRuleSpec{
+				uid:              getRuleUID(fmt.Sprintf("%s_part_%d", spec.conversionObject.ConversionName, part), conversionID),
+				title:            title + suffix,
+				queries:          spec.queries[start:end],
+				config:           spec.config,
+				conversionObject: spec.conversionObject,
+			}
+			if perRule {
+				partSpec.conversionObject.Rules = spec.conversionObject.Rules[start:end]
+			}
+			// Keep just the data source overrides of the part's queries
+			if start < len(spec.config.QueryDataSources) {
+				partSpec.config.QueryDataSources = spec.config.QueryDataSources[start:min(end, len(spec.config.QueryDataSources))]
+			} else {
+				partSpec.config.QueryDataSources = nil
+			}
+			chunked = append(chunked, partSpec)
+		}
+	}
+	return chunked
+}
+
+// removeStaleRuleFiles removes the deployment files generated from conversionFile which are not in
+// ruleFiles. Only files whose ConversionFile annotation references conversionFile are considered, so
+// files of other conversions sharing the same filename prefix are left untouched.
+func (i *Integrator) removeStaleRuleFiles(conversionFile, conversionName, ruleFilename string, ruleFiles []string) error {
+	deploymentGlob, err := shared.AlertFileGlob(i.config.IntegratorConfig.AlertFileNameTemplate, conversionName, ruleFilename)
+	if err != nil {
+		return err
+	}
+	deploymentFiles, err := fs.Glob(os.DirFS(i.config.Folders.DeploymentPath), deploymentGlob)
+	if err != nil {
+		return fmt.Errorf("error when searching for deployment files for %s: %v", conversionFile, err)
+	}
+	for _, file := range deploymentFiles {
+		fullPath := i.config.Folders.DeploymentPath + string(filepath.Separator) + file
+		if slices.Contains(ruleFiles, fullPath) {
+			continue
+		}
+		rule := &model.ProvisionedAlertRule{}
+		if err := i.readRule(rule, fullPath); err != nil {
+			i.warnings.Add("Could not check file %s: %v", fullPath, err)
+			continue
+		}
+		if rule.Annotations[i.annotationKey("ConversionFile")] != conversionFile || keepAsManual(fullPath, "stale", i.warnings) {
+			continue
+		}
+		fmt.Printf("Removing stale alert rule file: %s\n", fullPath)
+		if err := i.removeDeploymentFile(fullPath); err != nil {
+			return fmt.Errorf("error when deleting deployment file %s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+// splitConversionFilename splits the name of a conversion file into the name of its conversion and the
+// rule filename used in the names of its alert rule files. The longest matching configured conversion
+// name is used, falling back to the part before the first underscore for unknown conversions.
+func (i *Integrator) splitConversionFilename(conversionFile string) (string, string) {
+	filename := strings.TrimSuffix(filepath.Base(conversionFile), ".json")
+	conversionName := ""
+	for _, conf := range i.config.Conversions {
+		if strings.HasPrefix(filename, conf.Name+"_") && len(conf.Name) > len(conversionName) {
+			conversionName = conf.Name
+		}
+	}
+	if conversionName == "" {
+		conversionName, _, _ = strings.Cut(filename, "_")
+	}
+	return conversionName, strings.TrimPrefix(filename, conversionName+"_")
+}
+
+// DoCleanup handles the removal of deleted files and cleanup of orphaned files
+func (i *Integrator) DoCleanup() error {
+	if err := i.DoRemovals(); err != nil {
+		return err
+	}
+	i.DoOrphanCleanup()
+	return nil
+}
+
+// DoRemovals removes the deployment files generated from the deleted conversion files
+func (i *Integrator) DoRemovals() error {
+	for _, deletedFile := range i.removedFiles {
+		fmt.Printf("Deleting alert rule file: %s\n", deletedFile)
+		conversionName, ruleFilename := i.splitConversionFilename(deletedFile)
+		deploymentGlob, err := shared.AlertFileGlob(i.config.IntegratorConfig.AlertFileNameTemplate, conversionName, ruleFilename)
+		if err != nil {
+			return err
+		}
 		deploymentFiles, err := fs.Glob(os.DirFS(i.config.Folders.DeploymentPath), deploymentGlob)
 		if err != nil {
 			return fmt.Errorf("error when searching for deployment files for %s: %v", deletedFile, err)
 		}
-		for _, file := range deploymentFiles {
-			fullPath := i.config.Folders.DeploymentPath + string(filepath.Separator) + file
-			if keepAsManual(fullPath, "deployment") {
-				continue
-			}
-			err = os.Remove(fullPath)
-			if err != nil {
-				return fmt.Errorf("error when deleting deployment file %s: %v", file, err)
+		for _, file := range deploymentFiles {
+			fullPath := i.config.Folders.DeploymentPath + string(filepath.Separator) + file
+			if keepAsManual(fullPath, "deployment", i.warnings) {
+				continue
+			}
+			err = i.removeDeploymentFile(fullPath)
+			if err != nil {
+				return fmt.Errorf("error when deleting deployment file %s: %v", file, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DoOrphanCleanup removes the conversion and deployment files which no longer belong to a configured
+// conversion or conversion file. Failures are reported as warnings, as they don't affect the integration.
+func (i *Integrator) DoOrphanCleanup() {
+	// Clean up orphaned conversion files
+	if err := i.cleanupOrphanedFilesInPath(i.config.Folders.ConversionPath, i.isConversionFileOrphaned); err != nil {
+		i.warnings.Add("Error during orphaned conversion file cleanup: %v", err)
+	}
+
+	// Clean up orphaned deployment files
+	if err := i.cleanupOrphanedFilesInPath(i.config.Folders.DeploymentPath, i.isDeploymentFileOrphaned); err != nil {
+		i.warnings.Add("Error during orphaned deployment file cleanup: %v", err)
+	}
+
+	// Clean up deployment files of conversions which are no longer configured, e.g. after a rename
+	if err := i.cleanupOrphanedFilesInPath(i.config.Folders.DeploymentPath, i.isDeploymentFileOfUnknownConversion); err != nil {
+		i.warnings.Add("Error during unknown conversion deployment file cleanup: %v", err)
+	}
+}
+
+// ruleTitle adds the configured title prefix and suffix to the title of a generated rule. The title is
+// truncated rather than the prefix and suffix so that the rule's title, along with reserved characters for
+// a suffix added later, fits within Grafana's limit of 190 characters. Prefixes and suffixes leaving no room
+// for the title are an error.
+func (i *Integrator) ruleTitle(title string, reserved int, conversionObject model.ConversionOutput, config model.ConversionConfig) (string, error) {
+	data := i.templateData(conversionObject, config)
+	affixes := make([]string, 2)
+	for index, setting := range []struct{ name, value string }{
+		{"title_prefix", i.config.IntegratorConfig.TitlePrefix},
+		{"title_suffix", i.config.IntegratorConfig.TitleSuffix},
+	} {
+		tmpl, err := template.New(setting.name).Funcs(FuncMap).Parse(setting.value)
+		if err != nil {
+			return "", fmt.Errorf("error parsing template %s: %v", setting.name, err)
+		}
+		var buf bytes.Buffer
+		if err = tmpl.Execute(&buf, data); err != nil {
+			return "", fmt.Errorf("error executing template %s: %v", setting.name, err)
+		}
+		affixes[index] = buf.String()
+	}
+	available := 190 - reserved - len(affixes[0]) - len(affixes[1])
+	if available <= 0 {
+		return "", fmt.Errorf("title_prefix and title_suffix of conversion %s are %d characters long, leaving no room for the title within the limit of 190 characters",
+			config.Name, len(affixes[0])+len(affixes[1]))
+	}
+	return affixes[0] + truncateTitle(title, available) + affixes[1], nil
+}
+
+// truncateTitle shortens a title to at most size bytes, without splitting a multi-byte character
+func truncateTitle(title string, size int) string {
+	if len(title) <= size {
+		return title
+	}
+	for size > 0 && !utf8.RuneStart(title[size]) {
+		size--
+	}
+	return title[:size]
+}
+
+// titleSuffix returns the suffix disambiguating the title of the alert rule with the given UID. Being
+// derived from the UID, it is stable across runs and can be stripped to recover the original title.
+func titleSuffix(uid string) string {
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+	return fmt.Sprintf(" (%s)", uid)
+}
+
+// DedupeTitles suffixes the titles of the alert rules in the deployment folder which would otherwise
+// collide, as Grafana requires titles to be unique within a folder. The suffix is removed again once a
+// title no longer collides. Manually-maintained files count towards collisions but are never rewritten.
+func (i *Integrator) DedupeTitles() error {
+	type deploymentRule struct {
+		file  string
+		rule  *model.ProvisionedAlertRule
+		title string
+	}
+
+	files, err := i.deploymentFiles()
+	if err != nil {
+		return err
+	}
+	rules := make([]deploymentRule, 0, len(files))
+	titleCounts := map[string]int{}
+	for _, file := range files {
+		rule := &model.ProvisionedAlertRule{}
+		if err := i.readRule(rule, file); err != nil {
+			i.warnings.Add("Could not check the title of %s: %v", file, err)
+			continue
+		}
+		title := strings.TrimSuffix(rule.Title, titleSuffix(rule.UID))
+		rules = append(rules, deploymentRule{file: file, rule: rule, title: title})
+		titleCounts[title]++
+	}
+
+	for _, r := range rules {
+		title := r.title
+		if titleCounts[title] > 1 {
+			suffix := titleSuffix(r.rule.UID)
+			title = truncateTitle(title, 190-len(suffix)) + suffix
+		}
+		if title == r.rule.Title {
+			continue
+		}
+		if r.rule.Annotations[ManualAnnotation] == TRUE {
+			fmt.Printf("Skipping manually-maintained deployment file (not retitling): %s\n", r.file)
+			continue
+		}
+		fmt.Printf("Retitling alert rule %s from %q to %q\n", r.rule.UID, r.rule.Title, title)
+		r.rule.Title = title
+		if err := i.writeRule(r.rule, r.file); err != nil {
+			return err
+		}
+		i.addToPlan(model.PlanUpdate, r.file, r.rule)
+	}
+
+	return nil
+}
+
+// ruleContentDigest returns a digest of what an alert rule evaluates and how it notifies, leaving out what
+// identifies its deployment file: its UID, the suffix of a deduplicated title, its annotations, which describe
+// the Sigma rules and conversion file it was generated from, and its fingerprint label.
+func ruleContentDigest(rule *model.ProvisionedAlertRule) (string, error) {
+	content := *rule
+	content.ID = 0
+	content.UID = ""
+	content.Title = strings.TrimSuffix(rule.Title, titleSuffix(rule.UID))
+	content.Updated = time.Time{}
+	content.Provenance = ""
+	content.Annotations = nil
+	content.Labels = maps.Clone(rule.Labels)
+	delete(content.Labels, FingerprintLabel)
+
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x", murmur3.Sum64(contentJSON)), nil
+}
+
+// DedupeRules removes the alert rule files of the deployment folder with the same content as another one,
+// as deploying both would only duplicate the alerts. The alert rules deployed before this run are kept over the
+// ones added by it, then the first by file name. Rules sharing a title but not their queries, labels or
+// settings are distinct, and manually-maintained files are never removed nor kept over a generated one.
+func (i *Integrator) DedupeRules() error {
+	files, err := i.deploymentFiles()
+	if err != nil {
+		return err
+	}
+	// Files are sorted by name, keep the ones already deployed first
+	slices.SortStableFunc(files, func(a, b string) int {
+		aAdded, bAdded := i.plan[a].Operation == model.PlanAdd, i.plan[b].Operation == model.PlanAdd
+		switch {
+		case aAdded == bAdded:
+			return 0
+		case bAdded:
+			return -1
+		default:
+			return 1
+		}
+	})
+
+	keptFiles := map[string]string{}
+	for _, file := range files {
+		rule := &model.ProvisionedAlertRule{}
+		if err := i.readRule(rule, file); err != nil {
+			i.warnings.Add("Could not check %s for duplicated alert rules: %v", file, err)
+			continue
+		}
+		if rule.Annotations[ManualAnnotation] == TRUE {
+			continue
+		}
+		digest, err := ruleContentDigest(rule)
+		if err != nil {
+			return fmt.Errorf("error computing the digest of %s: %v", file, err)
+		}
+		keptFile, ok := keptFiles[digest]
+		if !ok {
+			keptFiles[digest] = file
+			continue
+		}
+		fmt.Printf("Alert rule %s has the same content as %s, removing its file: %s\n", rule.UID, keptFile, file)
+		if err := i.removeDeploymentFile(file); err != nil {
+			return fmt.Errorf("error when deleting duplicated deployment file %s: %v", file, err)
+		}
+		i.dedupedFiles = append(i.dedupedFiles, file)
+	}
+
+	return nil
+}
+
+// Config returns the configuration
+func (i *Integrator) Config() model.Configuration {
+	return i.config
+}
+
+// Warnings returns the warnings raised so far, so that other stages of the integration can add to them
+func (i *Integrator) Warnings() *shared.Warnings {
+	return i.warnings
+}
+
+// CheckWarnings returns an error listing the warnings raised during the run when strict mode is enabled.
+// It is meant to be called once everything else has run, so outputs are written before failing.
+func (i *Integrator) CheckWarnings() error {
+	if !i.strictMode {
+		return nil
+	}
+	return i.warnings.Err()
+}
+
+// TestFiles returns the list of test files
+func (i *Integrator) TestFiles() []string {
+	return i.testFiles
+}
+
+// SkipFiles removes the given conversion files from those to be integrated, so no alert rule
+// is written (and therefore deployed) for them on this run. They are reported as skipped for reason.
+func (i *Integrator) SkipFiles(files []string, reason string) {
+	i.addedFiles = slices.DeleteFunc(i.addedFiles, func(file string) bool {
+		if slices.Contains(files, file) {
+			i.skipFile(file, reason)
+			return true
+		}
+		return false
+	})
+}
+
+// SetTestResults sets the results of testing the queries of the conversion files, by conversion file,
+// for annotating the alert rules with their baseline when annotate_baseline is enabled
+func (i *Integrator) SetTestResults(results map[string][]model.QueryTestResult) {
+	i.testResults = results
+}
+
+// SetOutputs writes the output of rules integrated (updated and removed) to the GitHub Action outputs
+func (i *Integrator) SetOutputs() error {
+	i.addedFiles = append(i.addedFiles, i.removedFiles...)
+	rulesIntegrated := strings.Join(i.addedFiles, " ")
+
+	if err := shared.SetOutput("rules_integrated", rulesIntegrated); err != nil {
+		return fmt.Errorf("failed to set rules integrated output: %w", err)
+	}
+
+	if i.config.IntegratorConfig.StaleAfterDays > 0 {
+		if err := shared.SetOutput("stale_rules", strings.Join(i.staleFiles, " ")); err != nil {
+			return fmt.Errorf("failed to set stale rules output: %w", err)
+		}
+	}
+	if i.config.IntegratorConfig.DedupeRules {
+		if err := shared.SetOutput("deduplicated_rules", strings.Join(i.dedupedFiles, " ")); err != nil {
+			return fmt.Errorf("failed to set deduplicated rules output: %w", err)
+		}
+	}
+
+	// Skipped conversion files are always reported, so operators can tell why an alert rule didn't appear
+	skipped := make(map[string]string, len(i.skippedFiles))
+	for _, file := range slices.Sorted(maps.Keys(i.skippedFiles)) {
+		fmt.Printf("Skipped conversion file %s: %s\n", file, i.skippedFiles[file])
+		skipped[file] = i.skippedFiles[file]
+	}
+	skippedJSON, err := json.Marshal(skipped)
+	if err != nil {
+		return fmt.Errorf("error marshalling skipped conversions: %v", err)
+	}
+	if err := shared.SetOutput("skipped_conversions", string(skippedJSON)); err != nil {
+		return fmt.Errorf("failed to set skipped conversions output: %w", err)
+	}
+
+	if i.dryRun {
+		planned, err := json.Marshal(i.Plan())
+		if err != nil {
+			return fmt.Errorf("error marshalling deployment plan: %v", err)
+		}
+		if err := shared.SetOutput("planned_changes", string(planned)); err != nil {
+			return fmt.Errorf("failed to set planned changes output: %w", err)
+		}
+	}
+	return nil
+}
+
+func (i *Integrator) ConvertToAlert(rule *model.ProvisionedAlertRule, queries []string, titles string, config model.ConversionConfig, conversionFile string, conversionObject model.ConversionOutput) error {
+	datasource, err := i.conversionDatasource(queries, config)
+	if err != nil {
+		return err
+	}
+	timewindow := shared.GetConfigValue(config.TimeWindow, i.config.ConversionDefaults.TimeWindow, "1m")
+	lookback := shared.GetConfigValue(config.Lookback, i.config.ConversionDefaults.Lookback, "0s")
+	duration, timerange, err := queryTimeRange(timewindow, lookback)
+	if err != nil {
+		return err
+	}
+
+	queryData, combiner, err := i.createQueries(queries, datasource, timerange, config)
+	if err != nil {
+		return err
+	}
+	noDataState, err := i.noDataState(config)
+	if err != nil {
+		return err
+	}
+	// The threshold fires when the queries match, or when they don't for conversions alerting on no data,
+	// unless the conversion output sets its own threshold
+	evaluatorParam, evaluatorType := 0.0, "gt"
+	if config.AlertOnNoData || i.config.ConversionDefaults.AlertOnNoData {
+		evaluatorParam, evaluatorType = 1, "lt"
+	}
+	if conversionObject.Threshold != nil {
+		evaluatorParam = *conversionObject.Threshold
+	}
+	if operator := conversionObject.ThresholdOperator; operator != "" {
+		if !slices.Contains(thresholdOperators, operator) {
+			return fmt.Errorf("invalid threshold_operator %s of conversion file %s, must be one of %s", operator, conversionFile, strings.Join(thresholdOperators, ", "))
+		}
+		evaluatorType = operator
+	}
+	threshold := json.RawMessage(fmt.Sprintf(`{"refId":"%[1]s","hide":%[3]t,"type":"threshold","datasource":{"uid":"__expr__","type":"__expr__"},"conditions":[{"type":"query","evaluator":{"params":[%[4]s],"type":"%[5]s"},"operator":{"type":"and"},"query":{"params":["%[1]s"]},"reducer":{"params":[],"type":"last"}}],"expression":"%[2]s"}`,
+		thresholdRefID, combinerRefID, hiddenRefID(thresholdRefID, config, i.config.ConversionDefaults), strconv.FormatFloat(evaluatorParam, 'f', -1, 64), evaluatorType))
+
+	queryData = append(queryData,
+		model.AlertQuery{
+			RefID:             combinerRefID,
+			DatasourceUID:     "__expr__",
+			RelativeTimeRange: timerange,
+			QueryType:         "",
+			Model:             combiner,
+		},
+		model.AlertQuery{
+			RefID:             thresholdRefID,
+			DatasourceUID:     "__expr__",
+			RelativeTimeRange: timerange,
+			QueryType:         "",
+			Model:             threshold,
+		},
+	)
+
+	// The condition may be any of the queries or expressions, e.g. for a custom query model doing its own thresholding,
+	// and the one of the conversion output, set by the converter, takes precedence over the configured one
+	condition := shared.GetConfigValue(config.ConditionRefID, i.config.ConversionDefaults.ConditionRefID, thresholdRefID)
+	if conversionObject.Condition != "" {
+		condition = conversionObject.Condition
+	}
+	if !slices.ContainsFunc(queryData, func(query model.AlertQuery) bool { return query.RefID == condition }) {
+		return fmt.Errorf("condition %s of conversion %s does not reference any of the queries or expressions of the alert rule", condition, config.Name)
+	}
+	if hiddenRefID(condition, config, i.config.ConversionDefaults) {
+		return fmt.Errorf("condition %s of conversion %s must not be hidden", condition, config.Name)
+	}
+
+	var missingSeriesEvalsToResolve *int
+	if evals := config.MissingSeriesEvalsToResolve; evals > 0 {
+		missingSeriesEvalsToResolve = &evals
+	} else if evals := i.config.ConversionDefaults.MissingSeriesEvalsToResolve; evals > 0 {
+		missingSeriesEvalsToResolve = &evals
+	}
+
+	pendingPeriod, err := i.pendingPeriod(config, duration)
+	if err != nil {
+		return err
+	}
+	title, err := i.ruleTitle(titles, 0, conversionObject, config)
+	if err != nil {
+		return err
+	}
+
+	rule.Data = queryData
+
+	// alerting rule metadata
+	rule.OrgID = i.config.IntegratorConfig.OrgID
+	rule.FolderUID = i.config.IntegratorConfig.FolderID
+	rule.RuleGroup = shared.GetConfigValue(config.RuleGroup, i.config.ConversionDefaults.RuleGroup, "Default")
+	rule.NoDataState = noDataState
+	rule.ExecErrState = model.OkErrState
+	// The suffix DedupeTitles may have added is kept, DedupeTitles removes it once the title is unique
+	if strings.TrimSuffix(rule.Title, titleSuffix(rule.UID)) != title {
+		rule.Title = title
+	}
+	rule.Condition = condition
+	rule.MissingSeriesEvalsToResolve = missingSeriesEvalsToResolve
+	rule.For = prommodel.Duration(pendingPeriod)
+
+	// Add annotations for context
+	if rule.Annotations == nil {
+		rule.Annotations = make(map[string]string)
+	}
+	// Drop the annotations written under their default key before it was renamed
+	for key, customKey := range i.config.IntegratorConfig.AnnotationKeyMap {
+		if customKey != key {
+			delete(rule.Annotations, key)
+		}
+	}
+
+	// Placeholders are paused until their conversion has queries
+	if len(queries) == 0 {
+		rule.IsPaused = true
+		rule.Annotations[PlaceholderAnnotation] = TRUE
+		delete(rule.Annotations, i.annotationKey("Query"))
+	} else {
+		if rule.Annotations[PlaceholderAnnotation] == TRUE {
+			rule.IsPaused = false
+			delete(rule.Annotations, PlaceholderAnnotation)
+		}
+		rule.Annotations[i.annotationKey("Query")] = queries[0]
+	}
+	rule.Annotations[i.annotationKey("TimeWindow")] = timewindow
+	rule.Annotations[i.annotationKey("Lookback")] = lookback
+
+	// LogSourceUid annotation (data source)
+	rule.Annotations[i.annotationKey("LogSourceUid")] = datasource
+
+	// LogSourceType annotation (target)
+	logSourceType := shared.GetConfigValue(config.Target, i.config.ConversionDefaults.Target, shared.Loki)
+	rule.Annotations[i.annotationKey("LogSourceType")] = logSourceType
+
+	// Path to associated conversion file
+	rule.Annotations[i.annotationKey("ConversionFile")] = conversionFile
+	i.markManaged(rule)
+
+	// Path to the Sigma rule file the conversion was produced from, for responders to find the detection
+	if i.config.IntegratorConfig.AnnotateInputFile {
+		if conversionObject.InputFile != "" {
+			rule.Annotations[i.annotationKey(SigmaInputFileAnnotation)] = conversionObject.InputFile
+		} else {
+			delete(rule.Annotations, i.annotationKey(SigmaInputFileAnnotation))
+		}
+	}
+
+	// IDs of the Sigma rules in the conversion, for tracing the alert back to its detections
+	if i.config.IntegratorConfig.AnnotateRuleIDs {
+		ruleIDs := make([]string, len(conversionObject.Rules))
+		for index, sigmaRule := range conversionObject.Rules {
+			ruleIDs[index] = sigmaRule.ID
+		}
+		rule.Annotations[i.annotationKey(SigmaRuleIDsAnnotation)] = strings.Join(ruleIDs, ",")
+	}
+
+	// Date the Sigma rules were last modified, for spotting outdated detections
+	if i.config.IntegratorConfig.AnnotateRuleModified {
+		if modified, ok := i.rulesLastModified(conversionObject); ok {
+			rule.Annotations[i.annotationKey(RuleModifiedAnnotation)] = modified.In(i.location()).Format(time.DateOnly)
+		} else {
+			delete(rule.Annotations, i.annotationKey(RuleModifiedAnnotation))
+		}
+	}
+
+	// Lineage of the Sigma rules, for finding the rules they derive from or replace
+	if i.config.IntegratorConfig.AnnotateRelatedRules {
+		if related := relatedRules(conversionObject.Rules); related != "" {
+			rule.Annotations[i.annotationKey(RelatedRulesAnnotation)] = related
+		} else {
+			delete(rule.Annotations, i.annotationKey(RelatedRulesAnnotation))
+		}
+	}
+
+	// Known false positives of the Sigma rules, for responders to triage alerts
+	if i.config.IntegratorConfig.AnnotateFalsePositives {
+		if falsePositives := falsePositives(conversionObject.Rules); falsePositives != "" {
+			rule.Annotations[i.annotationKey(FalsePositivesAnnotation)] = falsePositives
+		} else {
+			delete(rule.Annotations, i.annotationKey(FalsePositivesAnnotation))
+		}
+	}
+
+	// Link to the Sigma rule on GitHub, for responders to read the detection. Outside of GitHub Actions, any
+	// existing link is kept as the commit is unknown.
+	if i.config.IntegratorConfig.AnnotateSourceLink {
+		if link := shared.GitHubBlobURL(shared.GetConfigValue(conversionObject.InputFile, conversionFile, "")); link != "" {
+			rule.Annotations[i.annotationKey(SourceLinkAnnotation)] = link
+		}
+	}
+
+	// Link to the query in Explore, for responders to look at the matching logs from the alert
+	if i.config.IntegratorConfig.AnnotateExploreLink {
+		if len(queries) == 0 {
+			delete(rule.Annotations, i.annotationKey(ExploreLinkAnnotation))
+		} else {
+			link, err := i.exploreLink(queries[0], datasource, timerange, config)
+			if err != nil {
+				return err
+			}
+			rule.Annotations[i.annotationKey(ExploreLinkAnnotation)] = link
+		}
+	}
+
+	// Volume of matches observed when testing the queries, for responders to gauge how unusual an alert is
+	if i.config.IntegratorConfig.AnnotateBaseline {
+		i.annotateBaseline(rule, config, conversionFile)
+	}
+
+	if rule.Labels == nil {
+		rule.Labels = make(map[string]string)
+	}
+
+	// Context looked up from the Sigma rules' logsource, templated annotations and labels take precedence
+	i.applyEnrichment(rule, conversionObject)
+
+	// Labels encoded in the directories of the conversion file, e.g. the owning team, templated labels take precedence
+	if err := i.addPathLabels(rule.Labels, conversionFile); err != nil {
+		return err
+	}
+
+	// Tags of the Sigma rules, e.g. their MITRE ATT&CK techniques, templated labels take precedence
+	if err := addTagLabels(rule.Labels, conversionObject.Rules, i.config.IntegratorConfig.TagsLabelMode); err != nil {
+		return err
+	}
+
+	data := i.templateData(conversionObject, config)
+	if i.config.IntegratorConfig.TemplateAnnotations != nil {
+		for key, value := range i.config.IntegratorConfig.TemplateAnnotations {
+			tmpl, err := template.New("annotation_" + key).Funcs(FuncMap).Parse(value)
+			if err != nil {
+				return fmt.Errorf("error parsing template %s: %v", key, err)
+			}
+			var buf bytes.Buffer
+			if err = tmpl.Execute(&buf, data); err != nil {
+				return fmt.Errorf("error executing template %s: %v", key, err)
+			}
+			rule.Annotations[key] = buf.String()
+		}
+	}
+
+	if i.config.IntegratorConfig.TemplateLabels != nil {
+		for key, value := range i.config.IntegratorConfig.TemplateLabels {
+			tmpl, err := template.New("label_" + key).Parse(value)
+			if err != nil {
+				return fmt.Errorf("error parsing template %s: %v", key, err)
+			}
+			var buf bytes.Buffer
+			if err = tmpl.Execute(&buf, data); err != nil {
+				return fmt.Errorf("error executing template %s: %v", key, err)
+			}
+			rule.Labels[key] = buf.String()
+		}
+	}
+
+	if i.config.IntegratorConfig.FingerprintLabel {
+		if _, ok := i.config.IntegratorConfig.TemplateLabels[FingerprintLabel]; ok {
+			return fmt.Errorf("fingerprint label %s is also set by template_labels", FingerprintLabel)
+		}
+		rule.Labels[FingerprintLabel] = ruleFingerprint(conversionObject)
+	}
+
+	if err := addOnCallLabels(rule.Labels, config.OnCall, i.config.ConversionDefaults.OnCall, i.config.IntegratorConfig.TemplateLabels); err != nil {
+		return err
+	}
+
+	i.applyKeyAllowlists(rule)
+
+	if budget := i.config.IntegratorConfig.MaxMetadataBytes; budget > 0 {
+		applyMetadataBudget(rule, budget, i.config.IntegratorConfig.AnnotationKeyMap, i.warnings)
+	}
+
+	return nil
+}
+
+// markManaged sets the managed_by annotation the deployer checks before deleting alert rules when
+// deployment.require_managed_annotation is set, and removes it otherwise
+func (i *Integrator) markManaged(rule *model.ProvisionedAlertRule) {
+	if i.config.DeployerConfig.RequireManagedAnnotation {
+		rule.Annotations[shared.ManagedByAnnotation] = shared.ManagedByValue
+	} else {
+		delete(rule.Annotations, shared.ManagedByAnnotation)
+	}
+}
+
+// applyKeyAllowlists removes the labels and annotations of a rule whose keys are not in allowed_label_keys and
+// allowed_annotation_keys, when set. The annotations the integrator and deployer rely on are always kept:
+// ConversionFile to detect orphaned deployment files, managed_by, and the markers of manually maintained
+// and placeholder alert rules.
+func (i *Integrator) applyKeyAllowlists(rule *model.ProvisionedAlertRule) {
+	if allowed := i.config.IntegratorConfig.AllowedLabelKeys; len(allowed) > 0 {
+		removeDisallowedKeys(rule.Labels, allowed, "label", rule.Title, i.warnings)
+	}
+	if allowed := i.config.IntegratorConfig.AllowedAnnotationKeys; len(allowed) > 0 {
+		allowed = append(slices.Clone(allowed), i.annotationKey("ConversionFile"), shared.ManagedByAnnotation, ManualAnnotation, PlaceholderAnnotation)
+		removeDisallowedKeys(rule.Annotations, allowed, "annotation", rule.Title, i.warnings)
+	}
+}
+
+// removeDisallowedKeys removes the entries of metadata whose keys are not allowed, with a warning listing them
+func removeDisallowedKeys(metadata map[string]string, allowed []string, kind, title string, warnings *shared.Warnings) {
+	removed := []string{}
+	for _, key := range slices.Sorted(maps.Keys(metadata)) {
+		if !slices.Contains(allowed, key) {
+			delete(metadata, key)
+			removed = append(removed, key)
+		}
+	}
+	if len(removed) > 0 {
+		warnings.Add("Removed the %s keys %s of alert rule %s, which are not allowed", kind, strings.Join(removed, ", "), title)
+	}
+}
+
+// compilePathLabelPattern compiles the path label pattern, which must have at least one named group
+// to derive labels from. A nil regexp is returned for an empty pattern.
+func compilePathLabelPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path label pattern %s: %v", pattern, err)
+	}
+	if !slices.ContainsFunc(re.SubexpNames(), func(name string) bool { return name != "" }) {
+		return nil, fmt.Errorf("invalid path label pattern %s: no named group, e.g. (?P<team>[^/]+)", pattern)
+	}
+	return re, nil
+}
+
+// addPathLabels sets the labels captured by the named groups of the path label pattern from the path of
+// the conversion file, relative to the conversion folder. Groups which don't participate in the match are
+// skipped, and so are all of them when the path doesn't match.
+func (i *Integrator) addPathLabels(labels map[string]string, conversionFile string) error {
+	re, err := compilePathLabelPattern(i.config.IntegratorConfig.PathLabelPattern)
+	if err != nil || re == nil {
+		return err
+	}
+	path := conversionFile
+	if rel, err := filepath.Rel(i.config.Folders.ConversionPath, conversionFile); err == nil && filepath.IsLocal(rel) {
+		path = rel
+	}
+	path = filepath.ToSlash(path)
+	match := re.FindStringSubmatchIndex(path)
+	if match == nil {
+		return nil
+	}
+	for index, name := range re.SubexpNames() {
+		if name == "" || match[2*index] < 0 {
+			continue
+		}
+		labels[name] = path[match[2*index]:match[2*index+1]]
+	}
+	return nil
+}
+
+// metadataBudgetOrder lists the integrator-managed annotations that may be shrunk to fit the
+// metadata budget, lowest priority first. ConversionFile is never removed as it is needed to
+// detect orphaned deployment files.
+var metadataBudgetOrder = []string{"Query", "LogSourceType", "LogSourceUid", "Lookback", "TimeWindow"}
+
+// truncatedSuffix marks an annotation value that was shortened to fit the metadata budget
+const truncatedSuffix = "..."
+
+// metadataSize returns the combined size in bytes of the rule's label and annotation keys and values
+func metadataSize(rule *model.ProvisionedAlertRule) int {
+	size := 0
+	for key, value := range rule.Labels {
+		size += len(key) + len(value)
+	}
+	for key, value := range rule.Annotations {
+		size += len(key) + len(value)
+	}
+	return size
+}
+
+// applyMetadataBudget shrinks the integrator-managed annotations, in metadataBudgetOrder, until the
+// rule's labels and annotations fit within budget bytes. The Query annotation is truncated where
+// possible, any other annotation is dropped. User-defined labels and annotations are left untouched.
+// The annotations are looked up under their renamed keys from keyMap, if any.
+func applyMetadataBudget(rule *model.ProvisionedAlertRule, budget int, keyMap map[string]string, warnings *shared.Warnings) {
+	size := metadataSize(rule)
+	for _, defaultKey := range metadataBudgetOrder {
+		excess := size - budget
+		if excess <= 0 {
+			return
+		}
+		key := annotationKey(keyMap, defaultKey)
+		value, ok := rule.Annotations[key]
+		if !ok {
+			continue
+		}
+		if defaultKey == "Query" && len(value) > excess+len(truncatedSuffix) {
+			cut := len(value) - excess - len(truncatedSuffix)
+			// Don't split a multi-byte character
+			for cut > 0 && !utf8.RuneStart(value[cut]) {
+				cut--
 			}
+			rule.Annotations[key] = value[:cut] + truncatedSuffix
+			size += len(rule.Annotations[key]) - len(value)
+			warnings.Add("truncated the %s annotation of alert rule %s to fit the metadata budget of %d bytes", key, rule.Title, budget)
+			continue
 		}
+		delete(rule.Annotations, key)
+		size -= len(key) + len(value)
+		warnings.Add("dropped the %s annotation of alert rule %s to fit the metadata budget of %d bytes", key, rule.Title, budget)
+	}
+	if size > budget {
+		warnings.Add("labels and annotations of alert rule %s use %d bytes, exceeding the metadata budget of %d bytes", rule.Title, size, budget)
 	}
+}
 
-	// Clean up orphaned conversion files
-	if err := i.cleanupOrphanedFilesInPath(i.config.Folders.ConversionPath, i.isConversionFileOrphaned); err != nil {
-		fmt.Printf("Warning: Error during orphaned conversion file cleanup: %v\n", err)
+// conversionDatasource returns the data source of a conversion's queries. A missing data source, for any query
+// without its own, is an error naming the conversion, unless allow_missing_data_source is enabled, in which case
+// the MissingDataSource placeholder is used with a warning.
+func (i *Integrator) conversionDatasource(queries []string, config model.ConversionConfig) (string, error) {
+	datasource := shared.GetConfigValue(config.DataSource, i.config.ConversionDefaults.DataSource, "")
+	if datasource != "" {
+		return datasource, nil
+	}
+	missing := false
+	for index := range queries {
+		if queryDatasource, _ := ResolveQueryDataSource(index, datasource, config); queryDatasource == "" {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		return datasource, nil
 	}
+	if !i.config.IntegratorConfig.AllowMissingDataSource {
+		return "", fmt.Errorf("conversion %s has no data source: set data_source in the conversion or the conversion defaults", config.Name)
+	}
+	i.warnings.Add("Conversion %s has no data source, its alert rules query the %q placeholder data source and will fail in Grafana", config.Name, MissingDataSource)
+	return MissingDataSource, nil
+}
 
-	// Clean up orphaned deployment files
-	if err := i.cleanupOrphanedFilesInPath(i.config.Folders.DeploymentPath, i.isDeploymentFileOrphaned); err != nil {
-		fmt.Printf("Warning: Error during orphaned deployment file cleanup: %v\n", err)
+// CheckAllowedDatasource returns an error if the allowlist is not empty and doesn't contain the data source
+// a query of the conversion resolves to. As the allowlist and the conversions may refer to the same data source
+// by name and by UID, a data source not listed as is is looked up with lookup, and allowed if its UID or name is.
+func CheckAllowedDatasource(datasource, conversionName string, allowed []string, lookup func(string) (*GrafanaDatasource, error)) error {
+	if len(allowed) == 0 || slices.Contains(allowed, datasource) {
+		return nil
+	}
+	if live, err := lookup(datasource); err == nil && (slices.Contains(allowed, live.UID) || slices.Contains(allowed, live.Name)) {
+		return nil
 	}
+	return fmt.Errorf("data source %s of conversion %s is not in allowed_datasources", datasource, conversionName)
+}
 
-	return nil
+// lookupDatasource gets a data source of allowed_datasources from Grafana, when the integrator is given access to
+// it as for query testing. The data sources are looked up once per run.
+func (i *Integrator) lookupDatasource(ref string) (*GrafanaDatasource, error) {
+	if datasource, ok := i.datasources[ref]; ok {
+		return datasource, nil
+	}
+	apiKey := os.Getenv("INTEGRATOR_GRAFANA_SA_TOKEN")
+	if i.config.DeployerConfig.GrafanaInstance == "" || apiKey == "" {
+		return nil, fmt.Errorf("no access to Grafana to look up data source %s", ref)
+	}
+	timeout := 10 * time.Second
+	if parsed, err := time.ParseDuration(i.config.DeployerConfig.Timeout); err == nil {
+		timeout = parsed
+	}
+	datasource, err := LookupDatasource(ref, i.config.DeployerConfig.GrafanaInstance, apiKey, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if i.datasources == nil {
+		i.datasources = make(map[string]*GrafanaDatasource)
+	}
+	i.datasources[ref] = datasource
+	return datasource, nil
 }
 
-// Config returns the configuration
-func (i *Integrator) Config() model.Configuration {
-	return i.config
+// annotateBaseline writes the number of matches and the fields returned when testing the queries of a conversion
+// file to the BaselineMatches and DetectedFields annotations. The annotations are left untouched when the queries
+// weren't tested on this run or failed, keeping the last known baseline.
+func (i *Integrator) annotateBaseline(rule *model.ProvisionedAlertRule, config model.ConversionConfig, conversionFile string) {
+	results := i.testResults[conversionFile]
+	if len(results) == 0 {
+		return
+	}
+	count := 0
+	fields := []string{}
+	for _, result := range results {
+		if len(result.Stats.Errors) > 0 {
+			return
+		}
+		count += result.Stats.Count
+		for field := range result.Stats.Fields {
+			if !slices.Contains(fields, field) {
+				fields = append(fields, field)
+			}
+		}
+	}
+	slices.Sort(fields)
+
+	from := shared.GetConfigValue(config.From, i.config.ConversionDefaults.From, i.config.IntegratorConfig.From)
+	to := shared.GetConfigValue(config.To, i.config.ConversionDefaults.To, i.config.IntegratorConfig.To)
+	rule.Annotations[i.annotationKey(BaselineMatchesAnnotation)] = fmt.Sprintf("%d matches from %s to %s", count, formatTimeExpression(from, i.location()), formatTimeExpression(to, i.location()))
+	if len(fields) > 0 {
+		rule.Annotations[i.annotationKey(DetectedFieldsAnnotation)] = strings.Join(fields, ",")
+	} else {
+		delete(rule.Annotations, i.annotationKey(DetectedFieldsAnnotation))
+	}
 }
 
-// TestFiles returns the list of test files
-func (i *Integrator) TestFiles() []string {
-	return i.testFiles
+// formatTimeExpression renders a time of a Grafana time range for an annotation: Unix timestamps in milliseconds
+// are formatted as RFC 3339 timestamps in the location, relative times are kept as is
+func formatTimeExpression(value string, location *time.Location) string {
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return value
+	}
+	return time.UnixMilli(millis).In(location).Format(time.RFC3339)
 }
 
-// SetOutputs writes the output of rules integrated (updated and removed) to the GitHub Action outputs
-func (i *Integrator) SetOutputs() error {
-	i.addedFiles = append(i.addedFiles, i.removedFiles...)
-	rulesIntegrated := strings.Join(i.addedFiles, " ")
+// location returns the time zone the timestamps of annotations are rendered in, UTC unless configured
+func (i *Integrator) location() *time.Location {
+	location, err := time.LoadLocation(i.config.IntegratorConfig.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
 
-	if err := shared.SetOutput("rules_integrated", rulesIntegrated); err != nil {
-		return fmt.Errorf("failed to set rules integrated output: %w", err)
+// timeNow returns the current time, against which the staleness of Sigma rules is checked
+var timeNow = time.Now
+
+// sigmaDateLayouts lists the date formats accepted for the date and modified fields of Sigma rules.
+// The specification uses YYYY-MM-DD, older rules use YYYY/MM/DD, sometimes without zero-padding.
+var sigmaDateLayouts = []string{"2006-01-02", "2006/01/02", "2006-1-2", "2006/1/2", time.RFC3339}
+
+// parseSigmaDate parses the date or modified field of a Sigma rule. Dates without a time are taken to be in the
+// location, so they are rendered as the same date there.
+func parseSigmaDate(value string, location *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range sigmaDateLayouts {
+		if date, err := time.ParseInLocation(layout, value, location); err == nil {
+			return date, nil
+		}
 	}
-	return nil
+	return time.Time{}, fmt.Errorf("invalid Sigma rule date %q, expected YYYY-MM-DD", value)
 }
 
-func (i *Integrator) ConvertToAlert(rule *model.ProvisionedAlertRule, queries []string, titles string, config model.ConversionConfig, conversionFile string, conversionObject model.ConversionOutput) error {
-	datasource := shared.GetConfigValue(config.DataSource, i.config.ConversionDefaults.DataSource, "nil")
-	timewindow := shared.GetConfigValue(config.TimeWindow, i.config.ConversionDefaults.TimeWindow, "1m")
+// rulesLastModified returns the most recent modification date of the Sigma rules in a conversion,
+// using a rule's creation date when it was never modified. Rules with invalid dates are skipped
+// with a warning, and false is returned if none of the rules have a date.
+func (i *Integrator) rulesLastModified(conversionObject model.ConversionOutput) (time.Time, bool) {
+	var lastModified time.Time
+	found := false
+	for _, sigmaRule := range conversionObject.Rules {
+		value := shared.GetConfigValue(sigmaRule.Modified, sigmaRule.Date, "")
+		if value == "" {
+			continue
+		}
+		modified, err := parseSigmaDate(value, i.location())
+		if err != nil {
+			i.warnings.Add("Could not parse the modification date of Sigma rule %s: %v", sigmaRule.ID, err)
+			continue
+		}
+		if !found || modified.After(lastModified) {
+			lastModified = modified
+			found = true
+		}
+	}
+	return lastModified, found
+}
+
+// annotationKey returns the key under which a built-in annotation is written, as renamed by keyMap
+func annotationKey(keyMap map[string]string, key string) string {
+	if customKey := keyMap[key]; customKey != "" {
+		return customKey
+	}
+	return key
+}
+
+// annotationKey returns the key under which a built-in annotation is written, following annotation_key_map
+func (i *Integrator) annotationKey(key string) string {
+	return annotationKey(i.config.IntegratorConfig.AnnotationKeyMap, key)
+}
+
+// queryTimeRange returns the evaluation interval of a time window and the time range of its queries,
+// shifted back by the lookback
+func queryTimeRange(timewindow, lookback string) (time.Duration, model.RelativeTimeRange, error) {
 	duration, err := time.ParseDuration(timewindow)
 	if err != nil {
-		return fmt.Errorf("error parsing time window: %v", err)
+		return 0, model.RelativeTimeRange{}, fmt.Errorf("error parsing time window: %v", err)
 	}
-
-	lookback := shared.GetConfigValue(config.Lookback, i.config.ConversionDefaults.Lookback, "0s")
 	lookbackDuration, err := time.ParseDuration(lookback)
 	if err != nil {
-		return fmt.Errorf("error parsing lookback: %v", err)
+		return 0, model.RelativeTimeRange{}, fmt.Errorf("error parsing lookback: %v", err)
 	}
 
 	// Apply lookback to time range: now-5m to now with 1m lookback becomes now-6m to now-1m
 	fromDuration := duration + lookbackDuration
 	toDuration := lookbackDuration
-	timerange := model.RelativeTimeRange{From: model.Duration(fromDuration), To: model.Duration(toDuration)}
+	return duration, model.RelativeTimeRange{From: model.Duration(fromDuration), To: model.Duration(toDuration)}, nil
+}
+
+// exploreLink returns the link opening the first query of an alert rule in Grafana Explore. Annotations can't
+// reference the time an alert fired, so the link covers the query time range relative to when it's opened.
+func (i *Integrator) exploreLink(query, datasource string, timerange model.RelativeTimeRange, config model.ConversionConfig) (string, error) {
+	defaultConf := i.config.ConversionDefaults
+	queryDatasource, queryConfig := ResolveQueryDataSource(0, datasource, config)
+	datasourceType := shared.GetConfigValue(queryConfig.DataSourceType, defaultConf.DataSourceType, shared.GetConfigValue(queryConfig.Target, defaultConf.Target, shared.Loki))
+	from := fmt.Sprintf("now-%ds", int64(time.Duration(timerange.From).Seconds()))
+	to := "now"
+	if timerange.To > 0 {
+		to = fmt.Sprintf("now-%ds", int64(time.Duration(timerange.To).Seconds()))
+	}
+	link, err := shared.GenerateExploreLink(query, queryDatasource, datasourceType, queryConfig, defaultConf,
+		i.config.DeployerConfig.GrafanaInstance, from, to, i.config.IntegratorConfig.OrgID)
+	if err != nil {
+		return "", fmt.Errorf("error generating explore link for conversion %s: %v", config.Name, err)
+	}
+	return link, nil
+}
 
+// createQueries creates the alert queries of a conversion's queries, along with the model of the math
+// expression summing their results
+func (i *Integrator) createQueries(queries []string, datasource string, timerange model.RelativeTimeRange, config model.ConversionConfig) ([]model.AlertQuery, json.RawMessage, error) {
 	queryData := make([]model.AlertQuery, 0, len(queries)+2)
 	refIDs := make([]string, len(queries))
 	for index, query := range queries {
 		refIDs[index] = fmt.Sprintf("A%d", index)
-		alertQuery, err := createAlertQuery(query, refIDs[index], datasource, timerange, config, i.config.ConversionDefaults)
+		queryDatasource, queryConfig := ResolveQueryDataSource(index, datasource, config)
+		if err := CheckAllowedDatasource(queryDatasource, config.Name, i.config.IntegratorConfig.AllowedDatasources, i.lookupDatasource); err != nil {
+			return nil, nil, err
+		}
+		if i.config.IntegratorConfig.RejectMalformedQueries {
+			defaults := i.config.ConversionDefaults
+			datasourceType := shared.GetConfigValue(queryConfig.DataSourceType, defaults.DataSourceType, shared.GetConfigValue(queryConfig.Target, defaults.Target, shared.Loki))
+			if err := checkMalformedQuery(query, datasourceType); err != nil {
+				return nil, nil, fmt.Errorf("malformed query %s of conversion %s: %v", query, config.Name, err)
+			}
+		}
+		alertQuery, err := createAlertQuery(query, refIDs[index], queryDatasource, timerange, queryConfig, i.config.ConversionDefaults, i.warnings)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 		queryData = append(queryData, alertQuery)
 	}
+	// Range queries return time series, which must be reduced to a single value per series before they can be
+	// combined and alerted on: they are reduced to their maximum over the time range, so any match fires
+	for index, alertQuery := range slices.Clone(queryData) {
+		if alertQuery.QueryType != "range" {
+			continue
+		}
+		reducedRefID := fmt.Sprintf("%s%d", reducerRefIDPrefix, index)
+		queryData = append(queryData, model.AlertQuery{
+			RefID:             reducedRefID,
+			DatasourceUID:     "__expr__",
+			RelativeTimeRange: timerange,
+			Model: json.RawMessage(fmt.Sprintf(`{"refId":"%s","hide":%t,"type":"reduce","datasource":{"uid":"__expr__","type":"__expr__"},"expression":"%s","reducer":"max","settings":{"mode":"dropNN"}}`,
+				reducedRefID, hiddenRefID(reducedRefID, config, i.config.ConversionDefaults), refIDs[index])),
+		})
+		refIDs[index] = reducedRefID
+	}
 	// Use Math expression to combine queries: ${A0}+${A1}+...
 	// For single query: ${A0}
-	// For multiple queries: ${A0}+${A1}+${A2}
+	// For multiple queries: ${A0}+${A1}+${A2}, or their reductions, e.g. ${R0}, for range queries
 	mathExpression := make([]string, len(refIDs))
 	for i, refID := range refIDs {
 		mathExpression[i] = fmt.Sprintf("${%s}", refID)
 	}
+	combinerExpression := strings.Join(mathExpression, "+")
+	if len(queries) == 0 {
+		// A placeholder for a conversion without queries never fires
+		combinerExpression = "0"
+	}
 	combiner := json.RawMessage(
-		fmt.Sprintf(`{"refId":"B","hide":false,"type":"math","datasource":{"uid":"__expr__","type":"__expr__"},"expression":"%s"}`,
-			strings.Join(mathExpression, "+")))
-	threshold := json.RawMessage(`{"refId":"C","hide":false,"type":"threshold","datasource":{"uid":"__expr__","type":"__expr__"},"conditions":[{"type":"query","evaluator":{"params":[0],"type":"gt"},"operator":{"type":"and"},"query":{"params":["C"]},"reducer":{"params":[],"type":"last"}}],"expression":"B"}`)
-
-	queryData = append(queryData,
-		model.AlertQuery{
-			RefID:             "B",
-			DatasourceUID:     "__expr__",
-			RelativeTimeRange: timerange,
-			QueryType:         "",
-			Model:             combiner,
-		},
-		model.AlertQuery{
-			RefID:             "C",
-			DatasourceUID:     "__expr__",
-			RelativeTimeRange: timerange,
-			QueryType:         "",
-			Model:             threshold,
-		},
-	)
+		fmt.Sprintf(`{"refId":"%s","hide":%t,"type":"math","datasource":{"uid":"__expr__","type":"__expr__"},"expression":"%s"}`,
+			combinerRefID, hiddenRefID(combinerRefID, config, i.config.ConversionDefaults), combinerExpression))
+	return queryData, combiner, nil
+}
 
-	if len(queryData) == len(rule.Data) {
-		for qIdx, query := range queryData {
-			if !bytes.Equal(query.Model, rule.Data[qIdx].Model) {
-				break
-			}
-			if qIdx == len(queryData)-1 {
-				// if we get here, all the queries are the same, no need to update the rule
-				fmt.Printf("No changes to the relevant alert rule, skipping\n")
-				return nil
-			}
+// pendingPeriod resolves the pending period of an alert rule: an explicit pending period takes precedence,
+// otherwise, with auto_pending_period, it is the evaluation interval times the pending period multiplier
+func (i *Integrator) pendingPeriod(config model.ConversionConfig, interval time.Duration) (time.Duration, error) {
+	if pendingPeriod := shared.GetConfigValue(config.PendingPeriod, i.config.ConversionDefaults.PendingPeriod, ""); pendingPeriod != "" {
+		duration, err := time.ParseDuration(pendingPeriod)
+		if err != nil || duration < 0 {
+			return 0, fmt.Errorf("error parsing pending period %s: must be a non-negative duration", pendingPeriod)
 		}
+		return duration, nil
 	}
-	rule.Data = queryData
-
-	// alerting rule metadata
-	rule.OrgID = i.config.IntegratorConfig.OrgID
-	rule.FolderUID = i.config.IntegratorConfig.FolderID
-	rule.RuleGroup = shared.GetConfigValue(config.RuleGroup, i.config.ConversionDefaults.RuleGroup, "Default")
-	rule.NoDataState = model.OK
-	rule.ExecErrState = model.OkErrState
-	rule.Title = titles
-	rule.Condition = "C"
-
-	// Add annotations for context
-	if rule.Annotations == nil {
-		rule.Annotations = make(map[string]string)
+	if !i.config.IntegratorConfig.AutoPendingPeriod {
+		return 0, nil
 	}
+	multiplier := max(i.config.IntegratorConfig.PendingPeriodMultiplier, 1)
+	return interval * time.Duration(multiplier), nil
+}
 
-	rule.Annotations["Query"] = queries[0]
-	rule.Annotations["TimeWindow"] = timewindow
-	rule.Annotations["Lookback"] = lookback
-
-	// LogSourceUid annotation (data source)
-	rule.Annotations["LogSourceUid"] = datasource
-
-	// LogSourceType annotation (target)
-	logSourceType := shared.GetConfigValue(config.Target, i.config.ConversionDefaults.Target, shared.Loki)
-	rule.Annotations["LogSourceType"] = logSourceType
-
-	// Path to associated conversion file
-	rule.Annotations["ConversionFile"] = conversionFile
-
-	if i.config.IntegratorConfig.TemplateAnnotations != nil {
-		for key, value := range i.config.IntegratorConfig.TemplateAnnotations {
-			tmpl, err := template.New("annotation_" + key).Funcs(FuncMap).Parse(value)
-			if err != nil {
-				return fmt.Errorf("error parsing template %s: %v", key, err)
-			}
-			var buf bytes.Buffer
-			if i.config.IntegratorConfig.TemplateAllRules {
-				err = tmpl.Execute(&buf, conversionObject.Rules)
-			} else {
-				err = tmpl.Execute(&buf, conversionObject.Rules[0])
-			}
-			if err != nil {
-				return fmt.Errorf("error executing template %s: %v", key, err)
-			}
-			rule.Annotations[key] = buf.String()
+// validateAnnotationKeyMap checks that annotation_key_map only renames built-in annotations,
+// and that no two annotations end up sharing a key
+func validateAnnotationKeyMap(keyMap map[string]string) error {
+	usedKeys := map[string]string{ManualAnnotation: ManualAnnotation, PlaceholderAnnotation: PlaceholderAnnotation}
+	for _, key := range builtinAnnotationKeys {
+		customKey := annotationKey(keyMap, key)
+		if other, ok := usedKeys[customKey]; ok {
+			return fmt.Errorf("invalid annotation_key_map: %s and %s would both use the annotation key %s", other, key, customKey)
 		}
+		usedKeys[customKey] = key
 	}
+	for key, customKey := range keyMap {
+		if !slices.Contains(builtinAnnotationKeys, key) {
+			return fmt.Errorf("invalid annotation_key_map: %s is not a built-in annotation, must be one of %s", key, strings.Join(builtinAnnotationKeys, ", "))
+		}
+		if customKey == "" {
+			return fmt.Errorf("invalid annotation_key_map: the annotation key for %s is empty", key)
+		}
+	}
+	return nil
+}
 
-	if rule.Labels == nil {
-		rule.Labels = make(map[string]string)
+// FingerprintLabel is the label holding a fingerprint of the Sigma rules an alert rule was generated
+// from, when fingerprint_label is enabled
+const FingerprintLabel = "alert_fingerprint"
+
+// ruleFingerprint returns a fingerprint of the conversion name and the IDs of its Sigma rules. Unlike the
+// alert rule's labels as a whole, it does not depend on the query, so Alertmanager keeps grouping and
+// deduplicating the alerts of a detection when only its query is edited.
+func ruleFingerprint(conversionObject model.ConversionOutput) string {
+	ruleIDs := make([]string, len(conversionObject.Rules))
+	for index, rule := range conversionObject.Rules {
+		ruleIDs[index] = rule.ID
 	}
+	slices.Sort(ruleIDs)
+	return fmt.Sprintf("%016x", murmur3.Sum64([]byte(conversionObject.ConversionName+"_"+strings.Join(ruleIDs, ","))))
+}
 
-	if i.config.IntegratorConfig.TemplateLabels != nil {
-		for key, value := range i.config.IntegratorConfig.TemplateLabels {
-			tmpl, err := template.New("label_" + key).Parse(value)
-			if err != nil {
-				return fmt.Errorf("error parsing template %s: %v", key, err)
-			}
-			var buf bytes.Buffer
-			if i.config.IntegratorConfig.TemplateAllRules {
-				err = tmpl.Execute(&buf, conversionObject.Rules)
-			} else {
-				err = tmpl.Execute(&buf, conversionObject.Rules[0])
-			}
-			if err != nil {
-				return fmt.Errorf("error executing template %s: %v", key, err)
-			}
-			rule.Labels[key] = buf.String()
+// Labels used by Grafana OnCall to route alerts from Grafana Alerting
+const (
+	OnCallRouteLabel           = "grafana_oncall_route"
+	OnCallEscalationChainLabel = "grafana_oncall_escalation_chain"
+	OnCallTeamLabel            = "grafana_oncall_team"
+)
+
+// addOnCallLabels validates the OnCall routing values from the conversion (falling back to the
+// defaults) and merges them into labels. A value may not span multiple lines or have surrounding
+// whitespace, and may not override a label of the same name set by template_labels.
+func addOnCallLabels(labels map[string]string, config, defaultConf model.OnCallConfig, templateLabels map[string]string) error {
+	onCallLabels := []struct {
+		key   string
+		value string
+	}{
+		{OnCallRouteLabel, shared.GetConfigValue(config.Route, defaultConf.Route, "")},
+		{OnCallEscalationChainLabel, shared.GetConfigValue(config.EscalationChain, defaultConf.EscalationChain, "")},
+		{OnCallTeamLabel, shared.GetConfigValue(config.Team, defaultConf.Team, "")},
+	}
+	for _, label := range onCallLabels {
+		if label.value == "" {
+			continue
+		}
+		if strings.TrimSpace(label.value) != label.value || strings.ContainsAny(label.value, "\r\n") {
+			return fmt.Errorf("invalid value for OnCall label %s: %q", label.key, label.value)
 		}
+		if _, ok := templateLabels[label.key]; ok {
+			return fmt.Errorf("OnCall label %s is also set by template_labels", label.key)
+		}
+		labels[label.key] = label.value
 	}
-
 	return nil
 }
 
@@ -705,14 +2388,17 @@ func readRuleFromFile(rule *model.ProvisionedAlertRule, inputPath string) error
 		}
 		err = json.Unmarshal([]byte(ruleJSON), rule)
 		if err != nil {
-			return fmt.Errorf("error unmarshalling rule file %s: %v", inputPath, err)
+			return fmt.Errorf("error unmarshalling rule file %w", shared.DescribeJSONError(inputPath, []byte(ruleJSON), err))
 		}
 	}
 	return nil
 }
 
 // marshalJSON serialises v as JSON, honouring the pretty-print flag used across the
-// integrator's file writes so output formatting stays consistent in one place.
+// integrator's file writes so output formatting stays consistent in one place. Writing the
+// same content again is byte-identical, and doesn't churn the files in Git, as encoding/json
+// sorts map keys, such as the labels and annotations of alert rules, and compacts raw query
+// models before indenting them.
 func marshalJSON(v any, prettyPrint bool) ([]byte, error) {
 	if prettyPrint {
 		return json.MarshalIndent(v, "", "  ")
@@ -720,22 +2406,46 @@ func marshalJSON(v any, prettyPrint bool) ([]byte, error) {
 	return json.Marshal(v)
 }
 
-func writeRuleToFile(rule *model.ProvisionedAlertRule, outputFile string, prettyPrint bool) error {
+// renameFile replaces a file by another, a variable so that tests can simulate failed writes
+var renameFile = os.Rename
+
+// writeRuleToFile writes the alert rule atomically: it is written to a temporary file in the same
+// directory, then renamed over the output file, so an interrupted write never leaves a corrupt file
+func writeRuleToFile(rule *model.ProvisionedAlertRule, outputFile string, prettyPrint bool) (err error) {
 	ruleBytes, err := marshalJSON(rule, prettyPrint)
 	if err != nil {
 		return fmt.Errorf("error marshalling alert rule: %v", err)
 	}
 
-	// write to output file
-	out, err := os.Create(outputFile) // will truncate existing file content
+	out, err := os.CreateTemp(filepath.Dir(outputFile), "."+filepath.Base(outputFile)+".tmp-*")
 	if err != nil {
 		return fmt.Errorf("error opening alert rule file %s to write to: %v", outputFile, err)
 	}
-	defer out.Close()
-	_, err = out.Write(ruleBytes)
-	if err != nil {
+	// The temporary file is removed unless it replaced the output file
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(out.Name())
+		}
+	}()
+	// Temporary files are only readable by their owner, so give it the mode of the file it replaces, or the
+	// mode os.Create would have, for the deployment files to stay readable by whoever commits them
+	mode := os.FileMode(0o644)
+	if info, statErr := os.Stat(outputFile); statErr == nil {
+		mode = info.Mode().Perm()
+	}
+	if err = out.Chmod(mode); err != nil {
+		return fmt.Errorf("error setting the mode of alert rule file %s: %v", outputFile, err)
+	}
+	if _, err = out.Write(ruleBytes); err != nil {
+		return fmt.Errorf("error writing alert rule file to %s: %v", outputFile, err)
+	}
+	if err = out.Close(); err != nil {
 		return fmt.Errorf("error writing alert rule file to %s: %v", outputFile, err)
 	}
+	if err = renameFile(out.Name(), outputFile); err != nil {
+		return fmt.Errorf("error replacing alert rule file %s: %v", outputFile, err)
+	}
 
 	return nil
 }
@@ -775,34 +2485,218 @@ func summariseSigmaRules(rules []model.SigmaRule) (id uuid.UUID, title string, e
 	return conversionID, title, nil
 }
 
+// summariseConversion derives a stable conversion ID and title from the conversion name and the rule filename of a
+// conversion file without Sigma rules, the rule filename telling apart the conversion files of the same conversion
+func summariseConversion(conversionName, ruleFilename string) (uuid.UUID, string) {
+	title := conversionName
+	if ruleFilename != conversionName {
+		title += " " + ruleFilename
+	}
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(conversionName+"/"+ruleFilename)), truncateTitle(title, 190)
+}
+
+// dedupeSigmaRules returns the conversion with only the first of the Sigma rules sharing an ID, along with the
+// duplicated IDs. When the conversion has one query per Sigma rule, the queries of the removed rules are removed too.
+func dedupeSigmaRules(conversionObject model.ConversionOutput) (model.ConversionOutput, []string) {
+	perRule := len(conversionObject.Queries) == len(conversionObject.Rules)
+	rules := make([]model.SigmaRule, 0, len(conversionObject.Rules))
+	queries := make([]string, 0, len(conversionObject.Queries))
+	duplicates := []string{}
+	for index, rule := range conversionObject.Rules {
+		if slices.ContainsFunc(rules, func(kept model.SigmaRule) bool { return kept.ID == rule.ID }) {
+			if !slices.Contains(duplicates, rule.ID) {
+				duplicates = append(duplicates, rule.ID)
+			}
+			continue
+		}
+		rules = append(rules, rule)
+		if perRule {
+			queries = append(queries, conversionObject.Queries[index])
+		}
+	}
+	if len(duplicates) == 0 {
+		return conversionObject, nil
+	}
+	conversionObject.Rules = rules
+	if perRule {
+		conversionObject.Queries = queries
+	}
+	return conversionObject, duplicates
+}
+
 func getRuleUID(conversionName string, conversionID uuid.UUID) string {
 	hash := int64(murmur3.Sum32([]byte(conversionName + "_" + conversionID.String())))
 	return fmt.Sprintf("%x", hash)
 }
 
-var lokiMetricQueryPrefixes = []string{"sum", "count", "avg", "min", "max"}
+// ResolveQueryDataSource returns the data source UID and conversion config to use for the query at
+// index. A matching entry in the conversion's query_data_sources takes precedence over the given
+// data source, and its type (if set) replaces the conversion's data source type.
+func ResolveQueryDataSource(index int, datasource string, config model.ConversionConfig) (string, model.ConversionConfig) {
+	if index < 0 || index >= len(config.QueryDataSources) {
+		return datasource, config
+	}
+	override := config.QueryDataSources[index]
+	if override.DataSourceType != "" {
+		config.DataSourceType = override.DataSourceType
+	}
+	return shared.GetConfigValue(override.DataSource, datasource, ""), config
+}
+
+// ESQLTarget is the Sigma backend, and conversion target, of ES|QL queries, which run on Elasticsearch
+// data sources with the ES|QL query model rather than the Lucene one
+const ESQLTarget = "esql"
+
+// backendDatasourceTypes maps the Sigma backends to the type of the data source their queries run on, when
+// the two differ. Other backends are taken to be named after their data source type, e.g. loki.
+var backendDatasourceTypes = map[string]string{
+	"lucene":        shared.Elasticsearch,
+	"elasticsearch": shared.Elasticsearch,
+	ESQLTarget:      shared.Elasticsearch,
+}
+
+// BackendConfig returns the conversion config selecting the query model of the Sigma backend that produced
+// a conversion output, overriding the configured target and data source type. The config is returned as is
+// if the conversion output doesn't declare its backend.
+func BackendConfig(config model.ConversionConfig, backend string) model.ConversionConfig {
+	if backend == "" {
+		return config
+	}
+	config.Target = strings.ToLower(backend)
+	config.DataSourceType = shared.GetConfigValue(backendDatasourceTypes[config.Target], config.Target, "")
+	return config
+}
 
+// lokiMetricQuery matches LogQL metric queries: an aggregation or range function, optionally grouped with a
+// by or without clause, applied to its arguments. Log queries start with a stream selector instead.
+var lokiMetricQuery = regexp.MustCompile(`^[\s(]*(sum|count|avg|min|max|stddev|stdvar|topk|bottomk|sort|sort_desc|` +
+	`rate|rate_counter|bytes_rate|bytes_over_time|count_over_time|(avg|min|max|sum|stddev|stdvar|quantile|first|last|absent)_over_time|` +
+	`approx_topk|label_replace|vector|abs|ceil|floor|round|sqrt|exp|ln)\s*((by|without)\s*\([^)]*\)\s*)?\(`)
+
+// isLokiMetricQuery reports whether the LogQL query is already a metric query, which is used as is rather
+// than being wrapped in a metric query.
 func isLokiMetricQuery(query string) bool {
-	trimmed := strings.TrimSpace(query)
-	for _, prefix := range lokiMetricQueryPrefixes {
-		if strings.HasPrefix(trimmed, prefix) {
-			return true
+	return lokiMetricQuery.MatchString(query)
+}
+
+// How the range of Loki log queries with an explicit range selector, e.g. [5m], is set when they are wrapped in a metric query
+const (
+	// LokiRangeKeep keeps the range of the query, log queries without a range get $__auto
+	LokiRangeKeep = "keep"
+	// LokiRangeAuto replaces the range of the query with $__auto, the evaluation window of the alert rule
+	LokiRangeAuto = "auto"
+)
+
+// lokiRangeSelector matches the range selector ending a LogQL log query, a duration or a variable
+// optionally followed by an offset, e.g. [5m], [1h30m] or [$__interval] offset 1h
+var lokiRangeSelector = regexp.MustCompile(`\s*\[\s*(([0-9]+(ms|s|m|h|d|w|y))+|\$\w+)\s*\](\s+offset\s+-?([0-9]+(ms|s|m|h|d|w|y))+)?\s*$`)
+
+// lokiLogRange returns the log query with the range selector of the metric query it is wrapped in: its own
+// range selector if it has one and the range is kept, otherwise [$__auto]
+func lokiLogRange(query, lokiRange string) string {
+	if loc := lokiRangeSelector.FindStringIndex(query); loc != nil {
+		if lokiRange == LokiRangeKeep {
+			return query
 		}
+		query = query[:loc[0]]
 	}
-	return false
+	return query + "[$__auto]"
+}
+
+// hiddenRefID reports whether the query or expression with the refID is hidden in the Grafana UI, through
+// the hidden_ref_ids of the conversion or, if unset, of the conversion defaults
+func hiddenRefID(refID string, config, defaultConf model.ConversionConfig) bool {
+	hidden := config.HiddenRefIDs
+	if hidden == nil {
+		hidden = defaultConf.HiddenRefIDs
+	}
+	return slices.Contains(hidden, refID)
+}
+
+// noDataState returns the state of the alert rules of a conversion when their queries return no data: Alerting
+// for conversions alerting on no data, otherwise the configured no_data_state, OK by default
+func (i *Integrator) noDataState(config model.ConversionConfig) (model.NoDataState, error) {
+	state := model.NoDataState(shared.GetConfigValue(config.NoDataState, i.config.ConversionDefaults.NoDataState, string(model.OK)))
+	switch state {
+	case model.OK, model.NoData, model.Alerting:
+	default:
+		return "", fmt.Errorf("invalid no_data_state %s of conversion %s: must be one of %s, %s or %s", state, config.Name, model.OK, model.NoData, model.Alerting)
+	}
+	if config.AlertOnNoData || i.config.ConversionDefaults.AlertOnNoData {
+		if configured := shared.GetConfigValue(config.NoDataState, i.config.ConversionDefaults.NoDataState, ""); configured != "" && state != model.Alerting {
+			return "", fmt.Errorf("conversion %s alerts on no data, its no_data_state must be %s, not %s", config.Name, model.Alerting, configured)
+		}
+		return model.Alerting, nil
+	}
+	return state, nil
+}
+
+// templateRule is the data of the annotation and label templates: the fields of a Sigma rule, along with the
+// configuration of its conversion, resolved against the conversion defaults, under Config
+type templateRule struct {
+	model.SigmaRule
+	Config model.ConversionConfig
+}
+
+// templateData returns the data the annotation and label templates are executed with, either the first Sigma rule
+// of the conversion output or, with template_all_rules, all of them
+func (i *Integrator) templateData(conversionObject model.ConversionOutput, config model.ConversionConfig) any {
+	defaults := i.config.ConversionDefaults
+	config.Target = shared.GetConfigValue(config.Target, defaults.Target, shared.Loki)
+	config.DataSource = shared.GetConfigValue(config.DataSource, defaults.DataSource, "")
+	config.DataSourceType = shared.GetConfigValue(config.DataSourceType, defaults.DataSourceType, config.Target)
+	config.RuleGroup = shared.GetConfigValue(config.RuleGroup, defaults.RuleGroup, "Default")
+	config.TimeWindow = shared.GetConfigValue(config.TimeWindow, defaults.TimeWindow, "1m")
+	config.Lookback = shared.GetConfigValue(config.Lookback, defaults.Lookback, "0s")
+
+	rules := make([]templateRule, len(conversionObject.Rules))
+	for idx, sigmaRule := range conversionObject.Rules {
+		rules[idx] = templateRule{SigmaRule: sigmaRule, Config: config}
+	}
+	if i.config.IntegratorConfig.TemplateAllRules {
+		return rules
+	}
+	if len(rules) == 0 {
+		return templateRule{Config: config}
+	}
+	return rules[0]
 }
 
 // createAlertQuery creates an AlertQuery based on the target data source and configuration
-func createAlertQuery(query string, refID string, datasource string, timerange model.RelativeTimeRange, config model.ConversionConfig, defaultConf model.ConversionConfig) (model.AlertQuery, error) {
+func createAlertQuery(query string, refID string, datasource string, timerange model.RelativeTimeRange, config model.ConversionConfig, defaultConf model.ConversionConfig, warnings *shared.Warnings) (model.AlertQuery, error) {
 	datasourceType := shared.GetConfigValue(config.DataSourceType, defaultConf.DataSourceType, shared.GetConfigValue(config.Target, defaultConf.Target, shared.Loki))
 	customModel := shared.GetConfigValue(config.QueryModel, defaultConf.QueryModel, "")
 
+	lokiQueryType := shared.GetConfigValue(config.LokiQueryType, defaultConf.LokiQueryType, "instant")
 	if datasourceType == shared.Loki {
+		// Log queries are wrapped in a metric query matching the query type: instant queries count the
+		// matches over the evaluation window, range queries compute the rate of matches at each step
+		var rangeFunction string
+		switch lokiQueryType {
+		case "instant":
+			rangeFunction = "count_over_time"
+		case "range":
+			rangeFunction = "rate"
+		default:
+			return model.AlertQuery{}, fmt.Errorf("invalid loki_query_type %s, must be instant or range", lokiQueryType)
+		}
+		lokiRange := shared.GetConfigValue(config.LokiRange, defaultConf.LokiRange, LokiRangeKeep)
+		if lokiRange != LokiRangeKeep && lokiRange != LokiRangeAuto {
+			return model.AlertQuery{}, fmt.Errorf("invalid loki_range %s, must be %s or %s", lokiRange, LokiRangeKeep, LokiRangeAuto)
+		}
 		if !isLokiMetricQuery(query) {
-			query = fmt.Sprintf("sum(count_over_time(%s[$__auto]))", query)
+			query = fmt.Sprintf("sum(%s(%s))", rangeFunction, lokiLogRange(query, lokiRange))
 		}
 	}
 
+	// The interval and maximum number of data points are set explicitly, as Grafana otherwise picks its own
+	// when evaluating the alert rule, which may not suit the query
+	intervalMs := cmp.Or(config.IntervalMs, defaultConf.IntervalMs, defaultQueryIntervals[datasourceType].intervalMs)
+	maxDataPoints := cmp.Or(config.MaxDataPoints, defaultConf.MaxDataPoints, defaultQueryIntervals[datasourceType].maxDataPoints)
+	if intervalMs < 0 || maxDataPoints < 0 {
+		return model.AlertQuery{}, fmt.Errorf("invalid interval_ms %d or max_data_points %d, must be positive", intervalMs, maxDataPoints)
+	}
+
 	// Must manually escape the query as JSON to include it in a json.RawMessage
 	escapedQuery, err := shared.EscapeQueryJSON(query)
 	if err != nil {
@@ -816,22 +2710,44 @@ func createAlertQuery(query string, refID string, datasource string, timerange m
 		RelativeTimeRange: timerange,
 	}
 
+	// Only the Loki model sets the hide flag by default, the other models omit it unless the query is hidden
+	hide := hiddenRefID(refID, config, defaultConf)
+	hideField := ""
+	if hide {
+		hideField = `"hide":true,`
+	}
+
+	// The type in the models is the data source type unless overridden, the models still being picked by the data source type
+	modelType := shared.GetConfigValue(config.ModelDatasourceType, defaultConf.ModelDatasourceType, datasourceType)
+
 	// Populate the alert query model, first see if the user has provided a custom model
 	// else use defaults based on the target data source type
 	switch {
 	case customModel != "":
 		alertQuery.Model = json.RawMessage(fmt.Sprintf(customModel, refID, datasource, escapedQuery))
 	case datasourceType == shared.Loki:
-		alertQuery.QueryType = "instant"
-		alertQuery.Model = json.RawMessage(fmt.Sprintf(`{"refId":"%s","datasource":{"type":"loki","uid":"%s"},"hide":false,"expr":"%s","queryType":"instant","editorMode":"code"}`, refID, datasource, escapedQuery))
+		alertQuery.QueryType = lokiQueryType
+		alertQuery.Model = json.RawMessage(fmt.Sprintf(`{"refId":"%s","datasource":{"type":"%s","uid":"%s"},"hide":%t,"expr":"%s","queryType":"%s","editorMode":"code","intervalMs":%d,"maxDataPoints":%d}`, refID, modelType, datasource, hide, escapedQuery, lokiQueryType, intervalMs, maxDataPoints))
+	case datasourceType == shared.Elasticsearch && shared.GetConfigValue(config.Target, defaultConf.Target, "") == ESQLTarget:
+		// ES|QL queries compute their own aggregations, so they are sent as is with the ES|QL query type of the
+		// Elasticsearch data source plugin
+		alertQuery.Model = json.RawMessage(fmt.Sprintf(`{"refId":"%s","datasource":{"type":"%s","uid":"%s"},%s"queryType":"%s","query":"%s","intervalMs":%d,"maxDataPoints":%d,"timeField":"@timestamp"}`, refID, modelType, datasource, hideField, ESQLTarget, escapedQuery, intervalMs, maxDataPoints))
 	case datasourceType == shared.Elasticsearch:
 		// Based on the Elasticsearch data source plugin
 		// https://github.com/grafana/grafana/blob/main/public/app/plugins/datasource/elasticsearch/dataquery.gen.ts
-		alertQuery.Model = json.RawMessage(fmt.Sprintf(`{"refId":"%s","datasource":{"type":"elasticsearch","uid":"%s"},"query":"%s","alias":"","metrics":[{"type":"%s","id":"1"}],"bucketAggs":[{"type":"date_histogram","id":"2","settings":{"interval":"auto"}}],"intervalMs":2000,"maxDataPoints":1354,"timeField":"@timestamp"}`, refID, datasource, escapedQuery, elasticsearchMetricTypeCount))
+		alertQuery.Model = json.RawMessage(fmt.Sprintf(`{"refId":"%s","datasource":{"type":"%s","uid":"%s"},%s"query":"%s","alias":"","metrics":[{"type":"%s","id":"1"}],"bucketAggs":[{"type":"date_histogram","id":"2","settings":{"interval":"auto"}}],"intervalMs":%d,"maxDataPoints":%d,"timeField":"@timestamp"}`, refID, modelType, datasource, hideField, escapedQuery, elasticsearchMetricTypeCount, intervalMs, maxDataPoints))
+	case datasourceType == shared.Prometheus:
+		// PromQL queries, e.g. of Mimir, are metric queries already, so they are evaluated as is at the time of
+		// evaluation, as instant queries like the Loki ones
+		alertQuery.QueryType = "instant"
+		alertQuery.Model = json.RawMessage(fmt.Sprintf(`{"refId":"%s","datasource":{"type":"%s","uid":"%s"},%s"expr":"%s","instant":true,"range":false,"editorMode":"code","intervalMs":%d,"maxDataPoints":%d}`, refID, modelType, datasource, hideField, escapedQuery, intervalMs, maxDataPoints))
+	case datasourceType == shared.Graphite:
+		// Graphite targets are metric queries already, so they are used as is
+		alertQuery.Model = json.RawMessage(fmt.Sprintf(`{"refId":"%s","datasource":{"type":"%s","uid":"%s"},%s"target":"%s"}`, refID, modelType, datasource, hideField, escapedQuery))
 	default:
 		// try a basic query
-		fmt.Printf("WARNING: Using generic query model for the data source type %s; if these queries don't work, try configuring a custom query_model\n", datasourceType)
-		alertQuery.Model = json.RawMessage(fmt.Sprintf(`{"refId":"%s","datasource":{"type":"%s","uid":"%s"},"query":"%s"}`, refID, datasourceType, datasource, escapedQuery))
+		warnings.Add("Using generic query model for the data source type %s; if these queries don't work, try configuring a custom query_model", datasourceType)
+		alertQuery.Model = json.RawMessage(fmt.Sprintf(`{"refId":"%s","datasource":{"type":"%s","uid":"%s"},%s"query":"%s"}`, refID, modelType, datasource, hideField, escapedQuery))
 	}
 
 	return alertQuery, nil
@@ -1,19 +1,27 @@
 package integrate
 
 import (
+	"cmp"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/grafana/sigma-rule-deployment/internal/model"
 	"github.com/grafana/sigma-rule-deployment/shared"
+	"github.com/jarcoal/httpmock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestConvertToAlert(t *testing.T) {
@@ -27,11 +35,15 @@ func TestConvertToAlert(t *testing.T) {
 		convObject             model.ConversionOutput
 		wantQueryText          string
 		wantDuration           model.Duration
-		wantUnchanged          bool
 		wantError              bool
 		wantLabels             map[string]string
 		wantAnnotations        map[string]string
 		wantCombinerExpression string
+		wantMissingSeriesEvals *int
+		wantCondition          string
+		wantNoDataState        model.NoDataState
+		wantTitle              string
+		wantFor                string
 	}{
 		{
 			name:          "value_count correlation metric query is not wrapped",
@@ -61,6 +73,25 @@ func TestConvertToAlert(t *testing.T) {
 			wantDuration:  model.Duration(300 * time.Second),
 			wantError:     false,
 		},
+		{
+			name:    "loki query with an overridden model data source type",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Alert Rule 1",
+			rule: &model.ProvisionedAlertRule{
+				UID: "5c1c217a",
+			},
+			convConfig: model.ConversionConfig{
+				Name:                "conv",
+				Target:              "loki",
+				DataSource:          "my_data_source",
+				ModelDatasourceType: "grafana-loki-datasource",
+				RuleGroup:           "Every 5 Minutes",
+				TimeWindow:          "5m",
+			},
+			wantQueryText: `"datasource":{"type":"grafana-loki-datasource","uid":"my_data_source"}`,
+			wantDuration:  model.Duration(300 * time.Second),
+			wantError:     false,
+		},
 		{
 			name:    "valid ES query",
 			queries: []string{`from * | where eventSource=="kms.amazonaws.com" and eventName=="CreateGrant"`},
@@ -106,6 +137,22 @@ func TestConvertToAlert(t *testing.T) {
 			wantDuration: 0, // invalid time window, expect no value
 			wantError:    true,
 		},
+		{
+			name:    "prometheus queries are combined from their refIds",
+			queries: []string{`sum(rate(auth_failures_total[5m]))`, `sum(rate(mfa_resets_total[5m]))`},
+			titles:  "Prometheus Test",
+			rule:    &model.ProvisionedAlertRule{UID: "prom-test"},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "prometheus",
+				DataSource: "mimir_ds",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+			},
+			wantQueryText:          `"expr":"sum(rate(auth_failures_total[5m]))","instant":true,"range":false`,
+			wantDuration:           model.Duration(5 * time.Minute),
+			wantCombinerExpression: `"expression":"${A0}+${A1}"`,
+		},
 		{
 			name:    "multiple queries use math combiner",
 			queries: []string{"{job=`.+`} | json | test=`true`", "{job=`.+`} | json | test=`false`"},
@@ -125,15 +172,375 @@ func TestConvertToAlert(t *testing.T) {
 			wantCombinerExpression: `"expression":"${A0}+${A1}"`,
 		},
 		{
-			name:    "skip unchanged queries",
+			name:    "custom condition refId",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:           "conv",
+				Target:         "loki",
+				DataSource:     "my_data_source",
+				RuleGroup:      "Every 5 Minutes",
+				TimeWindow:     "5m",
+				QueryModel:     `{"refId":"%s","datasource":{"type":"loki","uid":"%s"},"expr":"sum(count_over_time(%s[$__auto])) > 10"}`,
+				ConditionRefID: "A0",
+			},
+			wantQueryText: "> 10",
+			wantDuration:  model.Duration(300 * time.Second),
+			wantCondition: "A0",
+		},
+		{
+			name:    "hidden queries and expressions",
+			queries: []string{"{job=`.+`} | json | test=`true`", "{job=`.+`} | json | test=`false`"},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:         "conv",
+				Target:       "loki",
+				DataSource:   "my_data_source",
+				RuleGroup:    "Every 5 Minutes",
+				TimeWindow:   "5m",
+				HiddenRefIDs: []string{"A0", "B"},
+			},
+			wantQueryText:          `"hide":true,"expr":"sum(count_over_time({job=`,
+			wantDuration:           model.Duration(300 * time.Second),
+			wantCombinerExpression: `"refId":"B","hide":true,"type":"math"`,
+		},
+		{
+			name:    "alert on no data",
+			queries: []string{`{job="heartbeat"} | json`},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:          "conv",
+				Target:        "loki",
+				DataSource:    "my_data_source",
+				RuleGroup:     "Every 5 Minutes",
+				TimeWindow:    "5m",
+				AlertOnNoData: true,
+			},
+			wantQueryText:          `"expr":"sum(count_over_time({job=\"heartbeat\"} | json[$__auto]))"`,
+			wantDuration:           model.Duration(300 * time.Second),
+			wantCombinerExpression: `"evaluator":{"params":[1],"type":"lt"}`,
+			wantNoDataState:        model.Alerting,
+		},
+		{
+			name:    "inline threshold overrides the default",
+			queries: []string{`{job="heartbeat"} | json`},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:          "conv",
+				Target:        "loki",
+				DataSource:    "my_data_source",
+				RuleGroup:     "Every 5 Minutes",
+				TimeWindow:    "5m",
+				AlertOnNoData: true,
+			},
+			convObject:             model.ConversionOutput{Threshold: func() *float64 { v := 2.5; return &v }(), ThresholdOperator: "gte"},
+			wantQueryText:          `"expr":"sum(count_over_time({job=\"heartbeat\"} | json[$__auto]))"`,
+			wantDuration:           model.Duration(300 * time.Second),
+			wantCombinerExpression: `"evaluator":{"params":[2.5],"type":"gte"}`,
+			wantNoDataState:        model.Alerting,
+		},
+		{
+			name:    "inline threshold keeps the default operator",
+			queries: []string{`{job="test"} | json`},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				DataSource: "my_data_source",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+			},
+			convObject:             model.ConversionOutput{Threshold: func() *float64 { v := 10.0; return &v }()},
+			wantQueryText:          `"expr":"sum(count_over_time({job=\"test\"} | json[$__auto]))"`,
+			wantDuration:           model.Duration(300 * time.Second),
+			wantCombinerExpression: `"evaluator":{"params":[10],"type":"gt"}`,
+		},
+		{
+			name:    "invalid inline threshold operator",
+			queries: []string{`{job="test"} | json`},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				DataSource: "my_data_source",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+			},
+			convObject: model.ConversionOutput{ThresholdOperator: ">"},
+			wantError:  true,
+		},
+		{
+			name:    "inline condition overrides the configured one",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:           "conv",
+				Target:         "loki",
+				DataSource:     "my_data_source",
+				RuleGroup:      "Every 5 Minutes",
+				TimeWindow:     "5m",
+				ConditionRefID: "B",
+			},
+			convObject:    model.ConversionOutput{Condition: "A0"},
+			wantQueryText: `"expr":"sum(count_over_time({job=`,
+			wantDuration:  model.Duration(300 * time.Second),
+			wantCondition: "A0",
+		},
+		{
+			name:    "no data state",
+			queries: []string{`{job="test"} | json`},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:        "conv",
+				Target:      "loki",
+				DataSource:  "my_data_source",
+				RuleGroup:   "Every 5 Minutes",
+				TimeWindow:  "5m",
+				NoDataState: "NoData",
+			},
+			wantQueryText:          `"expr":"sum(count_over_time({job=\"test\"} | json[$__auto]))"`,
+			wantDuration:           model.Duration(300 * time.Second),
+			wantCombinerExpression: `"evaluator":{"params":[0],"type":"gt"}`,
+			wantNoDataState:        model.NoData,
+		},
+		{
+			name:    "invalid no data state",
+			queries: []string{`{job="test"} | json`},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:        "conv",
+				Target:      "loki",
+				DataSource:  "my_data_source",
+				RuleGroup:   "Every 5 Minutes",
+				TimeWindow:  "5m",
+				NoDataState: "Error",
+			},
+			wantError: true,
+		},
+		{
+			name:    "alert on no data with a conflicting no data state",
+			queries: []string{`{job="heartbeat"} | json`},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:          "conv",
+				Target:        "loki",
+				DataSource:    "my_data_source",
+				RuleGroup:     "Every 5 Minutes",
+				TimeWindow:    "5m",
+				AlertOnNoData: true,
+				NoDataState:   "OK",
+			},
+			wantError: true,
+		},
+		{
+			name:    "configured query interval",
+			queries: []string{`{job="test"} | json`},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:          "conv",
+				Target:        "loki",
+				DataSource:    "my_data_source",
+				RuleGroup:     "Every 5 Minutes",
+				TimeWindow:    "5m",
+				IntervalMs:    60000,
+				MaxDataPoints: 500,
+			},
+			wantQueryText: `"editorMode":"code","intervalMs":60000,"maxDataPoints":500}`,
+			wantDuration:  model.Duration(300 * time.Second),
+		},
+		{
+			name:    "changed query interval is not skipped",
 			queries: []string{`{job=".+"} | json | test="true"`},
-			titles:  "New Alert Rule Title", // This should be ignored
+			titles:  "New Alert Rule Title",
+			convConfig: model.ConversionConfig{
+				DataSource: MissingDataSource,
+				RuleGroup:  "Default",
+				IntervalMs: 2000,
+			},
 			rule: &model.ProvisionedAlertRule{
-				UID:   "5c1c217a",
-				Title: "Unchanged Alert Rule",
+				UID:         "5c1c217a",
+				Title:       "Unchanged Alert Rule",
+				Condition:   "C",
+				NoDataState: model.OK,
 				Data: []model.AlertQuery{
 					{
-						Model: json.RawMessage(`{"refId":"A0","datasource":{"type":"loki","uid":"nil"},"hide":false,"expr":"sum(count_over_time({job=\".+\"} | json | test=\"true\"[$__auto]))","queryType":"instant","editorMode":"code"}`),
+						Model: json.RawMessage(`{"refId":"A0","datasource":{"type":"loki","uid":"nil"},"hide":false,"expr":"sum(count_over_time({job=\".+\"} | json | test=\"true\"[$__auto]))","queryType":"instant","editorMode":"code","intervalMs":1000,"maxDataPoints":43200}`),
+					},
+					{
+						Model: json.RawMessage(`{"refId":"B","hide":false,"type":"math","datasource":{"uid":"__expr__","type":"__expr__"},"expression":"${A0}"}`),
+					},
+					{
+						Model: json.RawMessage(`{"refId":"C","hide":false,"type":"threshold","datasource":{"uid":"__expr__","type":"__expr__"},"conditions":[{"type":"query","evaluator":{"params":[0],"type":"gt"},"operator":{"type":"and"},"query":{"params":["C"]},"reducer":{"params":[],"type":"last"}}],"expression":"B"}`),
+					},
+				},
+			},
+			wantQueryText: `"intervalMs":2000,"maxDataPoints":43200}`,
+			wantDuration:  model.Duration(60 * time.Second),
+		},
+		{
+			name:    "invalid query interval",
+			queries: []string{`{job="test"} | json`},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				DataSource: "my_data_source",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+				IntervalMs: -1000,
+			},
+			wantError: true,
+		},
+		{
+			name:    "loki range query",
+			queries: []string{`{job="test"} | json`},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:          "conv",
+				Target:        "loki",
+				DataSource:    "my_data_source",
+				RuleGroup:     "Every 5 Minutes",
+				TimeWindow:    "5m",
+				LokiQueryType: "range",
+			},
+			wantQueryText: `"expr":"sum(rate({job=\"test\"} | json[$__auto]))","queryType":"range"`,
+			wantDuration:  model.Duration(300 * time.Second),
+		},
+		{
+			name:    "loki range metric query",
+			queries: []string{`sum by (job) (rate({job="test"} | json [5m]))`},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:          "conv",
+				Target:        "loki",
+				DataSource:    "my_data_source",
+				RuleGroup:     "Every 5 Minutes",
+				TimeWindow:    "5m",
+				LokiQueryType: "range",
+			},
+			wantQueryText: `"expr":"sum by (job) (rate({job=\"test\"} | json [5m]))","queryType":"range"`,
+			wantDuration:  model.Duration(300 * time.Second),
+		},
+		{
+			name:    "invalid loki query type",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:          "conv",
+				Target:        "loki",
+				DataSource:    "my_data_source",
+				RuleGroup:     "Every 5 Minutes",
+				TimeWindow:    "5m",
+				LokiQueryType: "log",
+			},
+			wantError: true,
+		},
+		{
+			name:    "hidden condition",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:         "conv",
+				Target:       "loki",
+				DataSource:   "my_data_source",
+				RuleGroup:    "Every 5 Minutes",
+				TimeWindow:   "5m",
+				HiddenRefIDs: []string{"C"},
+			},
+			wantError: true,
+		},
+		{
+			name:    "dangling condition refId",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:           "conv",
+				Target:         "loki",
+				DataSource:     "my_data_source",
+				RuleGroup:      "Every 5 Minutes",
+				TimeWindow:     "5m",
+				ConditionRefID: "D",
+			},
+			wantError: true,
+		},
+		{
+			name:    "empty datasource errors by default",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Alert Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+			},
+			wantError: true,
+		},
+		{
+			name:    "complete rule with unchanged queries",
+			queries: []string{`{job=".+"} | json | test="true"`},
+			titles:  "Unchanged Alert Rule",
+			// The placeholder data source can still be configured explicitly
+			convConfig: model.ConversionConfig{DataSource: MissingDataSource, RuleGroup: "Default"},
+			rule: &model.ProvisionedAlertRule{
+				UID:         "5c1c217a",
+				Title:       "Unchanged Alert Rule",
+				Condition:   "C",
+				NoDataState: model.OK,
+				Data: []model.AlertQuery{
+					{
+						Model: json.RawMessage(`{"refId":"A0","datasource":{"type":"loki","uid":"nil"},"hide":false,"expr":"sum(count_over_time({job=\".+\"} | json | test=\"true\"[$__auto]))","queryType":"instant","editorMode":"code","intervalMs":1000,"maxDataPoints":43200}`),
+					},
+					{
+						Model: json.RawMessage(`{"refId":"B","hide":false,"type":"math","datasource":{"uid":"__expr__","type":"__expr__"},"expression":"${A0}"}`),
+					},
+					{
+						Model: json.RawMessage(`{"refId":"C","hide":false,"type":"threshold","datasource":{"uid":"__expr__","type":"__expr__"},"conditions":[{"type":"query","evaluator":{"params":[0],"type":"gt"},"operator":{"type":"and"},"query":{"params":["C"]},"reducer":{"params":[],"type":"last"}}],"expression":"B"}`),
+					},
+				},
+			},
+			// The metadata and annotations missing from the existing rule are still added
+			wantQueryText: `sum(count_over_time({job=\".+\"} | json | test=\"true\"[$__auto]))`,
+			wantDuration:  model.Duration(60 * time.Second),
+			wantAnnotations: map[string]string{
+				"ConversionFile": "test_conversion_file.json",
+				"LogSourceType":  "loki",
+				"LogSourceUid":   "nil",
+				"Lookback":       "0s",
+				"Query":          `{job=".+"} | json | test="true"`,
+				"TimeWindow":     "1m",
+			},
+		},
+		{
+			name:       "title prefix updates unchanged queries",
+			queries:    []string{`{job=".+"} | json | test="true"`},
+			titles:     "Unchanged Alert Rule",
+			convConfig: model.ConversionConfig{DataSource: MissingDataSource, RuleGroup: "Default"},
+			rule: &model.ProvisionedAlertRule{
+				UID:         "5c1c217a",
+				Title:       "Unchanged Alert Rule",
+				Condition:   "C",
+				NoDataState: model.OK,
+				Data: []model.AlertQuery{
+					{
+						Model: json.RawMessage(`{"refId":"A0","datasource":{"type":"loki","uid":"nil"},"hide":false,"expr":"sum(count_over_time({job=\".+\"} | json | test=\"true\"[$__auto]))","queryType":"instant","editorMode":"code","intervalMs":1000,"maxDataPoints":43200}`),
 					},
 					{
 						Model: json.RawMessage(`{"refId":"B","hide":false,"type":"math","datasource":{"uid":"__expr__","type":"__expr__"},"expression":"${A0}"}`),
@@ -143,7 +550,10 @@ func TestConvertToAlert(t *testing.T) {
 					},
 				},
 			},
-			wantUnchanged: true,
+			integratorConfig: model.IntegrationConfig{TitlePrefix: "[STAGING] "},
+			wantQueryText:    `sum(count_over_time({job=\".+\"} | json | test=\"true\"[$__auto]))`,
+			wantDuration:     model.Duration(60 * time.Second),
+			wantTitle:        "[STAGING] Unchanged Alert Rule",
 		},
 		{
 			name:    "process changed queries",
@@ -172,8 +582,7 @@ func TestConvertToAlert(t *testing.T) {
 					},
 				},
 			},
-			wantDuration:  model.Duration(1 * time.Minute),
-			wantUnchanged: false,
+			wantDuration: model.Duration(1 * time.Minute),
 		},
 		{
 			name:    "valid query with a custom query model",
@@ -195,143 +604,1123 @@ func TestConvertToAlert(t *testing.T) {
 			wantError:     false,
 		},
 		{
-			name:    "valid query with a generic query model",
-			queries: []string{"DO MY QUERY"},
-			titles:  "Alert Rule 8",
-			rule: &model.ProvisionedAlertRule{
-				UID: "5c1c217a",
-			},
-			convConfig: model.ConversionConfig{
-				Name:       "conv",
-				Target:     "generic",
-				DataSource: "generic_uid",
-				RuleGroup:  "Every 30 Minutes",
-				TimeWindow: "30m",
-			},
-			wantQueryText: `"DO MY QUERY"`,
-			wantDuration:  model.Duration(30 * time.Minute),
-			wantError:     false,
+			name:    "valid query with a generic query model",
+			queries: []string{"DO MY QUERY"},
+			titles:  "Alert Rule 8",
+			rule: &model.ProvisionedAlertRule{
+				UID: "5c1c217a",
+			},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "generic",
+				DataSource: "generic_uid",
+				RuleGroup:  "Every 30 Minutes",
+				TimeWindow: "30m",
+			},
+			wantQueryText: `"DO MY QUERY"`,
+			wantDuration:  model.Duration(30 * time.Minute),
+			wantError:     false,
+		},
+		{
+			name:    "valid query with lookback",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Alert Rule with Lookback",
+			rule: &model.ProvisionedAlertRule{
+				UID: "5c1c217a",
+			},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				DataSource: "my_data_source",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+				Lookback:   "2m",
+			},
+			wantQueryText: "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:  model.Duration(7 * time.Minute), // 5m + 2m lookback = 7m
+			wantError:     false,
+		},
+		{
+			name:    "template labels from the conversion config",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Template Rule",
+			rule: &model.ProvisionedAlertRule{
+				UID: "",
+			},
+			convObject: model.ConversionOutput{
+				Rules: []model.SigmaRule{{Title: "Template Rule", Level: "high"}},
+			},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				DataSource: "my_data_source",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+			},
+			integratorConfig: model.IntegrationConfig{
+				TemplateLabels: map[string]string{
+					"Level":         "{{.Level}}",
+					"source_system": "{{.Config.Target}}",
+					"source":        "{{.Config.DataSource}}/{{.Config.RuleGroup}}",
+				},
+			},
+			wantQueryText: "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:  model.Duration(300 * time.Second),
+			wantLabels: map[string]string{
+				"Level":         "high",
+				"source_system": "loki",
+				"source":        "my_data_source/Every 5 Minutes",
+			},
+		},
+		{
+			name:    "template annotations and labels",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Template Rule",
+			rule: &model.ProvisionedAlertRule{
+				UID: "",
+			},
+			convObject: model.ConversionOutput{
+				Rules: []model.SigmaRule{
+					{
+						Title:     "A non-title case title",
+						Level:     "high",
+						Logsource: model.SigmaLogsource{Product: "okta", Service: "okta"},
+						Author:    "John Doe",
+					},
+				},
+			},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				DataSource: "my_data_source",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+			},
+			integratorConfig: model.IntegrationConfig{
+				TemplateLabels: map[string]string{
+					"Level":   "{{.Level}}",
+					"Product": "{{.Logsource.Product}}",
+					"Service": "{{.Logsource.Service}}",
+				},
+				TemplateAnnotations: map[string]string{
+					"Author":      "{{.Author}}",
+					"summary":     "{{title .Title }}",
+					"runbook_url": "https://my.runbook.url/{{ replaceAll .Title ` ` `_` }}",
+				},
+			},
+			wantQueryText: "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:  model.Duration(300 * time.Second),
+			wantError:     false,
+			wantLabels: map[string]string{
+				"Level":   "high",
+				"Product": "okta",
+				"Service": "okta",
+			},
+			wantAnnotations: map[string]string{
+				"Author":         "John Doe",
+				"ConversionFile": "test_conversion_file.json",
+				"LogSourceType":  "loki",
+				"LogSourceUid":   "my_data_source",
+				"Lookback":       "0s",
+				"Query":          "{job=`.+`} | json | test=`true`",
+				"TimeWindow":     "5m",
+				"summary":        "A Non-Title Case Title",
+				"runbook_url":    "https://my.runbook.url/A_non-title_case_title",
+			},
+		},
+		{
+			name:             "title prefix and suffix",
+			queries:          []string{"{job=`.+`} | json | test=`true`"},
+			titles:           "Okta MFA Reset",
+			rule:             &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convObject:       model.ConversionOutput{Rules: []model.SigmaRule{{Title: "Okta MFA Reset", Level: "high"}}},
+			convConfig:       model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", RuleGroup: "Every 5 Minutes", TimeWindow: "5m"},
+			integratorConfig: model.IntegrationConfig{TitlePrefix: "[STAGING] ", TitleSuffix: " ({{ toUpper .Level }})"},
+			wantQueryText:    "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:     model.Duration(300 * time.Second),
+			wantTitle:        "[STAGING] Okta MFA Reset (HIGH)",
+		},
+		{
+			name:             "title prefix truncates long titles",
+			queries:          []string{"{job=`.+`} | json | test=`true`"},
+			titles:           strings.Repeat("a", 190),
+			rule:             &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig:       model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", RuleGroup: "Every 5 Minutes", TimeWindow: "5m"},
+			integratorConfig: model.IntegrationConfig{TitlePrefix: "[STAGING] ", TitleSuffix: " - {{ .Config.Name }}"},
+			wantQueryText:    "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:     model.Duration(300 * time.Second),
+			wantTitle:        "[STAGING] " + strings.Repeat("a", 190-len("[STAGING] ")-len(" - conv")) + " - conv",
+		},
+		{
+			name:             "title prefix truncates long titles without splitting characters",
+			queries:          []string{"{job=`.+`} | json | test=`true`"},
+			titles:           strings.Repeat("é", 95),
+			rule:             &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig:       model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", RuleGroup: "Every 5 Minutes", TimeWindow: "5m"},
+			integratorConfig: model.IntegrationConfig{TitlePrefix: "[STAGING] ", TitleSuffix: " - conv"},
+			wantQueryText:    "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:     model.Duration(300 * time.Second),
+			wantTitle:        "[STAGING] " + strings.Repeat("é", 86) + " - conv",
+		},
+		{
+			name:             "title prefix and suffix leaving no room for the title",
+			queries:          []string{"{job=`.+`} | json | test=`true`"},
+			titles:           "Okta MFA Reset",
+			rule:             &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig:       model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", RuleGroup: "Every 5 Minutes", TimeWindow: "5m"},
+			integratorConfig: model.IntegrationConfig{TitlePrefix: strings.Repeat("p", 100), TitleSuffix: strings.Repeat("s", 90)},
+			wantError:        true,
+		},
+		{
+			name:             "invalid title prefix template",
+			queries:          []string{"{job=`.+`} | json | test=`true`"},
+			titles:           "Okta MFA Reset",
+			rule:             &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convConfig:       model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", RuleGroup: "Every 5 Minutes", TimeWindow: "5m"},
+			integratorConfig: model.IntegrationConfig{TitlePrefix: "{{ .Missing }"},
+			wantError:        true,
+		},
+		{
+			name:    "false positives annotation",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convObject: model.ConversionOutput{
+				Rules: []model.SigmaRule{{Title: "Rule 1", FalsePositives: []string{"Administrative activity", " Unknown "}}},
+			},
+			convConfig:       model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", RuleGroup: "Every 5 Minutes", TimeWindow: "5m"},
+			integratorConfig: model.IntegrationConfig{AnnotateFalsePositives: true},
+			wantQueryText:    "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:     model.Duration(300 * time.Second),
+			wantAnnotations: map[string]string{
+				"ConversionFile": "test_conversion_file.json",
+				"FalsePositives": "- Administrative activity\n- Unknown",
+				"LogSourceType":  "loki",
+				"LogSourceUid":   "my_data_source",
+				"Lookback":       "0s",
+				"Query":          "{job=`.+`} | json | test=`true`",
+				"TimeWindow":     "5m",
+			},
+		},
+		{
+			name:    "false positives annotation of several rules",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Rule 1 & Rule 2 & Rule 3",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a", Annotations: map[string]string{"FalsePositives": "- Stale"}},
+			convObject: model.ConversionOutput{
+				Rules: []model.SigmaRule{
+					{Title: "Rule 1", FalsePositives: []string{"Administrative activity"}},
+					{Title: "Rule 2"},
+					{Title: "Rule 3", FalsePositives: []string{"Backup jobs", "Monitoring"}},
+				},
+			},
+			convConfig:       model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", RuleGroup: "Every 5 Minutes", TimeWindow: "5m"},
+			integratorConfig: model.IntegrationConfig{AnnotateFalsePositives: true},
+			wantQueryText:    "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:     model.Duration(300 * time.Second),
+			wantAnnotations: map[string]string{
+				"ConversionFile": "test_conversion_file.json",
+				"FalsePositives": "Rule 1:\n- Administrative activity\n\nRule 3:\n- Backup jobs\n- Monitoring",
+				"LogSourceType":  "loki",
+				"LogSourceUid":   "my_data_source",
+				"Lookback":       "0s",
+				"Query":          "{job=`.+`} | json | test=`true`",
+				"TimeWindow":     "5m",
+			},
+		},
+		{
+			name:    "missing series evals to resolve",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Alert Rule 1",
+			rule: &model.ProvisionedAlertRule{
+				UID: "5c1c217a",
+			},
+			convConfig: model.ConversionConfig{
+				Name:                        "conv",
+				Target:                      "loki",
+				DataSource:                  "my_data_source",
+				RuleGroup:                   "Every 5 Minutes",
+				TimeWindow:                  "5m",
+				MissingSeriesEvalsToResolve: 3,
+			},
+			wantQueryText:          "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:           model.Duration(300 * time.Second),
+			wantError:              false,
+			wantMissingSeriesEvals: func() *int { v := 3; return &v }(),
+		},
+		{
+			name:    "changed missing series evals to resolve with unchanged queries",
+			queries: []string{`{job=".+"} | json | test="true"`},
+			titles:  "New Alert Rule Title",
+			convConfig: model.ConversionConfig{
+				DataSource:                  "nil",
+				RuleGroup:                   "Default",
+				MissingSeriesEvalsToResolve: 2,
+			},
+			rule: &model.ProvisionedAlertRule{
+				UID:   "5c1c217a",
+				Title: "Unchanged Alert Rule",
+				Data: []model.AlertQuery{
+					{
+						Model: json.RawMessage(`{"refId":"A0","datasource":{"type":"loki","uid":"nil"},"hide":false,"expr":"sum(count_over_time({job=\".+\"} | json | test=\"true\"[$__auto]))","queryType":"instant","editorMode":"code"}`),
+					},
+					{
+						Model: json.RawMessage(`{"refId":"B","hide":false,"type":"math","datasource":{"uid":"__expr__","type":"__expr__"},"expression":"${A0}"}`),
+					},
+					{
+						Model: json.RawMessage(`{"refId":"C","hide":false,"type":"threshold","datasource":{"uid":"__expr__","type":"__expr__"},"conditions":[{"type":"query","evaluator":{"params":[0],"type":"gt"},"operator":{"type":"and"},"query":{"params":["C"]},"reducer":{"params":[],"type":"last"}}],"expression":"B"}`),
+					},
+				},
+			},
+			wantQueryText:          `sum(count_over_time({job=\".+\"} | json | test=\"true\"[$__auto]))`,
+			wantDuration:           model.Duration(time.Minute),
+			wantError:              false,
+			wantMissingSeriesEvals: func() *int { v := 2; return &v }(),
+		},
+		{
+			name:    "Sigma rule IDs annotation",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Rule 1 & Rule 2",
+			rule: &model.ProvisionedAlertRule{
+				UID: "",
+			},
+			convObject: model.ConversionOutput{
+				Rules: []model.SigmaRule{
+					{Title: "Rule 1", ID: "996f8884-9144-40e7-ac63-29090ccde9a0"},
+					{Title: "Rule 2", ID: "dcb63bd5-2a1e-4ac7-9e61-aa5c2a4e1c3a"},
+				},
+			},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				DataSource: "my_data_source",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+			},
+			integratorConfig: model.IntegrationConfig{
+				AnnotateRuleIDs: true,
+			},
+			wantQueryText: "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:  model.Duration(300 * time.Second),
+			wantError:     false,
+			wantAnnotations: map[string]string{
+				"ConversionFile": "test_conversion_file.json",
+				"LogSourceType":  "loki",
+				"LogSourceUid":   "my_data_source",
+				"Lookback":       "0s",
+				"Query":          "{job=`.+`} | json | test=`true`",
+				"TimeWindow":     "5m",
+				"SigmaRuleIDs":   "996f8884-9144-40e7-ac63-29090ccde9a0,dcb63bd5-2a1e-4ac7-9e61-aa5c2a4e1c3a",
+			},
+		},
+		{
+			name:    "remapped annotation keys",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Remapped Rule",
+			rule: &model.ProvisionedAlertRule{
+				UID: "",
+				// Annotations written before the keys were remapped are replaced
+				Annotations: map[string]string{
+					"Query":          "{job=`.+`} | json | test=`false`",
+					"ConversionFile": "test_conversion_file.json",
+				},
+			},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				DataSource: "my_data_source",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+			},
+			integratorConfig: model.IntegrationConfig{
+				AnnotationKeyMap: map[string]string{
+					"Query":          "sigma_query",
+					"ConversionFile": "sigma_conversion_file",
+					"LogSourceUid":   "log_source_uid",
+				},
+			},
+			wantQueryText: "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:  model.Duration(300 * time.Second),
+			wantError:     false,
+			wantAnnotations: map[string]string{
+				"sigma_conversion_file": "test_conversion_file.json",
+				"LogSourceType":         "loki",
+				"log_source_uid":        "my_data_source",
+				"Lookback":              "0s",
+				"sigma_query":           "{job=`.+`} | json | test=`true`",
+				"TimeWindow":            "5m",
+			},
+		},
+		{
+			name:    "rule modified annotation",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Rule 1 & Rule 2",
+			rule: &model.ProvisionedAlertRule{
+				UID: "",
+			},
+			convObject: model.ConversionOutput{
+				Rules: []model.SigmaRule{
+					{Title: "Rule 1", ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Date: "2023/01/15", Modified: "2024/03/02"},
+					{Title: "Rule 2", ID: "dcb63bd5-2a1e-4ac7-9e61-aa5c2a4e1c3a", Date: "2024-05-20"},
+				},
+			},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				DataSource: "my_data_source",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+			},
+			integratorConfig: model.IntegrationConfig{
+				AnnotateRuleModified: true,
+			},
+			wantQueryText: "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:  model.Duration(300 * time.Second),
+			wantError:     false,
+			wantAnnotations: map[string]string{
+				"ConversionFile": "test_conversion_file.json",
+				"LogSourceType":  "loki",
+				"LogSourceUid":   "my_data_source",
+				"Lookback":       "0s",
+				"Query":          "{job=`.+`} | json | test=`true`",
+				"TimeWindow":     "5m",
+				"RuleModified":   "2024-05-20",
+			},
+		},
+		{
+			name:    "rule modified in the configured timezone",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Rule 1 & Rule 2",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convObject: model.ConversionOutput{
+				Rules: []model.SigmaRule{
+					{Title: "Rule 1", ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Date: "2023/01/15", Modified: "2024-03-02T20:00:00Z"},
+					{Title: "Rule 2", ID: "dcb63bd5-2a1e-4ac7-9e61-aa5c2a4e1c3a", Date: "2024-03-02"},
+				},
+			},
+			convConfig:       model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", RuleGroup: "Every 5 Minutes", TimeWindow: "5m"},
+			integratorConfig: model.IntegrationConfig{AnnotateRuleModified: true, Timezone: "Asia/Tokyo"},
+			wantQueryText:    "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:     model.Duration(300 * time.Second),
+			wantAnnotations: map[string]string{
+				"ConversionFile": "test_conversion_file.json",
+				"LogSourceType":  "loki",
+				"LogSourceUid":   "my_data_source",
+				"Lookback":       "0s",
+				"Query":          "{job=`.+`} | json | test=`true`",
+				"TimeWindow":     "5m",
+				"RuleModified":   "2024-03-03",
+			},
+		},
+		{
+			name:    "rule modified date is kept in a timezone behind UTC",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Rule 1",
+			rule:    &model.ProvisionedAlertRule{UID: "5c1c217a"},
+			convObject: model.ConversionOutput{
+				Rules: []model.SigmaRule{{Title: "Rule 1", ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Modified: "2024-03-02"}},
+			},
+			convConfig:       model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", RuleGroup: "Every 5 Minutes", TimeWindow: "5m"},
+			integratorConfig: model.IntegrationConfig{AnnotateRuleModified: true, Timezone: "America/Los_Angeles"},
+			wantQueryText:    "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:     model.Duration(300 * time.Second),
+			wantAnnotations: map[string]string{
+				"ConversionFile": "test_conversion_file.json",
+				"LogSourceType":  "loki",
+				"LogSourceUid":   "my_data_source",
+				"Lookback":       "0s",
+				"Query":          "{job=`.+`} | json | test=`true`",
+				"TimeWindow":     "5m",
+				"RuleModified":   "2024-03-02",
+			},
+		},
+		{
+			name:    "oversized metadata is truncated to the budget",
+			queries: []string{"{job=`.+`} | json | test=`" + strings.Repeat("x", 500) + "`"},
+			titles:  "Budget Rule",
+			rule: &model.ProvisionedAlertRule{
+				UID: "",
+			},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				DataSource: "my_data_source",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+			},
+			integratorConfig: model.IntegrationConfig{
+				MaxMetadataBytes: 200,
+			},
+			wantQueryText: "sum(count_over_time({job=`.+`} | json | test=`xxxx",
+			wantDuration:  model.Duration(300 * time.Second),
+			wantError:     false,
+			wantAnnotations: map[string]string{
+				"ConversionFile": "test_conversion_file.json",
+				"LogSourceType":  "loki",
+				"LogSourceUid":   "my_data_source",
+				"Lookback":       "0s",
+				"Query":          "{job=`.+`} | json | test=`" + strings.Repeat("x", 62) + "...",
+				"TimeWindow":     "5m",
+			},
+		},
+		{
+			name:    "OnCall routing labels",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "OnCall Rule",
+			rule: &model.ProvisionedAlertRule{
+				UID: "",
+			},
+			convObject: model.ConversionOutput{
+				Rules: []model.SigmaRule{{Title: "OnCall Rule", Level: "high"}},
+			},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				DataSource: "my_data_source",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+				OnCall: model.OnCallConfig{
+					Route:           "security",
+					EscalationChain: "secops-critical",
+					Team:            "SecOps",
+				},
+			},
+			integratorConfig: model.IntegrationConfig{
+				TemplateLabels: map[string]string{
+					"Level": "{{.Level}}",
+				},
+			},
+			wantQueryText: "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:  model.Duration(300 * time.Second),
+			wantError:     false,
+			wantLabels: map[string]string{
+				"Level":                           "high",
+				"grafana_oncall_route":            "security",
+				"grafana_oncall_escalation_chain": "secops-critical",
+				"grafana_oncall_team":             "SecOps",
+			},
+		},
+		{
+			name:    "OnCall label conflicting with a template label",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "OnCall Rule",
+			rule: &model.ProvisionedAlertRule{
+				UID: "",
+			},
+			convObject: model.ConversionOutput{
+				Rules: []model.SigmaRule{{Title: "OnCall Rule"}},
+			},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				DataSource: "my_data_source",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+				OnCall:     model.OnCallConfig{Route: "security"},
+			},
+			integratorConfig: model.IntegrationConfig{
+				TemplateLabels: map[string]string{
+					"grafana_oncall_route": "{{.Title}}",
+				},
+			},
+			wantError: true,
+		},
+		{
+			name:    "invalid multi-line OnCall label",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "OnCall Rule",
+			rule: &model.ProvisionedAlertRule{
+				UID: "",
+			},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				DataSource: "my_data_source",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+				OnCall:     model.OnCallConfig{Team: "Sec\nOps"},
+			},
+			wantError: true,
+		},
+		{
+			name:    "labels and annotations not allowed are removed",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Allowlisted Rule",
+			rule: &model.ProvisionedAlertRule{
+				UID:         "5c1c217a",
+				Labels:      map[string]string{"legacy": "value"},
+				Annotations: map[string]string{"legacy": "value"},
+			},
+			convConfig: model.ConversionConfig{
+				Name:       "conv",
+				Target:     "loki",
+				DataSource: "my_data_source",
+				RuleGroup:  "Every 5 Minutes",
+				TimeWindow: "5m",
+			},
+			integratorConfig: model.IntegrationConfig{
+				TemplateLabels:        map[string]string{"team": "secops", "scratch": "value"},
+				TemplateAnnotations:   map[string]string{"runbook": "https://runbooks.example.com", "scratch": "value"},
+				AllowedLabelKeys:      []string{"team"},
+				AllowedAnnotationKeys: []string{"Query", "runbook"},
+			},
+			wantQueryText: "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:  model.Duration(300 * time.Second),
+			wantLabels:    map[string]string{"team": "secops"},
+			wantAnnotations: map[string]string{
+				"Query":          "{job=`.+`} | json | test=`true`",
+				"ConversionFile": "test_conversion_file.json",
+				"runbook":        "https://runbooks.example.com",
+			},
+		},
+		{
+			name:       "keys not allowed are removed from a rule with unchanged queries",
+			queries:    []string{`{job=".+"} | json | test="true"`},
+			titles:     "Unchanged Alert Rule",
+			convConfig: model.ConversionConfig{DataSource: MissingDataSource, RuleGroup: "Default"},
+			rule: &model.ProvisionedAlertRule{
+				UID:         "5c1c217a",
+				Title:       "Unchanged Alert Rule",
+				Condition:   "C",
+				NoDataState: model.OK,
+				Labels:      map[string]string{"legacy": "value"},
+				Annotations: map[string]string{"legacy": "value"},
+				Data: []model.AlertQuery{
+					{
+						Model: json.RawMessage(`{"refId":"A0","datasource":{"type":"loki","uid":"nil"},"hide":false,"expr":"sum(count_over_time({job=\".+\"} | json | test=\"true\"[$__auto]))","queryType":"instant","editorMode":"code","intervalMs":1000,"maxDataPoints":43200}`),
+					},
+					{
+						Model: json.RawMessage(`{"refId":"B","hide":false,"type":"math","datasource":{"uid":"__expr__","type":"__expr__"},"expression":"${A0}"}`),
+					},
+					{
+						Model: json.RawMessage(`{"refId":"C","hide":false,"type":"threshold","datasource":{"uid":"__expr__","type":"__expr__"},"conditions":[{"type":"query","evaluator":{"params":[0],"type":"gt"},"operator":{"type":"and"},"query":{"params":["C"]},"reducer":{"params":[],"type":"last"}}],"expression":"B"}`),
+					},
+				},
+			},
+			integratorConfig: model.IntegrationConfig{
+				AllowedLabelKeys:      []string{"team"},
+				AllowedAnnotationKeys: []string{"Query"},
+			},
+			wantQueryText: `sum(count_over_time({job=\".+\"} | json | test=\"true\"[$__auto]))`,
+			wantDuration:  model.Duration(60 * time.Second),
+			wantLabels:    map[string]string{},
+			wantAnnotations: map[string]string{
+				"Query":          `{job=".+"} | json | test="true"`,
+				"ConversionFile": "test_conversion_file.json",
+			},
+		},
+		{
+			name:    "explicit zero pending period is written",
+			queries: []string{"{job=`.+`} | json | test=`true`"},
+			titles:  "Instant Rule",
+			rule: &model.ProvisionedAlertRule{
+				UID: "5c1c217a",
+			},
+			convConfig: model.ConversionConfig{
+				Name:          "conv",
+				Target:        "loki",
+				DataSource:    "my_data_source",
+				RuleGroup:     "Every 5 Minutes",
+				TimeWindow:    "5m",
+				PendingPeriod: "0s",
+			},
+			integratorConfig: model.IntegrationConfig{
+				AutoPendingPeriod: true,
+			},
+			wantQueryText: "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
+			wantDuration:  model.Duration(300 * time.Second),
+			wantFor:       "0s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := NewIntegrator()
+			i.config.IntegratorConfig = tt.integratorConfig
+			err := i.ConvertToAlert(tt.rule, tt.queries, tt.titles, tt.convConfig, "test_conversion_file.json", tt.convObject)
+			if tt.wantError {
+				assert.NotNil(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Contains(t, string(tt.rule.Data[0].Model), tt.wantQueryText)
+				assert.Equal(t, tt.wantDuration, tt.rule.Data[0].RelativeTimeRange.From)
+				assert.Equal(t, tt.convConfig.RuleGroup, tt.rule.RuleGroup)
+				assert.Equal(t, tt.convConfig.DataSource, tt.rule.Data[0].DatasourceUID)
+				assert.Equal(t, cmp.Or(tt.wantTitle, tt.titles), tt.rule.Title)
+
+				if tt.wantCombinerExpression != "" {
+					combinerModel := string(tt.rule.Data[2].Model)
+					assert.Contains(t, combinerModel, tt.wantCombinerExpression)
+				}
+				for _, query := range tt.rule.Data {
+					hidden := slices.Contains(tt.convConfig.HiddenRefIDs, query.RefID)
+					assert.Equal(t, hidden, strings.Contains(string(query.Model), `"hide":true`), query.RefID)
+				}
+
+				if tt.convConfig.Lookback != "" {
+					lookbackDuration, err := time.ParseDuration(tt.convConfig.Lookback)
+					assert.NoError(t, err)
+					expectedTo := model.Duration(lookbackDuration)
+					assert.Equal(t, tt.wantDuration, tt.rule.Data[0].RelativeTimeRange.From, "From should match expected duration (time window + lookback)")
+					assert.Equal(t, expectedTo, tt.rule.Data[0].RelativeTimeRange.To, "To should be lookback duration")
+				} else {
+					assert.Equal(t, model.Duration(0), tt.rule.Data[0].RelativeTimeRange.To, "To should be 0 when no lookback")
+				}
+				if tt.wantLabels != nil {
+					assert.Equal(t, tt.wantLabels, tt.rule.Labels)
+				}
+				if tt.wantAnnotations != nil {
+					assert.Equal(t, tt.wantAnnotations, tt.rule.Annotations)
+				}
+				if tt.wantNoDataState != "" {
+					assert.Equal(t, tt.wantNoDataState, tt.rule.NoDataState)
+				}
+				assert.Equal(t, tt.wantMissingSeriesEvals, tt.rule.MissingSeriesEvalsToResolve)
+				assert.Equal(t, shared.GetConfigValue(tt.wantCondition, "", "C"), tt.rule.Condition)
+				ruleJSON, err := json.Marshal(tt.rule)
+				assert.NoError(t, err)
+				if tt.wantMissingSeriesEvals != nil {
+					assert.Contains(t, string(ruleJSON), fmt.Sprintf(`"missingSeriesEvalsToResolve":%d`, *tt.wantMissingSeriesEvals))
+				} else {
+					assert.NotContains(t, string(ruleJSON), "missingSeriesEvalsToResolve")
+				}
+				if tt.wantFor != "" {
+					assert.Contains(t, string(ruleJSON), fmt.Sprintf(`"for":"%s"`, tt.wantFor))
+				}
+			}
+		})
+	}
+}
+
+func TestConvertToAlertExpressionChain(t *testing.T) {
+	tests := []struct {
+		name          string
+		queryType     string
+		wantRefIDs    []string
+		wantReducers  map[string]string
+		wantCombiner  string
+		wantQueryType string
+	}{
+		{
+			name:          "instant queries are combined as is",
+			queryType:     "instant",
+			wantRefIDs:    []string{"A0", "A1", "B", "C"},
+			wantCombiner:  "${A0}+${A1}",
+			wantQueryType: "instant",
+		},
+		{
+			name:          "range queries are reduced before being combined",
+			queryType:     "range",
+			wantRefIDs:    []string{"A0", "A1", "R0", "R1", "B", "C"},
+			wantReducers:  map[string]string{"R0": "A0", "R1": "A1"},
+			wantCombiner:  "${R0}+${R1}",
+			wantQueryType: "range",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := NewIntegrator()
+			convConfig := model.ConversionConfig{
+				Name:          "conv",
+				Target:        "loki",
+				DataSource:    "my_data_source",
+				RuleGroup:     "Every 5 Minutes",
+				TimeWindow:    "5m",
+				LokiQueryType: tt.queryType,
+			}
+			rule := &model.ProvisionedAlertRule{UID: "5c1c217a"}
+			queries := []string{`{job="a"} | json`, `{job="b"} | json`}
+			require.NoError(t, i.ConvertToAlert(rule, queries, "Alert Rule 1", convConfig, "test_conversion_file.json", model.ConversionOutput{}))
+
+			type expressionModel struct {
+				Type       string `json:"type"`
+				Expression string `json:"expression"`
+				Reducer    string `json:"reducer"`
+				Settings   struct {
+					Mode string `json:"mode"`
+				} `json:"settings"`
+			}
+			refIDs := make([]string, len(rule.Data))
+			models := map[string]expressionModel{}
+			for index, query := range rule.Data {
+				refIDs[index] = query.RefID
+				var expression expressionModel
+				require.NoError(t, json.Unmarshal(query.Model, &expression))
+				models[query.RefID] = expression
+			}
+			assert.Equal(t, tt.wantRefIDs, refIDs)
+
+			// Each query keeps its query type, and each reducer reduces its query to its maximum
+			for _, query := range rule.Data[:len(queries)] {
+				assert.Equal(t, tt.wantQueryType, query.QueryType)
+			}
+			for refID, reduced := range tt.wantReducers {
+				assert.Equal(t, expressionModel{Type: "reduce", Expression: reduced, Reducer: "max", Settings: struct {
+					Mode string `json:"mode"`
+				}{Mode: "dropNN"}}, models[refID])
+			}
+
+			// The combiner sums the reduced values, which the threshold the alert rule fires on is applied to
+			assert.Equal(t, "math", models["B"].Type)
+			assert.Equal(t, tt.wantCombiner, models["B"].Expression)
+			assert.Equal(t, "threshold", models["C"].Type)
+			assert.Equal(t, "B", models["C"].Expression)
+			assert.Equal(t, "C", rule.Condition)
+		})
+	}
+}
+
+func TestConvertToAlertFingerprintLabel(t *testing.T) {
+	convConfig := model.ConversionConfig{
+		Name:       "conv",
+		Target:     "loki",
+		DataSource: "my_data_source",
+		TimeWindow: "5m",
+	}
+	convObject := model.ConversionOutput{
+		ConversionName: "conv",
+		Rules: []model.SigmaRule{
+			{Title: "Rule 1", ID: "996f8884-9144-40e7-ac63-29090ccde9a0"},
+			{Title: "Rule 2", ID: "dcb63bd5-2a1e-4ac7-9e61-aa5c2a4e1c3a"},
+		},
+	}
+
+	i := NewIntegrator()
+	i.config.IntegratorConfig.FingerprintLabel = true
+
+	rule := &model.ProvisionedAlertRule{}
+	assert.NoError(t, i.ConvertToAlert(rule, []string{"{job=`a`} | json"}, "Rule 1 & Rule 2", convConfig, "test_conversion_file.json", convObject))
+	fingerprint := rule.Labels[FingerprintLabel]
+	assert.Len(t, fingerprint, 16)
+
+	// Editing the query keeps the fingerprint
+	assert.NoError(t, i.ConvertToAlert(rule, []string{"{job=`b`} | logfmt"}, "Rule 1 & Rule 2", convConfig, "test_conversion_file.json", convObject))
+	assert.Contains(t, string(rule.Data[0].Model), "logfmt")
+	assert.Equal(t, fingerprint, rule.Labels[FingerprintLabel])
+
+	// A different set of Sigma rules changes it
+	other := &model.ProvisionedAlertRule{}
+	convObject.Rules = convObject.Rules[:1]
+	assert.NoError(t, i.ConvertToAlert(other, []string{"{job=`a`} | json"}, "Rule 1", convConfig, "test_conversion_file.json", convObject))
+	assert.NotEqual(t, fingerprint, other.Labels[FingerprintLabel])
+
+	// The label can't also be templated
+	i.config.IntegratorConfig.TemplateLabels = map[string]string{FingerprintLabel: "{{.ID}}"}
+	assert.Error(t, i.ConvertToAlert(&model.ProvisionedAlertRule{}, []string{"{job=`a`} | json"}, "Rule 1", convConfig, "test_conversion_file.json", convObject))
+}
+
+func TestConvertToAlertPathLabels(t *testing.T) {
+	convConfig := model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", TimeWindow: "5m"}
+	convObject := model.ConversionOutput{ConversionName: "conv"}
+	queries := []string{"{job=`a`} | json"}
+
+	i := NewIntegrator()
+	i.config.Folders.ConversionPath = "conversions"
+	i.config.IntegratorConfig.PathLabelPattern = `^(?P<team>[^/]+)/((?P<product>[^/]+)/)?`
+
+	// Labels are derived from the path relative to the conversion folder
+	rule := &model.ProvisionedAlertRule{}
+	require.NoError(t, i.ConvertToAlert(rule, queries, "Rule 1", convConfig, "conversions/okta/login.json", convObject))
+	assert.Equal(t, "okta", rule.Labels["team"])
+	assert.NotContains(t, rule.Labels, "product")
+
+	rule = &model.ProvisionedAlertRule{}
+	require.NoError(t, i.ConvertToAlert(rule, queries, "Rule 1", convConfig, "conversions/identity/okta/login.json", convObject))
+	assert.Equal(t, "identity", rule.Labels["team"])
+	assert.Equal(t, "okta", rule.Labels["product"])
+
+	// Conversion files directly in the conversion folder don't match
+	rule = &model.ProvisionedAlertRule{}
+	require.NoError(t, i.ConvertToAlert(rule, queries, "Rule 1", convConfig, "conversions/conv_login.json", convObject))
+	assert.NotContains(t, rule.Labels, "team")
+
+	// Templated labels take precedence
+	i.config.IntegratorConfig.TemplateLabels = map[string]string{"team": "security"}
+	rule = &model.ProvisionedAlertRule{}
+	require.NoError(t, i.ConvertToAlert(rule, queries, "Rule 1", convConfig, "conversions/okta/login.json", convObject))
+	assert.Equal(t, "security", rule.Labels["team"])
+
+	// Patterns without a named group are rejected
+	i.config.IntegratorConfig.PathLabelPattern = `^([^/]+)/`
+	assert.ErrorContains(t, i.ConvertToAlert(&model.ProvisionedAlertRule{}, queries, "Rule 1", convConfig, "conversions/okta/login.json", convObject), "no named group")
+}
+
+func TestConvertToAlertSourceLink(t *testing.T) {
+	convConfig := model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", TimeWindow: "5m"}
+	convObject := model.ConversionOutput{ConversionName: "conv", InputFile: "rules/okta/mfa reset.yml"}
+	queries := []string{"{job=`a`} | json"}
+
+	i := NewIntegrator()
+	i.config.IntegratorConfig.AnnotateSourceLink = true
+
+	// Outside of GitHub Actions, no link is added
+	t.Setenv("GITHUB_SERVER_URL", "")
+	t.Setenv("GITHUB_REPOSITORY", "")
+	t.Setenv("GITHUB_SHA", "")
+	rule := &model.ProvisionedAlertRule{}
+	require.NoError(t, i.ConvertToAlert(rule, queries, "Rule 1", convConfig, "conversions/conv_mfa_reset.json", convObject))
+	assert.NotContains(t, rule.Annotations, SourceLinkAnnotation)
+
+	t.Setenv("GITHUB_REPOSITORY", "grafana/detections")
+	t.Setenv("GITHUB_SHA", "8f14e45fceea167a5a36dedd4bea2543")
+	rule = &model.ProvisionedAlertRule{}
+	require.NoError(t, i.ConvertToAlert(rule, queries, "Rule 1", convConfig, "conversions/conv_mfa_reset.json", convObject))
+	assert.Equal(t, "https://github.com/grafana/detections/blob/8f14e45fceea167a5a36dedd4bea2543/rules/okta/mfa%20reset.yml", rule.Annotations[SourceLinkAnnotation])
+
+	// Conversion files without an input file link to the conversion file, on the configured server
+	t.Setenv("GITHUB_SERVER_URL", "https://github.example.com/")
+	rule = &model.ProvisionedAlertRule{}
+	require.NoError(t, i.ConvertToAlert(rule, queries, "Rule 1", convConfig, "conversions/conv_mfa_reset.json", model.ConversionOutput{ConversionName: "conv"}))
+	assert.Equal(t, "https://github.example.com/grafana/detections/blob/8f14e45fceea167a5a36dedd4bea2543/conversions/conv_mfa_reset.json", rule.Annotations[SourceLinkAnnotation])
+}
+
+func TestConvertToAlertExploreLink(t *testing.T) {
+	convConfig := model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", TimeWindow: "5m", Lookback: "1m"}
+	convObject := model.ConversionOutput{ConversionName: "conv"}
+	queries := []string{"{job=`a`} | json", "{job=`b`} | json"}
+
+	i := NewIntegrator()
+	i.config.IntegratorConfig.AnnotateExploreLink = true
+	i.config.IntegratorConfig.OrgID = 3
+	i.config.DeployerConfig.GrafanaInstance = "https://test.grafana.com"
+
+	// The link opens the first query over the query time range, relative to when it's opened
+	rule := &model.ProvisionedAlertRule{}
+	require.NoError(t, i.ConvertToAlert(rule, queries, "Rule 1", convConfig, "conversions/conv_a.json", convObject))
+	link, err := url.Parse(rule.Annotations[ExploreLinkAnnotation])
+	require.NoError(t, err)
+	assert.Equal(t, "test.grafana.com", link.Host)
+	assert.Equal(t, "/explore", link.Path)
+	assert.Equal(t, "3", link.Query().Get("orgId"))
+	var panes map[string]struct {
+		Datasource string `json:"datasource"`
+		Queries    []struct {
+			Expr string `json:"expr"`
+		} `json:"queries"`
+		Range struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+		} `json:"range"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(link.Query().Get("panes")), &panes))
+	require.Len(t, panes["yyz"].Queries, 1)
+	assert.Equal(t, "my_data_source", panes["yyz"].Datasource)
+	assert.Equal(t, queries[0], panes["yyz"].Queries[0].Expr)
+	assert.Equal(t, "now-360s", panes["yyz"].Range.From)
+	assert.Equal(t, "now-60s", panes["yyz"].Range.To)
+
+	// Placeholders have no query to link to
+	rule = &model.ProvisionedAlertRule{Annotations: map[string]string{ExploreLinkAnnotation: "https://test.grafana.com/explore"}}
+	require.NoError(t, i.ConvertToAlert(rule, nil, "Rule 1", convConfig, "conversions/conv_a.json", convObject))
+	assert.NotContains(t, rule.Annotations, ExploreLinkAnnotation)
+}
+
+func TestReadRuleFromFileInvalidJSON(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.WriteFile("hand_edited.json", []byte("{\n  \"uid\": \"5c1c217a\",\n  \"title\": \"Alert Rule 1\", // renamed\n  \"ruleGroup\": \"Default\"\n}"), 0o600))
+	require.NoError(t, os.WriteFile("trailing_comma.json", []byte(`{"uid":"5c1c217a","title":"Alert Rule 1",}`), 0o600))
+
+	err := readRuleFromFile(&model.ProvisionedAlertRule{}, "hand_edited.json")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "hand_edited.json")
+	assert.Contains(t, err.Error(), "line 3, column 28")
+	assert.Contains(t, err.Error(), "renamed")
+
+	err = readRuleFromFile(&model.ProvisionedAlertRule{}, "trailing_comma.json")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "trailing_comma.json")
+	assert.Contains(t, err.Error(), "line 1, column 42 (byte offset 41)")
+
+	// A missing file is not an error, the rule is generated from scratch
+	assert.NoError(t, readRuleFromFile(&model.ProvisionedAlertRule{}, "missing.json"))
+}
+
+func TestConvertToAlertMissingDataSource(t *testing.T) {
+	convConfig := model.ConversionConfig{Name: "conv", Target: "loki", TimeWindow: "5m"}
+	queries := []string{"{job=`a`} | json"}
+
+	i := NewIntegrator()
+	err := i.ConvertToAlert(&model.ProvisionedAlertRule{}, queries, "Rule 1", convConfig, "test_conversion_file.json", model.ConversionOutput{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "conversion conv has no data source")
+
+	// Queries with their own data source don't need the conversion's
+	withOverride := convConfig
+	withOverride.QueryDataSources = []model.QueryDataSource{{DataSource: "query_ds"}}
+	rule := &model.ProvisionedAlertRule{}
+	require.NoError(t, i.ConvertToAlert(rule, queries, "Rule 1", withOverride, "test_conversion_file.json", model.ConversionOutput{}))
+	assert.Equal(t, "query_ds", rule.Data[0].DatasourceUID)
+
+	i.config.IntegratorConfig.AllowMissingDataSource = true
+	rule = &model.ProvisionedAlertRule{}
+	require.NoError(t, i.ConvertToAlert(rule, queries, "Rule 1", convConfig, "test_conversion_file.json", model.ConversionOutput{}))
+	assert.Equal(t, MissingDataSource, rule.Data[0].DatasourceUID)
+	assert.Len(t, i.warnings.List(), 1)
+}
+
+func TestConvertToAlertAllowedDatasources(t *testing.T) {
+	convConfig := model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "loki-ds", TimeWindow: "5m"}
+	queries := []string{"{job=`a`} | json", "{job=`b`} | json"}
+
+	i := NewIntegrator()
+	i.config.IntegratorConfig.AllowedDatasources = []string{"loki-ds", "prometheus-ds"}
+	rule := &model.ProvisionedAlertRule{}
+	require.NoError(t, i.ConvertToAlert(rule, queries, "Rule 1", convConfig, "test_conversion_file.json", model.ConversionOutput{}))
+	assert.Equal(t, "loki-ds", rule.Data[0].DatasourceUID)
+
+	// A per-query data source must be allowed too
+	withOverride := convConfig
+	withOverride.QueryDataSources = []model.QueryDataSource{{}, {DataSource: "billing-ds"}}
+	err := i.ConvertToAlert(&model.ProvisionedAlertRule{}, queries, "Rule 1", withOverride, "test_conversion_file.json", model.ConversionOutput{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "data source billing-ds of conversion conv is not in allowed_datasources")
+
+	disallowed := convConfig
+	disallowed.DataSource = "billing-ds"
+	err = i.ConvertToAlert(&model.ProvisionedAlertRule{}, queries, "Rule 1", disallowed, "test_conversion_file.json", model.ConversionOutput{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "data source billing-ds of conversion conv is not in allowed_datasources")
+
+	// Recording rules may only record to an allowed data source
+	err = i.ConvertToRecordingRule(&model.ProvisionedAlertRule{}, queries, "Rule 1", "metric", "mimir-ds", convConfig, "test_conversion_file.json", model.ConversionOutput{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "data source mimir-ds of conversion conv is not in allowed_datasources")
+}
+
+func TestConvertToAlertAllowedDatasourcesLookup(t *testing.T) {
+	httpmock.Activate(t)
+	t.Setenv("INTEGRATOR_GRAFANA_SA_TOKEN", "test-token")
+	httpmock.RegisterResponder("GET", "http://grafana:3000/api/datasources/uid/loki-uid",
+		httpmock.NewStringResponder(200, `{"id":1,"uid":"loki-uid","name":"Loki","type":"loki"}`))
+	httpmock.RegisterResponder("GET", "http://grafana:3000/api/datasources/uid/Loki",
+		httpmock.NewStringResponder(404, `{"message":"Data source not found"}`))
+	httpmock.RegisterResponder("GET", "http://grafana:3000/api/datasources/name/Loki",
+		httpmock.NewStringResponder(200, `{"id":1,"uid":"loki-uid","name":"Loki","type":"loki"}`))
+	httpmock.RegisterResponder("GET", "http://grafana:3000/api/datasources/uid/billing-uid",
+		httpmock.NewStringResponder(200, `{"id":2,"uid":"billing-uid","name":"Billing","type":"loki"}`))
+	queries := []string{"{job=`a`} | json"}
+
+	tests := []struct {
+		name       string
+		datasource string
+		allowed    []string
+		wantError  bool
+	}{
+		{name: "UID allowed by name", datasource: "loki-uid", allowed: []string{"Loki"}},
+		{name: "name allowed by UID", datasource: "Loki", allowed: []string{"loki-uid"}},
+		{name: "other data source", datasource: "billing-uid", allowed: []string{"Loki"}, wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := NewIntegrator()
+			i.config.DeployerConfig.GrafanaInstance = "http://grafana:3000"
+			i.config.IntegratorConfig.AllowedDatasources = tt.allowed
+			convConfig := model.ConversionConfig{Name: "conv", Target: "loki", DataSource: tt.datasource, TimeWindow: "5m"}
+			err := i.ConvertToAlert(&model.ProvisionedAlertRule{}, queries, "Rule 1", convConfig, "test_conversion_file.json", model.ConversionOutput{})
+			if tt.wantError {
+				assert.ErrorContains(t, err, "data source billing-uid of conversion conv is not in allowed_datasources")
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConvertToAlertPendingPeriod(t *testing.T) {
+	tests := []struct {
+		name              string
+		timeWindow        string
+		pendingPeriod     string
+		defaultPending    string
+		autoPendingPeriod bool
+		multiplier        int
+		wantFor           time.Duration
+		wantError         bool
+	}{
+		{
+			name:       "no pending period by default",
+			timeWindow: "5m",
+			wantFor:    0,
+		},
+		{
+			name:              "derived from the evaluation interval",
+			timeWindow:        "5m",
+			autoPendingPeriod: true,
+			wantFor:           5 * time.Minute,
 		},
 		{
-			name:    "valid query with lookback",
-			queries: []string{"{job=`.+`} | json | test=`true`"},
-			titles:  "Alert Rule with Lookback",
-			rule: &model.ProvisionedAlertRule{
-				UID: "5c1c217a",
-			},
-			convConfig: model.ConversionConfig{
-				Name:       "conv",
-				Target:     "loki",
-				DataSource: "my_data_source",
-				RuleGroup:  "Every 5 Minutes",
-				TimeWindow: "5m",
-				Lookback:   "2m",
-			},
-			wantQueryText: "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
-			wantDuration:  model.Duration(7 * time.Minute), // 5m + 2m lookback = 7m
-			wantError:     false,
+			name:              "derived from the evaluation interval times the multiplier",
+			timeWindow:        "10m",
+			autoPendingPeriod: true,
+			multiplier:        3,
+			wantFor:           30 * time.Minute,
 		},
 		{
-			name:    "template annotations and labels",
-			queries: []string{"{job=`.+`} | json | test=`true`"},
-			titles:  "Template Rule",
-			rule: &model.ProvisionedAlertRule{
-				UID: "",
-			},
-			convObject: model.ConversionOutput{
-				Rules: []model.SigmaRule{
-					{
-						Title:     "A non-title case title",
-						Level:     "high",
-						Logsource: model.SigmaLogsource{Product: "okta", Service: "okta"},
-						Author:    "John Doe",
-					},
-				},
-			},
-			convConfig: model.ConversionConfig{
-				Name:       "conv",
-				Target:     "loki",
-				DataSource: "my_data_source",
-				RuleGroup:  "Every 5 Minutes",
-				TimeWindow: "5m",
-			},
-			integratorConfig: model.IntegrationConfig{
-				TemplateLabels: map[string]string{
-					"Level":   "{{.Level}}",
-					"Product": "{{.Logsource.Product}}",
-					"Service": "{{.Logsource.Service}}",
-				},
-				TemplateAnnotations: map[string]string{
-					"Author":      "{{.Author}}",
-					"summary":     "{{title .Title }}",
-					"runbook_url": "https://my.runbook.url/{{ replaceAll .Title ` ` `_` }}",
-				},
-			},
-			wantQueryText: "sum(count_over_time({job=`.+`} | json | test=`true`[$__auto]))",
-			wantDuration:  model.Duration(300 * time.Second),
-			wantError:     false,
-			wantLabels: map[string]string{
-				"Level":   "high",
-				"Product": "okta",
-				"Service": "okta",
-			},
-			wantAnnotations: map[string]string{
-				"Author":         "John Doe",
-				"ConversionFile": "test_conversion_file.json",
-				"LogSourceType":  "loki",
-				"LogSourceUid":   "my_data_source",
-				"Lookback":       "0s",
-				"Query":          "{job=`.+`} | json | test=`true`",
-				"TimeWindow":     "5m",
-				"summary":        "A Non-Title Case Title",
-				"runbook_url":    "https://my.runbook.url/A_non-title_case_title",
-			},
+			name:              "explicit pending period takes precedence",
+			timeWindow:        "5m",
+			pendingPeriod:     "2m",
+			autoPendingPeriod: true,
+			multiplier:        3,
+			wantFor:           2 * time.Minute,
+		},
+		{
+			name:              "explicit zero pending period takes precedence",
+			timeWindow:        "5m",
+			pendingPeriod:     "0s",
+			autoPendingPeriod: true,
+			wantFor:           0,
+		},
+		{
+			name:              "pending period from the conversion defaults",
+			timeWindow:        "5m",
+			defaultPending:    "15m",
+			autoPendingPeriod: true,
+			wantFor:           15 * time.Minute,
+		},
+		{
+			name:          "invalid pending period",
+			timeWindow:    "5m",
+			pendingPeriod: "soon",
+			wantError:     true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			i := NewIntegrator()
-			i.config.IntegratorConfig = tt.integratorConfig
-			err := i.ConvertToAlert(tt.rule, tt.queries, tt.titles, tt.convConfig, "test_conversion_file.json", tt.convObject)
-			if tt.wantError {
-				assert.NotNil(t, err)
-			} else {
-				assert.NoError(t, err)
-				if tt.wantUnchanged {
-					// The rule should not be changed as the generated alert rule was identical
-					assert.NotEqual(t, tt.titles, tt.rule.Title)
-				} else {
-					assert.Contains(t, string(tt.rule.Data[0].Model), tt.wantQueryText)
-					assert.Equal(t, tt.wantDuration, tt.rule.Data[0].RelativeTimeRange.From)
-					assert.Equal(t, tt.convConfig.RuleGroup, tt.rule.RuleGroup)
-					assert.Equal(t, tt.convConfig.DataSource, tt.rule.Data[0].DatasourceUID)
-					assert.Equal(t, tt.titles, tt.rule.Title)
-
-					if tt.wantCombinerExpression != "" {
-						combinerModel := string(tt.rule.Data[2].Model)
-						assert.Contains(t, combinerModel, tt.wantCombinerExpression)
-					}
+			i.config.ConversionDefaults.PendingPeriod = tt.defaultPending
+			i.config.IntegratorConfig.AutoPendingPeriod = tt.autoPendingPeriod
+			i.config.IntegratorConfig.PendingPeriodMultiplier = tt.multiplier
+			convConfig := model.ConversionConfig{
+				Name:          "conv",
+				Target:        "loki",
+				DataSource:    "my_data_source",
+				TimeWindow:    tt.timeWindow,
+				PendingPeriod: tt.pendingPeriod,
+			}
 
-					if tt.convConfig.Lookback != "" {
-						lookbackDuration, err := time.ParseDuration(tt.convConfig.Lookback)
-						assert.NoError(t, err)
-						expectedTo := model.Duration(lookbackDuration)
-						assert.Equal(t, tt.wantDuration, tt.rule.Data[0].RelativeTimeRange.From, "From should match expected duration (time window + lookback)")
-						assert.Equal(t, expectedTo, tt.rule.Data[0].RelativeTimeRange.To, "To should be lookback duration")
-					} else {
-						assert.Equal(t, model.Duration(0), tt.rule.Data[0].RelativeTimeRange.To, "To should be 0 when no lookback")
-					}
-					if tt.wantLabels != nil {
-						assert.Equal(t, tt.wantLabels, tt.rule.Labels)
-					}
-					if tt.wantAnnotations != nil {
-						assert.Equal(t, tt.wantAnnotations, tt.rule.Annotations)
-					}
-				}
+			rule := &model.ProvisionedAlertRule{}
+			err := i.ConvertToAlert(rule, []string{"{job=`a`} | json"}, "Rule 1", convConfig, "test_conversion_file.json", model.ConversionOutput{})
+			if tt.wantError {
+				assert.Error(t, err)
+				return
 			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantFor, time.Duration(rule.For))
 		})
 	}
+
+	// Changing only the pending period updates an otherwise unchanged alert rule
+	i := NewIntegrator()
+	convConfig := model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", TimeWindow: "5m"}
+	rule := &model.ProvisionedAlertRule{}
+	assert.NoError(t, i.ConvertToAlert(rule, []string{"{job=`a`} | json"}, "Rule 1", convConfig, "test_conversion_file.json", model.ConversionOutput{}))
+	assert.Zero(t, rule.For)
+	i.config.IntegratorConfig.AutoPendingPeriod = true
+	i.config.IntegratorConfig.PendingPeriodMultiplier = 2
+	assert.NoError(t, i.ConvertToAlert(rule, []string{"{job=`a`} | json"}, "Rule 1", convConfig, "test_conversion_file.json", model.ConversionOutput{}))
+	assert.Equal(t, 10*time.Minute, time.Duration(rule.For))
 }
 
 func TestLoadConfig(t *testing.T) {
@@ -651,45 +2040,349 @@ func TestLoadConfig(t *testing.T) {
 			wantError:  true,
 		},
 		{
-			name:       "deployment path is not local",
-			configPath: "testdata/non-local-deploy-config.yml",
-			testFiles:  "",
-			allRules:   false,
-			wantError:  true,
+			name:       "deployment path is not local",
+			configPath: "testdata/non-local-deploy-config.yml",
+			testFiles:  "",
+			allRules:   false,
+			wantError:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("INTEGRATOR_CONFIG_PATH", tt.configPath)
+			os.Setenv("INTEGRATOR_GRAFANA_SA_TOKEN", tt.token)
+			os.Setenv("CHANGED_FILES", tt.changed)
+			os.Setenv("DELETED_FILES", tt.deleted)
+			os.Setenv("TEST_FILES", tt.testFiles)
+			if tt.allRules {
+				os.Setenv("ALL_RULES", "true")
+			} else {
+				os.Setenv("ALL_RULES", "false")
+			}
+
+			i := NewIntegrator()
+			err := i.LoadConfig()
+			if tt.wantError {
+				assert.NotNil(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expConfig, i.config)
+				assert.Equal(t, tt.expAdd, i.addedFiles)
+				assert.Equal(t, tt.expDel, i.removedFiles)
+				assert.Equal(t, tt.expTest, i.testFiles)
+			}
+		})
+	}
+	defer os.Unsetenv("INTEGRATOR_CONFIG_PATH")
+	defer os.Unsetenv("INTEGRATOR_GRAFANA_SA_TOKEN")
+	defer os.Unsetenv("CHANGED_FILES")
+	defer os.Unsetenv("DELETED_FILES")
+	defer os.Unsetenv("TEST_FILES")
+	defer os.Unsetenv("ALL_RULES")
+}
+
+func TestLoadConfigChangedAndDeletedFiles(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		wantAdded   []string
+		wantRemoved []string
+		wantTested  []string
+		wantError   string
+	}{
+		{
+			name:        "deletion wins by default",
+			wantAdded:   []string{filepath.Join("conv", "conv_a.json")},
+			wantRemoved: []string{filepath.Join("conv", "conv_b.json"), filepath.Join("conv", "conv_c.json")},
+			wantTested:  []string{filepath.Join("conv", "conv_a.json")},
+		},
+		{
+			name:        "delete",
+			mode:        "delete",
+			wantAdded:   []string{filepath.Join("conv", "conv_a.json")},
+			wantRemoved: []string{filepath.Join("conv", "conv_b.json"), filepath.Join("conv", "conv_c.json")},
+			wantTested:  []string{filepath.Join("conv", "conv_a.json")},
+		},
+		{
+			name:      "error",
+			mode:      "error",
+			wantError: "conversion files are listed as both changed and deleted: " + filepath.Join("conv", "conv_b.json"),
+		},
+		{
+			name:      "invalid mode",
+			mode:      "keep",
+			wantError: "invalid changed_and_deleted_files keep",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			config := "folders:\n  conversion_path: conv\n  deployment_path: deploy\n" +
+				"integration:\n  test_queries: true\n  changed_and_deleted_files: \"" + tt.mode + "\"\n"
+			require.NoError(t, os.WriteFile("config.yml", []byte(config), 0o600))
+			require.NoError(t, os.MkdirAll("conv", 0o755))
+			for _, file := range []string{"conv_a.json", "conv_b.json"} {
+				require.NoError(t, os.WriteFile(filepath.Join("conv", file), []byte("{}"), 0o600))
+			}
+
+			t.Setenv("INTEGRATOR_CONFIG_PATH", "config.yml")
+			t.Setenv("CHANGED_FILES", filepath.Join("conv", "conv_a.json")+" "+filepath.Join("conv", "conv_b.json"))
+			t.Setenv("TEST_FILES", filepath.Join("conv", "conv_a.json")+" "+filepath.Join("conv", "conv_b.json"))
+			t.Setenv("DELETED_FILES", filepath.Join("conv", "conv_b.json")+" "+filepath.Join("conv", "conv_c.json"))
+			t.Setenv("ALL_RULES", "")
+			i := NewIntegrator()
+			err := i.LoadConfig()
+			if tt.wantError != "" {
+				assert.ErrorContains(t, err, tt.wantError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantAdded, i.addedFiles)
+			assert.Equal(t, tt.wantRemoved, i.removedFiles)
+			assert.Equal(t, tt.wantTested, i.testFiles)
+		})
+	}
+}
+
+func TestFilterFilesUnderDir(t *testing.T) {
+	paths := []string{
+		"",
+		filepath.Join("conv", "conv_a.json"),
+		filepath.Join("conv", "okta", "login.json"),
+		filepath.Join("conv", "okta", "mfa", "reset.json"),
+		filepath.Join("other", "conv_b.json"),
+		filepath.Join("conversions", "conv_c.json"),
+		"conv",
+	}
+	filtered, err := filterFilesUnderDir(paths, "conv")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join("conv", "conv_a.json"),
+		filepath.Join("conv", "okta", "login.json"),
+		filepath.Join("conv", "okta", "mfa", "reset.json"),
+	}, filtered)
+}
+
+func TestLoadConfigSkipUnsupported(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		want      string
+		wantError string
+	}{
+		{name: "yes", value: "yes", want: "true"},
+		{name: "capitalised true", value: "True", want: "true"},
+		{name: "one", value: "1", want: "true"},
+		{name: "off", value: "off", want: "false"},
+		{name: "quoted false", value: `"false"`, want: "false"},
+		{name: "invalid value", value: "sometimes", wantError: `invalid skip_unsupported of conversion conv: "sometimes" is not a boolean`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			config := "folders:\n  conversion_path: conv\n  deployment_path: deploy\n" +
+				"conversion_defaults:\n  skip_unsupported: Yes\n" +
+				"conversions:\n  - name: conv\n    skip_unsupported: " + tt.value + "\n  - name: unset\n"
+			require.NoError(t, os.WriteFile("config.yml", []byte(config), 0o600))
+
+			t.Setenv("INTEGRATOR_CONFIG_PATH", "config.yml")
+			t.Setenv("CHANGED_FILES", "")
+			t.Setenv("DELETED_FILES", "")
+			i := NewIntegrator()
+			err := i.LoadConfig()
+			if tt.wantError != "" {
+				assert.ErrorContains(t, err, tt.wantError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "true", i.config.ConversionDefaults.SkipUnsupported)
+			assert.Equal(t, tt.want, i.config.Conversions[0].SkipUnsupported)
+			assert.Empty(t, i.config.Conversions[1].SkipUnsupported)
+		})
+	}
+}
+
+func TestLoadConfigEnvOverrides(t *testing.T) {
+	t.Setenv("INTEGRATOR_CONFIG_PATH", "testdata/config.yml")
+	t.Setenv("GRAFANA_INSTANCE", "https://staging.grafana.net")
+	t.Setenv("FOLDER_ID", "staging-folder")
+	t.Setenv("ORG_ID", "42")
+
+	i := NewIntegrator()
+	assert.NoError(t, i.LoadConfig())
+	assert.Equal(t, "https://staging.grafana.net", i.config.DeployerConfig.GrafanaInstance)
+	assert.Equal(t, "staging-folder", i.config.IntegratorConfig.FolderID)
+	assert.Equal(t, int64(42), i.config.IntegratorConfig.OrgID)
+
+	t.Setenv("FOLDER_ID", "invalid folder")
+	assert.Error(t, NewIntegrator().LoadConfig())
+}
+
+func TestLoadConfigTimeRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		wantError string
+	}{
+		{
+			name:   "relative time",
+			config: "integration:\n  from: now-1h\n  to: now\n",
+		},
+		{
+			name:   "epoch millis",
+			config: "integration:\n  from: \"1758615188601\"\n  to: \"1758618788601\"\n",
+		},
+		{
+			name:      "invalid expression",
+			config:    "integration:\n  from: now-1hour\n",
+			wantError: `invalid integration.from "now-1hour": use a Grafana relative time such as now-1h, or a Unix timestamp in milliseconds`,
+		},
+		{
+			name:      "invalid conversion expression",
+			config:    "conversions:\n  - name: conv\n    from: now-7days\n",
+			wantError: `invalid from of conversion conv "now-7days"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			config := "folders:\n  conversion_path: conv\n  deployment_path: deploy\n" + tt.config
+			require.NoError(t, os.WriteFile("config.yml", []byte(config), 0o600))
+			t.Setenv("INTEGRATOR_CONFIG_PATH", "config.yml")
+
+			err := NewIntegrator().LoadConfig()
+			if tt.wantError != "" {
+				assert.ErrorContains(t, err, tt.wantError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestLoadConfigQueryTesting(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		wantError string
+	}{
+		{
+			name:   "valid query timeouts",
+			config: "integration:\n  query_timeouts:\n    elasticsearch: 30s\n",
+		},
+		{
+			name:      "invalid query timeout",
+			config:    "integration:\n  query_timeouts:\n    elasticsearch: 30\n",
+			wantError: "invalid query timeout 30 for data source type elasticsearch: must be a positive duration, e.g. 30s",
+		},
+		{
+			name:      "negative query timeout",
+			config:    "integration:\n  query_timeouts:\n    loki: -5s\n",
+			wantError: "invalid query timeout -5s for data source type loki",
+		},
+		{
+			name:   "valid data source ready timeout",
+			config: "integration:\n  datasource_ready_timeout: 1m\n",
+		},
+		{
+			name:      "invalid data source ready timeout",
+			config:    "integration:\n  datasource_ready_timeout: a minute\n",
+			wantError: "invalid data source ready timeout a minute: must be a duration, e.g. 30s",
+		},
+		{
+			name:      "negative query test concurrency",
+			config:    "integration:\n  query_test_concurrency: -1\n",
+			wantError: "invalid query test concurrency -1: must not be negative",
+		},
+		{
+			name:   "valid test fields",
+			config: "integration:\n  test_value_fields: [message]\n  test_label_fields: [fields]\n",
+		},
+		{
+			name:      "empty test field",
+			config:    "integration:\n  test_value_fields: [message, \"\"]\n",
+			wantError: "invalid integration.test_value_fields: field names must not be empty",
+		},
+		{
+			name:   "valid test sample window",
+			config: "integration:\n  test_sample_window: 5m\n",
+		},
+		{
+			name:      "invalid test sample window",
+			config:    "integration:\n  test_sample_window: 0s\n",
+			wantError: "invalid test sample window 0s: must be a positive duration, e.g. 5m",
+		},
+		{
+			name:   "valid result errors handling",
+			config: "integration:\n  result_errors: report\n",
+		},
+		{
+			name:      "invalid result errors handling",
+			config:    "integration:\n  result_errors: ignore\n",
+			wantError: "invalid result_errors ignore: must be fail or report",
 		},
 	}
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			os.Setenv("INTEGRATOR_CONFIG_PATH", tt.configPath)
-			os.Setenv("INTEGRATOR_GRAFANA_SA_TOKEN", tt.token)
-			os.Setenv("CHANGED_FILES", tt.changed)
-			os.Setenv("DELETED_FILES", tt.deleted)
-			os.Setenv("TEST_FILES", tt.testFiles)
-			if tt.allRules {
-				os.Setenv("ALL_RULES", "true")
-			} else {
-				os.Setenv("ALL_RULES", "false")
-			}
+			t.Chdir(t.TempDir())
+			config := "folders:\n  conversion_path: conv\n  deployment_path: deploy\n" + tt.config
+			require.NoError(t, os.WriteFile("config.yml", []byte(config), 0o600))
+			t.Setenv("INTEGRATOR_CONFIG_PATH", "config.yml")
 
-			i := NewIntegrator()
-			err := i.LoadConfig()
-			if tt.wantError {
-				assert.NotNil(t, err)
-			} else {
-				assert.NoError(t, err)
-				assert.Equal(t, tt.expConfig, i.config)
-				assert.Equal(t, tt.expAdd, i.addedFiles)
-				assert.Equal(t, tt.expDel, i.removedFiles)
-				assert.Equal(t, tt.expTest, i.testFiles)
+			err := NewIntegrator().LoadConfig()
+			if tt.wantError != "" {
+				assert.ErrorContains(t, err, tt.wantError)
+				annotation, ok := shared.ErrorAnnotation(err)
+				require.True(t, ok)
+				assert.Equal(t, "config.yml", annotation.File)
+				return
 			}
+			assert.NoError(t, err)
 		})
 	}
-	defer os.Unsetenv("INTEGRATOR_CONFIG_PATH")
-	defer os.Unsetenv("INTEGRATOR_GRAFANA_SA_TOKEN")
-	defer os.Unsetenv("CHANGED_FILES")
-	defer os.Unsetenv("DELETED_FILES")
-	defer os.Unsetenv("TEST_FILES")
-	defer os.Unsetenv("ALL_RULES")
+}
+
+func TestValidationAnnotations(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll("conv", 0o755))
+
+	// A configuration missing a required field is annotated
+	require.NoError(t, os.WriteFile("config.yml", []byte("folders:\n  deployment_path: deploy\n"), 0o600))
+	t.Setenv("INTEGRATOR_CONFIG_PATH", "config.yml")
+	err := NewIntegrator().LoadConfig()
+	require.EqualError(t, err, "folders.conversion_path is required")
+	annotation, ok := shared.ErrorAnnotation(err)
+	require.True(t, ok)
+	assert.Equal(t, "::error file=config.yml::folders.conversion_path is required", shared.AnnotationCommand(annotation))
+
+	// So is a conversion file missing its conversion_name
+	convFile := filepath.Join("conv", "conv_rule.json")
+	require.NoError(t, os.WriteFile(convFile, []byte(`{"queries":["{job=\"test\"}"]}`), 0o600))
+	i := NewIntegrator()
+	i.config.Folders = model.FoldersConfig{ConversionPath: "conv", DeploymentPath: "deploy"}
+	i.addedFiles = []string{convFile}
+	err = i.DoConversions()
+	require.Error(t, err)
+	annotation, ok = shared.ErrorAnnotation(err)
+	require.True(t, ok)
+	assert.Equal(t, model.Annotation{
+		File:    "conv/conv_rule.json",
+		Level:   model.AnnotationError,
+		Message: "conversion file conv/conv_rule.json has no conversion_name: set it, or set integration.default_conversion to the conversion to use",
+	}, annotation)
+
+	// Warnings located in a conversion file are annotated too
+	require.NoError(t, os.WriteFile(convFile, []byte(`{"conversion_name":"unknown","queries":["{job=\"test\"}"]}`), 0o600))
+	require.NoError(t, i.DoConversions())
+	assert.Equal(t, []model.Annotation{{
+		File:    "conv/conv_rule.json",
+		Level:   model.AnnotationWarning,
+		Message: "No configuration found for conversion name: unknown, skipping file: conv/conv_rule.json",
+	}}, i.Warnings().Annotations())
 }
 
 func TestDoConversions(t *testing.T) {
@@ -847,6 +2540,621 @@ func TestDoConversions(t *testing.T) {
 	}
 }
 
+func TestParseSigmaDate(t *testing.T) {
+	tests := []struct {
+		value     string
+		want      string
+		wantError bool
+	}{
+		{value: "2024-03-02", want: "2024-03-02"},
+		{value: "2024/03/02", want: "2024-03-02"},
+		{value: "2024/3/2", want: "2024-03-02"},
+		{value: " 2024-3-2 ", want: "2024-03-02"},
+		{value: "2024-03-02T10:00:00Z", want: "2024-03-02"},
+		{value: "02/03/2024", wantError: true},
+		{value: "yesterday", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			date, err := parseSigmaDate(tt.value, time.UTC)
+			if tt.wantError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, date.Format(time.DateOnly))
+		})
+	}
+}
+
+func TestFormatTimeExpression(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+	assert.Equal(t, "2023-11-14T22:13:20Z", formatTimeExpression("1700000000000", time.UTC))
+	assert.Equal(t, "2023-11-14T23:13:20+01:00", formatTimeExpression("1700000000000", paris))
+	assert.Equal(t, "now-1h", formatTimeExpression("now-1h", paris))
+}
+
+func TestDoConversionsStaleRules(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("GITHUB_OUTPUT", "github-output")
+	assert.NoError(t, os.MkdirAll("conv", 0o755))
+	assert.NoError(t, os.MkdirAll("deploy", 0o755))
+
+	originalTimeNow := timeNow
+	defer func() { timeNow = originalTimeNow }()
+	timeNow = func() time.Time { return time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	conversions := map[string][]model.SigmaRule{
+		// Last modified more than 180 days ago
+		"conv/test_conv_stale.json": {{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Stale Rule", Date: "2020/01/01", Modified: "2024/06/01"}},
+		// Never modified, but recently created
+		"conv/test_conv_fresh.json": {{ID: "dcb63bd5-2a1e-4ac7-9e61-aa5c2a4e1c3a", Title: "Fresh Rule", Date: "2024-12-01"}},
+		// No date, so its staleness is unknown
+		"conv/test_conv_undated.json": {{ID: "5f2d1a0e-6b8c-4e3f-9a7d-2c1b0e9f8a7d", Title: "Undated Rule"}},
+	}
+	addedFiles := []string{}
+	for file, rules := range conversions {
+		convBytes, err := json.Marshal(model.ConversionOutput{
+			ConversionName: "test_conv",
+			Queries:        []string{"{job=`test`} | json"},
+			Rules:          rules,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(file, convBytes, 0o600))
+		addedFiles = append(addedFiles, file)
+	}
+	slices.Sort(addedFiles)
+
+	i := NewIntegrator()
+	i.config = model.Configuration{
+		Folders: model.FoldersConfig{
+			ConversionPath: "conv",
+			DeploymentPath: "deploy",
+		},
+		ConversionDefaults: model.ConversionConfig{
+			Target:     "loki",
+			DataSource: "test-datasource",
+		},
+		Conversions: []model.ConversionConfig{
+			{Name: "test_conv", RuleGroup: "Test Rules", TimeWindow: "5m"},
+		},
+		IntegratorConfig: model.IntegrationConfig{
+			StaleAfterDays: 180,
+		},
+	}
+	i.addedFiles = addedFiles
+	assert.NoError(t, i.DoConversions())
+	assert.Equal(t, []string{"conv/test_conv_stale.json"}, i.staleFiles)
+	assert.Len(t, i.Warnings().List(), 1)
+
+	assert.NoError(t, i.SetOutputs())
+	outputBytes, err := os.ReadFile("github-output")
+	assert.NoError(t, err)
+	assert.Contains(t, string(outputBytes), "stale_rules=conv/test_conv_stale.json\n")
+}
+
+func TestDoConversionsAlertFileNameTemplate(t *testing.T) {
+	t.Chdir(t.TempDir())
+	assert.NoError(t, os.MkdirAll("conv", 0o755))
+	assert.NoError(t, os.MkdirAll("deploy", 0o755))
+
+	convOutput := model.ConversionOutput{
+		ConversionName: "test_conv",
+		Queries:        []string{"{job=`test`} | json"},
+		Rules:          []model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}},
+	}
+	convBytes, err := json.Marshal(convOutput)
+	assert.NoError(t, err)
+	convFile := filepath.Join("conv", "test_conv_rule.json")
+	assert.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+
+	fileNameTemplate := "{{.UID}}--{{.ConversionName}}--{{.RuleFilename}}.json"
+	i := NewIntegrator()
+	i.config = model.Configuration{
+		Folders: model.FoldersConfig{
+			ConversionPath: "conv",
+			DeploymentPath: "deploy",
+		},
+		ConversionDefaults: model.ConversionConfig{
+			Target:     "loki",
+			DataSource: "test-datasource",
+		},
+		Conversions: []model.ConversionConfig{
+			{Name: "test_conv", RuleGroup: "Test Rules", TimeWindow: "5m"},
+		},
+		IntegratorConfig: model.IntegrationConfig{
+			AlertFileNameTemplate: fileNameTemplate,
+		},
+	}
+	i.addedFiles = []string{convFile}
+	assert.NoError(t, i.DoConversions())
+
+	convID, _, err := summariseSigmaRules(convOutput.Rules)
+	assert.NoError(t, err)
+	uid := getRuleUID("test_conv", convID)
+	deployFile := filepath.Join("deploy", uid+"--test_conv--rule.json")
+	rule := &model.ProvisionedAlertRule{}
+	assert.NoError(t, readRuleFromFile(rule, deployFile))
+	assert.Equal(t, uid, rule.UID)
+	assert.Equal(t, uid, shared.AlertUIDFromFileName(fileNameTemplate, deployFile))
+
+	// The file is still recognised as belonging to a configured conversion
+	orphaned, err := i.isDeploymentFileOfUnknownConversion(deployFile)
+	assert.NoError(t, err)
+	assert.False(t, orphaned)
+
+	// And is removed along with its conversion file
+	assert.NoError(t, os.Remove(convFile))
+	i.addedFiles = nil
+	i.removedFiles = []string{convFile}
+	assert.NoError(t, i.DoCleanup())
+	assert.NoFileExists(t, deployFile)
+}
+
+func TestDoConversionsEmptyConversionName(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll("conv", 0o755))
+	require.NoError(t, os.MkdirAll("deploy", 0o755))
+
+	convOutput := model.ConversionOutput{
+		Queries: []string{"{job=`a`} | json"},
+		Rules:   []model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}},
+	}
+	convBytes, err := json.Marshal(convOutput)
+	require.NoError(t, err)
+	convFile := filepath.Join("conv", "handwritten_rule.json")
+	require.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+
+	i := NewIntegrator()
+	i.config = model.Configuration{
+		Folders: model.FoldersConfig{ConversionPath: "conv", DeploymentPath: "deploy"},
+		ConversionDefaults: model.ConversionConfig{
+			Target:     "loki",
+			DataSource: "test-datasource",
+		},
+		Conversions: []model.ConversionConfig{
+			{Name: "test_conv", RuleGroup: "Test Rules", TimeWindow: "5m"},
+			{Name: "fallback_conv", RuleGroup: "Fallback Rules", TimeWindow: "5m"},
+		},
+		IntegratorConfig: model.IntegrationConfig{FolderID: "test-folder", OrgID: 1},
+	}
+	i.addedFiles = []string{convFile}
+
+	err = i.DoConversions()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "conversion file conv/handwritten_rule.json has no conversion_name")
+	// The file can't be told to be orphaned either, so it is kept
+	_, err = i.isConversionFileOrphaned(convFile)
+	assert.Error(t, err)
+
+	// Files without a conversion name are integrated with the default conversion
+	i.config.IntegratorConfig.DefaultConversion = "fallback_conv"
+	require.NoError(t, i.DoConversions())
+	files, err := os.ReadDir("deploy")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	rule := &model.ProvisionedAlertRule{}
+	require.NoError(t, readRuleFromFile(rule, filepath.Join("deploy", files[0].Name())))
+	assert.Equal(t, "Fallback Rules", rule.RuleGroup)
+	orphaned, err := i.isConversionFileOrphaned(convFile)
+	require.NoError(t, err)
+	assert.False(t, orphaned)
+}
+
+func TestDoConversionsBackend(t *testing.T) {
+	tests := []struct {
+		name      string
+		backend   string
+		query     string
+		wantModel string
+	}{
+		{
+			name:      "no backend keeps the configured target",
+			query:     "type:log AND level:ERROR",
+			wantModel: `{"refId":"A0","datasource":{"type":"elasticsearch","uid":"test-datasource"},"query":"type:log AND level:ERROR","alias":"","metrics":[{"type":"count","id":"1"}],"bucketAggs":[{"type":"date_histogram","id":"2","settings":{"interval":"auto"}}],"intervalMs":2000,"maxDataPoints":1354,"timeField":"@timestamp"}`,
+		},
+		{
+			name:      "loki backend selects the Loki model",
+			backend:   "loki",
+			query:     "{job=`a`} | json",
+			wantModel: `{"refId":"A0","datasource":{"type":"loki","uid":"test-datasource"},"hide":false,"expr":"sum(count_over_time({job=` + "`a`" + `} | json[$__auto]))","queryType":"instant","editorMode":"code","intervalMs":1000,"maxDataPoints":43200}`,
+		},
+		{
+			name:      "lucene backend selects the Elasticsearch model",
+			backend:   "lucene",
+			query:     "type:log AND level:ERROR",
+			wantModel: `{"refId":"A0","datasource":{"type":"elasticsearch","uid":"test-datasource"},"query":"type:log AND level:ERROR","alias":"","metrics":[{"type":"count","id":"1"}],"bucketAggs":[{"type":"date_histogram","id":"2","settings":{"interval":"auto"}}],"intervalMs":2000,"maxDataPoints":1354,"timeField":"@timestamp"}`,
+		},
+		{
+			name:      "esql backend selects the ES|QL model",
+			backend:   "esql",
+			query:     "FROM logs-* | WHERE level == \"ERROR\" | STATS count = COUNT(*)",
+			wantModel: `{"refId":"A0","datasource":{"type":"elasticsearch","uid":"test-datasource"},"queryType":"esql","query":"FROM logs-* | WHERE level == \"ERROR\" | STATS count = COUNT(*)","intervalMs":2000,"maxDataPoints":1354,"timeField":"@timestamp"}`,
+		},
+		{
+			name:      "other backends use the generic model",
+			backend:   "splunk",
+			query:     `index=main sourcetype=auth action=failure`,
+			wantModel: `{"refId":"A0","datasource":{"type":"splunk","uid":"test-datasource"},"query":"index=main sourcetype=auth action=failure"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			require.NoError(t, os.MkdirAll("conv", 0o755))
+			require.NoError(t, os.MkdirAll("deploy", 0o755))
+
+			convOutput := model.ConversionOutput{
+				ConversionName: "test_conv",
+				Queries:        []string{tt.query},
+				Rules:          []model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}},
+				Backend:        tt.backend,
+			}
+			convBytes, err := json.Marshal(convOutput)
+			require.NoError(t, err)
+			convFile := filepath.Join("conv", "test_conv_rule.json")
+			require.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+
+			i := NewIntegrator()
+			i.config = model.Configuration{
+				Folders: model.FoldersConfig{ConversionPath: "conv", DeploymentPath: "deploy"},
+				ConversionDefaults: model.ConversionConfig{
+					Target:     shared.Elasticsearch,
+					DataSource: "test-datasource",
+				},
+				Conversions: []model.ConversionConfig{
+					{Name: "test_conv", RuleGroup: "Test Rules", TimeWindow: "5m"},
+				},
+				IntegratorConfig: model.IntegrationConfig{FolderID: "test-folder", OrgID: 1},
+			}
+			i.addedFiles = []string{convFile}
+			require.NoError(t, i.DoConversions())
+
+			files, err := os.ReadDir("deploy")
+			require.NoError(t, err)
+			require.Len(t, files, 1)
+			rule := &model.ProvisionedAlertRule{}
+			require.NoError(t, readRuleFromFile(rule, filepath.Join("deploy", files[0].Name())))
+			assert.JSONEq(t, tt.wantModel, string(rule.Data[0].Model))
+		})
+	}
+}
+
+func TestConvertToAlertManagedBy(t *testing.T) {
+	tests := []struct {
+		name            string
+		existingManaged bool
+		requireManaged  bool
+		wantAnnotation  bool
+	}{
+		{name: "set when the deployer requires it", requireManaged: true, wantAnnotation: true},
+		{name: "not set otherwise"},
+		{name: "removed when no longer required", existingManaged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := NewIntegrator()
+			i.config.DeployerConfig.RequireManagedAnnotation = tt.requireManaged
+			rule := &model.ProvisionedAlertRule{UID: "5c1c217a"}
+			if tt.existingManaged {
+				rule.Annotations = map[string]string{shared.ManagedByAnnotation: shared.ManagedByValue}
+			}
+			convConfig := model.ConversionConfig{Target: "loki", DataSource: "my_data_source", TimeWindow: "5m"}
+			require.NoError(t, i.ConvertToAlert(rule, []string{"{job=`.+`} | json"}, "Managed Rule", convConfig, "conv.json", model.ConversionOutput{}))
+			_, ok := rule.Annotations[shared.ManagedByAnnotation]
+			assert.Equal(t, tt.wantAnnotation, ok)
+		})
+	}
+}
+
+func TestDoConversionsPlaceholder(t *testing.T) {
+	testDir := filepath.Join("testdata", "test_do_conversions_placeholder")
+	convPath := filepath.Join(testDir, "conv")
+	deployPath := filepath.Join(testDir, "deploy")
+	assert.NoError(t, os.MkdirAll(convPath, 0o755))
+	assert.NoError(t, os.MkdirAll(deployPath, 0o755))
+	defer os.RemoveAll(testDir)
+
+	convOutput := model.ConversionOutput{
+		ConversionName: "test_conv",
+		Queries:        []string{},
+		Rules:          []model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}},
+	}
+	convFile := filepath.Join(convPath, "test_conv_rule.json")
+	writeConversion := func() {
+		convBytes, err := json.Marshal(convOutput)
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+	}
+	writeConversion()
+
+	i := &Integrator{
+		config: model.Configuration{
+			Folders: model.FoldersConfig{
+				ConversionPath: convPath,
+				DeploymentPath: deployPath,
+			},
+			ConversionDefaults: model.ConversionConfig{
+				Target:     "loki",
+				DataSource: "test-datasource",
+			},
+			Conversions: []model.ConversionConfig{
+				{Name: "test_conv", RuleGroup: "Test Rules", TimeWindow: "5m"},
+			},
+			IntegratorConfig: model.IntegrationConfig{
+				FolderID:                         "test-folder",
+				OrgID:                            1,
+				CreatePlaceholderForEmptyQueries: true,
+			},
+		},
+		addedFiles: []string{convFile},
+	}
+	assert.NoError(t, i.DoConversions())
+
+	convID, _, err := summariseSigmaRules(convOutput.Rules)
+	assert.NoError(t, err)
+	deployFile := filepath.Join(deployPath, fmt.Sprintf("alert_rule_test_conv_rule_%s.json", getRuleUID("test_conv", convID)))
+	rule := &model.ProvisionedAlertRule{}
+	assert.NoError(t, readRuleFromFile(rule, deployFile))
+	assert.True(t, rule.IsPaused)
+	assert.Equal(t, "Test Rule", rule.Title)
+	assert.Equal(t, TRUE, rule.Annotations[PlaceholderAnnotation])
+	assert.Equal(t, convFile, rule.Annotations["ConversionFile"])
+	assert.NotContains(t, rule.Annotations, "Query")
+	assert.Len(t, rule.Data, 2)
+	assert.Contains(t, string(rule.Data[0].Model), `"expression":"0"`)
+
+	// Once the conversion has a query, the rule is unpaused
+	convOutput.Queries = []string{"{job=`test`} | json"}
+	writeConversion()
+	assert.NoError(t, i.DoConversions())
+	rule = &model.ProvisionedAlertRule{}
+	assert.NoError(t, readRuleFromFile(rule, deployFile))
+	assert.False(t, rule.IsPaused)
+	assert.NotContains(t, rule.Annotations, PlaceholderAnnotation)
+	assert.Equal(t, "{job=`test`} | json", rule.Annotations["Query"])
+	assert.Len(t, rule.Data, 3)
+}
+
+func TestDoConversionsSplitQueries(t *testing.T) {
+	testDir := filepath.Join("testdata", "test_do_conversions_split")
+	convPath := filepath.Join(testDir, "conv")
+	deployPath := filepath.Join(testDir, "deploy")
+	assert.NoError(t, os.MkdirAll(convPath, 0o755))
+	assert.NoError(t, os.MkdirAll(deployPath, 0o755))
+	defer os.RemoveAll(testDir)
+
+	convOutput := model.ConversionOutput{
+		ConversionName: "test_conv",
+		Queries:        []string{"{job=`one`} | json", "{job=`two`} | json"},
+		Rules: []model.SigmaRule{
+			{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Rule One"},
+			{ID: "dcb63bd5-2a1e-4ac7-9e61-aa5c2a4e1c3a", Title: "Rule Two"},
+		},
+	}
+	convBytes, err := json.Marshal(convOutput)
+	assert.NoError(t, err)
+	convFile := filepath.Join(convPath, "test_conv_rules.json")
+	assert.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+
+	i := &Integrator{
+		config: model.Configuration{
+			Folders: model.FoldersConfig{
+				ConversionPath: convPath,
+				DeploymentPath: deployPath,
+			},
+			ConversionDefaults: model.ConversionConfig{
+				Target:     "loki",
+				DataSource: "test-datasource",
+			},
+			Conversions: []model.ConversionConfig{
+				{
+					Name:         "test_conv",
+					RuleGroup:    "Test Rules",
+					TimeWindow:   "5m",
+					SplitQueries: true,
+				},
+			},
+			IntegratorConfig: model.IntegrationConfig{
+				FolderID: "test-folder",
+				OrgID:    1,
+			},
+		},
+		addedFiles: []string{convFile},
+	}
+	assert.NoError(t, i.DoConversions())
+
+	files, err := os.ReadDir(deployPath)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	uids := map[string]bool{}
+	titles := map[string]string{}
+	for _, file := range files {
+		rule := &model.ProvisionedAlertRule{}
+		assert.NoError(t, readRuleFromFile(rule, filepath.Join(deployPath, file.Name())))
+		assert.Contains(t, file.Name(), rule.UID)
+		assert.Len(t, rule.Data, 3, "each split rule has a single query plus the combiner and threshold")
+		uids[rule.UID] = true
+		titles[rule.Title] = rule.Annotations["Query"]
+	}
+	assert.Len(t, uids, 2, "split rules have distinct UIDs")
+	assert.Equal(t, map[string]string{
+		"Rule One": "{job=`one`} | json",
+		"Rule Two": "{job=`two`} | json",
+	}, titles)
+
+	// Integrating again is stable, and switching back to a combined rule removes the split rules
+	assert.NoError(t, i.DoConversions())
+	files, err = os.ReadDir(deployPath)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	i.config.Conversions[0].SplitQueries = false
+	assert.NoError(t, i.DoConversions())
+	files, err = os.ReadDir(deployPath)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	rule := &model.ProvisionedAlertRule{}
+	assert.NoError(t, readRuleFromFile(rule, filepath.Join(deployPath, files[0].Name())))
+	assert.Equal(t, "Rule One & Rule Two", rule.Title)
+	assert.Len(t, rule.Data, 4)
+}
+
+func TestDoConversionsMaxQueriesPerRule(t *testing.T) {
+	testDir := filepath.Join("testdata", "test_do_conversions_max_queries")
+	convPath := filepath.Join(testDir, "conv")
+	deployPath := filepath.Join(testDir, "deploy")
+	assert.NoError(t, os.MkdirAll(convPath, 0o755))
+	assert.NoError(t, os.MkdirAll(deployPath, 0o755))
+	defer os.RemoveAll(testDir)
+
+	convOutput := model.ConversionOutput{
+		ConversionName: "test_conv",
+		Queries: []string{
+			"{job=`one`} | json", "{job=`two`} | json", "{job=`three`} | json",
+			"{job=`four`} | json", "{job=`five`} | json",
+		},
+		Rules: []model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Many Queries"}},
+	}
+	convBytes, err := json.Marshal(convOutput)
+	assert.NoError(t, err)
+	convFile := filepath.Join(convPath, "test_conv_rules.json")
+	assert.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+
+	newIntegrator := func(maxQueries int, split bool) *Integrator {
+		return &Integrator{
+			config: model.Configuration{
+				Folders: model.FoldersConfig{
+					ConversionPath: convPath,
+					DeploymentPath: deployPath,
+				},
+				ConversionDefaults: model.ConversionConfig{
+					Target:     "loki",
+					DataSource: "test-datasource",
+				},
+				Conversions: []model.ConversionConfig{
+					{
+						Name:       "test_conv",
+						RuleGroup:  "Test Rules",
+						TimeWindow: "5m",
+					},
+				},
+				IntegratorConfig: model.IntegrationConfig{
+					FolderID:            "test-folder",
+					OrgID:               1,
+					MaxQueriesPerRule:   maxQueries,
+					SplitOversizedRules: split,
+				},
+			},
+			addedFiles: []string{convFile},
+		}
+	}
+
+	// Exceeding the maximum fails with guidance, without writing any alert rule
+	err = newIntegrator(2, false).DoConversions()
+	assert.ErrorContains(t, err, "an alert rule with 5 queries, more than the maximum of 2")
+	assert.ErrorContains(t, err, "split_oversized_rules")
+	files, err := os.ReadDir(deployPath)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	// A maximum which isn't exceeded keeps a single alert rule
+	assert.NoError(t, newIntegrator(5, false).DoConversions())
+	files, err = os.ReadDir(deployPath)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	// Auto-splitting replaces it with parts of at most the maximum number of queries
+	assert.NoError(t, newIntegrator(2, true).DoConversions())
+	files, err = os.ReadDir(deployPath)
+	assert.NoError(t, err)
+	assert.Len(t, files, 3)
+
+	queriesByTitle := map[string]int{}
+	uids := map[string]bool{}
+	for _, file := range files {
+		rule := &model.ProvisionedAlertRule{}
+		assert.NoError(t, readRuleFromFile(rule, filepath.Join(deployPath, file.Name())))
+		// Each part has its queries plus the combiner and threshold
+		queriesByTitle[rule.Title] = len(rule.Data) - 2
+		uids[rule.UID] = true
+	}
+	assert.Len(t, uids, 3, "parts have distinct UIDs")
+	assert.Equal(t, map[string]int{
+		"Many Queries (part 1 of 3)": 2,
+		"Many Queries (part 2 of 3)": 2,
+		"Many Queries (part 3 of 3)": 1,
+	}, queriesByTitle)
+
+	// Integrating again is stable
+	assert.NoError(t, newIntegrator(2, true).DoConversions())
+	files, err = os.ReadDir(deployPath)
+	assert.NoError(t, err)
+	assert.Len(t, files, 3)
+
+	// The maximum applies to each alert rule once split_queries has split the conversion
+	assert.NoError(t, os.RemoveAll(deployPath))
+	assert.NoError(t, os.MkdirAll(deployPath, 0o755))
+	integrator := newIntegrator(2, false)
+	integrator.config.Conversions[0].SplitQueries = true
+	assert.NoError(t, integrator.DoConversions())
+	files, err = os.ReadDir(deployPath)
+	assert.NoError(t, err)
+	assert.Len(t, files, 5)
+}
+
+func TestSplitAlertRules(t *testing.T) {
+	convID := uuid.MustParse("996f8884-9144-40e7-ac63-29090ccde9a0")
+	convOutput := model.ConversionOutput{
+		ConversionName: "test_conv",
+		Queries:        []string{"query one", "query two"},
+		Rules:          []model.SigmaRule{{ID: convID.String(), Title: "Correlation"}},
+	}
+	config := model.ConversionConfig{
+		Name:             "test_conv",
+		QueryDataSources: []model.QueryDataSource{{}, {DataSource: "other-datasource"}},
+	}
+
+	specs := splitAlertRules(convOutput, convID, "Correlation", config)
+	assert.Len(t, specs, 2)
+	assert.Equal(t, "Correlation #1", specs[0].title)
+	assert.Equal(t, "Correlation #2", specs[1].title)
+	assert.NotEqual(t, specs[0].uid, specs[1].uid)
+	assert.Equal(t, []string{"query two"}, specs[1].queries)
+	assert.Equal(t, []model.QueryDataSource{{DataSource: "other-datasource"}}, specs[1].config.QueryDataSources)
+
+	// UIDs are stable across runs
+	assert.Equal(t, specs, splitAlertRules(convOutput, convID, "Correlation", config))
+
+	// Long titles are truncated without splitting multi-byte characters
+	specs = splitAlertRules(convOutput, convID, "a"+strings.Repeat("é", 95), config)
+	assert.Equal(t, "a"+strings.Repeat("é", 94), specs[0].title)
+}
+
+func TestTruncateTitle(t *testing.T) {
+	tests := []struct {
+		name  string
+		title string
+		size  int
+		want  string
+	}{
+		{name: "short title", title: "Short", size: 10, want: "Short"},
+		{name: "ascii title", title: "Long title", size: 4, want: "Long"},
+		{name: "multi-byte character kept whole", title: "Détection", size: 3, want: "Dé"},
+		{name: "multi-byte character not split", title: "Détection", size: 2, want: "D"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateTitle(tt.title, tt.size)
+			assert.Equal(t, tt.want, got)
+			assert.True(t, utf8.ValidString(got))
+		})
+	}
+}
+
 func TestDoCleanup(t *testing.T) {
 	tests := []struct {
 		name                     string
@@ -1001,6 +3309,124 @@ func TestDoCleanup(t *testing.T) {
 	}
 }
 
+func TestDoCleanupRenamedConversion(t *testing.T) {
+	testDir := filepath.Join("testdata", "test_do_cleanup_renamed")
+	convPath := filepath.Join(testDir, "conv")
+	deployPath := filepath.Join(testDir, "deploy")
+	assert.NoError(t, os.MkdirAll(convPath, 0o755))
+	assert.NoError(t, os.MkdirAll(deployPath, 0o755))
+	defer os.RemoveAll(testDir)
+
+	convBytes, err := json.Marshal(model.ConversionOutput{ConversionName: "new_conv"})
+	assert.NoError(t, err)
+	for _, convFile := range []string{"old_conv_rule.json", "new_conv_rule.json", "new_conv_other.json"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(convPath, convFile), convBytes, 0o600))
+	}
+
+	deploymentFiles := []struct {
+		file           string
+		conversionFile string
+		manual         bool
+		wantKept       bool
+	}{
+		// Generated before the conversion was renamed from old_conv to new_conv
+		{file: "alert_rule_old_conv_rule_aaa.json", conversionFile: "old_conv_rule.json", wantKept: false},
+		{file: "alert_rule_old_conv_rule_ccc.json", conversionFile: "old_conv_rule.json", manual: true, wantKept: true},
+		{file: "alert_rule_new_conv_rule_bbb.json", conversionFile: "new_conv_rule.json", wantKept: true},
+		// Filename doesn't match, but the conversion file still belongs to a configured conversion
+		{file: "alert_rule_legacy_ddd.json", conversionFile: "new_conv_other.json", wantKept: true},
+	}
+	for _, deployment := range deploymentFiles {
+		rule := &model.ProvisionedAlertRule{
+			UID:         "123abc",
+			Title:       "Test Rule",
+			Annotations: map[string]string{"ConversionFile": filepath.Join(convPath, deployment.conversionFile)},
+		}
+		if deployment.manual {
+			rule.Annotations[ManualAnnotation] = TRUE
+		}
+		assert.NoError(t, writeRuleToFile(rule, filepath.Join(deployPath, deployment.file), false))
+	}
+
+	i := &Integrator{
+		config: model.Configuration{
+			Folders: model.FoldersConfig{
+				ConversionPath: convPath,
+				DeploymentPath: deployPath,
+			},
+			Conversions: []model.ConversionConfig{{Name: "new_conv"}},
+		},
+	}
+	assert.NoError(t, i.DoCleanup())
+
+	for _, deployment := range deploymentFiles {
+		_, err := os.Stat(filepath.Join(deployPath, deployment.file))
+		if deployment.wantKept {
+			assert.NoError(t, err, "%s should be kept", deployment.file)
+		} else {
+			assert.True(t, os.IsNotExist(err), "%s should be deleted", deployment.file)
+		}
+	}
+}
+
+func TestRunRenamedRule(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("GITHUB_OUTPUT", "github-output")
+	assert.NoError(t, os.MkdirAll("conv", 0o755))
+	assert.NoError(t, os.MkdirAll("deploy", 0o755))
+
+	writeConversion := func(file, ruleID string) string {
+		convBytes, err := json.Marshal(model.ConversionOutput{
+			ConversionName: "test_conv",
+			Queries:        []string{"{job=`test`} | json"},
+			Rules:          []model.SigmaRule{{ID: ruleID, Title: "Test Rule"}},
+		})
+		require.NoError(t, err)
+		convFile := filepath.Join("conv", file)
+		require.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+		return convFile
+	}
+	run := func(addedFiles, removedFiles []string) {
+		i := NewIntegrator()
+		i.config = model.Configuration{
+			Folders: model.FoldersConfig{
+				ConversionPath: "conv",
+				DeploymentPath: "deploy",
+			},
+			ConversionDefaults: model.ConversionConfig{
+				Target:     "loki",
+				DataSource: "test-datasource",
+			},
+			Conversions: []model.ConversionConfig{
+				{Name: "test_conv", RuleGroup: "Test Rules", TimeWindow: "5m"},
+			},
+			IntegratorConfig: model.IntegrationConfig{
+				DedupeTitles: true,
+			},
+		}
+		i.addedFiles = addedFiles
+		i.removedFiles = removedFiles
+		require.NoError(t, i.Run())
+	}
+
+	oldFile := writeConversion("test_conv_old.json", "996f8884-9144-40e7-ac63-29090ccde9a0")
+	run([]string{oldFile}, nil)
+
+	// The rule is renamed, with a new ID and the same title
+	require.NoError(t, os.Remove(oldFile))
+	newFile := writeConversion("test_conv_new.json", "c1e4b5f2-2a0b-4a4f-9d7e-2f8c6e1d0b3a")
+	run([]string{newFile}, []string{oldFile})
+
+	deploymentFiles, err := filepath.Glob(filepath.Join("deploy", "*.json"))
+	require.NoError(t, err)
+	require.Len(t, deploymentFiles, 1)
+	assert.Contains(t, deploymentFiles[0], "test_conv_new")
+	rule := &model.ProvisionedAlertRule{}
+	require.NoError(t, readRuleFromFile(rule, deploymentFiles[0]))
+	// The title was never shared with the old rule, so it isn't disambiguated
+	assert.Equal(t, "Test Rule", rule.Title)
+}
+
 func TestRun(t *testing.T) {
 	tests := []struct {
 		name                      string
@@ -1191,6 +3617,468 @@ func TestRun(t *testing.T) {
 	}
 }
 
+func TestSkipFiles(t *testing.T) {
+	i := NewIntegrator()
+	i.addedFiles = []string{"conv/conv_a.json", "conv/conv_b.json", "conv/conv_c.json"}
+	i.removedFiles = []string{"conv/conv_d.json"}
+
+	i.SkipFiles([]string{"conv/conv_b.json", "conv/conv_other.json"}, SkipReasonNoTestMatches)
+
+	assert.Equal(t, []string{"conv/conv_a.json", "conv/conv_c.json"}, i.addedFiles)
+	assert.Equal(t, []string{"conv/conv_d.json"}, i.removedFiles)
+	assert.Equal(t, map[string]string{"conv/conv_b.json": SkipReasonNoTestMatches}, i.skippedFiles)
+}
+
+func TestDoConversionsSkippedConversions(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("GITHUB_OUTPUT", "github-output")
+	require.NoError(t, os.MkdirAll("conv", 0o755))
+	require.NoError(t, os.MkdirAll("deploy", 0o755))
+
+	writeConversion := func(file, conversionName string, queries []string, rule model.SigmaRule) {
+		convBytes, err := json.Marshal(model.ConversionOutput{ConversionName: conversionName, Queries: queries, Rules: []model.SigmaRule{rule}})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(file, convBytes, 0o600))
+	}
+	queries := []string{"{job=`test`} | json"}
+	writeConversion("conv/test_conv_a.json", "test_conv", queries, model.SigmaRule{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Rule A"})
+	writeConversion("conv/test_conv_empty.json", "test_conv", []string{}, model.SigmaRule{ID: "dcb63bd5-2a1e-4ac7-9e61-aa5c2a4e1c3a", Title: "Empty Rule"})
+	writeConversion("conv/other_conv_b.json", "other_conv", queries, model.SigmaRule{ID: "5f2d1a0e-6b8c-4e3f-9a7d-2c1b0e9f8a7d", Title: "Unconfigured Rule"})
+	writeConversion("conv/test_conv_old_rule.json", "test_conv", queries, sigmaRuleWithRelated("0b1c2d3e-0000-4000-8000-000000000001"))
+	writeConversion("conv/test_conv_new_rule.json", "test_conv", queries, sigmaRuleWithRelated("0b1c2d3e-0000-4000-8000-000000000002",
+		[2]string{"0b1c2d3e-0000-4000-8000-000000000001", "obsolete"}))
+
+	i := NewIntegrator()
+	i.config = model.Configuration{
+		Folders:            model.FoldersConfig{ConversionPath: "conv", DeploymentPath: "deploy"},
+		ConversionDefaults: model.ConversionConfig{Target: "loki", DataSource: "test-datasource"},
+		Conversions:        []model.ConversionConfig{{Name: "test_conv", RuleGroup: "Test Rules", TimeWindow: "5m"}},
+		IntegratorConfig:   model.IntegrationConfig{SkipObsoletingRules: true},
+	}
+	var err error
+	i.ignore, err = parseIgnorePatterns("test_conv_ignored.json")
+	require.NoError(t, err)
+	i.addedFiles, err = i.filterIgnoredFiles([]string{"conv/test_conv_a.json", "conv/test_conv_empty.json", "conv/other_conv_b.json",
+		"conv/test_conv_old_rule.json", "conv/test_conv_ignored.json", "conv/test_conv_untested.json"})
+	require.NoError(t, err)
+	i.SkipFiles([]string{"conv/test_conv_untested.json"}, SkipReasonNoTestMatches)
+	require.NoError(t, i.DoConversions())
+	assert.Equal(t, map[string]string{
+		"conv/test_conv_empty.json":    SkipReasonNoQueries,
+		"conv/other_conv_b.json":       SkipReasonNoConfig,
+		"conv/test_conv_ignored.json":  SkipReasonIgnored,
+		"conv/test_conv_untested.json": SkipReasonNoTestMatches,
+	}, i.skippedFiles)
+
+	// Integrating the same conversion file again changes nothing, as does one whose deployment file is manually maintained
+	manualFiles, err := filepath.Glob("deploy/alert_rule_test_conv_old_rule_*.json")
+	require.NoError(t, err)
+	require.Len(t, manualFiles, 1)
+	rule := &model.ProvisionedAlertRule{}
+	require.NoError(t, readRuleFromFile(rule, manualFiles[0]))
+	rule.Annotations[ManualAnnotation] = TRUE
+	require.NoError(t, writeRuleToFile(rule, manualFiles[0], false))
+	i.addedFiles = []string{"conv/test_conv_a.json", "conv/test_conv_old_rule.json", "conv/test_conv_new_rule.json"}
+	require.NoError(t, i.DoConversions())
+
+	require.NoError(t, i.SetOutputs())
+	outputBytes, err := os.ReadFile("github-output")
+	require.NoError(t, err)
+	assert.Contains(t, string(outputBytes), `skipped_conversions={"conv/other_conv_b.json":"no_config","conv/test_conv_a.json":"unchanged",`+
+		`"conv/test_conv_empty.json":"no_queries","conv/test_conv_ignored.json":"ignored","conv/test_conv_new_rule.json":"obsoleting",`+
+		`"conv/test_conv_old_rule.json":"manual","conv/test_conv_untested.json":"no_test_matches"}`)
+}
+
+func TestRunStrictMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		strictMode bool
+		target     string
+		wantError  bool
+	}{
+		{
+			name:       "generic query model warning fails in strict mode",
+			strictMode: true,
+			target:     "generic",
+			wantError:  true,
+		},
+		{
+			name:       "generic query model warning is tolerated by default",
+			strictMode: false,
+			target:     "generic",
+			wantError:  false,
+		},
+		{
+			name:       "no warnings in strict mode",
+			strictMode: true,
+			target:     "loki",
+			wantError:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDir := t.TempDir()
+			t.Chdir(testDir)
+			t.Setenv("GITHUB_OUTPUT", "github-output")
+			assert.NoError(t, os.MkdirAll("conv", 0o755))
+			assert.NoError(t, os.MkdirAll("deploy", 0o755))
+
+			convBytes, err := json.Marshal(model.ConversionOutput{
+				ConversionName: "test_conv",
+				Queries:        []string{"test query"},
+				Rules:          []model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}},
+			})
+			assert.NoError(t, err)
+			convFile := filepath.Join("conv", "test_conv_rule.json")
+			assert.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+
+			i := NewIntegrator()
+			i.strictMode = tt.strictMode
+			i.addedFiles = []string{convFile}
+			i.config = model.Configuration{
+				Folders: model.FoldersConfig{
+					ConversionPath: "conv",
+					DeploymentPath: "deploy",
+				},
+				Conversions: []model.ConversionConfig{
+					{Name: "test_conv", Target: tt.target, DataSource: "test-datasource"},
+				},
+			}
+
+			assert.NoError(t, i.Run())
+			// The outputs are written even when strict mode fails the run
+			output, err := os.ReadFile("github-output")
+			assert.NoError(t, err)
+			assert.Contains(t, string(output), "rules_integrated="+convFile)
+
+			err = i.CheckWarnings()
+			if tt.wantError {
+				assert.ErrorContains(t, err, "Using generic query model")
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateAnnotationKeyMap(t *testing.T) {
+	tests := []struct {
+		name      string
+		keyMap    map[string]string
+		wantError bool
+	}{
+		{
+			name:   "no remapping",
+			keyMap: nil,
+		},
+		{
+			name:   "remapped keys",
+			keyMap: map[string]string{"Query": "sigma_query", "TimeWindow": "sigma/time_window"},
+		},
+		{
+			name:   "swapped keys",
+			keyMap: map[string]string{"Query": "TimeWindow", "TimeWindow": "Query"},
+		},
+		{
+			name:      "unknown annotation",
+			keyMap:    map[string]string{"Severity": "severity"},
+			wantError: true,
+		},
+		{
+			name:      "empty key",
+			keyMap:    map[string]string{"Query": ""},
+			wantError: true,
+		},
+		{
+			name:      "duplicate key",
+			keyMap:    map[string]string{"Query": "sigma", "Lookback": "sigma"},
+			wantError: true,
+		},
+		{
+			name:      "collides with a built-in annotation",
+			keyMap:    map[string]string{"Query": "TimeWindow"},
+			wantError: true,
+		},
+		{
+			name:      "collides with the manual annotation",
+			keyMap:    map[string]string{"Query": ManualAnnotation},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAnnotationKeyMap(tt.keyMap)
+			if tt.wantError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDedupeTitles(t *testing.T) {
+	t.Chdir(t.TempDir())
+	deployPath := "deploy"
+	assert.NoError(t, os.MkdirAll(deployPath, 0o755))
+	i := NewIntegrator()
+	i.config.Folders.DeploymentPath = deployPath
+
+	rules := map[string]*model.ProvisionedAlertRule{
+		"alert_rule_conv_a_1234abcd5678.json": {UID: "1234abcd5678", Title: "Same Title"},
+		"alert_rule_conv_b_9876fedc.json":     {UID: "9876fedc", Title: "Same Title"},
+		"alert_rule_conv_c_5555.json":         {UID: "5555", Title: "Other Title"},
+	}
+	for file, rule := range rules {
+		assert.NoError(t, writeRuleToFile(rule, filepath.Join(deployPath, file), false))
+	}
+	readTitles := func() map[string]string {
+		titles := map[string]string{}
+		files, err := os.ReadDir(deployPath)
+		assert.NoError(t, err)
+		for _, file := range files {
+			rule := &model.ProvisionedAlertRule{}
+			assert.NoError(t, readRuleFromFile(rule, filepath.Join(deployPath, file.Name())))
+			titles[file.Name()] = rule.Title
+		}
+		return titles
+	}
+
+	assert.NoError(t, i.DedupeTitles())
+	want := map[string]string{
+		"alert_rule_conv_a_1234abcd5678.json": "Same Title (1234abcd)",
+		"alert_rule_conv_b_9876fedc.json":     "Same Title (9876fedc)",
+		"alert_rule_conv_c_5555.json":         "Other Title",
+	}
+	assert.Equal(t, want, readTitles())
+
+	// The suffixes are stable across runs
+	assert.NoError(t, i.DedupeTitles())
+	assert.Equal(t, want, readTitles())
+
+	// A regenerated rule gets its suffix back
+	rule := &model.ProvisionedAlertRule{UID: "9876fedc", Title: "Same Title"}
+	assert.NoError(t, writeRuleToFile(rule, filepath.Join(deployPath, "alert_rule_conv_b_9876fedc.json"), false))
+	assert.NoError(t, i.DedupeTitles())
+	assert.Equal(t, want, readTitles())
+
+	// Once the titles no longer collide, the suffix is removed
+	assert.NoError(t, os.Remove(filepath.Join(deployPath, "alert_rule_conv_b_9876fedc.json")))
+	assert.NoError(t, i.DedupeTitles())
+	assert.Equal(t, map[string]string{
+		"alert_rule_conv_a_1234abcd5678.json": "Same Title",
+		"alert_rule_conv_c_5555.json":         "Other Title",
+	}, readTitles())
+
+	// Long titles are truncated before the suffix without splitting multi-byte characters
+	longTitle := strings.Repeat("é", 95)
+	for file, uid := range map[string]string{"alert_rule_conv_a_1234abcd5678.json": "1234abcd5678", "alert_rule_conv_c_5555.json": "5555"} {
+		rule := &model.ProvisionedAlertRule{UID: uid, Title: longTitle}
+		assert.NoError(t, writeRuleToFile(rule, filepath.Join(deployPath, file), false))
+	}
+	assert.NoError(t, i.DedupeTitles())
+	assert.Equal(t, map[string]string{
+		"alert_rule_conv_a_1234abcd5678.json": strings.Repeat("é", 89) + " (1234abcd)",
+		"alert_rule_conv_c_5555.json":         strings.Repeat("é", 91) + " (5555)",
+	}, readTitles())
+}
+
+func TestDedupeTitlesDryRun(t *testing.T) {
+	t.Chdir(t.TempDir())
+	deployPath := "deploy"
+	assert.NoError(t, os.MkdirAll(deployPath, 0o755))
+	i := NewIntegrator()
+	i.config.Folders.DeploymentPath = deployPath
+	i.dryRun = true
+
+	deployed := filepath.Join(deployPath, "alert_rule_conv_a_1234abcd.json")
+	removed := filepath.Join(deployPath, "alert_rule_conv_c_5555.json")
+	assert.NoError(t, writeRuleToFile(&model.ProvisionedAlertRule{UID: "1234abcd", Title: "Same Title"}, deployed, false))
+	assert.NoError(t, writeRuleToFile(&model.ProvisionedAlertRule{UID: "5555", Title: "Same Title"}, removed, false))
+
+	// The rules written and removed earlier in the dry run are seen instead of the files on disk
+	planned := filepath.Join(deployPath, "alert_rule_conv_b_9876fedc.json")
+	assert.NoError(t, i.writeRule(&model.ProvisionedAlertRule{UID: "9876fedc", Title: "Same Title"}, planned))
+	assert.NoError(t, i.removeDeploymentFile(removed))
+	files, err := i.deploymentFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{deployed, planned}, files)
+
+	assert.NoError(t, i.DedupeTitles())
+	titles := map[string]string{}
+	for _, file := range files {
+		rule := &model.ProvisionedAlertRule{}
+		assert.NoError(t, i.readRule(rule, file))
+		titles[file] = rule.Title
+	}
+	assert.Equal(t, map[string]string{deployed: "Same Title (1234abcd)", planned: "Same Title (9876fedc)"}, titles)
+
+	// Nothing is written to disk
+	entries, err := os.ReadDir(deployPath)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	rule := &model.ProvisionedAlertRule{}
+	assert.NoError(t, readRuleFromFile(rule, deployed))
+	assert.Equal(t, "Same Title", rule.Title)
+}
+
+func TestRunDedupeRules(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("GITHUB_OUTPUT", "github-output")
+	require.NoError(t, os.MkdirAll("conv", 0o755))
+	require.NoError(t, os.MkdirAll("deploy", 0o755))
+
+	writeConversion := func(file, ruleID, query string) string {
+		convBytes, err := json.Marshal(model.ConversionOutput{
+			ConversionName: "test_conv",
+			Queries:        []string{query},
+			Rules:          []model.SigmaRule{{ID: ruleID, Title: "Test Rule"}},
+		})
+		require.NoError(t, err)
+		convFile := filepath.Join("conv", file)
+		require.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+		return convFile
+	}
+	run := func(addedFiles []string) {
+		i := NewIntegrator()
+		i.config = model.Configuration{
+			Folders: model.FoldersConfig{
+				ConversionPath: "conv",
+				DeploymentPath: "deploy",
+			},
+			ConversionDefaults: model.ConversionConfig{
+				Target:     "loki",
+				DataSource: "test-datasource",
+			},
+			Conversions: []model.ConversionConfig{
+				{Name: "test_conv", RuleGroup: "Test Rules", TimeWindow: "5m"},
+			},
+			IntegratorConfig: model.IntegrationConfig{
+				DedupeRules:      true,
+				FingerprintLabel: true,
+			},
+		}
+		i.addedFiles = addedFiles
+		require.NoError(t, i.Run())
+	}
+	deploymentFiles := func() []string {
+		files, err := filepath.Glob(filepath.Join("deploy", "*.json"))
+		require.NoError(t, err)
+		return files
+	}
+
+	// A duplicated Sigma rule generates the same alert rule under another UID
+	original := writeConversion("test_conv_original.json", "996f8884-9144-40e7-ac63-29090ccde9a0", "{job=`test`} | json")
+	duplicate := writeConversion("test_conv_duplicate.json", "c1e4b5f2-2a0b-4a4f-9d7e-2f8c6e1d0b3a", "{job=`test`} | json")
+	run([]string{original, duplicate})
+	files := deploymentFiles()
+	require.Len(t, files, 1)
+	// The first file by name is kept when both are added by the same run
+	assert.Contains(t, files[0], "test_conv_duplicate")
+	outputBytes, err := os.ReadFile("github-output")
+	require.NoError(t, err)
+	assert.Contains(t, string(outputBytes), "deduplicated_rules="+filepath.Join("deploy", "alert_rule_test_conv_original_"))
+
+	// Rules sharing a title but not their query are both deployed
+	other := writeConversion("test_conv_other.json", "5d1b7a3e-8f4c-4e2a-9b6d-3c7e1f0a2b4d", "{job=`other`} | json")
+	run([]string{other})
+	assert.Len(t, deploymentFiles(), 2)
+
+	// The deployed rule is kept over a duplicate added later
+	copied := writeConversion("test_conv_a_copy.json", "8a2c4e6f-1b3d-4f5a-8c7e-9d0b2a4c6e8f", "{job=`other`} | json")
+	run([]string{copied})
+	files = deploymentFiles()
+	require.Len(t, files, 2)
+	for _, file := range files {
+		assert.NotContains(t, file, "test_conv_a_copy")
+	}
+}
+
+func TestApplyMetadataBudget(t *testing.T) {
+	longQuery := "{job=`.+`} | json | " + strings.Repeat("field=`value` or ", 20) + "other=`ü`"
+	baseAnnotations := func() map[string]string {
+		return map[string]string{
+			"Query":          longQuery,
+			"TimeWindow":     "5m",
+			"Lookback":       "0s",
+			"LogSourceUid":   "my_data_source",
+			"LogSourceType":  "loki",
+			"ConversionFile": "conversions/conv_rule.json",
+			"Author":         "John Doe",
+		}
+	}
+
+	tests := []struct {
+		name            string
+		budget          int
+		labels          map[string]string
+		wantAnnotations func(map[string]string) map[string]string
+		wantQueryPrefix bool
+	}{
+		{
+			name:   "within budget is unchanged",
+			budget: 10000,
+			wantAnnotations: func(a map[string]string) map[string]string {
+				return a
+			},
+		},
+		{
+			name:   "query truncated to fit",
+			budget: 300,
+			wantAnnotations: func(a map[string]string) map[string]string {
+				delete(a, "Query")
+				return a
+			},
+			wantQueryPrefix: true,
+		},
+		{
+			name:   "query and lower priority annotations dropped",
+			budget: 85,
+			labels: map[string]string{"Level": "high"},
+			wantAnnotations: func(_ map[string]string) map[string]string {
+				return map[string]string{
+					"TimeWindow":     "5m",
+					"Lookback":       "0s",
+					"ConversionFile": "conversions/conv_rule.json",
+					"Author":         "John Doe",
+				}
+			},
+		},
+		{
+			name:   "user metadata and conversion file are never dropped",
+			budget: 10,
+			wantAnnotations: func(_ map[string]string) map[string]string {
+				return map[string]string{
+					"ConversionFile": "conversions/conv_rule.json",
+					"Author":         "John Doe",
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &model.ProvisionedAlertRule{
+				Title:       "Budget Rule",
+				Labels:      tt.labels,
+				Annotations: baseAnnotations(),
+			}
+			applyMetadataBudget(rule, tt.budget, nil, nil)
+
+			if tt.wantQueryPrefix {
+				query := rule.Annotations["Query"]
+				assert.True(t, strings.HasSuffix(query, truncatedSuffix))
+				assert.True(t, strings.HasPrefix(longQuery, strings.TrimSuffix(query, truncatedSuffix)))
+				assert.LessOrEqual(t, metadataSize(rule), tt.budget)
+				delete(rule.Annotations, "Query")
+			}
+			assert.Equal(t, tt.wantAnnotations(baseAnnotations()), rule.Annotations)
+		})
+	}
+}
+
 func TestReadWriteAlertRule(t *testing.T) {
 	// A simple test of reading and writing alert rule files
 	rule := &model.ProvisionedAlertRule{}
@@ -1200,6 +4088,98 @@ func TestReadWriteAlertRule(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestWriteRuleToFileStable(t *testing.T) {
+	t.Chdir(t.TempDir())
+	keys := []string{"Query", "TimeWindow", "owner", "ConversionFile", "Lookback", "criticality", "SigmaRuleIDs", "LogSourceUid"}
+	newRule := func(keys []string) *model.ProvisionedAlertRule {
+		rule := &model.ProvisionedAlertRule{
+			UID:         "5c1c217a",
+			Title:       "Rule 1",
+			Annotations: map[string]string{},
+			Labels:      map[string]string{},
+			Data: []model.AlertQuery{{
+				RefID: "A0",
+				Model: json.RawMessage(`{"refId":"A0", "datasource":{"type":"loki","uid":"loki-ds"},"expr":"{job=` + "`a`" + `}"}`),
+			}},
+		}
+		for _, key := range keys {
+			rule.Annotations[key] = key + " value"
+			rule.Labels[key] = key + " label"
+		}
+		return rule
+	}
+	reversed := slices.Clone(keys)
+	slices.Reverse(reversed)
+
+	for _, prettyPrint := range []bool{false, true} {
+		require.NoError(t, writeRuleToFile(newRule(keys), "first.json", prettyPrint))
+		require.NoError(t, writeRuleToFile(newRule(reversed), "second.json", prettyPrint))
+		first, err := os.ReadFile("first.json")
+		require.NoError(t, err)
+		second, err := os.ReadFile("second.json")
+		require.NoError(t, err)
+		assert.Equal(t, string(first), string(second), "pretty print: %t", prettyPrint)
+		assert.Less(t, strings.Index(string(first), `"ConversionFile"`), strings.Index(string(first), `"owner"`))
+
+		// Reading the file back and writing it again, as re-runs do, doesn't change it either
+		rule := &model.ProvisionedAlertRule{}
+		require.NoError(t, readRuleFromFile(rule, "first.json"))
+		require.NoError(t, writeRuleToFile(rule, "second.json", prettyPrint))
+		second, err = os.ReadFile("second.json")
+		require.NoError(t, err)
+		assert.Equal(t, string(first), string(second), "pretty print: %t", prettyPrint)
+	}
+}
+
+func TestWriteRuleToFileAtomic(t *testing.T) {
+	t.Chdir(t.TempDir())
+	rule := &model.ProvisionedAlertRule{UID: "5c1c217a", Title: "Rule 1"}
+	require.NoError(t, writeRuleToFile(rule, "alert_rule.json", false))
+	original, err := os.ReadFile("alert_rule.json")
+	require.NoError(t, err)
+
+	// A write interrupted before the rename leaves the previous file untouched and no temporary file behind
+	renameFile = func(string, string) error { return errors.New("interrupted") }
+	t.Cleanup(func() { renameFile = os.Rename })
+	rule.Title = "Rule 2"
+	assert.ErrorContains(t, writeRuleToFile(rule, "alert_rule.json", false), "error replacing alert rule file alert_rule.json: interrupted")
+	content, err := os.ReadFile("alert_rule.json")
+	require.NoError(t, err)
+	assert.Equal(t, string(original), string(content))
+	entries, err := os.ReadDir(".")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "alert_rule.json", entries[0].Name())
+
+	// Once the rename succeeds, the file is replaced
+	renameFile = os.Rename
+	require.NoError(t, writeRuleToFile(rule, "alert_rule.json", false))
+	content, err = os.ReadFile("alert_rule.json")
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `"title":"Rule 2"`)
+	entries, err = os.ReadDir(".")
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestWriteRuleToFileMode(t *testing.T) {
+	t.Chdir(t.TempDir())
+	rule := &model.ProvisionedAlertRule{UID: "5c1c217a", Title: "Rule 1"}
+
+	// New files are readable by everyone, like files created with os.Create
+	require.NoError(t, writeRuleToFile(rule, "alert_rule.json", false))
+	info, err := os.Stat("alert_rule.json")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o644), info.Mode().Perm())
+
+	// Replaced files keep their mode
+	require.NoError(t, os.Chmod("alert_rule.json", 0o664))
+	require.NoError(t, writeRuleToFile(rule, "alert_rule.json", false))
+	info, err = os.Stat("alert_rule.json")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o664), info.Mode().Perm())
+}
+
 func TestSummariseSigmaRules(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -1248,6 +4228,164 @@ func TestSummariseSigmaRules(t *testing.T) {
 	}
 }
 
+func TestRunMissingRules(t *testing.T) {
+	tests := []struct {
+		name      string
+		allow     bool
+		wantError string
+	}{
+		{
+			name:      "error by default",
+			wantError: "conversion file " + filepath.Join("conv", "test_conv_a.json") + " has queries but no Sigma rules",
+		},
+		{
+			name:  "derived from the conversion name",
+			allow: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			t.Setenv("GITHUB_OUTPUT", "github-output")
+			config := "folders:\n  conversion_path: conv\n  deployment_path: deploy\n" +
+				"conversion_defaults:\n  target: loki\n  data_source: test-datasource\n" +
+				"conversions:\n  - name: test_conv\n    rule_group: Test Rules\n    time_window: 5m\n" +
+				fmt.Sprintf("integration:\n  allow_missing_rules: %t\n", tt.allow)
+			require.NoError(t, os.WriteFile("config.yml", []byte(config), 0o600))
+			require.NoError(t, os.MkdirAll("conv", 0o755))
+			convFiles := []string{filepath.Join("conv", "test_conv_a.json"), filepath.Join("conv", "test_conv_b.json")}
+			for _, convFile := range convFiles {
+				convBytes, err := json.Marshal(model.ConversionOutput{ConversionName: "test_conv", Queries: []string{"{job=`a`} | json"}})
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+			}
+
+			t.Setenv("INTEGRATOR_CONFIG_PATH", "config.yml")
+			t.Setenv("CHANGED_FILES", strings.Join(convFiles, " "))
+			t.Setenv("DELETED_FILES", "")
+			t.Setenv("ALL_RULES", "")
+			i := NewIntegrator()
+			require.NoError(t, i.LoadConfig())
+			err := i.Run()
+			if tt.wantError != "" {
+				assert.ErrorContains(t, err, tt.wantError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, i.Warnings().List(), 2)
+
+			// Each conversion file gets its own alert rule, with a UID stable across runs
+			titles := map[string]string{}
+			for _, ruleFilename := range []string{"a", "b"} {
+				conversionID, title := summariseConversion("test_conv", ruleFilename)
+				otherID, _ := summariseConversion("test_conv", ruleFilename)
+				assert.Equal(t, conversionID, otherID)
+				titles[getRuleUID("test_conv", conversionID)] = title
+			}
+			assert.Len(t, titles, 2)
+			deployed, err := filepath.Glob(filepath.Join("deploy", "*.json"))
+			require.NoError(t, err)
+			require.Len(t, deployed, 2)
+			for _, file := range deployed {
+				rule := &model.ProvisionedAlertRule{}
+				require.NoError(t, readRuleFromFile(rule, file))
+				assert.Equal(t, titles[rule.UID], rule.Title, rule.UID)
+			}
+			assert.ElementsMatch(t, []string{"test_conv a", "test_conv b"}, slices.Collect(maps.Values(titles)))
+		})
+	}
+}
+
+func TestSummariseConversionLongTitle(t *testing.T) {
+	// The title is truncated without splitting multi-byte characters
+	_, title := summariseConversion("test_conv", strings.Repeat("é", 95))
+	assert.Equal(t, "test_conv "+strings.Repeat("é", 90), title)
+	assert.True(t, utf8.ValidString(title))
+}
+
+func TestRunDuplicateRuleIDs(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		wantError   string
+		wantQueries []string
+	}{
+		{
+			name:      "error by default",
+			wantError: "several Sigma rules with the ID 996f8884-9144-40e7-ac63-29090ccde9a0",
+		},
+		{
+			name:      "error",
+			mode:      "error",
+			wantError: "set integration.duplicate_rule_ids to dedupe",
+		},
+		{
+			name:        "dedupe",
+			mode:        "dedupe",
+			wantQueries: []string{"sum(count_over_time({job=`a`} | json[$__auto]))", "sum(count_over_time({job=`c`} | json[$__auto]))"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			t.Setenv("GITHUB_OUTPUT", "github-output")
+			config := "folders:\n  conversion_path: conv\n  deployment_path: deploy\n" +
+				"conversion_defaults:\n  target: loki\n  data_source: test-datasource\n" +
+				"conversions:\n  - name: test_conv\n    rule_group: Test Rules\n    time_window: 5m\n" +
+				"integration:\n  duplicate_rule_ids: \"" + tt.mode + "\"\n"
+			require.NoError(t, os.WriteFile("config.yml", []byte(config), 0o600))
+			require.NoError(t, os.MkdirAll("conv", 0o755))
+			convBytes, err := json.Marshal(model.ConversionOutput{
+				ConversionName: "test_conv",
+				Queries:        []string{"{job=`a`} | json", "{job=`b`} | json", "{job=`c`} | json"},
+				Rules: []model.SigmaRule{
+					{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Rule A"},
+					{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Rule A copy"},
+					{ID: "dcb63bd5-2a1e-4ac7-9e61-aa5c2a4e1c3a", Title: "Rule C"},
+				},
+			})
+			require.NoError(t, err)
+			convFile := filepath.Join("conv", "test_conv_a.json")
+			require.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+
+			t.Setenv("INTEGRATOR_CONFIG_PATH", "config.yml")
+			t.Setenv("CHANGED_FILES", convFile)
+			t.Setenv("DELETED_FILES", "")
+			t.Setenv("ALL_RULES", "")
+			i := NewIntegrator()
+			require.NoError(t, i.LoadConfig())
+			err = i.Run()
+			if tt.wantError != "" {
+				assert.ErrorContains(t, err, tt.wantError)
+				return
+			}
+			require.NoError(t, err)
+
+			// The duplicate Sigma rule and its query are dropped, with a warning
+			deployed, err := filepath.Glob(filepath.Join("deploy", "*.json"))
+			require.NoError(t, err)
+			require.Len(t, deployed, 1)
+			rule := &model.ProvisionedAlertRule{}
+			require.NoError(t, readRuleFromFile(rule, deployed[0]))
+			assert.Equal(t, "Rule A & Rule C", rule.Title)
+			queries := []string{}
+			for _, query := range rule.Data {
+				var queryModel struct {
+					Expr string `json:"expr"`
+				}
+				require.NoError(t, json.Unmarshal(query.Model, &queryModel))
+				if queryModel.Expr != "" {
+					queries = append(queries, queryModel.Expr)
+				}
+			}
+			assert.Equal(t, tt.wantQueries, queries)
+			assert.Contains(t, strings.Join(i.Warnings().List(), "\n"), "keeping the first of each")
+		})
+	}
+}
+
 // No query testing in this test
 func TestIntegratorRun(t *testing.T) {
 	tests := []struct {
@@ -1260,6 +4398,7 @@ func TestIntegratorRun(t *testing.T) {
 		wantError           bool
 		wantAnnotations     map[string]string
 		wantOrphanedCleanup bool
+		annotateInputFile   bool
 	}{
 		{
 			name:           "single rule single query",
@@ -1368,6 +4507,29 @@ func TestIntegratorRun(t *testing.T) {
 				"ConversionFile": "test_annotations.json",
 			},
 		},
+		{
+			name:           "input file annotation",
+			conversionName: "test_input_file",
+			convOutput: model.ConversionOutput{
+				ConversionName: "test_input_file",
+				InputFile:      "rules/okta/okta_mfa_reset.yml",
+				Queries:        []string{"{job=`test`} | json"},
+				Rules: []model.SigmaRule{
+					{
+						ID:    "996f8884-9144-40e7-ac63-29090ccde9a0",
+						Title: "Test Input File Rule",
+					},
+				},
+			},
+			wantQueries:       []string{"sum(count_over_time({job=`test`} | json[$__auto]))"},
+			wantTitles:        "Test Input File Rule",
+			removedFiles:      []string{},
+			annotateInputFile: true,
+			wantAnnotations: map[string]string{
+				"ConversionFile": "test_input_file.json",
+				"SigmaInputFile": "rules/okta/okta_mfa_reset.yml",
+			},
+		},
 		{
 			name:           "cleanup orphaned files",
 			conversionName: "orphaned_test",
@@ -1435,8 +4597,9 @@ func TestIntegratorRun(t *testing.T) {
 				},
 				Conversions: conversions,
 				IntegratorConfig: model.IntegrationConfig{
-					FolderID: "test-folder",
-					OrgID:    1,
+					FolderID:          "test-folder",
+					OrgID:             1,
+					AnnotateInputFile: tt.annotateInputFile,
 				},
 			}
 
@@ -1484,10 +4647,14 @@ func TestIntegratorRun(t *testing.T) {
 				assert.NoError(t, err)
 			}
 
-			// Set up integrator
+			// Set up integrator, a removed conversion file is never integrated again
+			addedFiles := []string{convFile}
+			if len(tt.removedFiles) > 0 {
+				addedFiles = []string{}
+			}
 			i := &Integrator{
 				config:       config,
-				addedFiles:   []string{convFile},
+				addedFiles:   addedFiles,
 				removedFiles: tt.removedFiles,
 				testFiles:    []string{}, // No query testing in this test
 			}
@@ -0,0 +1,123 @@
+package integrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/grafana/sigma-rule-deployment/shared"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadQueryLibrary reads the shared queries referenced by conversion outputs from a YAML or JSON file,
+// mapping each query ID to its query
+func LoadQueryLibrary(path string) (map[string]string, error) {
+	if !filepath.IsLocal(path) {
+		return nil, fmt.Errorf("query library is not local: %s", path)
+	}
+	contents, err := shared.ReadLocalFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading query library %s: %v", path, err)
+	}
+	library := map[string]string{}
+	if err := yaml.Unmarshal([]byte(contents), &library); err != nil {
+		return nil, fmt.Errorf("error parsing query library %s: %v", path, err)
+	}
+	for id, query := range library {
+		if query == "" {
+			return nil, fmt.Errorf("query %s of the query library %s is empty", id, path)
+		}
+	}
+	return library, nil
+}
+
+// ResolveQueryRefs returns the queries of a conversion output, followed by the queries of the query library
+// referenced by its query_refs, in order. All the references must resolve.
+func ResolveQueryRefs(conversionObject model.ConversionOutput, library map[string]string) ([]string, error) {
+	if len(conversionObject.QueryRefs) == 0 {
+		return conversionObject.Queries, nil
+	}
+	if library == nil {
+		return nil, fmt.Errorf("conversion %s references the queries %s, but integration.query_library is not set",
+			conversionObject.ConversionName, strings.Join(conversionObject.QueryRefs, ", "))
+	}
+	queries := slices.Clone(conversionObject.Queries)
+	var unresolved []string
+	for _, ref := range conversionObject.QueryRefs {
+		query, ok := library[ref]
+		if !ok {
+			unresolved = append(unresolved, ref)
+			continue
+		}
+		queries = append(queries, query)
+	}
+	if len(unresolved) > 0 {
+		return nil, fmt.Errorf("conversion %s references queries missing from the query library: %s",
+			conversionObject.ConversionName, strings.Join(unresolved, ", "))
+	}
+	return queries, nil
+}
+
+// conversionsReferencingLibrary lists the conversion files with query_refs, which are integrated again when the
+// query library changes, as their alert rules embed its queries. Files matched by the ignore file are skipped.
+func (i *Integrator) conversionsReferencingLibrary() ([]string, error) {
+	referencing := []string{}
+	err := filepath.WalkDir(i.config.Folders.ConversionPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to walk directory: %w", err)
+		}
+		if d.IsDir() {
+			if relpath, err := filepath.Rel(i.config.Folders.ConversionPath, path); err == nil && relpath != "." && i.ignore.ignored(relpath, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ignored, err := i.isIgnoredConversionFile(path); err != nil || ignored {
+			return err
+		}
+		contents, err := shared.ReadLocalFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading conversion file %s: %v", path, err)
+		}
+		var conversionObject model.ConversionOutput
+		if err := json.Unmarshal([]byte(contents), &conversionObject); err != nil {
+			i.warnings.Add("Could not check %s for references to the query library: %v", path, err)
+			return nil
+		}
+		if len(conversionObject.QueryRefs) > 0 {
+			referencing = append(referencing, path)
+		}
+		return nil
+	})
+	return referencing, err
+}
+
+// addLibraryConversions adds the conversion files referencing the query library to the changed and tested
+// conversion files, when the query library itself is among the changed or tested files
+func (i *Integrator) addLibraryConversions(changedFiles, testFiles, updated, tested []string) ([]string, []string, error) {
+	queryLibrary := filepath.Clean(i.config.IntegratorConfig.QueryLibrary)
+	isLibrary := func(path string) bool { return path != "" && filepath.Clean(path) == queryLibrary }
+	libraryChanged := slices.ContainsFunc(changedFiles, isLibrary)
+	libraryTested := i.config.IntegratorConfig.TestQueries && slices.ContainsFunc(testFiles, isLibrary)
+	if i.config.IntegratorConfig.QueryLibrary == "" || (!libraryChanged && !libraryTested) {
+		return updated, tested, nil
+	}
+	referencing, err := i.conversionsReferencingLibrary()
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Printf("Query library %s changed, integrating the %d conversion file(s) referencing it\n", queryLibrary, len(referencing))
+	for _, path := range referencing {
+		if libraryChanged && !slices.Contains(updated, path) {
+			updated = append(updated, path)
+		}
+		if libraryTested && !slices.Contains(tested, path) {
+			tested = append(tested, path)
+		}
+	}
+	return updated, tested, nil
+}
@@ -0,0 +1,192 @@
+package integrate
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadQueryLibrary(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.WriteFile("library.yml", []byte("okta_auth: '{job=\"okta\"} | json | eventType=\"user.session.start\"'\n"), 0o600))
+	require.NoError(t, os.WriteFile("library.json", []byte(`{"okta_auth": "{job=\"okta\"} | json"}`), 0o600))
+	require.NoError(t, os.WriteFile("empty.yml", []byte("okta_auth: ''\n"), 0o600))
+	require.NoError(t, os.WriteFile("invalid.yml", []byte("okta_auth: [okta"), 0o600))
+
+	library, err := LoadQueryLibrary("library.yml")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"okta_auth": `{job="okta"} | json | eventType="user.session.start"`}, library)
+
+	library, err = LoadQueryLibrary("library.json")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"okta_auth": `{job="okta"} | json`}, library)
+
+	_, err = LoadQueryLibrary("missing.yml")
+	assert.Error(t, err)
+	_, err = LoadQueryLibrary("empty.yml")
+	assert.ErrorContains(t, err, "query okta_auth of the query library empty.yml is empty")
+	_, err = LoadQueryLibrary("invalid.yml")
+	assert.Error(t, err)
+	_, err = LoadQueryLibrary("/etc/library.yml")
+	assert.Error(t, err)
+}
+
+func TestResolveQueryRefs(t *testing.T) {
+	library := map[string]string{
+		"okta_auth":  `{job="okta"} | json | eventType="user.session.start"`,
+		"okta_reset": `{job="okta"} | json | eventType="user.mfa.factor.reset_all"`,
+	}
+	tests := []struct {
+		name        string
+		queries     []string
+		queryRefs   []string
+		library     map[string]string
+		wantQueries []string
+		wantError   string
+	}{
+		{
+			name:        "no references",
+			queries:     []string{`{job="test"}`},
+			library:     library,
+			wantQueries: []string{`{job="test"}`},
+		},
+		{
+			name:        "references appended to the queries",
+			queries:     []string{`{job="test"}`},
+			queryRefs:   []string{"okta_reset", "okta_auth"},
+			library:     library,
+			wantQueries: []string{`{job="test"}`, library["okta_reset"], library["okta_auth"]},
+		},
+		{
+			name:        "references only",
+			queryRefs:   []string{"okta_auth"},
+			library:     library,
+			wantQueries: []string{library["okta_auth"]},
+		},
+		{
+			name:      "unresolved references",
+			queryRefs: []string{"okta_auth", "missing", "other"},
+			library:   library,
+			wantError: "conversion conv references queries missing from the query library: missing, other",
+		},
+		{
+			name:      "no query library",
+			queryRefs: []string{"okta_auth"},
+			wantError: "conversion conv references the queries okta_auth, but integration.query_library is not set",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries, err := ResolveQueryRefs(model.ConversionOutput{
+				ConversionName: "conv",
+				Queries:        tt.queries,
+				QueryRefs:      tt.queryRefs,
+			}, tt.library)
+			if tt.wantError != "" {
+				assert.EqualError(t, err, tt.wantError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantQueries, queries)
+		})
+	}
+}
+
+func TestDoConversionsQueryLibrary(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll("conv", 0o755))
+	require.NoError(t, os.MkdirAll("deploy", 0o755))
+	require.NoError(t, os.WriteFile("library.yml", []byte("okta_auth: '{job=\"okta\"} | json'\n"), 0o600))
+
+	writeConversion := func(file string, queryRefs []string) string {
+		convBytes, err := json.Marshal(model.ConversionOutput{
+			ConversionName: "test_conv",
+			Queries:        []string{`{job="test"} | json`},
+			QueryRefs:      queryRefs,
+			Rules:          []model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}},
+		})
+		require.NoError(t, err)
+		convFile := filepath.Join("conv", file)
+		require.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+		return convFile
+	}
+
+	i := NewIntegrator()
+	i.config = model.Configuration{
+		Folders: model.FoldersConfig{
+			ConversionPath: "conv",
+			DeploymentPath: "deploy",
+		},
+		ConversionDefaults: model.ConversionConfig{
+			Target:     "loki",
+			DataSource: "test-datasource",
+		},
+		Conversions: []model.ConversionConfig{
+			{Name: "test_conv", RuleGroup: "Test Rules", TimeWindow: "5m"},
+		},
+	}
+	var err error
+	i.queryLibrary, err = LoadQueryLibrary("library.yml")
+	require.NoError(t, err)
+
+	convFile := writeConversion("test_conv_rule.json", []string{"okta_auth"})
+	i.addedFiles = []string{convFile}
+	require.NoError(t, i.DoConversions())
+
+	convID, _, err := summariseSigmaRules([]model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}})
+	require.NoError(t, err)
+	rule := &model.ProvisionedAlertRule{}
+	require.NoError(t, readRuleFromFile(rule, filepath.Join("deploy", "alert_rule_test_conv_rule_"+getRuleUID("test_conv", convID)+".json")))
+
+	// The library query is expanded into the alert model after the conversion's own query
+	require.Len(t, rule.Data, 4)
+	assert.Contains(t, string(rule.Data[0].Model), `"expr":"sum(count_over_time({job=\"test\"} | json[$__auto]))"`)
+	assert.Contains(t, string(rule.Data[1].Model), `"expr":"sum(count_over_time({job=\"okta\"} | json[$__auto]))"`)
+
+	// An unresolved reference fails the integration
+	i.addedFiles = []string{writeConversion("test_conv_other.json", []string{"missing"})}
+	assert.ErrorContains(t, i.DoConversions(), "references queries missing from the query library: missing")
+}
+
+func TestLoadConfigQueryLibraryChanged(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll(filepath.Join("conv", "okta"), 0o755))
+	config := "folders:\n  conversion_path: conv\n  deployment_path: deploy\n" +
+		"integration:\n  test_queries: true\n  query_library: ./library.yml\n"
+	require.NoError(t, os.WriteFile("config.yml", []byte(config), 0o600))
+	require.NoError(t, os.WriteFile("library.yml", []byte("okta_auth: '{job=\"okta\"} | json'\n"), 0o600))
+	for file, queryRefs := range map[string][]string{
+		filepath.Join("conv", "okta", "test_conv_auth.json"): {"okta_auth"},
+		filepath.Join("conv", "test_conv_other.json"):        nil,
+	} {
+		convBytes, err := json.Marshal(model.ConversionOutput{ConversionName: "test_conv", Queries: []string{`{job="test"} | json`}, QueryRefs: queryRefs})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(file, convBytes, 0o600))
+	}
+	t.Setenv("INTEGRATOR_CONFIG_PATH", "config.yml")
+	t.Setenv("DELETED_FILES", "")
+	t.Setenv("MANUAL_FILES", "")
+	t.Setenv("ALL_RULES", "")
+
+	// The conversions referencing the changed query library are integrated and tested again, once
+	t.Setenv("CHANGED_FILES", "library.yml conv/okta/test_conv_auth.json")
+	t.Setenv("TEST_FILES", "library.yml")
+	i := NewIntegrator()
+	require.NoError(t, i.LoadConfig())
+	assert.Equal(t, []string{filepath.Join("conv", "okta", "test_conv_auth.json")}, i.addedFiles)
+	assert.Equal(t, []string{filepath.Join("conv", "okta", "test_conv_auth.json")}, i.testFiles)
+
+	// They aren't when the query library is unchanged
+	t.Setenv("CHANGED_FILES", "conv/test_conv_other.json")
+	t.Setenv("TEST_FILES", "")
+	i = NewIntegrator()
+	require.NoError(t, i.LoadConfig())
+	assert.Equal(t, []string{filepath.Join("conv", "test_conv_other.json")}, i.addedFiles)
+	assert.Empty(t, i.testFiles)
+}
@@ -0,0 +1,172 @@
+package integrate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/sigma-rule-deployment/shared"
+)
+
+// lokiMatcher matches a label matcher of a LogQL stream selector, e.g. job=`okta` or level!~"debug|info"
+var lokiMatcher = regexp.MustCompile("^\\s*[a-zA-Z_][a-zA-Z0-9_]*\\s*(=~|!~|!=|=)\\s*(\"(?:[^\"\\\\]|\\\\.)*\"|`[^`]*`)\\s*$")
+
+// closingBrackets maps the opening brackets to their closing bracket
+var closingBrackets = map[rune]rune{'(': ')', '[': ']', '{': '}'}
+
+// checkMalformedQuery looks for the signs of a truncated or mangled query before it is deployed, so it fails the
+// integration rather than the deployment or the evaluation of its alert rule. LogQL queries must have balanced
+// brackets and terminated strings, well-formed stream selectors and no empty pipeline stages. The queries of other
+// data source types, whose syntax varies, must be non-empty, with terminated double quoted strings and balanced
+// parentheses. This is not a parser: a query passing these checks may still be invalid.
+func checkMalformedQuery(query, datasourceType string) error {
+	if strings.TrimSpace(query) == "" {
+		return fmt.Errorf("query is empty")
+	}
+	if datasourceType == shared.Loki {
+		return checkMalformedLogQL(query)
+	}
+	depth := 0
+	quoted := false
+	for index := 0; index < len(query); index++ {
+		switch char := query[index]; {
+		case quoted && char == '\\':
+			index++
+		case char == '"':
+			quoted = !quoted
+		case quoted:
+		case char == '(':
+			depth++
+		case char == ')':
+			if depth--; depth < 0 {
+				return fmt.Errorf("unexpected ) at position %d", index)
+			}
+		}
+	}
+	if quoted {
+		return fmt.Errorf("unterminated string")
+	}
+	if depth > 0 {
+		return fmt.Errorf("unclosed (")
+	}
+	return nil
+}
+
+// checkMalformedLogQL checks the brackets, strings, stream selectors and pipeline stages of a LogQL query
+func checkMalformedLogQL(query string) error {
+	runes := []rune(query)
+	brackets := []rune{}
+	// start of the stream selector being read, -1 outside of stream selectors
+	selectorStart := -1
+	selectors := 0
+	// whether the last pipeline stage is still empty
+	emptyStage := false
+	for index := 0; index < len(runes); index++ {
+		char := runes[index]
+		switch char {
+		case '"', '`':
+			end := index + 1
+			for ; end < len(runes) && runes[end] != char; end++ {
+				if char == '"' && runes[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(runes) {
+				return fmt.Errorf("unterminated string at position %d", index)
+			}
+			index = end
+			emptyStage = false
+		case '(', '[', '{':
+			if char == '{' {
+				if selectorStart >= 0 {
+					return fmt.Errorf("unexpected { at position %d", index)
+				}
+				selectorStart = index
+			}
+			brackets = append(brackets, char)
+			emptyStage = false
+		case ')', ']', '}':
+			if len(brackets) == 0 || closingBrackets[brackets[len(brackets)-1]] != char {
+				return fmt.Errorf("unexpected %c at position %d", char, index)
+			}
+			brackets = brackets[:len(brackets)-1]
+			if char == '}' {
+				if err := checkLokiStreamSelector(string(runes[selectorStart+1 : index])); err != nil {
+					return err
+				}
+				selectorStart = -1
+				selectors++
+			}
+			emptyStage = false
+		case '|':
+			// Line filters (|=, |~, |>) are stages of their own
+			if index+1 < len(runes) && strings.ContainsRune("=~>", runes[index+1]) {
+				index++
+				emptyStage = false
+				break
+			}
+			if emptyStage {
+				return fmt.Errorf("empty pipeline stage at position %d", index)
+			}
+			emptyStage = true
+		default:
+			if !strings.ContainsRune(" \t\r\n", char) {
+				emptyStage = false
+			}
+		}
+	}
+	if len(brackets) > 0 {
+		return fmt.Errorf("unclosed %c", brackets[len(brackets)-1])
+	}
+	if emptyStage {
+		return fmt.Errorf("empty pipeline stage at the end of the query")
+	}
+	if selectors == 0 {
+		return fmt.Errorf("no stream selector, e.g. {job=\"okta\"}")
+	}
+	return nil
+}
+
+// checkLokiStreamSelector checks the label matchers between the braces of a LogQL stream selector
+func checkLokiStreamSelector(selector string) error {
+	matchers := splitOutsideStrings(selector, ',')
+	// A trailing comma is allowed
+	if len(matchers) > 1 && strings.TrimSpace(matchers[len(matchers)-1]) == "" {
+		matchers = matchers[:len(matchers)-1]
+	}
+	for _, matcher := range matchers {
+		if strings.TrimSpace(matcher) == "" {
+			return fmt.Errorf("empty label matcher in stream selector {%s}", selector)
+		}
+		if !lokiMatcher.MatchString(matcher) {
+			return fmt.Errorf("invalid label matcher %s in stream selector {%s}", strings.TrimSpace(matcher), selector)
+		}
+	}
+	return nil
+}
+
+// splitOutsideStrings splits a LogQL expression around the separators outside of its double quoted and raw strings
+func splitOutsideStrings(value string, separator rune) []string {
+	parts := []string{}
+	start := 0
+	var quote rune
+	escaped := false
+	for index, char := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && char == '\\':
+			escaped = true
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '"' || char == '`':
+			quote = char
+		case char == separator:
+			parts = append(parts, value[start:index])
+			start = index + len(string(char))
+		}
+	}
+	return append(parts, value[start:])
+}
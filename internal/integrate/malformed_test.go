@@ -0,0 +1,69 @@
+package integrate
+
+import (
+	"testing"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckMalformedQuery(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		datasourceType string
+		wantError      string
+	}{
+		{name: "log query", query: testWrappedLogQuery, datasourceType: "loki"},
+		{name: "log query with raw strings", query: testGhAuditLogQuery, datasourceType: "loki"},
+		{name: "metric query", query: testValueCountMetricQuery, datasourceType: "loki"},
+		{name: "wrapped log query", query: testGhAuditLogQueryExpr, datasourceType: "loki"},
+		{name: "line filters", query: "{job=`okta`} |= `login` != \"debug\" |~ `(?i)fail` |> \"<_> user=<user>\"", datasourceType: "loki"},
+		{name: "line format template", query: "{job=`okta`} | json | line_format \"{{.user}} {{.action}}\"", datasourceType: "loki"},
+		{name: "escaped quote", query: `{job="okta"} |= "say \"hi\" |"`, datasourceType: "loki"},
+		{name: "trailing comma in selector", query: "{job=`okta`, }", datasourceType: "loki"},
+		{name: "empty query", query: "  ", datasourceType: "loki", wantError: "query is empty"},
+		{name: "unclosed selector", query: "{job=`okta` | json", datasourceType: "loki", wantError: "unclosed {"},
+		{name: "unbalanced parentheses", query: "sum(count_over_time({job=`okta`}[5m])", datasourceType: "loki", wantError: "unclosed ("},
+		{name: "mismatched brackets", query: "count_over_time({job=`okta`}[5m)", datasourceType: "loki", wantError: "unexpected ) at position 31"},
+		{name: "unterminated string", query: "{job=`okta`} |= \"login", datasourceType: "loki", wantError: "unterminated string at position 16"},
+		{name: "invalid matcher", query: "{job==`okta`}", datasourceType: "loki", wantError: "invalid label matcher job==`okta`"},
+		{name: "unquoted matcher value", query: "{job=okta}", datasourceType: "loki", wantError: "invalid label matcher job=okta"},
+		{name: "empty selector", query: "{} | json", datasourceType: "loki", wantError: "empty label matcher"},
+		{name: "empty pipeline stage", query: "{job=`okta`} | json | | logfmt", datasourceType: "loki", wantError: "empty pipeline stage at position 22"},
+		{name: "trailing pipe", query: "{job=`okta`} | json |", datasourceType: "loki", wantError: "empty pipeline stage at the end of the query"},
+		{name: "no stream selector", query: "| json", datasourceType: "loki", wantError: "no stream selector"},
+		{name: "lucene query", query: `event.action:"user.login" AND (user.name:admin OR user.name:"O'Brien")`, datasourceType: "elasticsearch"},
+		{name: "lucene range query", query: `status:[400 TO 500} AND NOT path:"/health"`, datasourceType: "elasticsearch"},
+		{name: "lucene unbalanced parentheses", query: `(event.action:login`, datasourceType: "elasticsearch", wantError: "unclosed ("},
+		{name: "lucene unexpected parenthesis", query: `event.action:login)`, datasourceType: "elasticsearch", wantError: "unexpected ) at position 18"},
+		{name: "lucene unterminated string", query: `user.name:"admin`, datasourceType: "elasticsearch", wantError: "unterminated string"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkMalformedQuery(tt.query, tt.datasourceType)
+			if tt.wantError != "" {
+				assert.ErrorContains(t, err, tt.wantError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestConvertToAlertRejectMalformedQueries(t *testing.T) {
+	convConfig := model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", TimeWindow: "5m"}
+	convObject := model.ConversionOutput{ConversionName: "conv"}
+	queries := []string{"{job=`okta`} | json", "{job=`okta` | json"}
+
+	// Malformed queries are only rejected when enabled
+	i := NewIntegrator()
+	require.NoError(t, i.ConvertToAlert(&model.ProvisionedAlertRule{}, queries, "Rule 1", convConfig, "conversions/conv.json", convObject))
+
+	i.config.IntegratorConfig.RejectMalformedQueries = true
+	err := i.ConvertToAlert(&model.ProvisionedAlertRule{}, queries, "Rule 1", convConfig, "conversions/conv.json", convObject)
+	assert.ErrorContains(t, err, "malformed query {job=`okta` | json of conversion conv: unclosed {")
+	require.NoError(t, i.ConvertToAlert(&model.ProvisionedAlertRule{}, queries[:1], "Rule 1", convConfig, "conversions/conv.json", convObject))
+}
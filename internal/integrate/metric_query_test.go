@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/grafana/sigma-rule-deployment/shared"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -22,6 +23,8 @@ func TestIsLokiMetricQuery(t *testing.T) {
 		{name: "log query stream selector", query: `{name="gh-audit-logs"} | json`, want: false},
 		{name: "log query with line filters", query: `{job=~".+"} |~ "error" | json | level="error"`, want: false},
 		{name: "log query with label filter", query: `{name="okta-logs",eventType="user.session.start"} | json | event_outcome="success"`, want: false},
+		{name: "plain stream selector", query: `{job="app"}`, want: false},
+		{name: "log query filtering on a summary label", query: `{job="app"} | json | summary="count"`, want: false},
 
 		{name: "sum by event_count correlation", query: testEventCountMetricQuery, want: true},
 		{name: "sum without aggregation", query: `sum without (instance) (count_over_time({job="app"} | json [1h]))`, want: true},
@@ -30,6 +33,13 @@ func TestIsLokiMetricQuery(t *testing.T) {
 		{name: "avg by host", query: `avg by (host) (rate({job="app"} | json [5m]))`, want: true},
 		{name: "min over time", query: `min by (pod) (min_over_time({namespace="prod"} | json | unwrap bytes [5m]))`, want: true},
 		{name: "max over time", query: `max by (pod) (max_over_time({namespace="prod"} | json | unwrap bytes [5m]))`, want: true},
+		{name: "topk", query: `topk(5, sum by (user) (count_over_time({job="app"} | json [5m])))`, want: true},
+		{name: "sum with leading space", query: ` sum(count_over_time({job="app"} [5m])) > 10`, want: true},
+		{name: "parenthesised sum", query: `(sum(count_over_time({job="app"} [5m]))) > 10`, want: true},
+		{name: "aggregation grouping before the arguments", query: `sum by(host)(rate({job="app"} [1m]))`, want: true},
+		{name: "range function", query: `rate({job="app"} |= "error" [1m])`, want: true},
+		{name: "bytes rate", query: `bytes_rate({job="app"} [1m])`, want: true},
+		{name: "quantile over time", query: `quantile_over_time(0.99, {job="app"} | json | unwrap latency [5m]) by (host)`, want: true},
 	}
 
 	for _, tt := range tests {
@@ -88,6 +98,24 @@ func TestCreateAlertQuery_LokiWrapping(t *testing.T) {
 			wantWrap:  false,
 			wantExact: `min by (pod) (min_over_time({namespace="prod"} | json [5m]))`,
 		},
+		{
+			name:      "preserves topk metric query",
+			input:     `topk(5, sum by (user) (count_over_time({job="app"} | json [5m])))`,
+			wantWrap:  false,
+			wantExact: `topk(5, sum by (user) (count_over_time({job="app"} | json [5m])))`,
+		},
+		{
+			name:      "preserves metric query with leading space",
+			input:     ` sum(count_over_time({job="app"} [5m])) > 10`,
+			wantWrap:  false,
+			wantExact: ` sum(count_over_time({job="app"} [5m])) > 10`,
+		},
+		{
+			name:      "wraps plain stream selector",
+			input:     `{job="app"}`,
+			wantWrap:  true,
+			wantExact: `sum(count_over_time({job="app"}[$__auto]))`,
+		},
 		{
 			name:      "preserves max metric query",
 			input:     `max by (pod) (max_over_time({namespace="prod"} | json [5m]))`,
@@ -100,7 +128,7 @@ func TestCreateAlertQuery_LokiWrapping(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 
-			alertQuery, err := createAlertQuery(tt.input, "A0", testGrafanaCloudLogsDS, timerange, lokiConfig, lokiConfig)
+			alertQuery, err := createAlertQuery(tt.input, "A0", testGrafanaCloudLogsDS, timerange, lokiConfig, lokiConfig, nil)
 			require.NoError(t, err)
 
 			var modelFields map[string]any
@@ -121,3 +149,111 @@ func TestCreateAlertQuery_LokiWrapping(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateAlertQuery_LokiRange(t *testing.T) {
+	t.Parallel()
+
+	timerange := model.RelativeTimeRange{From: model.Duration(5 * time.Minute), To: 0}
+
+	tests := []struct {
+		name      string
+		input     string
+		queryType string
+		lokiRange string
+		wantExpr  string
+		wantError bool
+	}{
+		{
+			name:     "adds the auto range to a log query without range",
+			input:    `{job="app"} | json`,
+			wantExpr: `sum(count_over_time({job="app"} | json[$__auto]))`,
+		},
+		{
+			name:     "keeps the explicit range of a log query",
+			input:    `{job="app"} | json [5m]`,
+			wantExpr: `sum(count_over_time({job="app"} | json [5m]))`,
+		},
+		{
+			name:      "keeps the explicit range of a range query",
+			input:     `{job="app"} | json[1h30m]`,
+			queryType: "range",
+			wantExpr:  `sum(rate({job="app"} | json[1h30m]))`,
+		},
+		{
+			name:     "keeps a variable range with an offset",
+			input:    `{job="app"} [$__interval] offset 1h`,
+			wantExpr: `sum(count_over_time({job="app"} [$__interval] offset 1h))`,
+		},
+		{
+			name:      "replaces the explicit range with the auto range",
+			input:     `{job="app"} | json [5m]`,
+			lokiRange: LokiRangeAuto,
+			wantExpr:  `sum(count_over_time({job="app"} | json[$__auto]))`,
+		},
+		{
+			name:     "ignores brackets in a line filter",
+			input:    `{job="app"} |= "[5m]"`,
+			wantExpr: `sum(count_over_time({job="app"} |= "[5m]"[$__auto]))`,
+		},
+		{
+			name:      "invalid range",
+			input:     `{job="app"} | json [5m]`,
+			lokiRange: "drop",
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			lokiConfig := model.ConversionConfig{Target: testLokiTarget, DataSource: testGrafanaCloudLogsDS, LokiQueryType: tt.queryType, LokiRange: tt.lokiRange}
+			alertQuery, err := createAlertQuery(tt.input, "A0", testGrafanaCloudLogsDS, timerange, lokiConfig, model.ConversionConfig{}, nil)
+			if tt.wantError {
+				assert.ErrorContains(t, err, "invalid loki_range")
+				return
+			}
+			require.NoError(t, err)
+
+			var modelFields map[string]any
+			require.NoError(t, json.Unmarshal(alertQuery.Model, &modelFields))
+			assert.Equal(t, tt.wantExpr, modelFields["expr"])
+		})
+	}
+}
+
+func TestCreateAlertQuery_Graphite(t *testing.T) {
+	t.Parallel()
+
+	graphiteConfig := model.ConversionConfig{Target: shared.Graphite, DataSource: "graphite-uid"}
+	timerange := model.RelativeTimeRange{From: model.Duration(5 * time.Minute), To: 0}
+	query := `sumSeries(auth.failures.*.count)`
+
+	alertQuery, err := createAlertQuery(query, "A0", "graphite-uid", timerange, graphiteConfig, model.ConversionConfig{}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, alertQuery.QueryType)
+	// Graphite targets are not wrapped in a Loki metric query
+	assert.JSONEq(t, `{"refId":"A0","datasource":{"type":"graphite","uid":"graphite-uid"},"target":"sumSeries(auth.failures.*.count)"}`, string(alertQuery.Model))
+}
+
+func TestCreateAlertQuery_Prometheus(t *testing.T) {
+	t.Parallel()
+
+	prometheusConfig := model.ConversionConfig{Target: shared.Prometheus, DataSource: "mimir-uid"}
+	timerange := model.RelativeTimeRange{From: model.Duration(5 * time.Minute), To: 0}
+	query := `sum(rate(auth_failures_total[5m]))`
+
+	alertQuery, err := createAlertQuery(query, "A0", "mimir-uid", timerange, prometheusConfig, model.ConversionConfig{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "A0", alertQuery.RefID)
+	assert.Equal(t, "mimir-uid", alertQuery.DatasourceUID)
+	assert.Equal(t, "instant", alertQuery.QueryType)
+	// PromQL queries are not wrapped in a Loki metric query, and use the Prometheus model rather than the generic one
+	assert.JSONEq(t, `{"refId":"A0","datasource":{"type":"prometheus","uid":"mimir-uid"},"expr":"sum(rate(auth_failures_total[5m]))","instant":true,"range":false,"editorMode":"code","intervalMs":1000,"maxDataPoints":43200}`, string(alertQuery.Model))
+
+	var modelFields map[string]any
+	require.NoError(t, json.Unmarshal(alertQuery.Model, &modelFields))
+	for _, field := range []string{"query", "target", "queryType", "metrics", "bucketAggs", "timeField"} {
+		assert.NotContains(t, modelFields, field)
+	}
+}
@@ -0,0 +1,198 @@
+package integrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/grafana/sigma-rule-deployment/shared"
+)
+
+// addToPlan records a change to a deployment file in the deployment plan. Successive changes to the
+// same file are merged, so the plan holds the single operation to deploy for each file.
+func (i *Integrator) addToPlan(operation, file string, rule *model.ProvisionedAlertRule) {
+	if i.plan == nil {
+		i.plan = map[string]model.PlannedAlert{}
+	}
+	i.planChanges++
+	if previous, ok := i.plan[file]; ok {
+		switch {
+		case previous.Operation == model.PlanAdd && operation == model.PlanDelete:
+			// The file was created and removed during the same run, there's nothing to deploy
+			delete(i.plan, file)
+			return
+		case previous.Operation == model.PlanAdd:
+			operation = model.PlanAdd
+		case previous.Operation == model.PlanDelete && operation != model.PlanDelete:
+			// The file was removed and then written again, so the alert rule still exists
+			operation = model.PlanUpdate
+		}
+	}
+	i.plan[file] = model.PlannedAlert{
+		Operation: operation,
+		File:      file,
+		UID:       rule.UID,
+		FolderUID: rule.FolderUID,
+		RuleGroup: rule.RuleGroup,
+		OrgID:     rule.OrgID,
+	}
+}
+
+// removeDeploymentFile removes a deployment file and records its deletion in the deployment plan
+func (i *Integrator) removeDeploymentFile(file string) error {
+	// The alert rule is only read to describe it in the plan, the deployer only needs its file name
+	rule := &model.ProvisionedAlertRule{}
+	if err := i.readRule(rule, file); err != nil {
+		rule = &model.ProvisionedAlertRule{}
+	}
+	if err := i.removeFile(file); err != nil {
+		return err
+	}
+	i.addToPlan(model.PlanDelete, file, rule)
+	return nil
+}
+
+// writeRule writes an alert rule to its deployment file. A dry run keeps it in memory instead, for the later
+// passes over the deployment folder to see it.
+func (i *Integrator) writeRule(rule *model.ProvisionedAlertRule, file string) error {
+	if i.dryRun {
+		// The rule is copied as it would be read back from its file, as the caller may modify it afterwards
+		ruleJSON, err := json.Marshal(rule)
+		if err != nil {
+			return fmt.Errorf("error marshalling alert rule: %v", err)
+		}
+		planned := &model.ProvisionedAlertRule{}
+		if err := json.Unmarshal(ruleJSON, planned); err != nil {
+			return fmt.Errorf("error unmarshalling alert rule: %v", err)
+		}
+		if i.plannedRules == nil {
+			i.plannedRules = map[string]*model.ProvisionedAlertRule{}
+		}
+		i.plannedRules[file] = planned
+		return nil
+	}
+	return writeRuleToFile(rule, file, i.prettyPrint)
+}
+
+// readRule reads the alert rule of a deployment file, as written earlier in a dry run if it was
+func (i *Integrator) readRule(rule *model.ProvisionedAlertRule, file string) error {
+	planned, ok := i.plannedRules[file]
+	if !ok {
+		return readRuleFromFile(rule, file)
+	}
+	if planned != nil {
+		*rule = *planned
+		rule.Annotations = maps.Clone(planned.Annotations)
+		rule.Labels = maps.Clone(planned.Labels)
+		rule.Data = slices.Clone(planned.Data)
+	}
+	return nil
+}
+
+// deploymentFiles lists the alert rule files of the deployment folder, sorted, along with those written and
+// without those removed earlier in a dry run
+func (i *Integrator) deploymentFiles() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(i.config.Folders.DeploymentPath, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing deployment files: %v", err)
+	}
+	for file, planned := range i.plannedRules {
+		if planned == nil {
+			files = slices.DeleteFunc(files, func(f string) bool { return f == file })
+		} else if !slices.Contains(files, file) {
+			files = append(files, file)
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// writeFile writes the content of a file, unless in a dry run
+func (i *Integrator) writeFile(file string, content []byte) error {
+	if i.dryRun {
+		return nil
+	}
+	return os.WriteFile(file, content, 0o644) //nolint:gosec // G306: the written files are committed, so the runner user must be able to read them
+}
+
+// removeFile removes a file. A dry run only records its removal, for the later passes over the deployment
+// folder not to see it.
+func (i *Integrator) removeFile(file string) error {
+	if i.dryRun {
+		if i.plannedRules == nil {
+			i.plannedRules = map[string]*model.ProvisionedAlertRule{}
+		}
+		i.plannedRules[file] = nil
+		return nil
+	}
+	return os.Remove(file)
+}
+
+// addManualFileToPlan records a deployment file modified by a human as updated in the deployment plan.
+// An update also creates the alert rule if it doesn't exist yet.
+func (i *Integrator) addManualFileToPlan(file string) {
+	rule := &model.ProvisionedAlertRule{}
+	if err := readRuleFromFile(rule, file); err != nil {
+		return
+	}
+	i.addToPlan(model.PlanUpdate, file, rule)
+}
+
+// Plan returns the deployment plan of the deployment files changed so far, sorted by file
+func (i *Integrator) Plan() model.DeploymentPlan {
+	plan := model.DeploymentPlan{Alerts: make([]model.PlannedAlert, 0, len(i.plan))}
+	for _, alert := range i.plan {
+		plan.Alerts = append(plan.Alerts, alert)
+	}
+	slices.SortFunc(plan.Alerts, func(a, b model.PlannedAlert) int {
+		return strings.Compare(a.File, b.File)
+	})
+	return plan
+}
+
+// printPlan prints the changes to the deployment files of a dry run, one operation and file per line
+func (i *Integrator) printPlan() {
+	plan := i.Plan()
+	fmt.Printf("Dry run: %d alert rule file(s) would change\n", len(plan.Alerts))
+	for _, alert := range plan.Alerts {
+		fmt.Printf("  %s %s\n", alert.Operation, alert.File)
+	}
+}
+
+// WritePlan writes the deployment plan to the plan file, for the deployer to consume
+// instead of discovering the changed deployment files from Git
+func (i *Integrator) WritePlan() error {
+	planFile := i.config.IntegratorConfig.PlanFile
+	planBytes, err := marshalJSON(i.Plan(), i.prettyPrint)
+	if err != nil {
+		return fmt.Errorf("error marshalling deployment plan: %v", err)
+	}
+	if err := os.WriteFile(planFile, planBytes, 0o644); err != nil { //nolint:gosec // G306: the plan is read by later steps running as the runner user
+		return fmt.Errorf("error writing deployment plan %s: %v", planFile, err)
+	}
+	fmt.Printf("Deployment plan written to %s: %d alert rule file(s) changed\n", planFile, len(i.plan))
+	return nil
+}
+
+// WriteLockFile writes the lock of all the alert rule files of the deployment folder to the lock file
+func (i *Integrator) WriteLockFile() error {
+	lockFile := i.config.IntegratorConfig.LockFile
+	lock, err := shared.LockAlerts(i.config.Folders.DeploymentPath, i.annotationKey("ConversionFile"))
+	if err != nil {
+		return err
+	}
+	lockBytes, err := marshalJSON(lock, i.prettyPrint)
+	if err != nil {
+		return fmt.Errorf("error marshalling lock file: %v", err)
+	}
+	if err := os.WriteFile(lockFile, lockBytes, 0o644); err != nil { //nolint:gosec // G306: the lock file is committed, so the runner user must be able to read it
+		return fmt.Errorf("error writing lock file %s: %v", lockFile, err)
+	}
+	fmt.Printf("Lock file written to %s: %d alert rule file(s)\n", lockFile, len(lock.Alerts))
+	return nil
+}
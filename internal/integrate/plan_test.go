@@ -0,0 +1,293 @@
+package integrate
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/grafana/sigma-rule-deployment/shared"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddToPlan(t *testing.T) {
+	rule := &model.ProvisionedAlertRule{UID: "abc123", FolderUID: "folder", RuleGroup: "group", OrgID: 1}
+	tests := []struct {
+		name       string
+		operations []string
+		want       string
+	}{
+		{name: "added", operations: []string{model.PlanAdd}, want: model.PlanAdd},
+		{name: "added then updated", operations: []string{model.PlanAdd, model.PlanUpdate}, want: model.PlanAdd},
+		{name: "added then deleted", operations: []string{model.PlanAdd, model.PlanDelete}, want: ""},
+		{name: "updated then deleted", operations: []string{model.PlanUpdate, model.PlanDelete}, want: model.PlanDelete},
+		{name: "deleted then added", operations: []string{model.PlanDelete, model.PlanAdd}, want: model.PlanUpdate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := NewIntegrator()
+			for _, operation := range tt.operations {
+				i.addToPlan(operation, "deploy/alert_rule_conv_rule_abc123.json", rule)
+			}
+			plan := i.Plan()
+			if tt.want == "" {
+				assert.Empty(t, plan.Alerts)
+				return
+			}
+			assert.Equal(t, []model.PlannedAlert{{
+				Operation: tt.want,
+				File:      "deploy/alert_rule_conv_rule_abc123.json",
+				UID:       "abc123",
+				FolderUID: "folder",
+				RuleGroup: "group",
+				OrgID:     1,
+			}}, plan.Alerts)
+		})
+	}
+}
+
+func TestRunWritesPlan(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("GITHUB_OUTPUT", "github-output")
+	assert.NoError(t, os.MkdirAll("conv", 0o755))
+	assert.NoError(t, os.MkdirAll("deploy", 0o755))
+
+	convFile := filepath.Join("conv", "test_conv_rule.json")
+	writeConversion := func(query string) {
+		convBytes, err := json.Marshal(model.ConversionOutput{
+			ConversionName: "test_conv",
+			Queries:        []string{query},
+			Rules:          []model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+	}
+	readPlan := func() model.DeploymentPlan {
+		planBytes, err := os.ReadFile("plan.json")
+		assert.NoError(t, err)
+		plan := model.DeploymentPlan{}
+		assert.NoError(t, json.Unmarshal(planBytes, &plan))
+		return plan
+	}
+	run := func(addedFiles, removedFiles []string) {
+		i := NewIntegrator()
+		i.config = model.Configuration{
+			Folders: model.FoldersConfig{
+				ConversionPath: "conv",
+				DeploymentPath: "deploy",
+			},
+			ConversionDefaults: model.ConversionConfig{
+				Target:     "loki",
+				DataSource: "test-datasource",
+			},
+			Conversions: []model.ConversionConfig{
+				{Name: "test_conv", RuleGroup: "Test Rules", TimeWindow: "5m"},
+			},
+			IntegratorConfig: model.IntegrationConfig{
+				FolderID: "test-folder",
+				OrgID:    1,
+				PlanFile: "plan.json",
+			},
+		}
+		i.addedFiles = addedFiles
+		i.removedFiles = removedFiles
+		assert.NoError(t, i.Run())
+	}
+
+	convID, _, err := summariseSigmaRules([]model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}})
+	assert.NoError(t, err)
+	uid := getRuleUID("test_conv", convID)
+	deployFile := filepath.Join("deploy", "alert_rule_test_conv_rule_"+uid+".json")
+	plannedAlert := func(operation string) model.PlannedAlert {
+		return model.PlannedAlert{
+			Operation: operation,
+			File:      deployFile,
+			UID:       uid,
+			FolderUID: "test-folder",
+			RuleGroup: "Test Rules",
+			OrgID:     1,
+		}
+	}
+
+	// A new alert rule file is added
+	writeConversion("{job=`test`} | json")
+	run([]string{convFile}, nil)
+	assert.Equal(t, []model.PlannedAlert{plannedAlert(model.PlanAdd)}, readPlan().Alerts)
+
+	// An unchanged alert rule file is left out of the plan
+	run([]string{convFile}, nil)
+	assert.Empty(t, readPlan().Alerts)
+
+	// A changed alert rule file is updated
+	writeConversion("{job=`other`} | json")
+	run([]string{convFile}, nil)
+	assert.Equal(t, []model.PlannedAlert{plannedAlert(model.PlanUpdate)}, readPlan().Alerts)
+
+	// An alert rule file missing an annotation is updated, even though its queries are unchanged
+	rule := &model.ProvisionedAlertRule{}
+	assert.NoError(t, readRuleFromFile(rule, deployFile))
+	delete(rule.Annotations, "TimeWindow")
+	assert.NoError(t, writeRuleToFile(rule, deployFile, false))
+	run([]string{convFile}, nil)
+	assert.Equal(t, []model.PlannedAlert{plannedAlert(model.PlanUpdate)}, readPlan().Alerts)
+	assert.NoError(t, readRuleFromFile(rule, deployFile))
+	assert.Equal(t, "5m", rule.Annotations["TimeWindow"])
+
+	// The alert rule file of a removed conversion file is deleted
+	assert.NoError(t, os.Remove(convFile))
+	run(nil, []string{convFile})
+	assert.Equal(t, []model.PlannedAlert{plannedAlert(model.PlanDelete)}, readPlan().Alerts)
+}
+
+func TestRunWritesLockFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("GITHUB_OUTPUT", "github-output")
+	assert.NoError(t, os.MkdirAll("conv", 0o755))
+	assert.NoError(t, os.MkdirAll("deploy", 0o755))
+
+	convFile := filepath.Join("conv", "test_conv_rule.json")
+	convBytes, err := json.Marshal(model.ConversionOutput{
+		ConversionName: "test_conv",
+		Queries:        []string{"{job=`test`} | json"},
+		Rules:          []model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+
+	i := NewIntegrator()
+	i.config = model.Configuration{
+		Folders: model.FoldersConfig{
+			ConversionPath: "conv",
+			DeploymentPath: "deploy",
+		},
+		ConversionDefaults: model.ConversionConfig{
+			Target:     "loki",
+			DataSource: "test-datasource",
+		},
+		Conversions: []model.ConversionConfig{
+			{Name: "test_conv", RuleGroup: "Test Rules", TimeWindow: "5m"},
+		},
+		IntegratorConfig: model.IntegrationConfig{
+			FolderID: "test-folder",
+			LockFile: "srd.lock",
+		},
+	}
+	i.addedFiles = []string{convFile}
+	assert.NoError(t, i.Run())
+
+	convID, _, err := summariseSigmaRules([]model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}})
+	assert.NoError(t, err)
+	uid := getRuleUID("test_conv", convID)
+	deployFile := filepath.Join("deploy", "alert_rule_test_conv_rule_"+uid+".json")
+	deployContent, err := os.ReadFile(deployFile)
+	assert.NoError(t, err)
+	digest, err := shared.AlertFileDigest(string(deployContent))
+	assert.NoError(t, err)
+
+	lock, err := shared.ReadAlertLock("srd.lock")
+	assert.NoError(t, err)
+	assert.Equal(t, []model.LockedAlert{{
+		File:           filepath.Base(deployFile),
+		ConversionFile: convFile,
+		UID:            uid,
+		Title:          "Test Rule",
+		FolderUID:      "test-folder",
+		RuleGroup:      "Test Rules",
+		SourceDigest:   digest,
+	}}, lock.Alerts)
+
+	// The lock matches the deployment folder until an alert rule file changes outside of the integrator
+	current, err := shared.LockAlerts("deploy", "")
+	assert.NoError(t, err)
+	assert.Empty(t, shared.CompareAlertLocks(lock, current))
+	assert.NoError(t, os.WriteFile(deployFile, []byte(strings.Replace(string(deployContent), "Test Rule", "Edited Rule", 1)), 0o600))
+	current, err = shared.LockAlerts("deploy", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alert rule " + uid + " (" + filepath.Base(deployFile) + ") changed since it was locked"}, shared.CompareAlertLocks(lock, current))
+}
+
+func TestRunDryRun(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("GITHUB_OUTPUT", "github-output")
+	assert.NoError(t, os.MkdirAll("conv", 0o755))
+	assert.NoError(t, os.MkdirAll("deploy", 0o755))
+
+	writeConversion := func(file, ruleID, query string) string {
+		convBytes, err := json.Marshal(model.ConversionOutput{
+			ConversionName: "test_conv",
+			Queries:        []string{query},
+			Rules:          []model.SigmaRule{{ID: ruleID, Title: "Test Rule " + ruleID[:4]}},
+		})
+		assert.NoError(t, err)
+		convFile := filepath.Join("conv", file)
+		assert.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+		return convFile
+	}
+	run := func(dryRun bool, addedFiles, removedFiles []string) {
+		i := NewIntegrator()
+		i.config = model.Configuration{
+			Folders: model.FoldersConfig{
+				ConversionPath: "conv",
+				DeploymentPath: "deploy",
+			},
+			ConversionDefaults: model.ConversionConfig{
+				Target:     "loki",
+				DataSource: "test-datasource",
+			},
+			Conversions: []model.ConversionConfig{
+				{Name: "test_conv", RuleGroup: "Test Rules", TimeWindow: "5m"},
+			},
+			IntegratorConfig: model.IntegrationConfig{
+				PlanFile: "plan.json",
+				LockFile: "srd.lock",
+			},
+		}
+		i.dryRun = dryRun
+		i.addedFiles = addedFiles
+		i.removedFiles = removedFiles
+		assert.NoError(t, i.Run())
+	}
+	snapshot := func() map[string]string {
+		files := map[string]string{}
+		assert.NoError(t, filepath.WalkDir(".", func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() || path == "github-output" {
+				return err
+			}
+			content, err := os.ReadFile(path)
+			files[path] = string(content)
+			return err
+		}))
+		return files
+	}
+
+	updated := writeConversion("test_conv_updated.json", "996f8884-9144-40e7-ac63-29090ccde9a0", "{job=`test`} | json")
+	removed := writeConversion("test_conv_removed.json", "dcb63bd5-2a1e-4ac7-9e61-aa5c2a4e1c3a", "{job=`removed`} | json")
+	run(false, []string{updated, removed}, nil)
+	assert.NoError(t, os.Remove("github-output"))
+
+	// A dry run of an updated, an added and a removed conversion file leaves every file untouched
+	writeConversion("test_conv_updated.json", "996f8884-9144-40e7-ac63-29090ccde9a0", "{job=`other`} | json")
+	added := writeConversion("test_conv_added.json", "5d1b7a3e-8f4c-4e2a-9b6d-3c7e1f0a2b4d", "{job=`added`} | json")
+	assert.NoError(t, os.Remove(removed))
+	before := snapshot()
+	run(true, []string{updated, added}, []string{removed})
+	assert.Equal(t, before, snapshot())
+
+	// The planned changes are reported in the outputs instead
+	outputBytes, err := os.ReadFile("github-output")
+	assert.NoError(t, err)
+	var planned model.DeploymentPlan
+	for line := range strings.SplitSeq(string(outputBytes), "\n") {
+		if value, ok := strings.CutPrefix(line, "planned_changes="); ok {
+			assert.NoError(t, json.Unmarshal([]byte(value), &planned))
+		}
+	}
+	operations := map[string]string{}
+	for _, alert := range planned.Alerts {
+		operations[strings.Split(filepath.Base(alert.File), "_")[4]] = alert.Operation
+	}
+	assert.Equal(t, map[string]string{"added": model.PlanAdd, "updated": model.PlanUpdate, "removed": model.PlanDelete}, operations)
+}
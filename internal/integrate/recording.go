@@ -0,0 +1,97 @@
+package integrate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/grafana/sigma-rule-deployment/shared"
+)
+
+// RecordingTitleSuffix is appended to the title of the alert rule a recording rule records the queries of,
+// as rule titles must be unique within a folder
+const RecordingTitleSuffix = " (recording)"
+
+// prometheusQueryModel is the query model of the alert rules querying a recorded metric, in the
+// query_model format: refID, datasource, query
+const prometheusQueryModel = `{"refId":"%s","datasource":{"type":"prometheus","uid":"%s"},"hide":false,"expr":"%s","instant":true,"range":false,"editorMode":"code"}`
+
+var invalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// recordedMetricName returns the name of the metric recording the matches of an alert rule's queries,
+// linking the recording rule to the alert rule through the conversion name and the alert rule UID
+func recordedMetricName(conversionName, uid string) string {
+	return fmt.Sprintf("sigma_%s_%s_matches", invalidMetricNameChars.ReplaceAllString(conversionName, "_"), uid)
+}
+
+// recordedMetricConfig returns the conversion config of an alert rule querying its recorded metric,
+// rather than the conversion's queries
+func recordedMetricConfig(config model.ConversionConfig, datasource string) model.ConversionConfig {
+	config.DataSource = datasource
+	config.DataSourceType = shared.Prometheus
+	config.QueryModel = prometheusQueryModel
+	config.ModelDatasourceType = ""
+	config.QueryDataSources = nil
+	return config
+}
+
+// ConvertToRecordingRule converts the queries of a conversion into a recording rule, which records their
+// combined number of matches to metric in the target data source at every evaluation
+func (i *Integrator) ConvertToRecordingRule(rule *model.ProvisionedAlertRule, queries []string, title, metric, targetDatasource string, config model.ConversionConfig, conversionFile string, conversionObject model.ConversionOutput) error {
+	datasource, err := i.conversionDatasource(queries, config)
+	if err != nil {
+		return err
+	}
+	timewindow := shared.GetConfigValue(config.TimeWindow, i.config.ConversionDefaults.TimeWindow, "1m")
+	lookback := shared.GetConfigValue(config.Lookback, i.config.ConversionDefaults.Lookback, "0s")
+	_, timerange, err := queryTimeRange(timewindow, lookback)
+	if err != nil {
+		return err
+	}
+
+	if err := CheckAllowedDatasource(targetDatasource, config.Name, i.config.IntegratorConfig.AllowedDatasources, i.lookupDatasource); err != nil {
+		return err
+	}
+	queryData, combiner, err := i.createQueries(queries, datasource, timerange, config)
+	if err != nil {
+		return err
+	}
+	rule.Data = append(queryData, model.AlertQuery{
+		RefID:             combinerRefID,
+		DatasourceUID:     "__expr__",
+		RelativeTimeRange: timerange,
+		Model:             combiner,
+	})
+	rule.Record = &model.Record{
+		Metric:              metric,
+		From:                combinerRefID,
+		TargetDatasourceUID: targetDatasource,
+	}
+
+	rule.OrgID = i.config.IntegratorConfig.OrgID
+	rule.FolderUID = i.config.IntegratorConfig.FolderID
+	rule.RuleGroup = shared.GetConfigValue(config.RuleGroup, i.config.ConversionDefaults.RuleGroup, "Default")
+	rule.NoDataState = model.OK
+	rule.ExecErrState = model.OkErrState
+	if title, err = i.ruleTitle(title, len(RecordingTitleSuffix), conversionObject, config); err != nil {
+		return err
+	}
+	rule.Title = strings.TrimSpace(title) + RecordingTitleSuffix
+
+	if rule.Annotations == nil {
+		rule.Annotations = make(map[string]string)
+	}
+	rule.Annotations[i.annotationKey("Query")] = queries[0]
+	rule.Annotations[i.annotationKey("TimeWindow")] = timewindow
+	rule.Annotations[i.annotationKey("Lookback")] = lookback
+	rule.Annotations[i.annotationKey("LogSourceUid")] = datasource
+	rule.Annotations[i.annotationKey("LogSourceType")] = shared.GetConfigValue(config.Target, i.config.ConversionDefaults.Target, shared.Loki)
+	// Path to associated conversion file, for detecting orphaned recording rules
+	rule.Annotations[i.annotationKey("ConversionFile")] = conversionFile
+	i.markManaged(rule)
+
+	i.applyKeyAllowlists(rule)
+
+	return nil
+}
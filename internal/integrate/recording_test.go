@@ -0,0 +1,115 @@
+package integrate
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordedMetricName(t *testing.T) {
+	assert.Equal(t, "sigma_okta_logins_5m_1a2b3c_matches", recordedMetricName("okta-logins.5m", "1a2b3c"))
+}
+
+func TestDoConversionsRecordedMetric(t *testing.T) {
+	t.Chdir(t.TempDir())
+	convPath := "conv"
+	deployPath := "deploy"
+	require.NoError(t, os.MkdirAll(convPath, 0o755))
+	require.NoError(t, os.MkdirAll(deployPath, 0o755))
+
+	convOutput := model.ConversionOutput{
+		ConversionName: "test_conv",
+		Queries:        []string{"{job=`one`} | json", "{job=`two`} | json"},
+		Rules:          []model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}},
+	}
+	convBytes, err := json.Marshal(convOutput)
+	require.NoError(t, err)
+	convFile := filepath.Join(convPath, "test_conv_rules.json")
+	require.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+
+	i := &Integrator{
+		config: model.Configuration{
+			Folders: model.FoldersConfig{
+				ConversionPath: convPath,
+				DeploymentPath: deployPath,
+			},
+			ConversionDefaults: model.ConversionConfig{
+				Target:     "loki",
+				DataSource: "test-datasource",
+			},
+			Conversions: []model.ConversionConfig{
+				{
+					Name:           "test_conv",
+					RuleGroup:      "Test Rules",
+					TimeWindow:     "5m",
+					RecordedMetric: model.RecordedMetricConfig{TargetDataSource: "prometheus-ds"},
+				},
+			},
+			IntegratorConfig: model.IntegrationConfig{
+				FolderID: "test-folder",
+				OrgID:    1,
+			},
+		},
+		addedFiles: []string{convFile},
+	}
+	require.NoError(t, i.DoConversions())
+
+	files, err := os.ReadDir(deployPath)
+	require.NoError(t, err)
+	require.Len(t, files, 2, "a recording rule is generated alongside the alert rule")
+
+	var recordingRule, alertRule *model.ProvisionedAlertRule
+	for _, file := range files {
+		rule := &model.ProvisionedAlertRule{}
+		require.NoError(t, readRuleFromFile(rule, filepath.Join(deployPath, file.Name())))
+		assert.Contains(t, file.Name(), rule.UID)
+		assert.Equal(t, convFile, rule.Annotations["ConversionFile"])
+		if rule.Record != nil {
+			recordingRule = rule
+		} else {
+			alertRule = rule
+		}
+	}
+	require.NotNil(t, recordingRule)
+	require.NotNil(t, alertRule)
+
+	// The recording rule records the sum of the conversion's queries to the target data source
+	metric := recordedMetricName("test_conv", alertRule.UID)
+	assert.Equal(t, &model.Record{Metric: metric, From: "B", TargetDatasourceUID: "prometheus-ds"}, recordingRule.Record)
+	assert.Equal(t, "Test Rule"+RecordingTitleSuffix, recordingRule.Title)
+	assert.Equal(t, "Test Rules", recordingRule.RuleGroup)
+	require.Len(t, recordingRule.Data, 3)
+	assert.Contains(t, string(recordingRule.Data[0].Model), "count_over_time({job=`one`} | json")
+	assert.Contains(t, string(recordingRule.Data[1].Model), "count_over_time({job=`two`} | json")
+	assert.Contains(t, string(recordingRule.Data[2].Model), `"expression":"${A0}+${A1}"`)
+
+	// The alert rule queries the recorded metric instead of the logs
+	assert.Equal(t, "Test Rule", alertRule.Title)
+	require.Len(t, alertRule.Data, 3)
+	assert.Equal(t, "prometheus-ds", alertRule.Data[0].DatasourceUID)
+	assert.JSONEq(t,
+		`{"refId":"A0","datasource":{"type":"prometheus","uid":"prometheus-ds"},"hide":false,"expr":"`+metric+`","instant":true,"range":false,"editorMode":"code"}`,
+		string(alertRule.Data[0].Model))
+	assert.Equal(t, metric, alertRule.Annotations["Query"])
+
+	// Integrating again is stable, and disabling the recorded metric removes the recording rule
+	require.NoError(t, i.DoConversions())
+	files, err = os.ReadDir(deployPath)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	i.config.Conversions[0].RecordedMetric = model.RecordedMetricConfig{}
+	require.NoError(t, i.DoConversions())
+	files, err = os.ReadDir(deployPath)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Contains(t, files[0].Name(), alertRule.UID)
+	rule := &model.ProvisionedAlertRule{}
+	require.NoError(t, readRuleFromFile(rule, filepath.Join(deployPath, files[0].Name())))
+	assert.Contains(t, string(rule.Data[0].Model), "count_over_time({job=`one`} | json")
+}
@@ -0,0 +1,112 @@
+package integrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/grafana/sigma-rule-deployment/shared"
+)
+
+// obsoletingRelationTypes are the types of related Sigma rule references marking the referenced rule as replaced
+var obsoletingRelationTypes = []string{"obsolete", "obsoletes", "deprecates"}
+
+// relatedRules formats the related rule references of the Sigma rules as "type: id" pairs,
+// e.g. "derived: 929a690e-bef0-4204-a928-ef5e620d6fcc, obsolete: 1e8df5b7-...", without duplicates
+func relatedRules(rules []model.SigmaRule) string {
+	related := []string{}
+	for _, rule := range rules {
+		for _, ref := range rule.Related {
+			if ref.ID == "" {
+				continue
+			}
+			entry := fmt.Sprintf("%s: %s", ref.Type, ref.ID)
+			if !slices.Contains(related, entry) {
+				related = append(related, entry)
+			}
+		}
+	}
+	return strings.Join(related, ", ")
+}
+
+// falsePositives formats the falsepositives of the Sigma rules as a bulleted list. When several rules have
+// false positives, each rule's list follows its title, e.g. "Rule 1:\n- Admin activity\n\nRule 2:\n- Unknown".
+func falsePositives(rules []model.SigmaRule) string {
+	lists := []string{}
+	titles := []string{}
+	for _, rule := range rules {
+		items := []string{}
+		for _, falsePositive := range rule.FalsePositives {
+			if falsePositive = strings.TrimSpace(falsePositive); falsePositive != "" {
+				items = append(items, "- "+falsePositive)
+			}
+		}
+		if len(items) > 0 {
+			lists = append(lists, strings.Join(items, "\n"))
+			titles = append(titles, rule.Title)
+		}
+	}
+	if len(lists) == 1 {
+		return lists[0]
+	}
+	for index, title := range titles {
+		lists[index] = title + ":\n" + lists[index]
+	}
+	return strings.Join(lists, "\n\n")
+}
+
+// obsoletedDeployedRule returns the ID of a Sigma rule of the conversion which obsoletes or deprecates a deployed
+// Sigma rule of another conversion file, along with the ID of that rule. Empty IDs are returned when the conversion
+// obsoletes no deployed rule.
+func obsoletedDeployedRule(conversionObject model.ConversionOutput, conversionFile string, deployed map[string]string) (string, string) {
+	for _, rule := range conversionObject.Rules {
+		for _, ref := range rule.Related {
+			if !slices.Contains(obsoletingRelationTypes, strings.ToLower(ref.Type)) {
+				continue
+			}
+			if deployedFile, ok := deployed[ref.ID]; ok && deployedFile != conversionFile {
+				return rule.ID, ref.ID
+			}
+		}
+	}
+	return "", ""
+}
+
+// deployedSigmaRuleIDs maps the IDs of the Sigma rules with alert rules in the deployment folder
+// to their conversion file, read from the ConversionFile annotation of the deployment files
+func (i *Integrator) deployedSigmaRuleIDs() (map[string]string, error) {
+	files, err := i.deploymentFiles()
+	if err != nil {
+		return nil, err
+	}
+	deployed := map[string]string{}
+	read := map[string]bool{}
+	for _, file := range files {
+		rule := &model.ProvisionedAlertRule{}
+		if err := i.readRule(rule, file); err != nil {
+			i.warnings.Add("Could not check the Sigma rules of %s: %v", file, err)
+			continue
+		}
+		conversionFile := rule.Annotations[i.annotationKey("ConversionFile")]
+		if conversionFile == "" || read[conversionFile] {
+			continue
+		}
+		read[conversionFile] = true
+		// The conversion file may have been removed along with its Sigma rules
+		content, err := shared.ReadLocalFile(conversionFile)
+		if err != nil {
+			continue
+		}
+		var conversionObject model.ConversionOutput
+		if err := json.Unmarshal([]byte(content), &conversionObject); err != nil {
+			i.warnings.Add("Could not check the Sigma rules of %s: %v", conversionFile, err)
+			continue
+		}
+		for _, sigmaRule := range conversionObject.Rules {
+			deployed[sigmaRule.ID] = conversionFile
+		}
+	}
+	return deployed, nil
+}
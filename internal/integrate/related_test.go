@@ -0,0 +1,147 @@
+package integrate
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/grafana/sigma-rule-deployment/shared"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sigmaRuleWithRelated(id string, related ...[2]string) model.SigmaRule {
+	rule := model.SigmaRule{ID: id, Title: "Rule " + id}
+	for _, ref := range related {
+		rule.Related = append(rule.Related, struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		}{ID: ref[0], Type: ref[1]})
+	}
+	return rule
+}
+
+func TestRelatedRules(t *testing.T) {
+	rules := []model.SigmaRule{
+		sigmaRuleWithRelated("a", [2]string{"b", "derived"}, [2]string{"c", "obsolete"}),
+		sigmaRuleWithRelated("d", [2]string{"b", "derived"}, [2]string{"", "similar"}),
+		sigmaRuleWithRelated("e"),
+	}
+	assert.Equal(t, "derived: b, obsolete: c", relatedRules(rules))
+	assert.Equal(t, "", relatedRules(rules[2:]))
+}
+
+func TestConvertToAlertRelatedRules(t *testing.T) {
+	convConfig := model.ConversionConfig{Name: "conv", Target: "loki", DataSource: "my_data_source", TimeWindow: "5m"}
+	tests := []struct {
+		name       string
+		annotate   bool
+		rules      []model.SigmaRule
+		annotation string
+	}{
+		{
+			name:       "related rules are annotated",
+			annotate:   true,
+			rules:      []model.SigmaRule{sigmaRuleWithRelated("a", [2]string{"b", "derived"}, [2]string{"c", "obsolete"})},
+			annotation: "derived: b, obsolete: c",
+		},
+		{
+			name:     "no related rules",
+			annotate: true,
+			rules:    []model.SigmaRule{sigmaRuleWithRelated("a")},
+		},
+		{
+			name:  "disabled",
+			rules: []model.SigmaRule{sigmaRuleWithRelated("a", [2]string{"b", "derived"})},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := NewIntegrator()
+			i.config.IntegratorConfig.AnnotateRelatedRules = tt.annotate
+			convObject := model.ConversionOutput{ConversionName: "conv", Rules: tt.rules}
+
+			rule := &model.ProvisionedAlertRule{Annotations: map[string]string{RelatedRulesAnnotation: "derived: z"}}
+			if tt.annotate {
+				// Stale annotations are removed
+				rule.Annotations = nil
+			}
+			require.NoError(t, i.ConvertToAlert(rule, []string{"{job=`a`} | json"}, "Rule a", convConfig, "test_conversion_file.json", convObject))
+			if tt.annotation != "" {
+				assert.Equal(t, tt.annotation, rule.Annotations[RelatedRulesAnnotation])
+			} else if tt.annotate {
+				assert.NotContains(t, rule.Annotations, RelatedRulesAnnotation)
+			} else {
+				assert.Equal(t, "derived: z", rule.Annotations[RelatedRulesAnnotation], "left untouched when disabled")
+			}
+		})
+	}
+}
+
+func TestDoConversionsSkipObsoletingRules(t *testing.T) {
+	writeConversion := func(t *testing.T, file string, rule model.SigmaRule) {
+		convBytes, err := json.Marshal(model.ConversionOutput{
+			ConversionName: "test_conv",
+			Queries:        []string{"{job=`test`} | json"},
+			Rules:          []model.SigmaRule{rule},
+		})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(file, convBytes, 0o600))
+	}
+
+	tests := []struct {
+		name         string
+		skip         bool
+		relationType string
+		wantFiles    int
+	}{
+		{name: "obsoleting rule is skipped", skip: true, relationType: "obsolete", wantFiles: 1},
+		{name: "deprecating rule is skipped", skip: true, relationType: "Deprecates", wantFiles: 1},
+		{name: "derived rule is integrated", skip: true, relationType: "derived", wantFiles: 2},
+		{name: "obsoleting rule is integrated when disabled", relationType: "obsolete", wantFiles: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			convPath := "conv"
+			deployPath := "deploy"
+			require.NoError(t, os.MkdirAll(convPath, 0o755))
+			require.NoError(t, os.MkdirAll(deployPath, 0o755))
+
+			oldFile := filepath.Join(convPath, "test_conv_old_rule.json")
+			newFile := filepath.Join(convPath, "test_conv_new_rule.json")
+			writeConversion(t, oldFile, sigmaRuleWithRelated("0b1c2d3e-0000-4000-8000-000000000001"))
+			writeConversion(t, newFile, sigmaRuleWithRelated("0b1c2d3e-0000-4000-8000-000000000002",
+				[2]string{"0b1c2d3e-0000-4000-8000-000000000001", tt.relationType}))
+
+			i := &Integrator{
+				config: model.Configuration{
+					Folders: model.FoldersConfig{ConversionPath: convPath, DeploymentPath: deployPath},
+					ConversionDefaults: model.ConversionConfig{
+						Target:     "loki",
+						DataSource: "test-datasource",
+					},
+					Conversions: []model.ConversionConfig{{Name: "test_conv", RuleGroup: "Test Rules", TimeWindow: "5m"}},
+					IntegratorConfig: model.IntegrationConfig{
+						FolderID:            "test-folder",
+						OrgID:               1,
+						SkipObsoletingRules: tt.skip,
+					},
+				},
+				warnings:   &shared.Warnings{},
+				addedFiles: []string{oldFile},
+			}
+			// Deploy the obsoleted rule first
+			require.NoError(t, i.DoConversions())
+
+			i.addedFiles = []string{newFile}
+			require.NoError(t, i.DoConversions())
+			files, err := os.ReadDir(deployPath)
+			require.NoError(t, err)
+			assert.Len(t, files, tt.wantFiles)
+			assert.Empty(t, i.warnings.List())
+		})
+	}
+}
@@ -68,11 +68,11 @@ type ProvisionedAlertRule struct {
 // Record contains mapping information for Recording Rules.
 type Record struct {
 	// Metric indicates a metric name to send results to.
-	Metric string
+	Metric string `json:"metric"`
 	// From contains a query RefID, indicating which expression node is the output of the recording rule.
-	From string
+	From string `json:"from"`
 	// TargetDatasourceUID is the data source to write the result of the recording rule.
-	TargetDatasourceUID string
+	TargetDatasourceUID string `json:"target_datasource_uid,omitempty"`
 }
 
 type AlertRuleNotificationSettings struct {
@@ -20,10 +20,77 @@ type ConversionConfig struct {
 	Lookback        string   `yaml:"lookback"`
 	// the data source type to use for the query, if unspecified, uses the target
 	DataSourceType string `yaml:"data_source_type,omitempty"`
+	// the datasource type set in the built-in query models, if unspecified, uses the data source type, e.g. for plugins
+	// whose type differs from the one of the query model, such as grafana-loki-datasource
+	ModelDatasourceType string `yaml:"model_data_source_type,omitempty"`
 	// Use a sprintf format string to populate a bespoke query model
 	// refID, datasource, query
 	QueryModel         string   `yaml:"query_model,omitempty"`
 	RequiredRuleFields []string `yaml:"required_rule_fields,omitempty"`
+	// per-query data source overrides, matched to the conversion's queries by position
+	QueryDataSources []QueryDataSource `yaml:"query_data_sources,omitempty"`
+	// Grafana OnCall routing labels added to the alert rule
+	OnCall OnCallConfig `yaml:"oncall,omitempty"`
+	// number of evaluations a missing series must stay missing before it resolves, if unspecified, uses Grafana's default
+	MissingSeriesEvalsToResolve int `yaml:"missing_series_evals_to_resolve,omitempty"`
+	// how long a condition must be met before the alert fires, if unspecified, uses integration.auto_pending_period,
+	// whereas an explicit 0s always fires on the first evaluation
+	PendingPeriod string `yaml:"pending_period,omitempty"`
+	// generate one alert rule per query instead of a single rule combining all of them
+	SplitQueries bool `yaml:"split_queries,omitempty"`
+	// time range of the conversion's query tests and explore links, if unspecified, uses integration.from and integration.to
+	From string `yaml:"from,omitempty"`
+	To   string `yaml:"to,omitempty"`
+	// record the queries' matches to a metric and alert on the recorded metric instead of the queries
+	RecordedMetric RecordedMetricConfig `yaml:"recorded_metric,omitempty"`
+	// refId of the query or expression the alert rule fires on, if unspecified, uses the threshold expression C
+	ConditionRefID string `yaml:"condition_ref_id,omitempty"`
+	// refIds of the queries and expressions hidden in the Grafana UI, e.g. A0 or B, the condition must stay visible
+	HiddenRefIDs []string `yaml:"hidden_ref_ids,omitempty"`
+	// query type of the Loki queries, instant (default) or range, log queries are wrapped in count_over_time or rate accordingly
+	LokiQueryType string `yaml:"loki_query_type,omitempty"`
+	// range of Loki log queries with an explicit range selector when wrapped, keep (default) or auto to use $__auto instead
+	LokiRange string `yaml:"loki_range,omitempty"`
+	// state of the alert rules when their queries return no data, OK (default), NoData or Alerting
+	NoDataState string `yaml:"no_data_state,omitempty"`
+	// fire when the queries match no logs, e.g. for a heartbeat which stopped, rather than when they match
+	AlertOnNoData bool `yaml:"alert_on_no_data,omitempty"`
+	// interval and maximum number of data points of the Loki and Elasticsearch queries when evaluating the alert rules,
+	// if unspecified, uses the defaults of the data source type
+	IntervalMs    int `yaml:"interval_ms,omitempty"`
+	MaxDataPoints int `yaml:"max_data_points,omitempty"`
+}
+
+// OnCallConfig contains the Grafana OnCall routing values set as labels on alert rules
+type OnCallConfig struct {
+	// set as the grafana_oncall_route label
+	Route string `yaml:"route,omitempty"`
+	// set as the grafana_oncall_escalation_chain label
+	EscalationChain string `yaml:"escalation_chain,omitempty"`
+	// set as the grafana_oncall_team label
+	Team string `yaml:"team,omitempty"`
+}
+
+// RecordedMetricConfig configures the recording rules generated alongside the alert rules, which record the number
+// of matches of the queries to a metric for the alert rules to query instead, which is cheaper to evaluate
+type RecordedMetricConfig struct {
+	// Prometheus data source the recording rules write their metric to and the alert rules query it from,
+	// setting it enables recorded metrics
+	TargetDataSource string `yaml:"target_data_source,omitempty"`
+}
+
+// QueryDataSource overrides the data source used for a single query of a conversion
+type QueryDataSource struct {
+	DataSource string `yaml:"data_source"`
+	// the data source type of the override, if unspecified, uses the conversion's type
+	DataSourceType string `yaml:"data_source_type,omitempty"`
+}
+
+// RuleGroupConfig sets the evaluation interval of an alert rule group explicitly, rather than deriving it
+// from the time windows of the group's conversions
+type RuleGroupConfig struct {
+	Name     string `yaml:"name"`
+	Interval string `yaml:"interval"`
 }
 
 // IntegrationConfig contains integration configuration
@@ -39,12 +106,159 @@ type IntegrationConfig struct {
 	TemplateLabels               map[string]string `yaml:"template_labels"`
 	TemplateAnnotations          map[string]string `yaml:"template_annotations"`
 	TemplateAllRules             bool              `yaml:"template_all_rules"`
+	// text/templates prepended and appended to the titles of the generated rules, e.g. "[STAGING] "
+	TitlePrefix string `yaml:"title_prefix"`
+	TitleSuffix string `yaml:"title_suffix"`
+	// regular expression matched against the conversion file paths, relative to the conversion folder, whose named groups are added as labels
+	PathLabelPattern string `yaml:"path_label_pattern"`
+	// how the tags of the Sigma rules are added as labels: none (default), joined into a tags label, or individual labels
+	TagsLabelMode string `yaml:"tags_label_mode"`
+	// handling of conversion files listed as both changed and deleted: delete (default) their alert rule, or error
+	ChangedAndDeletedFiles string `yaml:"changed_and_deleted_files"`
+	// handling of Sigma rules sharing an ID within a conversion: error (default), or dedupe to keep the first with a warning
+	DuplicateRuleIDs string `yaml:"duplicate_rule_ids"`
+	// IANA time zone the timestamps of annotations are rendered in, e.g. Europe/Paris, defaults to UTC
+	Timezone string `yaml:"timezone"`
+	// number of times a query test that timed out is retried
+	QueryTestRetries int `yaml:"query_test_retries"`
+	// delay before the first retry of a timed out query test, doubled for each further retry
+	QueryTestRetryBackoff string `yaml:"query_test_retry_backoff"`
+	// overall time allowed for query testing, retries which would exceed it are not attempted
+	QueryTestDeadline string `yaml:"query_test_deadline"`
+	// test the queries over the end of their time range of this duration, e.g. 5m, rather than the full range
+	TestSampleWindow string `yaml:"test_sample_window"`
+	// number of queries of a conversion tested at the same time, 1 to test them one by one
+	QueryTestConcurrency int `yaml:"query_test_concurrency"`
+	// fields of the query test response frames whose values are counted as matches, defaults to Line
+	TestValueFields []string `yaml:"test_value_fields"`
+	// fields of the query test response frames whose labels or values are reported as the fields of the matches, defaults to labels
+	TestLabelFields []string `yaml:"test_label_fields"`
+	// maximum time to wait for each data source to be found in Grafana before testing its queries, e.g. in ephemeral CI environments
+	DatasourceReadyTimeout string `yaml:"datasource_ready_timeout"`
+	// maximum combined size in bytes of an alert rule's labels and annotations, zero to disable
+	MaxMetadataBytes int `yaml:"max_metadata_bytes"`
+	// skip integrating rules whose queries all return no matches when tested
+	RequireTestMatches bool `yaml:"require_test_matches"`
+	// fail query testing when the data source returns warnings, such as partial results
+	FailOnQueryWarnings bool `yaml:"fail_on_query_warnings"`
+	// how the failed results of a successful query response are handled, fail (default) or report
+	ResultErrors string `yaml:"result_errors"`
+	// annotate alert rules with the IDs of the Sigma rules in their conversion
+	AnnotateRuleIDs bool `yaml:"annotate_rule_ids"`
+	// label alert rules with a fingerprint of their Sigma rule IDs and conversion name, which is stable across query changes
+	FingerprintLabel bool `yaml:"fingerprint_label"`
+	// create a paused placeholder alert rule for conversions without queries, rather than skipping them
+	CreatePlaceholderForEmptyQueries bool `yaml:"create_placeholder_for_empty_queries"`
+	// time range of the explore links of tested queries, if unspecified, uses from and to
+	ExploreFrom string `yaml:"explore_from"`
+	ExploreTo   string `yaml:"explore_to"`
+	// suffix colliding alert rule titles with their UID so they are unique within the folder
+	DedupeTitles bool `yaml:"dedupe_titles"`
+	// remove the alert rule files generated with the same content as another one, e.g. from duplicated Sigma rules
+	DedupeRules bool `yaml:"dedupe_rules"`
+	// write a Grafana dashboard with a panel per alert rule of the deployment folder to its dashboards subfolder
+	GenerateDashboard bool `yaml:"generate_dashboard"`
+	// custom keys for the built-in annotations written by the integrator, e.g. Query: sigma_query
+	AnnotationKeyMap map[string]string `yaml:"annotation_key_map"`
+	// annotate alert rules with the date their Sigma rules were last modified
+	AnnotateRuleModified bool `yaml:"annotate_rule_modified"`
+	// warn about Sigma rules not modified within this many days, zero to disable
+	StaleAfterDays int `yaml:"stale_after_days"`
+	// text/template for the names of alert rule files, with the ConversionName, RuleFilename and UID fields
+	AlertFileNameTemplate string `yaml:"alert_file_name_template"`
+	// file to write the plan of the changed alert rule files to, for the deployer to consume
+	PlanFile string `yaml:"plan_file"`
+	// file to write the lock of all the alert rule files of the deployment folder to, with their UIDs and digests
+	LockFile string `yaml:"lock_file"`
+	// derive the pending period of alert rules without an explicit one from their evaluation interval
+	AutoPendingPeriod bool `yaml:"auto_pending_period"`
+	// number of evaluation intervals in a derived pending period, defaults to 1
+	PendingPeriodMultiplier int `yaml:"pending_period_multiplier"`
+	// YAML or JSON file of annotations and labels added to alert rules based on their Sigma rules' logsource
+	EnrichmentFile string `yaml:"enrichment_file"`
+	// YAML or JSON file mapping IDs to the shared queries referenced by the query_refs of conversion outputs
+	QueryLibrary string `yaml:"query_library"`
+	// query testing timeouts by data source type, e.g. elasticsearch: 30s, overriding the default timeout
+	QueryTimeouts map[string]string `yaml:"query_timeouts"`
+	// only warn on a mismatch between the configured and live data source types, rather than failing query testing
+	WarnOnDataSourceTypeMismatch bool `yaml:"warn_on_data_source_type_mismatch"`
+	// fail on truncated or mangled queries before writing their alert rules, through a few structural checks
+	RejectMalformedQueries bool `yaml:"reject_malformed_queries"`
+	// maximum number of queries in a single alert rule, zero for unlimited
+	MaxQueriesPerRule int `yaml:"max_queries_per_rule"`
+	// split alert rules exceeding max_queries_per_rule into several alert rules, rather than failing
+	SplitOversizedRules bool `yaml:"split_oversized_rules"`
+	// annotate alert rules with the rules referenced by the related field of their Sigma rules
+	AnnotateRelatedRules bool `yaml:"annotate_related_rules"`
+	// annotate alert rules with the known false positives of their Sigma rules
+	AnnotateFalsePositives bool `yaml:"annotate_false_positives"`
+	// skip integrating Sigma rules which obsolete or deprecate a Sigma rule already in the deployment folder
+	SkipObsoletingRules bool `yaml:"skip_obsoleting_rules"`
+	// annotate alert rules with the number of matches and the fields returned when testing their queries
+	AnnotateBaseline bool `yaml:"annotate_baseline"`
+	// use the "nil" placeholder data source with a warning for conversions without a data source, rather than failing
+	AllowMissingDataSource bool `yaml:"allow_missing_data_source"`
+	// integrate conversion files with queries but no Sigma rules, deriving their UID and title from the conversion name
+	AllowMissingRules bool `yaml:"allow_missing_rules"`
+	// data sources, as referenced in the conversions, which alert rules may query; any data source if empty
+	AllowedDatasources []string `yaml:"allowed_datasources"`
+	// label keys kept on alert rules, any other label is removed, all labels are kept when empty
+	AllowedLabelKeys []string `yaml:"allowed_label_keys"`
+	// annotation keys kept on alert rules, any other annotation is removed, all annotations are kept when empty
+	AllowedAnnotationKeys []string `yaml:"allowed_annotation_keys"`
+	// conversion used for the conversion files without a conversion_name, which fail to integrate if unset
+	DefaultConversion string `yaml:"default_conversion"`
+	// annotate alert rules with a link to their Sigma rule file on GitHub, at the commit they were integrated from
+	AnnotateSourceLink bool `yaml:"annotate_source_link"`
+	// annotate alert rules with a link opening their query in Grafana Explore, over their query time range
+	AnnotateExploreLink bool `yaml:"annotate_explore_link"`
+	// annotate alert rules with the path of the Sigma rule file their conversion file was produced from
+	AnnotateInputFile bool `yaml:"annotate_input_file"`
+	// path of the Grafana API endpoint queries are tested against, e.g. a tenant-scoped endpoint, defaults to api/ds/query
+	QueryEndpoint string `yaml:"query_endpoint"`
+}
+
+// EnrichmentLookup maps the logsource values of Sigma rules to the annotations and labels added to their alert rules
+type EnrichmentLookup struct {
+	Category map[string]Enrichment `yaml:"category"`
+	Product  map[string]Enrichment `yaml:"product"`
+	Service  map[string]Enrichment `yaml:"service"`
+}
+
+// Enrichment contains the annotations and labels added to the alert rules of a logsource value
+type Enrichment struct {
+	Annotations map[string]string `yaml:"annotations"`
+	Labels      map[string]string `yaml:"labels"`
 }
 
 // DeploymentConfig contains deployment configuration
 type DeploymentConfig struct {
 	GrafanaInstance string `yaml:"grafana_instance"`
 	Timeout         string `yaml:"timeout"`
+	// minimum alert rule group evaluation interval accepted by Grafana, intervals are rounded up to a multiple of it
+	MinGroupInterval string `yaml:"min_group_interval"`
+	// fail on any alert rule UID conflict instead of updating the existing alert rule when it matches
+	FailOnConflict bool `yaml:"fail_on_conflict"`
+	// read back every created or updated alert rule and compare it to the deployed one, either to "warn" or "fail" on mismatch
+	VerifyAfterDeploy string `yaml:"verify_after_deploy"`
+	// deploy alert rules without provenance, so they remain editable in the Grafana UI
+	DisableProvenance bool `yaml:"disable_provenance"`
+	// skip alert rules whose live SourceDigest annotation matches the digest of their alert file
+	SkipUnchanged bool `yaml:"skip_unchanged"`
+	// number of alert rules deleted or created before pausing for batch_delay, zero to disable batching
+	BatchSize int `yaml:"batch_size"`
+	// pause between batches of alert rule deletions and creations
+	BatchDelay string `yaml:"batch_delay"`
+	// don't check that the service account token belongs to the organization of integration.org_id, e.g. for multi-org tokens
+	SkipOrgCheck bool `yaml:"skip_org_check"`
+	// percentage of the alert rules deployed as a canary, the others being deferred to a later deployment; zero to deploy all
+	CanaryPercent int `yaml:"canary_percent"`
+	// have the integrator set the managed_by annotation, and only delete alert rules carrying it, skipping the others with a warning
+	RequireManagedAnnotation bool `yaml:"require_managed_annotation"`
+	// base path of the Grafana alerting provisioning API, defaults to api/v1/provisioning
+	APIBasePath string `yaml:"api_base_path"`
+	// fail the deployment when the alert rule files of the deployment folder don't match integration.lock_file
+	VerifyLockFile bool `yaml:"verify_lock_file"`
 }
 
 // Configuration is the unified configuration structure
@@ -52,6 +266,7 @@ type Configuration struct {
 	Folders            FoldersConfig      `yaml:"folders"`
 	ConversionDefaults ConversionConfig   `yaml:"conversion_defaults"`
 	Conversions        []ConversionConfig `yaml:"conversions"`
+	RuleGroups         []RuleGroupConfig  `yaml:"rule_groups"`
 	IntegratorConfig   IntegrationConfig  `yaml:"integration"`
 	DeployerConfig     DeploymentConfig   `yaml:"deployment"`
 }
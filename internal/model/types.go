@@ -43,6 +43,15 @@ type ConversionOutput struct {
 	InputFile      string      `json:"input_file"`
 	Rules          []SigmaRule `json:"rules"`
 	OutputFile     string      `json:"output_file"`
+	// Sigma backend which produced the queries, e.g. loki or lucene, selecting their query model over the config
+	Backend string `json:"backend,omitempty"`
+	// IDs of queries of the query library, appended to the queries
+	QueryRefs []string `json:"query_refs,omitempty"`
+	// threshold the alert rule fires on and its operator, e.g. from a correlation count, over the defaults
+	Threshold         *float64 `json:"threshold,omitempty"`
+	ThresholdOperator string   `json:"threshold_operator,omitempty"`
+	// refId of the query or expression the alert rule fires on, over the condition_ref_id of the conversion
+	Condition string `json:"condition,omitempty"`
 }
 
 // MetricValue represents a value with its unit
@@ -58,6 +67,8 @@ type Stats struct {
 	BytesProcessed MetricValue       `json:"bytesProcessed"`
 	Fields         map[string]string `json:"fields"`
 	Errors         []string          `json:"errors"`
+	// Warnings are non-fatal notices from the data source, such as partial results
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 // QueryTestResult represents the result of testing a query
@@ -65,6 +76,8 @@ type QueryTestResult struct {
 	Datasource string `json:"datasource"`
 	Link       string `json:"link"`
 	Stats      Stats  `json:"stats"`
+	// Sampled is set when the query was tested over a sample of its time range, see test_sample_window
+	Sampled bool `json:"sampled,omitempty"`
 }
 
 // Frame represents a single frame from a Grafana datasource query response
@@ -76,6 +89,10 @@ type Frame struct {
 				DisplayName string  `json:"displayName"`
 				Unit        string  `json:"unit"`
 			} `json:"stats"`
+			Notices []struct {
+				Severity string `json:"severity"`
+				Text     string `json:"text"`
+			} `json:"notices"`
 		} `json:"meta"`
 		Fields []struct {
 			Name string `json:"name"`
@@ -90,6 +107,9 @@ type Frame struct {
 // ResultFrame represents a single result frame in the query response
 type ResultFrame struct {
 	Frames []Frame `json:"frames"`
+	// HTTP status of the result, which may fail even when the response succeeds
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
 }
 
 // QueryResponse represents the structure of a Grafana datasource query response
@@ -108,6 +128,69 @@ type Alert struct {
 	FolderUID string `json:"folderUID"`
 	RuleGroup string `json:"ruleGroup"`
 	OrgID     int64  `json:"orgID"`
+	// read from the live alert rules, for their SourceDigest and managed_by annotations, and compared when
+	// verifying the deployed alert rules
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// only compared when verifying the deployed alert rules
+	Condition string       `json:"condition,omitempty"`
+	For       string       `json:"for,omitempty"`
+	Data      []AlertQuery `json:"data,omitempty"`
+}
+
+// Levels of the annotations reporting validation errors and warnings
+const (
+	AnnotationError   = "error"
+	AnnotationWarning = "warning"
+)
+
+// Annotation is a validation error or warning located in a file, for CI to show next to the offending file,
+// e.g. as an inline annotation of a pull request
+type Annotation struct {
+	File string `json:"file"`
+	// line of the file, zero if the whole file is concerned
+	Line    int    `json:"line,omitempty"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// Operations on the alert rule files of a deployment plan
+const (
+	PlanAdd    = "add"
+	PlanUpdate = "update"
+	PlanDelete = "delete"
+)
+
+// PlannedAlert is an alert rule file changed by the integrator, along with where the alert rule is deployed
+type PlannedAlert struct {
+	Operation string `json:"operation"`
+	File      string `json:"file"`
+	UID       string `json:"uid"`
+	FolderUID string `json:"folderUID"`
+	RuleGroup string `json:"ruleGroup"`
+	OrgID     int64  `json:"orgID"`
+}
+
+// DeploymentPlan lists the alert rule files changed by the integrator, for the deployer to deploy
+type DeploymentPlan struct {
+	Alerts []PlannedAlert `json:"alerts"`
+}
+
+// LockedAlert is an alert rule file of the deployment folder, along with where the alert rule is deployed
+// and the digest of the file
+type LockedAlert struct {
+	File           string `json:"file"`
+	ConversionFile string `json:"conversionFile,omitempty"`
+	UID            string `json:"uid"`
+	Title          string `json:"title"`
+	FolderUID      string `json:"folderUID"`
+	RuleGroup      string `json:"ruleGroup"`
+	SourceDigest   string `json:"sourceDigest"`
+}
+
+// AlertLock lists all the alert rule files of the deployment folder, to reproduce the same alert rules
+// in other environments and detect changes to the deployment folder made outside of the integrator
+type AlertLock struct {
+	Alerts []LockedAlert `json:"alerts"`
 }
 
 // AlertRuleGroup represents an alert rule group
@@ -1,11 +1,18 @@
 package querytest
 
 import (
+	"cmp"
 	"encoding/json"
 	"fmt"
+	"maps"
+	"net/http"
 	"os"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/grafana/sigma-rule-deployment/internal/integrate"
@@ -13,25 +20,141 @@ import (
 	"github.com/grafana/sigma-rule-deployment/shared"
 )
 
+// Default delay before the first retry of a timed out query test
+var defaultRetryBackoff = time.Second
+
+// Delay between the lookups of a data source which is not ready yet
+var defaultReadyInterval = time.Second
+
+// Default number of queries of a conversion tested at the same time
+const defaultQueryTestConcurrency = 4
+
 // QueryTester handles testing queries against Grafana datasources
 type QueryTester struct {
 	config    model.Configuration
 	testFiles []string
 	timeout   time.Duration
+	// query timeouts by data source type, overriding timeout
+	typeTimeouts map[string]time.Duration
+
+	retryBackoff time.Duration
+	// number of queries of a conversion tested at the same time
+	concurrency int
+	// maximum duration of a Run, zero if unbounded
+	runTimeout time.Duration
+	// time by which query testing must complete, set when Run starts
+	deadline time.Time
+	// conversion files whose queries all returned no matches
+	noMatchFiles []string
+	// results of the last Run, by conversion file
+	results map[string][]model.QueryTestResult
+	// live types of the data sources checked so far, by UID
+	datasourceTypes map[string]string
+	// maximum time to wait for a data source to be found, zero to not wait
+	readyTimeout  time.Duration
+	readyInterval time.Duration
+	// data sources already waited for
+	readyDatasources map[string]bool
+	// duration of the end of the time range the queries are tested over, zero for the full range
+	sampleWindow time.Duration
+	// whether failed results of successful query responses are only reported rather than failing the query test
+	reportResultErrors bool
+	// warnings of the run, shared with the integrator so that strict mode covers them
+	warnings *shared.Warnings
+	// implementation the queries are executed with
+	datasourceQuery integrate.DatasourceQuery
 }
 
-// NewQueryTester creates a new QueryTester instance
-func NewQueryTester(config model.Configuration, testFiles []string, timeout time.Duration) *QueryTester {
-	return &QueryTester{
-		config:    config,
-		testFiles: testFiles,
-		timeout:   timeout,
+// NewQueryTester creates a new QueryTester instance, recording its warnings in warnings
+func NewQueryTester(config model.Configuration, testFiles []string, timeout time.Duration, warnings *shared.Warnings) *QueryTester {
+	qt := &QueryTester{
+		warnings:        warnings,
+		config:          config,
+		testFiles:       testFiles,
+		timeout:         timeout,
+		retryBackoff:    defaultRetryBackoff,
+		concurrency:     defaultQueryTestConcurrency,
+		readyInterval:   defaultReadyInterval,
+		datasourceQuery: integrate.DefaultDatasourceQuery,
+	}
+
+	// A custom query endpoint applies to the HTTP implementation, any other implementation is kept as is
+	if _, ok := qt.datasourceQuery.(*integrate.HTTPDatasourceQuery); ok && config.IntegratorConfig.QueryEndpoint != "" {
+		qt.datasourceQuery = &integrate.HTTPDatasourceQuery{QueryEndpoint: config.IntegratorConfig.QueryEndpoint}
+	}
+
+	if config.IntegratorConfig.QueryTestRetryBackoff != "" {
+		backoff, err := time.ParseDuration(config.IntegratorConfig.QueryTestRetryBackoff)
+		if err != nil {
+			qt.warnings.Add("Invalid query test retry backoff in config, using default: %v", err)
+		} else {
+			qt.retryBackoff = backoff
+		}
+	}
+	for datasourceType, value := range config.IntegratorConfig.QueryTimeouts {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			qt.warnings.Add("Invalid query timeout %s for data source type %s in config, using default", value, datasourceType)
+			continue
+		}
+		if qt.typeTimeouts == nil {
+			qt.typeTimeouts = make(map[string]time.Duration)
+		}
+		qt.typeTimeouts[datasourceType] = timeout
 	}
+	if concurrency := config.IntegratorConfig.QueryTestConcurrency; concurrency < 0 {
+		qt.warnings.Add("Invalid query test concurrency %d in config, using default", concurrency)
+	} else if concurrency > 0 {
+		qt.concurrency = concurrency
+	}
+	if config.IntegratorConfig.DatasourceReadyTimeout != "" {
+		readyTimeout, err := time.ParseDuration(config.IntegratorConfig.DatasourceReadyTimeout)
+		if err != nil {
+			qt.warnings.Add("Invalid data source ready timeout in config, not waiting for data sources: %v", err)
+		} else {
+			qt.readyTimeout = readyTimeout
+		}
+	}
+	if config.IntegratorConfig.TestSampleWindow != "" {
+		sampleWindow, err := time.ParseDuration(config.IntegratorConfig.TestSampleWindow)
+		if err != nil || sampleWindow <= 0 {
+			qt.warnings.Add("Invalid test sample window %s in config, testing the full time range", config.IntegratorConfig.TestSampleWindow)
+		} else {
+			qt.sampleWindow = sampleWindow
+		}
+	}
+	switch config.IntegratorConfig.ResultErrors {
+	case "", integrate.ResultErrorsFail:
+	case integrate.ResultErrorsReport:
+		qt.reportResultErrors = true
+	default:
+		qt.warnings.Add("Invalid result errors handling %s in config, failing the query tests", config.IntegratorConfig.ResultErrors)
+	}
+	if config.IntegratorConfig.QueryTestDeadline != "" {
+		runTimeout, err := time.ParseDuration(config.IntegratorConfig.QueryTestDeadline)
+		if err != nil {
+			qt.warnings.Add("Invalid query test deadline in config, ignoring it: %v", err)
+		} else {
+			qt.runTimeout = runTimeout
+		}
+	}
+
+	return qt
 }
 
 // Run executes query testing for all test files
 func (qt *QueryTester) Run() error {
 	fmt.Println("Testing queries against the datasource")
+	if qt.runTimeout > 0 {
+		qt.deadline = time.Now().Add(qt.runTimeout)
+	}
+	var queryLibrary map[string]string
+	if qt.config.IntegratorConfig.QueryLibrary != "" {
+		var err error
+		if queryLibrary, err = integrate.LoadQueryLibrary(qt.config.IntegratorConfig.QueryLibrary); err != nil {
+			return err
+		}
+	}
 	queryTestResults := make(map[string][]model.QueryTestResult, len(qt.testFiles))
 
 	for _, inputFile := range qt.testFiles {
@@ -56,19 +179,28 @@ func (qt *QueryTester) Run() error {
 		}
 
 		// Find matching configuration using ConversionName
-		var config model.ConversionConfig
-		for _, conf := range qt.config.Conversions {
-			if conf.Name == conversionObject.ConversionName {
-				config = conf
-				break
+		config, err := integrate.FindConversionConfig(qt.config, conversionObject, inputFile)
+		if err != nil {
+			fmt.Printf("Error testing queries for file %s: %v\n", inputFile, err)
+			if !qt.config.IntegratorConfig.ContinueOnQueryTestingErrors {
+				return err
 			}
+			continue
 		}
 		if config.Name == "" {
-			fmt.Printf("Warning: No configuration found for conversion name: %s, skipping file: %s\n", conversionObject.ConversionName, inputFile)
+			qt.warnings.Add("No configuration found for conversion name: %s, skipping file: %s", conversionObject.ConversionName, inputFile)
 			continue
 		}
+		config = integrate.BackendConfig(config, conversionObject.Backend)
 
-		queries := conversionObject.Queries
+		queries, err := integrate.ResolveQueryRefs(conversionObject, queryLibrary)
+		if err != nil {
+			fmt.Printf("Error testing queries for file %s: %v\n", inputFile, err)
+			if !qt.config.IntegratorConfig.ContinueOnQueryTestingErrors {
+				return err
+			}
+			continue
+		}
 		if len(queries) == 0 {
 			fmt.Printf("No queries found in conversion object for file %s\n", inputFile)
 			continue
@@ -101,6 +233,20 @@ func (qt *QueryTester) Run() error {
 					fmt.Printf("Error: %s\n", error)
 				}
 			}
+			if len(result.Stats.Warnings) > 0 {
+				fmt.Printf("Query testing warnings occurred for file %s\n", inputFile)
+				fmt.Printf("Datasource: %s\n", result.Datasource)
+				for _, warning := range result.Stats.Warnings {
+					qt.warnings.AddForFile(inputFile, "%s", warning)
+				}
+			}
+		}
+		if qt.config.IntegratorConfig.FailOnQueryWarnings && err == nil && hasWarnings(queryResults) {
+			err = fmt.Errorf("query testing returned warnings for file %s", inputFile)
+			fmt.Printf("Error testing queries for file %s: %v\n", inputFile, err)
+			if !qt.config.IntegratorConfig.ContinueOnQueryTestingErrors {
+				return err
+			}
 		}
 
 		if len(queryResults) > 0 {
@@ -130,8 +276,14 @@ func (qt *QueryTester) Run() error {
 			fmt.Printf("Query testing completed successfully for file %s\n", inputFile)
 		}
 
+		if qt.config.IntegratorConfig.RequireTestMatches && err == nil && hasNoMatches(queryResults) {
+			fmt.Printf("No matches found for the queries in file %s, skipping its alert rule\n", inputFile)
+			qt.noMatchFiles = append(qt.noMatchFiles, inputFile)
+		}
+
 		queryTestResults[inputFile] = queryResults
 	}
+	qt.results = queryTestResults
 
 	resultsJSON, err := json.Marshal(queryTestResults)
 	if err != nil {
@@ -143,20 +295,86 @@ func (qt *QueryTester) Run() error {
 		return fmt.Errorf("failed to set test query results output: %w", err)
 	}
 
+	if qt.config.IntegratorConfig.RequireTestMatches {
+		if err := shared.SetOutput("no_match_rules", strings.Join(qt.noMatchFiles, " ")); err != nil {
+			return fmt.Errorf("failed to set no match rules output: %w", err)
+		}
+	}
+
 	return nil
 }
 
-// TestQueries tests a map of queries against the datasource
+// Results returns the query test results of the last Run, by conversion file
+func (qt *QueryTester) Results() map[string][]model.QueryTestResult {
+	return qt.results
+}
+
+// NoMatchFiles returns the conversion files whose queries all returned no matches during the last Run.
+// It is only populated when require_test_matches is enabled.
+func (qt *QueryTester) NoMatchFiles() []string {
+	return qt.noMatchFiles
+}
+
+// hasNoMatches reports whether every query returned zero results without any error
+func hasNoMatches(results []model.QueryTestResult) bool {
+	if len(results) == 0 {
+		return false
+	}
+	for _, result := range results {
+		if result.Stats.Count > 0 || len(result.Stats.Errors) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hasWarnings reports whether the data source returned warnings for any of the queries
+func hasWarnings(results []model.QueryTestResult) bool {
+	for _, result := range results {
+		if len(result.Stats.Warnings) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// timeoutFor returns the query timeout of a data source type, falling back to the default timeout
+func (qt *QueryTester) timeoutFor(datasourceType string) time.Duration {
+	if timeout, ok := qt.typeTimeouts[datasourceType]; ok {
+		return timeout
+	}
+	return qt.timeout
+}
+
+// queryTest is a query of a conversion to test, once the checks of its data source passed
+type queryTest struct {
+	refID        string
+	query        string
+	datasource   string
+	timeout      time.Duration
+	exploreLink  string
+	typeMismatch string
+	// results of the query, or the failure of the query test when err is set
+	results []model.QueryTestResult
+	err     error
+}
+
+// TestQueries tests a map of queries against the datasource. The queries are checked one by one, then tested
+// concurrently, up to query_test_concurrency at a time. Their results are returned in the order of their refIDs
+// and, like when testing them one by one, the first failure in that order is returned instead.
 func (qt *QueryTester) TestQueries(queries map[string]string, config, defaultConf model.ConversionConfig) ([]model.QueryTestResult, error) {
-	queryResults := make([]model.QueryTestResult, 0, len(queries))
-	datasource := shared.GetConfigValue(config.DataSource, defaultConf.DataSource, "")
-	// Determine datasource type using the same logic as createAlertQuery
-	datasourceType := shared.GetConfigValue(
-		config.DataSourceType,
-		defaultConf.DataSourceType,
-		shared.GetConfigValue(config.Target, defaultConf.Target, shared.Loki),
-	)
+	conversionDatasource := shared.GetConfigValue(config.DataSource, defaultConf.DataSource, "")
 	customModel := shared.GetConfigValue(config.QueryModel, defaultConf.QueryModel, "")
+	// A conversion's own time range takes precedence over the global and explore ranges
+	from := shared.GetConfigValue(config.From, defaultConf.From, qt.config.IntegratorConfig.From)
+	to := shared.GetConfigValue(config.To, defaultConf.To, qt.config.IntegratorConfig.To)
+	exploreFrom := shared.GetConfigValue(config.From, defaultConf.From, shared.GetConfigValue(qt.config.IntegratorConfig.ExploreFrom, qt.config.IntegratorConfig.From, ""))
+	exploreTo := shared.GetConfigValue(config.To, defaultConf.To, shared.GetConfigValue(qt.config.IntegratorConfig.ExploreTo, qt.config.IntegratorConfig.To, ""))
+	// Explore links keep the full range, for the matches outside of the sample to be looked at
+	from, sampled := qt.sampleRange(from, to)
+	if sampled {
+		fmt.Printf("Testing the queries over a sample of the time range, from %s to %s\n", from, to)
+	}
 
 	// Sort refIDs to ensure consistent ordering
 	refIDs := make([]string, 0, len(queries))
@@ -165,87 +383,398 @@ func (qt *QueryTester) TestQueries(queries map[string]string, config, defaultCon
 	}
 	sort.Strings(refIDs)
 
+	// The data sources are checked one by one, as the checks are cached by data source.
+	// Queries after the first failed check are not tested, as their results would not be returned.
+	tests := make([]*queryTest, 0, len(refIDs))
+	var checkFailure *queryTest
 	for _, refID := range refIDs {
 		query := queries[refID]
 
+		// Each query may target its own datasource, matched by the position encoded in its refID
+		index, err := strconv.Atoi(strings.TrimPrefix(refID, "A"))
+		if err != nil {
+			index = -1
+		}
+		datasource, queryConfig := integrate.ResolveQueryDataSource(index, conversionDatasource, config)
+		// Determine datasource type using the same logic as createAlertQuery
+		datasourceType := shared.GetConfigValue(
+			queryConfig.DataSourceType,
+			defaultConf.DataSourceType,
+			shared.GetConfigValue(queryConfig.Target, defaultConf.Target, shared.Loki),
+		)
+
 		// Generate explore link first so it's available even if query testing fails
 		// (e.g., auth failure) — the link is a pure deeplink and doesn't depend on
 		// the test response.
-		exploreLink, err := GenerateExploreLink(
-			query, datasource, datasourceType, config, defaultConf,
+		exploreLink, err := shared.GenerateExploreLink(
+			query, datasource, datasourceType, queryConfig, defaultConf,
 			qt.config.DeployerConfig.GrafanaInstance,
-			qt.config.IntegratorConfig.From,
-			qt.config.IntegratorConfig.To,
+			exploreFrom,
+			exploreTo,
 			qt.config.IntegratorConfig.OrgID,
 		)
 		if err != nil {
-			return nil, fmt.Errorf("error generating explore link: %v", err)
+			checkFailure = &queryTest{err: fmt.Errorf("error generating explore link: %v", err)}
+			break
+		}
+		test := &queryTest{
+			refID:       refID,
+			query:       query,
+			datasource:  datasource,
+			timeout:     qt.timeoutFor(datasourceType),
+			exploreLink: exploreLink,
 		}
 
-		resp, err := integrate.TestQuery(
-			query,
-			datasource,
-			qt.config.DeployerConfig.GrafanaInstance,
-			os.Getenv("INTEGRATOR_GRAFANA_SA_TOKEN"),
-			refID,
-			qt.config.IntegratorConfig.From,
-			qt.config.IntegratorConfig.To,
-			customModel,
-			qt.timeout,
-		)
+		if err := integrate.CheckAllowedDatasource(datasource, config.Name, qt.config.IntegratorConfig.AllowedDatasources, func(ref string) (*integrate.GrafanaDatasource, error) {
+			return integrate.LookupDatasource(ref, qt.config.DeployerConfig.GrafanaInstance, os.Getenv("INTEGRATOR_GRAFANA_SA_TOKEN"), test.timeout)
+		}); err != nil {
+			test.fail(err.Error())
+			checkFailure = test
+			break
+		}
+
+		qt.waitForDatasource(datasource, test.timeout)
+
+		// Queries built for another type of data source fail at evaluation time, so catch them early. Only an
+		// explicit data_source_type is checked, as Sigma targets, e.g. lucene, aren't named after data source types.
+		// A custom query model is left to the user, as it may target any data source type.
+		if explicitType := shared.GetConfigValue(queryConfig.DataSourceType, defaultConf.DataSourceType, ""); customModel == "" && explicitType != "" {
+			test.typeMismatch = qt.checkDatasourceType(datasource, explicitType)
+		}
+		if test.typeMismatch != "" && !qt.config.IntegratorConfig.WarnOnDataSourceTypeMismatch {
+			test.fail(test.typeMismatch)
+			checkFailure = test
+			break
+		}
+		tests = append(tests, test)
+	}
+
+	qt.runQueryTests(tests, customModel, from, to)
+
+	queryResults := make([]model.QueryTestResult, 0, len(queries))
+	for _, test := range tests {
+		for index := range test.results {
+			test.results[index].Sampled = sampled
+		}
+		if test.err != nil {
+			return test.results, test.err
+		}
+		queryResults = append(queryResults, test.results...)
+	}
+	if checkFailure != nil {
+		return checkFailure.results, checkFailure.err
+	}
+
+	return queryResults, nil
+}
+
+// grafanaRelativeTime matches the offsets of a Grafana relative time without rounding, e.g. now-1d+2h
+var grafanaRelativeTime = regexp.MustCompile(`^now((?:[+-][0-9]+[smhdwMy])*)$`)
+
+var grafanaTimeOffset = regexp.MustCompile(`([+-])([0-9]+)([smhdwMy])`)
+
+// resolveTime resolves a time of a Grafana time range, a relative time or a Unix timestamp in milliseconds,
+// against now. False is returned for the times which can't be resolved, such as rounded relative times.
+func resolveTime(value string, now time.Time) (time.Time, bool) {
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(millis), true
+	}
+	match := grafanaRelativeTime.FindStringSubmatch(value)
+	if match == nil {
+		return time.Time{}, false
+	}
+	resolved := now
+	for _, offset := range grafanaTimeOffset.FindAllStringSubmatch(match[1], -1) {
+		amount, err := strconv.Atoi(offset[2])
 		if err != nil {
-			return []model.QueryTestResult{
-				{
-					Datasource: datasource,
-					Link:       exploreLink,
-					Stats: model.Stats{
-						Fields: make(map[string]string),
-						Errors: []string{err.Error()},
-					},
-				},
-			}, fmt.Errorf("error testing query %s: %v", query, err)
-		}
-		// Parse the response to extract statistics
-		result := model.QueryTestResult{
-			Datasource: datasource,
-			Link:       exploreLink,
+			return time.Time{}, false
+		}
+		if offset[1] == "-" {
+			amount = -amount
+		}
+		switch offset[3] {
+		case "s":
+			resolved = resolved.Add(time.Duration(amount) * time.Second)
+		case "m":
+			resolved = resolved.Add(time.Duration(amount) * time.Minute)
+		case "h":
+			resolved = resolved.Add(time.Duration(amount) * time.Hour)
+		case "d":
+			resolved = resolved.AddDate(0, 0, amount)
+		case "w":
+			resolved = resolved.AddDate(0, 0, 7*amount)
+		case "M":
+			resolved = resolved.AddDate(0, amount, 0)
+		case "y":
+			resolved = resolved.AddDate(amount, 0, 0)
+		}
+	}
+	return resolved, true
+}
+
+// sampleRange returns the start of the sample of a time range the queries are tested over: the last sampleWindow
+// of the range, relative when its end is. The start of the range is returned unchanged when sampling is disabled,
+// the range is no longer than the sample or can't be resolved, along with whether the range is sampled.
+func (qt *QueryTester) sampleRange(from, to string) (string, bool) {
+	if qt.sampleWindow <= 0 {
+		return from, false
+	}
+	now := time.Now()
+	fromTime, fromOK := resolveTime(from, now)
+	toTime, toOK := resolveTime(to, now)
+	if !fromOK || !toOK {
+		qt.warnings.Add("Could not resolve the time range from %s to %s, testing it in full", from, to)
+		return from, false
+	}
+	if toTime.Sub(fromTime) <= qt.sampleWindow {
+		return from, false
+	}
+	if millis, err := strconv.ParseInt(to, 10, 64); err == nil {
+		return strconv.FormatInt(millis-qt.sampleWindow.Milliseconds(), 10), true
+	}
+	return fmt.Sprintf("%s-%ds", to, int64(qt.sampleWindow.Seconds())), true
+}
+
+// fail records the failure of a query test, reported as the error of its result
+func (test *queryTest) fail(message string) {
+	test.results = []model.QueryTestResult{
+		{
+			Datasource: test.datasource,
+			Link:       test.exploreLink,
 			Stats: model.Stats{
 				Fields: make(map[string]string),
-				Errors: make([]string, 0),
+				Errors: []string{message},
 			},
+		},
+	}
+	test.err = fmt.Errorf("error testing query %s: %s", test.query, message)
+}
+
+// runQueryTests tests the queries with a pool of up to concurrency workers, each picking the next query in order.
+// Once a query test fails, the queries after it are not tested, as their results would not be returned.
+func (qt *QueryTester) runQueryTests(tests []*queryTest, customModel, from, to string) {
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		// index of the first failed query test so far
+		firstFailure = len(tests)
+	)
+	indexes := make(chan int)
+	for range min(max(qt.concurrency, 1), len(tests)) {
+		wg.Go(func() {
+			for index := range indexes {
+				mu.Lock()
+				skip := firstFailure < index
+				mu.Unlock()
+				if skip {
+					continue
+				}
+				if qt.runQueryTest(tests[index], customModel, from, to); tests[index].err != nil {
+					mu.Lock()
+					firstFailure = min(firstFailure, index)
+					mu.Unlock()
+				}
+			}
+		})
+	}
+	for index := range tests {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// runQueryTest tests a query against its data source and extracts the statistics of the response
+func (qt *QueryTester) runQueryTest(test *queryTest, customModel, from, to string) {
+	resp, err := qt.testQueryWithRetries(test.query, test.datasource, test.refID, customModel, from, to, test.timeout)
+	if err != nil {
+		test.fail(err.Error())
+		return
+	}
+	// Parse the response to extract statistics
+	result := model.QueryTestResult{
+		Datasource: test.datasource,
+		Link:       test.exploreLink,
+		Stats: model.Stats{
+			Fields: make(map[string]string),
+			Errors: make([]string, 0),
+		},
+	}
+
+	// Reported along with the other warnings of the result
+	if test.typeMismatch != "" {
+		result.Stats.Warnings = append(result.Stats.Warnings, test.typeMismatch)
+	}
+
+	// Parse the response to extract statistics
+	var responseData model.QueryResponse
+	if err := json.Unmarshal(resp, &responseData); err != nil {
+		test.err = fmt.Errorf("error unmarshalling query response: %v", err)
+		return
+	}
+
+	// Process errors
+	for _, err := range responseData.Errors {
+		if err.Type != "cancelled" && err.Message != "" {
+			result.Stats.Errors = append(result.Stats.Errors, err.Message)
+		}
+	}
+	// Grafana reports the failure of a query in the status of its result, with a successful response
+	resultErrors := failedResults(responseData)
+	result.Stats.Errors = append(result.Stats.Errors, resultErrors...)
+
+	// Process data frames from all results
+	for _, resultFrame := range responseData.Results {
+		for _, frame := range resultFrame.Frames {
+			if err := ProcessFrame(
+				frame,
+				&result,
+				qt.frameFields(),
+				qt.config.IntegratorConfig.ShowSampleValues,
+				qt.config.IntegratorConfig.ShowLogLines,
+				qt.warnings,
+			); err != nil {
+				test.err = fmt.Errorf("error processing frame: %v", err)
+				return
+			}
 		}
+	}
+
+	test.results = []model.QueryTestResult{result}
+	if len(resultErrors) > 0 && !qt.reportResultErrors {
+		test.err = fmt.Errorf("error testing query %s: %s", test.query, strings.Join(resultErrors, "; "))
+	}
+}
 
-		// Parse the response to extract statistics
-		var responseData model.QueryResponse
-		if err := json.Unmarshal(resp, &responseData); err != nil {
-			return nil, fmt.Errorf("error unmarshalling query response: %v", err)
+// failedResults describes the results of a query response with an error or an unsuccessful status, in the order
+// of their refIDs. Results without a status, as returned by older Grafana versions, only fail with an error.
+func failedResults(response model.QueryResponse) []string {
+	failures := []string{}
+	for _, refID := range slices.Sorted(maps.Keys(response.Results)) {
+		result := response.Results[refID]
+		switch {
+		case result.Status != 0 && (result.Status < http.StatusOK || result.Status >= http.StatusMultipleChoices):
+			message := cmp.Or(result.Error, http.StatusText(result.Status))
+			failures = append(failures, fmt.Sprintf("result %s failed with status %d: %s", refID, result.Status, message))
+		case result.Error != "":
+			failures = append(failures, fmt.Sprintf("result %s failed: %s", refID, result.Error))
 		}
+	}
+	return failures
+}
 
-		// Process errors
-		for _, err := range responseData.Errors {
-			if err.Type != "cancelled" && err.Message != "" {
-				result.Stats.Errors = append(result.Stats.Errors, err.Message)
-			}
+// checkDatasourceType compares the configured type of a data source to its live type in Grafana, returning
+// a description of the mismatch, if any. Data sources which can't be fetched are not checked, as testing
+// their queries reports the error.
+func (qt *QueryTester) checkDatasourceType(datasource, datasourceType string) string {
+	liveType, ok := qt.datasourceTypes[datasource]
+	if !ok {
+		live, err := integrate.GetDatasourceByName(
+			datasource,
+			qt.config.DeployerConfig.GrafanaInstance,
+			os.Getenv("INTEGRATOR_GRAFANA_SA_TOKEN"),
+			qt.timeoutFor(datasourceType),
+		)
+		if err != nil {
+			return ""
+		}
+		liveType = live.Type
+		if qt.datasourceTypes == nil {
+			qt.datasourceTypes = make(map[string]string)
 		}
+		qt.datasourceTypes[datasource] = liveType
+	}
+	if liveType == "" || liveType == datasourceType {
+		return ""
+	}
+	return fmt.Sprintf("data source %s is of type %s, but its queries are configured for %s: set data_source_type to %s or use a %s data source",
+		datasource, liveType, datasourceType, liveType, datasourceType)
+}
 
-		// Process data frames from all results
-		for _, resultFrame := range responseData.Results {
-			for _, frame := range resultFrame.Frames {
-				if err := ProcessFrame(
-					frame,
-					&result,
-					qt.config.IntegratorConfig.ShowSampleValues,
-					qt.config.IntegratorConfig.ShowLogLines,
-				); err != nil {
-					return nil, fmt.Errorf("error processing frame: %v", err)
-				}
-			}
+// waitForDatasource polls a data source until Grafana finds it, for data sources which may not be ready yet when
+// query testing starts, e.g. when started along with an ephemeral CI environment. Each data source is waited for
+// once. A data source still not found after readyTimeout has its queries tested anyway, for them to report the error.
+func (qt *QueryTester) waitForDatasource(datasource string, timeout time.Duration) {
+	if qt.readyTimeout <= 0 || qt.readyDatasources[datasource] {
+		return
+	}
+	if qt.readyDatasources == nil {
+		qt.readyDatasources = make(map[string]bool)
+	}
+	qt.readyDatasources[datasource] = true
+
+	deadline := time.Now().Add(qt.readyTimeout)
+	for {
+		_, err := integrate.GetDatasourceByName(
+			datasource,
+			qt.config.DeployerConfig.GrafanaInstance,
+			os.Getenv("INTEGRATOR_GRAFANA_SA_TOKEN"),
+			timeout,
+		)
+		if err == nil {
+			return
+		}
+		if time.Now().Add(qt.readyInterval).After(deadline) {
+			qt.warnings.Add("data source %s is still not ready after %s: %v", datasource, qt.readyTimeout, err)
+			return
 		}
+		fmt.Printf("Data source %s is not ready, retrying in %s: %v\n", datasource, qt.readyInterval, err)
+		time.Sleep(qt.readyInterval)
+	}
+}
 
-		queryResults = append(queryResults, result)
+// testQueryWithRetries tests a query, retrying with an exponential backoff when the request times out.
+// Any other error is returned straight away as retrying would not change the outcome. A retry is not
+// attempted if it could not complete before the query testing deadline.
+func (qt *QueryTester) testQueryWithRetries(query, datasource, refID, customModel, from, to string, timeout time.Duration) ([]byte, error) {
+	retries := qt.config.IntegratorConfig.QueryTestRetries
+	backoff := qt.retryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := qt.datasourceQuery.ExecuteQuery(
+			query,
+			datasource,
+			qt.config.DeployerConfig.GrafanaInstance,
+			os.Getenv("INTEGRATOR_GRAFANA_SA_TOKEN"),
+			refID,
+			from,
+			to,
+			customModel,
+			timeout,
+		)
+		if err == nil || attempt >= retries || !integrate.IsTimeoutError(err) {
+			return resp, err
+		}
+		if !qt.deadline.IsZero() && time.Now().Add(backoff+timeout).After(qt.deadline) {
+			fmt.Printf("Query %s timed out, not retrying as it would exceed the query testing deadline\n", refID)
+			return resp, err
+		}
+		fmt.Printf("Query %s timed out, retrying in %s (%d/%d)\n", refID, backoff, attempt+1, retries)
+		time.Sleep(backoff)
+		backoff *= 2
 	}
+}
 
-	return queryResults, nil
+// FrameFields are the names of the fields of the response frames holding the matches of a query
+type FrameFields struct {
+	// fields whose values are counted as matches, e.g. the Line of Loki log lines
+	Value []string
+	// fields whose labels, or values, are reported as the fields of the matches, e.g. the labels of Loki log lines
+	Label []string
+}
+
+// DefaultFrameFields are the fields of the log lines returned by Loki
+var DefaultFrameFields = FrameFields{Value: []string{"Line"}, Label: []string{"labels"}}
+
+// frameFields returns the configured fields of the response frames, falling back to those of Loki
+func (qt *QueryTester) frameFields() FrameFields {
+	fields := DefaultFrameFields
+	if len(qt.config.IntegratorConfig.TestValueFields) > 0 {
+		fields.Value = qt.config.IntegratorConfig.TestValueFields
+	}
+	if len(qt.config.IntegratorConfig.TestLabelFields) > 0 {
+		fields.Label = qt.config.IntegratorConfig.TestLabelFields
+	}
+	return fields
 }
 
 var (
@@ -253,8 +782,18 @@ var (
 	executionTimeStatKey  = "Summary: exec time"
 )
 
-// ProcessFrame processes a single frame from the query response and updates the result stats
-func ProcessFrame(frame model.Frame, result *model.QueryTestResult, showSampleValues, showLogLines bool) error {
+// ProcessFrame processes a single frame from the query response and updates the result stats. Each row with
+// a value in one of the value fields is counted as a match, and the labels of the label fields are reported as
+// its fields. A warning is added to warnings when a frame of log lines has none of the value fields, as its matches
+// would otherwise go unnoticed.
+func ProcessFrame(frame model.Frame, result *model.QueryTestResult, fields FrameFields, showSampleValues, showLogLines bool, warnings *shared.Warnings) error {
+	// Notices flag non-fatal issues, such as partial results, which are reported as warnings
+	for _, notice := range frame.Schema.Meta.Notices {
+		if (notice.Severity == "warning" || notice.Severity == "error") && notice.Text != "" && !slices.Contains(result.Stats.Warnings, notice.Text) {
+			result.Stats.Warnings = append(result.Stats.Warnings, notice.Text)
+		}
+	}
+
 	// Get metrics from frame metadata (Stats are nested within Schema.Meta)
 	for _, stat := range frame.Schema.Meta.Stats {
 		switch {
@@ -273,8 +812,10 @@ func ProcessFrame(frame model.Frame, result *model.QueryTestResult, showSampleVa
 
 	// Map field names to their indices
 	fieldIndices := make(map[string]int)
+	numeric := false
 	for i, field := range frame.Schema.Fields {
 		fieldIndices[field.Name] = i
+		numeric = numeric || field.Type == "number"
 	}
 
 	// Skip if no values
@@ -290,42 +831,57 @@ func ProcessFrame(frame model.Frame, result *model.QueryTestResult, showSampleVa
 		}
 	}
 
+	// Time series, e.g. of metric queries, hold numbers rather than matches
+	if numRows > 0 && !numeric && !slices.ContainsFunc(fields.Value, func(name string) bool { _, ok := fieldIndices[name]; return ok }) {
+		warnings.Add("none of the value fields %s are in the query response, its matches are not counted: set integration.test_value_fields to the fields of the response", strings.Join(fields.Value, ", "))
+	}
+
+	// value returns the value of a field in the row, if the frame has the field
+	value := func(name string, rowIndex int) (any, bool) {
+		index, ok := fieldIndices[name]
+		if !ok || index >= len(frame.Data.Values) || rowIndex >= len(frame.Data.Values[index]) {
+			return nil, false
+		}
+		return frame.Data.Values[index][rowIndex], frame.Data.Values[index][rowIndex] != nil
+	}
+
 	// Process each row of values
 	for rowIndex := 0; rowIndex < numRows; rowIndex++ {
-		// Process labels if present
-		if labelIndex, ok := fieldIndices["labels"]; ok {
-			if labelIndex < len(frame.Data.Values) {
-				if rowIndex < len(frame.Data.Values[labelIndex]) {
-					if labelValues, ok := frame.Data.Values[labelIndex][rowIndex].(map[string]any); ok {
-						for label, value := range labelValues {
-							if _, exists := result.Stats.Fields[label]; !exists {
-								if showSampleValues {
-									result.Stats.Fields[label] = fmt.Sprintf("%v", value)
-								} else {
-									result.Stats.Fields[label] = ""
-								}
-							}
-						}
+		// Process labels if present, a label field holds either a map of labels or the value of a single field
+		for _, labelField := range fields.Label {
+			labelValue, ok := value(labelField, rowIndex)
+			if !ok {
+				continue
+			}
+			labelValues, ok := labelValue.(map[string]any)
+			if !ok {
+				labelValues = map[string]any{labelField: labelValue}
+			}
+			for label, value := range labelValues {
+				if _, exists := result.Stats.Fields[label]; !exists {
+					if showSampleValues {
+						result.Stats.Fields[label] = fmt.Sprintf("%v", value)
+					} else {
+						result.Stats.Fields[label] = ""
 					}
 				}
 			}
 		}
 
-		// Process Line field if present
-		if lineIndex, ok := fieldIndices["Line"]; ok {
-			if lineIndex < len(frame.Data.Values) {
-				if rowIndex < len(frame.Data.Values[lineIndex]) {
-					if lineValue, ok := frame.Data.Values[lineIndex][rowIndex].(string); ok {
-						result.Stats.Count++
-						// Only store the line value if show_log_lines is enabled
-						if showLogLines {
-							if _, exists := result.Stats.Fields["Line"]; !exists {
-								result.Stats.Fields["Line"] = lineValue
-							}
-						}
-					}
+		// Process the first value field present, e.g. the Line of a log line
+		for _, valueField := range fields.Value {
+			lineValue, ok := value(valueField, rowIndex)
+			if !ok {
+				continue
+			}
+			result.Stats.Count++
+			// Only store the line value if show_log_lines is enabled
+			if showLogLines {
+				if _, exists := result.Stats.Fields[valueField]; !exists {
+					result.Stats.Fields[valueField] = fmt.Sprintf("%v", lineValue)
 				}
 			}
+			break
 		}
 	}
 	return nil
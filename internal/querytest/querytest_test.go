@@ -1,17 +1,26 @@
 package querytest
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/grafana/sigma-rule-deployment/internal/integrate"
 	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/grafana/sigma-rule-deployment/shared"
+	"github.com/jarcoal/httpmock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRun(t *testing.T) {
@@ -180,7 +189,7 @@ func TestRun(t *testing.T) {
 
 			// Create query tester and run
 			timeoutDuration := 5 * time.Second
-			queryTester := NewQueryTester(config, testFiles, timeoutDuration)
+			queryTester := NewQueryTester(config, testFiles, timeoutDuration, nil)
 			err = queryTester.Run()
 
 			if tt.wantError {
@@ -230,7 +239,7 @@ func TestTestQueriesPreservesExploreLinkOnError(t *testing.T) {
 		integrate.DefaultDatasourceQuery = originalDatasourceQuery
 	}()
 
-	queryTester := NewQueryTester(config, nil, 5*time.Second)
+	queryTester := NewQueryTester(config, nil, 5*time.Second, nil)
 	results, err := queryTester.TestQueries(
 		map[string]string{"A0": `{job="test"}`},
 		model.ConversionConfig{Name: "test_conv"},
@@ -244,10 +253,1000 @@ func TestTestQueriesPreservesExploreLinkOnError(t *testing.T) {
 	assert.Len(t, results[0].Stats.Errors, 1)
 }
 
+func TestTestQueriesExploreRange(t *testing.T) {
+	config := model.Configuration{
+		ConversionDefaults: model.ConversionConfig{
+			Target:     "loki",
+			DataSource: "test-datasource",
+		},
+		IntegratorConfig: model.IntegrationConfig{
+			OrgID:       1,
+			From:        "now-1h",
+			To:          "now",
+			ExploreFrom: "now-24h",
+		},
+		DeployerConfig: model.DeploymentConfig{
+			GrafanaInstance: "https://test.grafana.com",
+		},
+	}
+
+	mock := &testDatasourceQueryRange{testDatasourceQuery: newTestDatasourceQuery()}
+	originalDatasourceQuery := integrate.DefaultDatasourceQuery
+	integrate.DefaultDatasourceQuery = mock
+	defer func() {
+		integrate.DefaultDatasourceQuery = originalDatasourceQuery
+	}()
+
+	queryTester := NewQueryTester(config, nil, 5*time.Second, nil)
+	results, err := queryTester.TestQueries(
+		map[string]string{"A0": `{job="test"}`},
+		model.ConversionConfig{Name: "test_conv"},
+		config.ConversionDefaults,
+	)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	// The explore link uses the explore range, falling back to the test range for the unset end
+	assert.Contains(t, results[0].Link, url.QueryEscape(`"range":{"from":"now-24h","to":"now"}`))
+	assert.Equal(t, "now-1h", mock.from)
+	assert.Equal(t, "now", mock.to)
+}
+
+func TestTestQueriesConcurrently(t *testing.T) {
+	config := model.Configuration{
+		ConversionDefaults: model.ConversionConfig{
+			Target:     "loki",
+			DataSource: "test-datasource",
+		},
+		IntegratorConfig: model.IntegrationConfig{
+			QueryTestConcurrency: 3,
+		},
+		DeployerConfig: model.DeploymentConfig{
+			GrafanaInstance: "https://test.grafana.com",
+		},
+	}
+	queries := map[string]string{}
+	conversion := model.ConversionConfig{Name: "test_conv"}
+	for index := range 5 {
+		queries[fmt.Sprintf("A%d", index)] = fmt.Sprintf(`{job="test%d"}`, index)
+		conversion.QueryDataSources = append(conversion.QueryDataSources, model.QueryDataSource{DataSource: fmt.Sprintf("ds-%d", index)})
+	}
+
+	mock := &testDatasourceQueryBlocking{
+		testDatasourceQueryWithErrors: newTestDatasourceQueryWithErrors(),
+		started:                       make(chan string, len(queries)),
+		release:                       make(chan struct{}),
+	}
+	originalDatasourceQuery := integrate.DefaultDatasourceQuery
+	integrate.DefaultDatasourceQuery = mock
+	defer func() {
+		integrate.DefaultDatasourceQuery = originalDatasourceQuery
+	}()
+
+	type testResult struct {
+		results []model.QueryTestResult
+		err     error
+	}
+	testQueries := func() chan testResult {
+		done := make(chan testResult, 1)
+		go func() {
+			results, err := NewQueryTester(config, nil, 5*time.Second, nil).TestQueries(queries, conversion, config.ConversionDefaults)
+			done <- testResult{results, err}
+		}()
+		return done
+	}
+	waitForQueries := func(count int) {
+		for range count {
+			select {
+			case <-mock.started:
+			case <-time.After(5 * time.Second):
+				require.FailNow(t, "queries are not tested concurrently")
+			}
+		}
+	}
+
+	// Three queries are tested at the same time, the other ones waiting for a worker
+	done := testQueries()
+	waitForQueries(3)
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, mock.started)
+	close(mock.release)
+	waitForQueries(2)
+	result := <-done
+	require.NoError(t, result.err)
+	require.Len(t, result.results, 5)
+	for index, queryResult := range result.results {
+		assert.Equal(t, fmt.Sprintf("ds-%d", index), queryResult.Datasource)
+	}
+
+	// The first failure in the order of the queries is returned
+	mock.AddMockError(`{job="test1"}`, fmt.Errorf("query failed"))
+	mock.AddMockError(`{job="test2"}`, fmt.Errorf("query timed out"))
+	result = <-testQueries()
+	assert.EqualError(t, result.err, `error testing query {job="test1"}: query failed`)
+	require.Len(t, result.results, 1)
+	assert.Equal(t, "ds-1", result.results[0].Datasource)
+}
+
+func TestTestQueriesDatasourceReady(t *testing.T) {
+	tests := []struct {
+		name            string
+		readyTimeout    string
+		failedLookups   int
+		wantLookups     int
+		wantQueryTested bool
+	}{
+		{
+			name:            "ready straight away",
+			readyTimeout:    "1s",
+			failedLookups:   0,
+			wantLookups:     2, // the readiness check, then the type check
+			wantQueryTested: true,
+		},
+		{
+			name:            "ready after failed lookups",
+			readyTimeout:    "1s",
+			failedLookups:   3,
+			wantLookups:     5,
+			wantQueryTested: true,
+		},
+		{
+			name:            "not waiting by default",
+			failedLookups:   3,
+			wantLookups:     2, // the type check of each query, as failed lookups aren't cached
+			wantQueryTested: true,
+		},
+		{
+			name:            "never ready",
+			readyTimeout:    "50ms",
+			failedLookups:   1000,
+			wantQueryTested: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := model.Configuration{
+				ConversionDefaults: model.ConversionConfig{
+					Target:         "loki",
+					DataSourceType: "loki",
+					DataSource:     "test-datasource",
+				},
+				IntegratorConfig: model.IntegrationConfig{
+					DatasourceReadyTimeout: tt.readyTimeout,
+				},
+			}
+
+			mock := &testDatasourceQueryNotReady{testDatasourceQuery: newTestDatasourceQuery(), failedLookups: tt.failedLookups}
+			originalDatasourceQuery := integrate.DefaultDatasourceQuery
+			integrate.DefaultDatasourceQuery = mock
+			defer func() {
+				integrate.DefaultDatasourceQuery = originalDatasourceQuery
+			}()
+
+			queryTester := NewQueryTester(config, nil, 5*time.Second, nil)
+			queryTester.readyInterval = 10 * time.Millisecond
+			queries := map[string]string{"A0": `{job="test"}`, "A1": `{job="other"}`}
+			_, err := queryTester.TestQueries(queries, model.ConversionConfig{Name: "test_conv"}, config.ConversionDefaults)
+			require.NoError(t, err)
+
+			// The data source is only waited for once
+			if tt.wantLookups > 0 {
+				assert.Equal(t, tt.wantLookups, mock.lookups)
+			} else {
+				assert.Less(t, mock.lookups, 10)
+			}
+			if tt.wantQueryTested {
+				assert.Len(t, mock.queryLog, 2)
+			}
+		})
+	}
+}
+
+func TestTestQueriesDatasourceTypeMismatch(t *testing.T) {
+	tests := []struct {
+		name           string
+		liveType       string
+		target         string
+		dataSourceType string
+		warn           bool
+		customModel    string
+		wantError      bool
+		wantWarnings   []string
+	}{
+		{
+			name:           "matching data source type",
+			liveType:       "loki",
+			dataSourceType: "loki",
+		},
+		{
+			name:           "mismatching data source type is downgraded to a warning",
+			liveType:       "elasticsearch",
+			dataSourceType: "loki",
+			warn:           true,
+			wantWarnings:   []string{"data source test-ds is of type elasticsearch, but its queries are configured for loki: set data_source_type to elasticsearch or use a loki data source"},
+		},
+		{
+			name:           "mismatching data source type fails by default",
+			liveType:       "elasticsearch",
+			dataSourceType: "loki",
+			wantError:      true,
+		},
+		{
+			name:     "target without data source type is not checked",
+			liveType: "elasticsearch",
+			target:   "lucene",
+		},
+		{
+			name:           "custom query model is not checked",
+			liveType:       "elasticsearch",
+			dataSourceType: "loki",
+			customModel:    `{"refId":"%s","datasource":{"type":"elasticsearch","uid":"%s"},"query":"%s"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpmock.Activate(t)
+			defer httpmock.DeactivateAndReset()
+
+			config := model.Configuration{
+				ConversionDefaults: model.ConversionConfig{
+					Target:         cmp.Or(tt.target, "loki"),
+					DataSourceType: tt.dataSourceType,
+					DataSource:     "test-ds",
+					QueryModel:     tt.customModel,
+				},
+				IntegratorConfig: model.IntegrationConfig{
+					OrgID:                        1,
+					From:                         "now-1h",
+					To:                           "now",
+					WarnOnDataSourceTypeMismatch: tt.warn,
+				},
+				DeployerConfig: model.DeploymentConfig{
+					GrafanaInstance: "http://grafana:3000",
+				},
+			}
+
+			httpmock.RegisterResponder("GET", "http://grafana:3000/api/datasources/uid/test-ds",
+				httpmock.NewStringResponder(200, fmt.Sprintf(`{"id":1,"uid":"test-ds","type":"%s"}`, tt.liveType)))
+			httpmock.RegisterResponder("POST", "http://grafana:3000/api/ds/query",
+				httpmock.NewStringResponder(200, `{"results":{}}`))
+
+			queryTester := NewQueryTester(config, nil, 5*time.Second, nil)
+			results, err := queryTester.TestQueries(
+				map[string]string{"A0": `{job="loki"} |= "error"`},
+				model.ConversionConfig{Name: "test_conv"},
+				config.ConversionDefaults,
+			)
+			require.Len(t, results, 1)
+			if tt.wantError {
+				assert.ErrorContains(t, err, "data source test-ds is of type elasticsearch, but its queries are configured for loki")
+				assert.Len(t, results[0].Stats.Errors, 1)
+				// The query isn't sent to a data source it wasn't built for
+				assert.Zero(t, httpmock.GetCallCountInfo()["POST http://grafana:3000/api/ds/query"])
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantWarnings, results[0].Stats.Warnings)
+		})
+	}
+}
+
+func TestTestQueriesQueryEndpoint(t *testing.T) {
+	httpmock.Activate(t)
+	defer httpmock.DeactivateAndReset()
+
+	config := model.Configuration{
+		ConversionDefaults: model.ConversionConfig{
+			Target:     "loki",
+			DataSource: "test-ds",
+		},
+		IntegratorConfig: model.IntegrationConfig{
+			OrgID:         1,
+			From:          "now-1h",
+			To:            "now",
+			QueryEndpoint: "api/tenants/acme/ds/query",
+		},
+		DeployerConfig: model.DeploymentConfig{
+			GrafanaInstance: "http://grafana:3000",
+		},
+	}
+	httpmock.RegisterResponder("GET", "http://grafana:3000/api/datasources/uid/test-ds",
+		httpmock.NewStringResponder(200, `{"id":1,"uid":"test-ds","type":"loki"}`))
+	httpmock.RegisterResponder("POST", "http://grafana:3000/api/tenants/acme/ds/query",
+		httpmock.NewStringResponder(200, `{"results":{}}`))
+
+	// The queries are posted to the configured endpoint, without changing the default implementation
+	queryTester := NewQueryTester(config, nil, 5*time.Second, nil)
+	_, err := queryTester.TestQueries(map[string]string{"A0": `{job="loki"}`}, model.ConversionConfig{Name: "test_conv"}, config.ConversionDefaults)
+	require.NoError(t, err)
+	assert.Equal(t, 1, httpmock.GetCallCountInfo()["POST http://grafana:3000/api/tenants/acme/ds/query"])
+	assert.Equal(t, &integrate.HTTPDatasourceQuery{}, integrate.DefaultDatasourceQuery)
+}
+
+func TestTestQueriesTimeoutPerDatasourceType(t *testing.T) {
+	config := model.Configuration{
+		ConversionDefaults: model.ConversionConfig{
+			Target:     "loki",
+			DataSource: "loki-ds",
+		},
+		IntegratorConfig: model.IntegrationConfig{
+			OrgID: 1,
+			From:  "now-1h",
+			To:    "now",
+			QueryTimeouts: map[string]string{
+				shared.Elasticsearch: "30s",
+				"splunk":             "invalid",
+			},
+		},
+		DeployerConfig: model.DeploymentConfig{
+			GrafanaInstance: "https://test.grafana.com",
+		},
+	}
+	convConfig := model.ConversionConfig{
+		Name: "mixed_conv",
+		QueryDataSources: []model.QueryDataSource{
+			{},
+			{DataSource: "es-ds", DataSourceType: shared.Elasticsearch},
+		},
+	}
+
+	mock := &testDatasourceQueryTimeouts{testDatasourceQuery: newTestDatasourceQuery(), timeouts: map[string]time.Duration{}}
+	mock.datasourceTypes = map[string]string{"es-ds": shared.Elasticsearch}
+	originalDatasourceQuery := integrate.DefaultDatasourceQuery
+	integrate.DefaultDatasourceQuery = mock
+	defer func() {
+		integrate.DefaultDatasourceQuery = originalDatasourceQuery
+	}()
+
+	queryTester := NewQueryTester(config, nil, 5*time.Second, nil)
+	_, err := queryTester.TestQueries(
+		map[string]string{
+			"A0": `{job="loki"} |= "error"`,
+			"A1": `from logs-* | where event.action == "login"`,
+		},
+		convConfig,
+		config.ConversionDefaults,
+	)
+	require.NoError(t, err)
+
+	// The Elasticsearch query uses its longer timeout, the Loki query the default one
+	assert.Equal(t, map[string]time.Duration{
+		"loki-ds": 5 * time.Second,
+		"es-ds":   30 * time.Second,
+	}, mock.timeouts)
+
+	// An invalid timeout falls back to the default
+	assert.Equal(t, 5*time.Second, queryTester.timeoutFor("splunk"))
+}
+
+func TestTestQueriesConversionRange(t *testing.T) {
+	httpmock.Activate(t)
+	defer httpmock.DeactivateAndReset()
+
+	config := model.Configuration{
+		ConversionDefaults: model.ConversionConfig{
+			Target:     "loki",
+			DataSource: "loki-ds",
+		},
+		IntegratorConfig: model.IntegrationConfig{
+			OrgID:       1,
+			From:        "now-1h",
+			To:          "now",
+			ExploreFrom: "now-24h",
+		},
+		DeployerConfig: model.DeploymentConfig{
+			GrafanaInstance: "http://grafana:3000",
+		},
+	}
+
+	httpmock.RegisterResponder("GET", "http://grafana:3000/api/datasources/uid/loki-ds",
+		httpmock.NewStringResponder(200, `{"id":1,"uid":"loki-ds","type":"loki"}`))
+	var body struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	httpmock.RegisterResponder("POST", "http://grafana:3000/api/ds/query",
+		func(req *http.Request) (*http.Response, error) {
+			require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+			return httpmock.NewStringResponse(200, `{"results":{}}`), nil
+		})
+
+	queryTester := NewQueryTester(config, nil, 5*time.Second, nil)
+
+	// A conversion overriding the range is tested and explored over its own range
+	results, err := queryTester.TestQueries(
+		map[string]string{"A0": `{job="okta"} | json`},
+		model.ConversionConfig{Name: "weekly_logins", From: "now-7d", To: "now-1h"},
+		config.ConversionDefaults,
+	)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "now-7d", body.From)
+	assert.Equal(t, "now-1h", body.To)
+	assert.Contains(t, results[0].Link, url.QueryEscape(`"range":{"from":"now-7d","to":"now-1h"}`))
+
+	// Other conversions fall back to the global ranges
+	results, err = queryTester.TestQueries(
+		map[string]string{"A0": `{job="okta"} | json`},
+		model.ConversionConfig{Name: "logins"},
+		config.ConversionDefaults,
+	)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "now-1h", body.From)
+	assert.Equal(t, "now", body.To)
+	assert.Contains(t, results[0].Link, url.QueryEscape(`"range":{"from":"now-24h","to":"now"}`))
+}
+
+func TestTestQueriesSampleWindow(t *testing.T) {
+	httpmock.Activate(t)
+	defer httpmock.DeactivateAndReset()
+
+	config := model.Configuration{
+		ConversionDefaults: model.ConversionConfig{
+			Target:     "loki",
+			DataSource: "loki-ds",
+		},
+		IntegratorConfig: model.IntegrationConfig{
+			OrgID:            1,
+			From:             "now-1h",
+			To:               "now",
+			TestSampleWindow: "5m",
+		},
+		DeployerConfig: model.DeploymentConfig{
+			GrafanaInstance: "http://grafana:3000",
+		},
+	}
+
+	httpmock.RegisterResponder("GET", "http://grafana:3000/api/datasources/uid/loki-ds",
+		httpmock.NewStringResponder(200, `{"id":1,"uid":"loki-ds","type":"loki"}`))
+	var body struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	httpmock.RegisterResponder("POST", "http://grafana:3000/api/ds/query",
+		func(req *http.Request) (*http.Response, error) {
+			require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+			return httpmock.NewStringResponse(200, `{"results":{}}`), nil
+		})
+
+	tests := []struct {
+		name        string
+		convConfig  model.ConversionConfig
+		wantFrom    string
+		wantTo      string
+		wantSampled bool
+	}{
+		{
+			name:        "relative range",
+			convConfig:  model.ConversionConfig{Name: "logins"},
+			wantFrom:    "now-300s",
+			wantTo:      "now",
+			wantSampled: true,
+		},
+		{
+			name:        "range ending in the past",
+			convConfig:  model.ConversionConfig{Name: "weekly_logins", From: "now-7d", To: "now-1d"},
+			wantFrom:    "now-1d-300s",
+			wantTo:      "now-1d",
+			wantSampled: true,
+		},
+		{
+			name:        "absolute range",
+			convConfig:  model.ConversionConfig{Name: "incident", From: "1700000000000", To: "1700003600000"},
+			wantFrom:    "1700003300000",
+			wantTo:      "1700003600000",
+			wantSampled: true,
+		},
+		{
+			name:       "range shorter than the sample",
+			convConfig: model.ConversionConfig{Name: "recent", From: "now-2m", To: "now"},
+			wantFrom:   "now-2m",
+			wantTo:     "now",
+		},
+		{
+			name:       "rounded range",
+			convConfig: model.ConversionConfig{Name: "today", From: "now/d", To: "now"},
+			wantFrom:   "now/d",
+			wantTo:     "now",
+		},
+	}
+
+	queryTester := NewQueryTester(config, nil, 5*time.Second, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := queryTester.TestQueries(map[string]string{"A0": `{job="okta"} | json`}, tt.convConfig, config.ConversionDefaults)
+			require.NoError(t, err)
+			require.Len(t, results, 1)
+			assert.Equal(t, tt.wantFrom, body.From)
+			assert.Equal(t, tt.wantTo, body.To)
+			assert.Equal(t, tt.wantSampled, results[0].Sampled)
+		})
+	}
+
+	// Full range testing is the default
+	queryTester = NewQueryTester(model.Configuration{
+		ConversionDefaults: config.ConversionDefaults,
+		IntegratorConfig:   model.IntegrationConfig{OrgID: 1, From: "now-1h", To: "now"},
+		DeployerConfig:     config.DeployerConfig,
+	}, nil, 5*time.Second, nil)
+	results, err := queryTester.TestQueries(map[string]string{"A0": `{job="okta"} | json`}, model.ConversionConfig{Name: "logins"}, config.ConversionDefaults)
+	require.NoError(t, err)
+	assert.Equal(t, "now-1h", body.From)
+	assert.False(t, results[0].Sampled)
+}
+
+func TestTestQueriesPerQueryDatasource(t *testing.T) {
+	httpmock.Activate(t)
+	defer httpmock.DeactivateAndReset()
+
+	config := model.Configuration{
+		ConversionDefaults: model.ConversionConfig{
+			Target:     "loki",
+			DataSource: "loki-ds",
+		},
+		IntegratorConfig: model.IntegrationConfig{
+			OrgID: 1,
+			From:  "now-1h",
+			To:    "now",
+		},
+		DeployerConfig: model.DeploymentConfig{
+			GrafanaInstance: "http://grafana:3000",
+		},
+	}
+	convConfig := model.ConversionConfig{
+		Name: "mixed_conv",
+		QueryDataSources: []model.QueryDataSource{
+			{},
+			{DataSource: "es-ds", DataSourceType: shared.Elasticsearch},
+		},
+	}
+
+	httpmock.RegisterResponder("GET", "http://grafana:3000/api/datasources/uid/loki-ds",
+		httpmock.NewStringResponder(200, `{"id":1,"uid":"loki-ds","type":"loki"}`))
+	httpmock.RegisterResponder("GET", "http://grafana:3000/api/datasources/uid/es-ds",
+		httpmock.NewStringResponder(200, `{"id":2,"uid":"es-ds","type":"elasticsearch"}`))
+
+	// Capture each query object sent to the datasource, keyed by refId, as the queries are tested concurrently
+	var capturedMu sync.Mutex
+	capturedQueries := map[string]map[string]any{}
+	httpmock.RegisterResponder("POST", "http://grafana:3000/api/ds/query",
+		func(req *http.Request) (*http.Response, error) {
+			var body struct {
+				Queries []map[string]any `json:"queries"`
+			}
+			require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+			require.Len(t, body.Queries, 1)
+			capturedMu.Lock()
+			capturedQueries[body.Queries[0]["refId"].(string)] = body.Queries[0]
+			capturedMu.Unlock()
+			return httpmock.NewStringResponse(200, `{"results":{}}`), nil
+		})
+
+	queryTester := NewQueryTester(config, nil, 5*time.Second, nil)
+	results, err := queryTester.TestQueries(
+		map[string]string{
+			"A0": `{job="loki"} |= "error"`,
+			"A1": `type:log AND level:ERROR`,
+		},
+		convConfig,
+		config.ConversionDefaults,
+	)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	// The first query falls back to the conversion's Loki datasource
+	assert.Equal(t, "loki-ds", results[0].Datasource)
+	lokiQuery := capturedQueries["A0"]
+	require.NotNil(t, lokiQuery)
+	assert.Equal(t, `{job="loki"} |= "error"`, lokiQuery["expr"])
+	assert.Equal(t, "range", lokiQuery["queryType"])
+	assert.Equal(t, "loki-ds", lokiQuery["datasource"].(map[string]any)["uid"])
+	assert.NotContains(t, lokiQuery, "bucketAggs")
+
+	// The second query uses its own Elasticsearch datasource
+	assert.Equal(t, "es-ds", results[1].Datasource)
+	assert.Contains(t, results[1].Link, url.QueryEscape(`"type":"elasticsearch"`))
+	esQuery := capturedQueries["A1"]
+	require.NotNil(t, esQuery)
+	assert.Equal(t, `type:log AND level:ERROR`, esQuery["query"])
+	assert.Equal(t, "@timestamp", esQuery["timeField"])
+	assert.Equal(t, "es-ds", esQuery["datasource"].(map[string]any)["uid"])
+	assert.Contains(t, esQuery, "bucketAggs")
+	assert.NotContains(t, esQuery, "expr")
+}
+
+func TestTestQueriesAllowedDatasources(t *testing.T) {
+	httpmock.Activate(t)
+	defer httpmock.DeactivateAndReset()
+
+	config := model.Configuration{
+		ConversionDefaults: model.ConversionConfig{
+			Target:     "loki",
+			DataSource: "loki-ds",
+		},
+		IntegratorConfig: model.IntegrationConfig{
+			OrgID:              1,
+			From:               "now-1h",
+			To:                 "now",
+			AllowedDatasources: []string{"loki-ds"},
+		},
+		DeployerConfig: model.DeploymentConfig{
+			GrafanaInstance: "http://grafana:3000",
+		},
+	}
+
+	httpmock.RegisterResponder("GET", "http://grafana:3000/api/datasources/uid/loki-ds",
+		httpmock.NewStringResponder(200, `{"id":1,"uid":"loki-ds","type":"loki"}`))
+	httpmock.RegisterResponder("POST", "http://grafana:3000/api/ds/query",
+		httpmock.NewStringResponder(200, `{"results":{}}`))
+
+	queryTester := NewQueryTester(config, nil, 5*time.Second, nil)
+	results, err := queryTester.TestQueries(map[string]string{"A0": `{job="loki"}`}, model.ConversionConfig{Name: "allowed_conv"}, config.ConversionDefaults)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "loki-ds", results[0].Datasource)
+
+	// The disallowed data source is never queried
+	results, err = queryTester.TestQueries(map[string]string{"A0": `{job="loki"}`}, model.ConversionConfig{Name: "billing_conv", DataSource: "billing-ds"}, config.ConversionDefaults)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "data source billing-ds of conversion billing_conv is not in allowed_datasources")
+	require.Len(t, results, 1)
+	assert.Equal(t, []string{"data source billing-ds of conversion billing_conv is not in allowed_datasources"}, results[0].Stats.Errors)
+	assert.NotEmpty(t, results[0].Link)
+	info := httpmock.GetCallCountInfo()
+	assert.Equal(t, 1, info["POST http://grafana:3000/api/ds/query"])
+
+	// A data source listed by name is allowed for the conversions referring to it by UID
+	httpmock.RegisterResponder("GET", "http://grafana:3000/api/datasources/uid/loki-ds",
+		httpmock.NewStringResponder(200, `{"id":1,"uid":"loki-ds","name":"Loki Logs","type":"loki"}`))
+	config.IntegratorConfig.AllowedDatasources = []string{"Loki Logs"}
+	queryTester = NewQueryTester(config, nil, 5*time.Second, nil)
+	_, err = queryTester.TestQueries(map[string]string{"A0": `{job="loki"}`}, model.ConversionConfig{Name: "allowed_conv"}, config.ConversionDefaults)
+	require.NoError(t, err)
+	assert.Equal(t, 2, httpmock.GetCallCountInfo()["POST http://grafana:3000/api/ds/query"])
+}
+
+func TestTestQueriesRetriesTimeouts(t *testing.T) {
+	tests := []struct {
+		name         string
+		retries      int
+		failures     []error
+		deadline     time.Duration
+		wantError    bool
+		wantAttempts int
+	}{
+		{
+			name:         "timeout succeeds on retry",
+			retries:      2,
+			failures:     []error{fmt.Errorf("failed to execute request: %w", context.DeadlineExceeded)},
+			wantError:    false,
+			wantAttempts: 2,
+		},
+		{
+			name:         "query error is not retried",
+			retries:      2,
+			failures:     []error{fmt.Errorf("HTTP error 400 when querying datasource: parse error")},
+			wantError:    true,
+			wantAttempts: 1,
+		},
+		{
+			name:    "timeouts exhaust the retries",
+			retries: 1,
+			failures: []error{
+				context.DeadlineExceeded,
+				context.DeadlineExceeded,
+				context.DeadlineExceeded,
+			},
+			wantError:    true,
+			wantAttempts: 2,
+		},
+		{
+			name:         "retry not attempted past the deadline",
+			retries:      2,
+			failures:     []error{context.DeadlineExceeded},
+			deadline:     time.Millisecond,
+			wantError:    true,
+			wantAttempts: 1,
+		},
+		{
+			name:         "retries disabled by default",
+			failures:     []error{context.DeadlineExceeded},
+			wantError:    true,
+			wantAttempts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := model.Configuration{
+				ConversionDefaults: model.ConversionConfig{
+					Target:     "loki",
+					DataSource: "test-datasource",
+				},
+				IntegratorConfig: model.IntegrationConfig{
+					OrgID:                 1,
+					From:                  "now-1h",
+					To:                    "now",
+					QueryTestRetries:      tt.retries,
+					QueryTestRetryBackoff: "1ms",
+				},
+				DeployerConfig: model.DeploymentConfig{
+					GrafanaInstance: "https://test.grafana.com",
+				},
+			}
+
+			mock := &testDatasourceQueryWithFailures{
+				testDatasourceQuery: newTestDatasourceQuery(),
+				failures:            tt.failures,
+			}
+			originalDatasourceQuery := integrate.DefaultDatasourceQuery
+			integrate.DefaultDatasourceQuery = mock
+			defer func() {
+				integrate.DefaultDatasourceQuery = originalDatasourceQuery
+			}()
+
+			queryTester := NewQueryTester(config, nil, time.Second, nil)
+			if tt.deadline > 0 {
+				queryTester.deadline = time.Now().Add(tt.deadline)
+			}
+			results, err := queryTester.TestQueries(
+				map[string]string{"A0": `{job="test"}`},
+				model.ConversionConfig{Name: "test_conv"},
+				config.ConversionDefaults,
+			)
+
+			if tt.wantError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				require.Len(t, results, 1)
+				assert.Equal(t, 2, results[0].Stats.Count)
+			}
+			assert.Equal(t, tt.wantAttempts, mock.attempts)
+		})
+	}
+}
+
+func TestRunRequireTestMatches(t *testing.T) {
+	tests := []struct {
+		name             string
+		queries          []string
+		wantNoMatchFiles []string
+	}{
+		{
+			name:             "zero matches are skipped",
+			queries:          []string{`{job="empty"}`},
+			wantNoMatchFiles: []string{"conv_rule.json"},
+		},
+		{
+			name:    "matches are deployed",
+			queries: []string{`{job="test"}`},
+		},
+		{
+			name:    "any query with matches is deployed",
+			queries: []string{`{job="empty"}`, `{job="test"}`},
+		},
+		{
+			name:    "query errors are not treated as zero matches",
+			queries: []string{`{job="error"}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			convPath := filepath.Join("testdata", "test_do_query_testing", tt.name)
+			require.NoError(t, os.MkdirAll(convPath, 0o755))
+			defer os.RemoveAll(convPath)
+			convBytes, err := json.Marshal(model.ConversionOutput{
+				ConversionName: "conv",
+				Queries:        tt.queries,
+				Rules:          []model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}},
+			})
+			require.NoError(t, err)
+			convFile := filepath.Join(convPath, "conv_rule.json")
+			require.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+
+			config := model.Configuration{
+				ConversionDefaults: model.ConversionConfig{
+					Target:     "loki",
+					DataSource: "test-datasource",
+				},
+				Conversions: []model.ConversionConfig{{Name: "conv"}},
+				IntegratorConfig: model.IntegrationConfig{
+					OrgID:                        1,
+					From:                         "now-1h",
+					To:                           "now",
+					ContinueOnQueryTestingErrors: true,
+					RequireTestMatches:           true,
+				},
+				DeployerConfig: model.DeploymentConfig{
+					GrafanaInstance: "https://test.grafana.com",
+				},
+			}
+
+			outputFile, err := os.CreateTemp("", "github-output")
+			require.NoError(t, err)
+			defer os.Remove(outputFile.Name())
+			os.Setenv("GITHUB_OUTPUT", outputFile.Name())
+			defer os.Unsetenv("GITHUB_OUTPUT")
+
+			mock := &testDatasourceQueryNoMatches{
+				testDatasourceQueryWithErrors: newTestDatasourceQueryWithErrors(),
+				emptyQueries:                  map[string]bool{`{job="empty"}`: true},
+			}
+			mock.AddMockError(`{job="error"}`, fmt.Errorf("query failed"))
+			originalDatasourceQuery := integrate.DefaultDatasourceQuery
+			integrate.DefaultDatasourceQuery = mock
+			defer func() {
+				integrate.DefaultDatasourceQuery = originalDatasourceQuery
+			}()
+
+			queryTester := NewQueryTester(config, []string{convFile}, time.Second, nil)
+			require.NoError(t, queryTester.Run())
+
+			wantFiles := make([]string, 0, len(tt.wantNoMatchFiles))
+			for _, file := range tt.wantNoMatchFiles {
+				wantFiles = append(wantFiles, filepath.Join(convPath, file))
+			}
+			assert.ElementsMatch(t, wantFiles, queryTester.NoMatchFiles())
+
+			outputBytes, err := io.ReadAll(outputFile)
+			require.NoError(t, err)
+			assert.Contains(t, string(outputBytes), fmt.Sprintf("no_match_rules=%s\n", strings.Join(wantFiles, " ")))
+		})
+	}
+}
+
+func TestRunQueryWarnings(t *testing.T) {
+	tests := []struct {
+		name                string
+		failOnQueryWarnings bool
+		continueOnErrors    bool
+		wantError           bool
+	}{
+		{name: "warnings are captured", failOnQueryWarnings: false},
+		{name: "warnings fail testing", failOnQueryWarnings: true, wantError: true},
+		{name: "warnings fail testing but continue on errors", failOnQueryWarnings: true, continueOnErrors: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			t.Setenv("GITHUB_OUTPUT", "github-output")
+			convBytes, err := json.Marshal(model.ConversionOutput{
+				ConversionName: "test_conv",
+				Queries:        []string{`{job="test"}`},
+				Rules:          []model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}},
+			})
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile("test_conv.json", convBytes, 0o600))
+
+			originalDatasourceQuery := integrate.DefaultDatasourceQuery
+			integrate.DefaultDatasourceQuery = &testDatasourceQueryWarnings{testDatasourceQuery: newTestDatasourceQuery()}
+			defer func() {
+				integrate.DefaultDatasourceQuery = originalDatasourceQuery
+			}()
+
+			config := model.Configuration{
+				ConversionDefaults: model.ConversionConfig{
+					Target:     "loki",
+					DataSource: "test-datasource",
+				},
+				Conversions: []model.ConversionConfig{{Name: "test_conv"}},
+				IntegratorConfig: model.IntegrationConfig{
+					FailOnQueryWarnings:          tt.failOnQueryWarnings,
+					ContinueOnQueryTestingErrors: tt.continueOnErrors,
+				},
+			}
+			warnings := &shared.Warnings{}
+			queryTester := NewQueryTester(config, []string{"test_conv.json"}, 5*time.Second, warnings)
+
+			results, err := queryTester.TestQueries(map[string]string{"A0": `{job="test"}`}, config.Conversions[0], config.ConversionDefaults)
+			require.NoError(t, err)
+			require.Len(t, results, 1)
+			assert.Equal(t, 1, results[0].Stats.Count)
+			assert.Equal(t, []string{"Partial data response: 1 of 3 shards failed"}, results[0].Stats.Warnings)
+			assert.Empty(t, results[0].Stats.Errors)
+
+			err = queryTester.Run()
+			// The warnings are recorded, for strict mode to fail on them
+			assert.Equal(t, []string{"Partial data response: 1 of 3 shards failed"}, warnings.List())
+			if tt.wantError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			outputBytes, err := os.ReadFile("github-output")
+			require.NoError(t, err)
+			assert.Contains(t, string(outputBytes), `"warnings":["Partial data response: 1 of 3 shards failed"]`)
+		})
+	}
+}
+
+func TestNewQueryTesterWarnings(t *testing.T) {
+	warnings := &shared.Warnings{}
+	NewQueryTester(model.Configuration{
+		IntegratorConfig: model.IntegrationConfig{
+			QueryTestConcurrency: -1,
+			TestSampleWindow:     "soon",
+		},
+	}, nil, time.Second, warnings)
+
+	// Invalid query testing settings are recorded, for strict mode to fail on them
+	assert.Equal(t, []string{
+		"Invalid query test concurrency -1 in config, using default",
+		"Invalid test sample window soon in config, testing the full time range",
+	}, warnings.List())
+	assert.Error(t, warnings.Err())
+}
+
+func TestProcessFrame(t *testing.T) {
+	lokiFrame := `{"schema":{"fields":[{"name":"labels","type":"other"},{"name":"Time","type":"time"},{"name":"Line","type":"string"}]},` +
+		`"data":{"values":[[{"job":"app"},{"job":"app","level":"error"}],[1,2],["first line","second line"]]}}`
+	customFrame := `{"schema":{"fields":[{"name":"attributes","type":"other"},{"name":"host","type":"string"},{"name":"Time","type":"time"},{"name":"body","type":"string"}]},` +
+		`"data":{"values":[[{"service":"api"},{"service":"api"}],["web-1","web-2"],[1,2],["first line",null]]}}`
+	metricFrame := `{"schema":{"fields":[{"name":"Time","type":"time"},{"name":"Value","type":"number"}]},"data":{"values":[[1,2],[3,4]]}}`
+
+	tests := []struct {
+		name       string
+		frame      string
+		fields     FrameFields
+		wantCount  int
+		wantFields map[string]string
+	}{
+		{
+			name:       "loki log lines",
+			frame:      lokiFrame,
+			fields:     DefaultFrameFields,
+			wantCount:  2,
+			wantFields: map[string]string{"job": "app", "level": "error", "Line": "first line"},
+		},
+		{
+			name:       "non-standard fields with the default fields",
+			frame:      customFrame,
+			fields:     DefaultFrameFields,
+			wantCount:  0,
+			wantFields: map[string]string{},
+		},
+		{
+			name:       "non-standard fields with configured fields",
+			frame:      customFrame,
+			fields:     FrameFields{Value: []string{"message", "body"}, Label: []string{"attributes", "host"}},
+			wantCount:  1,
+			wantFields: map[string]string{"service": "api", "host": "web-1", "body": "first line"},
+		},
+		{
+			name:       "time series",
+			frame:      metricFrame,
+			fields:     DefaultFrameFields,
+			wantCount:  0,
+			wantFields: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var frame model.Frame
+			require.NoError(t, json.Unmarshal([]byte(tt.frame), &frame))
+			result := model.QueryTestResult{Stats: model.Stats{Fields: map[string]string{}}}
+			require.NoError(t, ProcessFrame(frame, &result, tt.fields, true, true, nil))
+			assert.Equal(t, tt.wantCount, result.Stats.Count)
+			assert.Equal(t, tt.wantFields, result.Stats.Fields)
+			assert.Empty(t, result.Stats.Warnings)
+		})
+	}
+}
+
 // testDatasourceQuery is a mock implementation for testing
 type testDatasourceQuery struct {
+	// guards the logs, as the queries of a conversion are tested concurrently
+	mu            sync.Mutex
 	queryLog      []string
 	datasourceLog []string
+	// types of the data sources by UID, loki if unset
+	datasourceTypes map[string]string
 }
 
 func newTestDatasourceQuery() *testDatasourceQuery {
@@ -258,17 +1257,25 @@ func newTestDatasourceQuery() *testDatasourceQuery {
 }
 
 func (t *testDatasourceQuery) GetDatasource(dsName, _ string, _ string, _ time.Duration) (*integrate.GrafanaDatasource, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	t.datasourceLog = append(t.datasourceLog, dsName)
+	datasourceType, ok := t.datasourceTypes[dsName]
+	if !ok {
+		datasourceType = "loki"
+	}
 	return &integrate.GrafanaDatasource{
 		UID:  dsName,
-		Type: "loki",
+		Type: datasourceType,
 		ID:   1,
 	}, nil
 }
 
 func (t *testDatasourceQuery) ExecuteQuery(query, dsName, _ string, _ string, _ string, _ string, _ string, _ string, _ time.Duration) ([]byte, error) {
+	t.mu.Lock()
 	t.queryLog = append(t.queryLog, query)
 	t.datasourceLog = append(t.datasourceLog, dsName)
+	t.mu.Unlock()
 
 	// Return a mock response with sample data
 	mockResponse := `{
@@ -328,3 +1335,277 @@ func (t *testDatasourceQueryWithErrors) ExecuteQuery(query, dsName, baseURL, api
 	// Otherwise use the parent implementation
 	return t.testDatasourceQuery.ExecuteQuery(query, dsName, baseURL, apiKey, refID, from, to, customModel, timeout)
 }
+
+// testDatasourceQueryRange records the time range of the last query
+type testDatasourceQueryRange struct {
+	*testDatasourceQuery
+	from string
+	to   string
+}
+
+func (t *testDatasourceQueryRange) ExecuteQuery(query, dsName, baseURL, apiKey, refID, from, to, customModel string, timeout time.Duration) ([]byte, error) {
+	t.mu.Lock()
+	t.from = from
+	t.to = to
+	t.mu.Unlock()
+	return t.testDatasourceQuery.ExecuteQuery(query, dsName, baseURL, apiKey, refID, from, to, customModel, timeout)
+}
+
+// testDatasourceQueryTimeouts records the timeout each data source was queried with
+type testDatasourceQueryTimeouts struct {
+	*testDatasourceQuery
+	timeouts map[string]time.Duration
+}
+
+func (t *testDatasourceQueryTimeouts) ExecuteQuery(query, dsName, baseURL, apiKey, refID, from, to, customModel string, timeout time.Duration) ([]byte, error) {
+	t.mu.Lock()
+	t.timeouts[dsName] = timeout
+	t.mu.Unlock()
+	return t.testDatasourceQuery.ExecuteQuery(query, dsName, baseURL, apiKey, refID, from, to, customModel, timeout)
+}
+
+// testDatasourceQueryWithFailures returns each of its failures in turn before succeeding
+type testDatasourceQueryWithFailures struct {
+	*testDatasourceQuery
+	failures []error
+	attempts int
+}
+
+func (t *testDatasourceQueryWithFailures) ExecuteQuery(query, dsName, baseURL, apiKey, refID, from, to, customModel string, timeout time.Duration) ([]byte, error) {
+	t.mu.Lock()
+	t.attempts++
+	attempt := t.attempts
+	t.mu.Unlock()
+	if attempt <= len(t.failures) {
+		return nil, t.failures[attempt-1]
+	}
+	return t.testDatasourceQuery.ExecuteQuery(query, dsName, baseURL, apiKey, refID, from, to, customModel, timeout)
+}
+
+// testDatasourceQueryNoMatches returns an empty result for its empty queries
+type testDatasourceQueryNoMatches struct {
+	*testDatasourceQueryWithErrors
+	emptyQueries map[string]bool
+}
+
+func (t *testDatasourceQueryNoMatches) ExecuteQuery(query, dsName, baseURL, apiKey, refID, from, to, customModel string, timeout time.Duration) ([]byte, error) {
+	if t.emptyQueries[query] {
+		return []byte(`{"results":{"A":{"frames":[]}},"errors":[]}`), nil
+	}
+	return t.testDatasourceQueryWithErrors.ExecuteQuery(query, dsName, baseURL, apiKey, refID, from, to, customModel, timeout)
+}
+
+// testDatasourceQueryWarnings returns a partial result, flagged by notices in the frame metadata
+type testDatasourceQueryWarnings struct {
+	*testDatasourceQuery
+}
+
+func (t *testDatasourceQueryWarnings) ExecuteQuery(_, _, _, _, _, _, _, _ string, _ time.Duration) ([]byte, error) {
+	return []byte(`{
+		"results": {
+			"A": {
+				"frames": [
+					{
+						"schema": {
+							"meta": {
+								"notices": [
+									{"severity": "warning", "text": "Partial data response: 1 of 3 shards failed"},
+									{"severity": "info", "text": "Data source is slow"}
+								]
+							},
+							"fields": [
+								{"name": "Time", "type": "time"},
+								{"name": "Line", "type": "string"}
+							]
+						},
+						"data": {"values": [[1000000000], ["error log line"]]}
+					},
+					{
+						"schema": {
+							"meta": {
+								"notices": [{"severity": "warning", "text": "Partial data response: 1 of 3 shards failed"}]
+							}
+						},
+						"data": {"values": []}
+					}
+				]
+			}
+		},
+		"errors": []
+	}`), nil
+}
+
+// testDatasourceQueryResultError returns a successful response whose result failed
+type testDatasourceQueryResultError struct {
+	*testDatasourceQuery
+}
+
+func (t *testDatasourceQueryResultError) ExecuteQuery(_, _, _, _, _, _, _, _ string, _ time.Duration) ([]byte, error) {
+	return []byte(`{
+		"results": {
+			"A": {
+				"status": 500,
+				"error": "parse error at line 1, col 8: syntax error: unexpected IDENTIFIER",
+				"frames": []
+			}
+		}
+	}`), nil
+}
+
+func TestRunResultErrors(t *testing.T) {
+	const wantError = "result A failed with status 500: parse error at line 1, col 8: syntax error: unexpected IDENTIFIER"
+	tests := []struct {
+		name             string
+		resultErrors     string
+		continueOnErrors bool
+		wantError        bool
+	}{
+		{name: "failed results fail testing", wantError: true},
+		{name: "failed results fail testing but continue on errors", resultErrors: integrate.ResultErrorsFail, continueOnErrors: true},
+		{name: "failed results are reported", resultErrors: integrate.ResultErrorsReport},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			t.Setenv("GITHUB_OUTPUT", "github-output")
+			convBytes, err := json.Marshal(model.ConversionOutput{
+				ConversionName: "test_conv",
+				Queries:        []string{`{job="test"}`},
+				Rules:          []model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}},
+			})
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile("test_conv.json", convBytes, 0o600))
+
+			originalDatasourceQuery := integrate.DefaultDatasourceQuery
+			integrate.DefaultDatasourceQuery = &testDatasourceQueryResultError{testDatasourceQuery: newTestDatasourceQuery()}
+			defer func() {
+				integrate.DefaultDatasourceQuery = originalDatasourceQuery
+			}()
+
+			config := model.Configuration{
+				ConversionDefaults: model.ConversionConfig{
+					Target:     "loki",
+					DataSource: "test-datasource",
+				},
+				Conversions: []model.ConversionConfig{{Name: "test_conv"}},
+				IntegratorConfig: model.IntegrationConfig{
+					ResultErrors:                 tt.resultErrors,
+					ContinueOnQueryTestingErrors: tt.continueOnErrors,
+				},
+			}
+			queryTester := NewQueryTester(config, []string{"test_conv.json"}, 5*time.Second, nil)
+
+			results, err := queryTester.TestQueries(map[string]string{"A0": `{job="test"}`}, config.Conversions[0], config.ConversionDefaults)
+			if tt.resultErrors == integrate.ResultErrorsReport {
+				require.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, wantError)
+			}
+			require.Len(t, results, 1)
+			assert.Equal(t, []string{wantError}, results[0].Stats.Errors)
+
+			err = queryTester.Run()
+			if tt.wantError {
+				assert.ErrorContains(t, err, wantError)
+				return
+			}
+			assert.NoError(t, err)
+			outputBytes, err := os.ReadFile("github-output")
+			require.NoError(t, err)
+			assert.Contains(t, string(outputBytes), wantError)
+		})
+	}
+}
+
+func TestRunAnnotateBaseline(t *testing.T) {
+	t.Chdir(t.TempDir())
+	require.NoError(t, os.MkdirAll("conversions", 0o755))
+	convBytes, err := json.Marshal(model.ConversionOutput{
+		ConversionName: "conv",
+		Queries:        []string{`{job="test"}`},
+		Rules:          []model.SigmaRule{{ID: "996f8884-9144-40e7-ac63-29090ccde9a0", Title: "Test Rule"}},
+	})
+	require.NoError(t, err)
+	convFile := filepath.Join("conversions", "conv_rule.json")
+	require.NoError(t, os.WriteFile(convFile, convBytes, 0o600))
+	require.NoError(t, os.WriteFile("config.yml", []byte(`folders:
+  conversion_path: conversions
+  deployment_path: deployments
+conversion_defaults:
+  target: loki
+  data_source: test-datasource
+conversions:
+  - name: conv
+    rule_group: Test Rules
+    time_window: 5m
+integration:
+  folder_id: test-folder
+  org_id: 1
+  test_queries: true
+  annotate_baseline: true
+deployment:
+  grafana_instance: https://test.grafana.com
+`), 0o600))
+	t.Setenv("INTEGRATOR_CONFIG_PATH", "config.yml")
+	t.Setenv("CHANGED_FILES", convFile)
+	t.Setenv("TEST_FILES", convFile)
+	t.Setenv("GITHUB_OUTPUT", "github-output")
+
+	mock := newTestDatasourceQuery()
+	originalDatasourceQuery := integrate.DefaultDatasourceQuery
+	integrate.DefaultDatasourceQuery = mock
+	defer func() {
+		integrate.DefaultDatasourceQuery = originalDatasourceQuery
+	}()
+
+	integrator := integrate.NewIntegrator()
+	require.NoError(t, integrator.LoadConfig())
+	queryTester := NewQueryTester(integrator.Config(), integrator.TestFiles(), time.Second, integrator.Warnings())
+	require.NoError(t, queryTester.Run())
+	integrator.SetTestResults(queryTester.Results())
+	require.NoError(t, integrator.Run())
+
+	files, err := filepath.Glob(filepath.Join("deployments", "*.json"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	content, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	var rule model.ProvisionedAlertRule
+	require.NoError(t, json.Unmarshal(content, &rule))
+
+	// The mock returns two log lines labelled with job and level
+	assert.Equal(t, "2 matches from now-1h to now", rule.Annotations[integrate.BaselineMatchesAnnotation])
+	assert.Equal(t, "job,level", rule.Annotations[integrate.DetectedFieldsAnnotation])
+}
+
+// testDatasourceQueryBlocking reports each query it starts testing, then blocks it until released
+type testDatasourceQueryBlocking struct {
+	*testDatasourceQueryWithErrors
+	started chan string
+	release chan struct{}
+}
+
+func (t *testDatasourceQueryBlocking) ExecuteQuery(query, dsName, baseURL, apiKey, refID, from, to, customModel string, timeout time.Duration) ([]byte, error) {
+	select {
+	case t.started <- query:
+	default:
+	}
+	<-t.release
+	return t.testDatasourceQueryWithErrors.ExecuteQuery(query, dsName, baseURL, apiKey, refID, from, to, customModel, timeout)
+}
+
+// testDatasourceQueryNotReady fails the first data source lookups, like a data source which is still starting
+type testDatasourceQueryNotReady struct {
+	*testDatasourceQuery
+	failedLookups int
+	lookups       int
+}
+
+func (t *testDatasourceQueryNotReady) GetDatasource(dsName, baseURL, apiKey string, timeout time.Duration) (*integrate.GrafanaDatasource, error) {
+	t.lookups++
+	if t.lookups <= t.failedLookups {
+		return nil, fmt.Errorf("data source %s not found", dsName)
+	}
+	return t.testDatasourceQuery.GetDatasource(dsName, baseURL, apiKey, timeout)
+}
@@ -0,0 +1,128 @@
+//nolint:revive
+package shared
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// DefaultAlertFileNameTemplate is the name of the alert rule files written by the integrator,
+// unless integration.alert_file_name_template is set
+const DefaultAlertFileNameTemplate = "alert_rule_{{.ConversionName}}_{{.RuleFilename}}_{{.UID}}.json"
+
+// ManagedByAnnotation is the annotation the integrator marks the alert rules it writes with, set to ManagedByValue,
+// so that the deployer can tell them apart from alert rules imported or created by hand in the same folder
+const (
+	ManagedByAnnotation = "managed_by"
+	ManagedByValue      = "srd"
+)
+
+// AlertFileNameFields are the fields available to the alert rule file name template
+type AlertFileNameFields struct {
+	// ConversionName is the name of the conversion the alert rule was generated from
+	ConversionName string
+	// RuleFilename is the name of the conversion file, without the conversion name prefix and extension
+	RuleFilename string
+	// UID is the alert rule UID
+	UID string
+}
+
+// Placeholders rendered into the template to locate the fields when building the UID regex
+const (
+	conversionNamePlaceholder = "\x00conversion\x00"
+	ruleFilenamePlaceholder   = "\x00rule\x00"
+	uidPlaceholder            = "\x00uid\x00"
+)
+
+func parseAlertFileNameTemplate(tmpl string) (*template.Template, error) {
+	tmpl = GetConfigValue(tmpl, DefaultAlertFileNameTemplate, "")
+	parsed, err := template.New("alert_file_name").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing alert file name template %s: %v", tmpl, err)
+	}
+	return parsed, nil
+}
+
+func renderAlertFileName(tmpl *template.Template, fields AlertFileNameFields) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, fields); err != nil {
+		return "", fmt.Errorf("error executing alert file name template: %v", err)
+	}
+	return buf.String(), nil
+}
+
+// ValidateAlertFileNameTemplate checks that the alert rule file name template can be rendered and that
+// the alert rule UID can be recovered from the file names it produces. An empty template uses the default.
+func ValidateAlertFileNameTemplate(tmpl string) error {
+	parsed, err := parseAlertFileNameTemplate(tmpl)
+	if err != nil {
+		return err
+	}
+	name, err := renderAlertFileName(parsed, AlertFileNameFields{
+		ConversionName: conversionNamePlaceholder,
+		RuleFilename:   ruleFilenamePlaceholder,
+		UID:            uidPlaceholder,
+	})
+	if err != nil {
+		return err
+	}
+	if strings.Count(name, uidPlaceholder) != 1 {
+		return fmt.Errorf("alert file name template %s must contain {{.UID}} exactly once", tmpl)
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("alert file name template %s must not contain a path separator", tmpl)
+	}
+	if !strings.HasSuffix(name, ".json") {
+		return fmt.Errorf("alert file name template %s must end with .json", tmpl)
+	}
+	return nil
+}
+
+// AlertFileName returns the name of the file of an alert rule, following the alert rule file name template
+func AlertFileName(tmpl, conversionName, ruleFilename, uid string) (string, error) {
+	parsed, err := parseAlertFileNameTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	return renderAlertFileName(parsed, AlertFileNameFields{ConversionName: conversionName, RuleFilename: ruleFilename, UID: uid})
+}
+
+// AlertFileGlob returns a glob pattern matching the files of the alert rules generated from a conversion
+// file, whatever their UID. An empty ruleFilename matches the files of every conversion file of the conversion.
+func AlertFileGlob(tmpl, conversionName, ruleFilename string) (string, error) {
+	return AlertFileName(tmpl, conversionName, GetConfigValue(ruleFilename, "*", ""), "*")
+}
+
+// AlertUIDFromFileName recovers the alert rule UID from the name of a file following the alert rule file
+// name template. It returns an empty string if the file name doesn't follow the template.
+func AlertUIDFromFileName(tmpl, filename string) string {
+	parsed, err := parseAlertFileNameTemplate(tmpl)
+	if err != nil {
+		return ""
+	}
+	name, err := renderAlertFileName(parsed, AlertFileNameFields{
+		ConversionName: conversionNamePlaceholder,
+		RuleFilename:   ruleFilenamePlaceholder,
+		UID:            uidPlaceholder,
+	})
+	if err != nil {
+		return ""
+	}
+	pattern := regexp.QuoteMeta(name)
+	pattern = strings.ReplaceAll(pattern, conversionNamePlaceholder, ".*")
+	pattern = strings.ReplaceAll(pattern, ruleFilenamePlaceholder, ".*")
+	pattern = strings.Replace(pattern, uidPlaceholder, `([^./\\]+?)`, 1)
+	regex, err := regexp.Compile("^" + pattern + "$")
+	if err != nil {
+		return ""
+	}
+	matches := regex.FindStringSubmatch(filepath.Base(filename))
+	if len(matches) != 2 {
+		return ""
+	}
+	return matches[1]
+}
@@ -0,0 +1,86 @@
+package shared
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAlertFileNameTemplate(t *testing.T) {
+	tests := []struct {
+		name      string
+		template  string
+		wantError bool
+	}{
+		{name: "default template", template: ""},
+		{name: "custom template", template: "{{.UID}}--{{.ConversionName}}.json"},
+		{name: "missing UID", template: "{{.ConversionName}}_{{.RuleFilename}}.json", wantError: true},
+		{name: "repeated UID", template: "{{.UID}}_{{.UID}}.json", wantError: true},
+		{name: "path separator", template: "{{.ConversionName}}/{{.UID}}.json", wantError: true},
+		{name: "not a JSON file", template: "{{.UID}}.yml", wantError: true},
+		{name: "unknown field", template: "{{.Title}}_{{.UID}}.json", wantError: true},
+		{name: "invalid template", template: "{{.UID}.json", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateAlertFileNameTemplate(tt.template)
+			if tt.wantError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAlertFileNameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantName string
+		wantGlob string
+	}{
+		{
+			name:     "default template",
+			template: "",
+			wantName: "alert_rule_aws_cloudtrail_root_login_1a2b3c4d.json",
+			wantGlob: "alert_rule_aws_cloudtrail_root_login_*.json",
+		},
+		{
+			name:     "UID first",
+			template: "{{.UID}}__{{.ConversionName}}__{{.RuleFilename}}.json",
+			wantName: "1a2b3c4d__aws_cloudtrail__root_login.json",
+			wantGlob: "*__aws_cloudtrail__root_login.json",
+		},
+		{
+			name:     "UID only",
+			template: "{{.UID}}.json",
+			wantName: "1a2b3c4d.json",
+			wantGlob: "*.json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.NoError(t, ValidateAlertFileNameTemplate(tt.template))
+			name, err := AlertFileName(tt.template, "aws_cloudtrail", "root_login", "1a2b3c4d")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantName, name)
+			assert.Equal(t, "1a2b3c4d", AlertUIDFromFileName(tt.template, name))
+			assert.Equal(t, "1a2b3c4d", AlertUIDFromFileName(tt.template, filepath.Join("deployments", name)))
+
+			glob, err := AlertFileGlob(tt.template, "aws_cloudtrail", "root_login")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantGlob, glob)
+			matched, err := filepath.Match(glob, name)
+			assert.NoError(t, err)
+			assert.True(t, matched)
+		})
+	}
+
+	// Files not following the template have no UID
+	assert.Equal(t, "", AlertUIDFromFileName("", "README.md"))
+	assert.Equal(t, "", AlertUIDFromFileName("{{.UID}}__{{.ConversionName}}.json", "alert_rule_conv_rule_1a2b3c4d.json"))
+}
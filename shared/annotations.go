@@ -0,0 +1,109 @@
+//nolint:revive
+package shared
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+)
+
+// AnnotationsFileEnv is the environment variable holding the file the annotations are written to, as a JSON array
+const AnnotationsFileEnv = "GITHUB_ANNOTATIONS"
+
+// FileError is a validation error caused by the content of a file, such as a configuration or conversion file
+// missing a required field, which is reported as an annotation of the file
+type FileError struct {
+	File string
+	// line of the file, zero if unknown
+	Line int
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// NewFileError returns a FileError for an error caused by a file, along with the line of YAML syntax errors
+func NewFileError(file string, err error) error {
+	if err == nil {
+		return nil
+	}
+	fileErr := &FileError{File: file, Err: err}
+	if match := regexYAMLErrorLine.FindStringSubmatch(err.Error()); match != nil {
+		fileErr.Line, _ = strconv.Atoi(match[1])
+	}
+	return fileErr
+}
+
+// regexYAMLErrorLine matches the line in the errors of the YAML decoder, e.g. "yaml: line 3: did not find expected key"
+var regexYAMLErrorLine = regexp.MustCompile(`yaml: line (\d+):`)
+
+// ErrorAnnotation returns the annotation of an error caused by a file, ok is false for other errors
+func ErrorAnnotation(err error) (annotation model.Annotation, ok bool) {
+	var fileErr *FileError
+	if !errors.As(err, &fileErr) {
+		return model.Annotation{}, false
+	}
+	return model.Annotation{
+		File:    filepath.ToSlash(fileErr.File),
+		Line:    fileErr.Line,
+		Level:   model.AnnotationError,
+		Message: err.Error(),
+	}, true
+}
+
+// workflowMessageEscaper and workflowPropertyEscaper escape the message and properties of GitHub workflow commands
+var (
+	workflowMessageEscaper  = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	workflowPropertyEscaper = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C")
+)
+
+// AnnotationCommand returns the GitHub workflow command creating an annotation,
+// e.g. ::error file=config.yml,line=3::invalid config
+func AnnotationCommand(annotation model.Annotation) string {
+	properties := "file=" + workflowPropertyEscaper.Replace(annotation.File)
+	if annotation.Line > 0 {
+		properties += ",line=" + strconv.Itoa(annotation.Line)
+	}
+	return fmt.Sprintf("::%s %s::%s", annotation.Level, properties, workflowMessageEscaper.Replace(annotation.Message))
+}
+
+// WriteAnnotations reports annotations as GitHub workflow commands when running in GitHub Actions, and writes
+// them as a JSON array to the file set in GITHUB_ANNOTATIONS, if any, for other CI systems to render them
+func WriteAnnotations(w io.Writer, annotations []model.Annotation) error {
+	if os.Getenv("GITHUB_ACTIONS") == "true" {
+		for _, annotation := range annotations {
+			if _, err := fmt.Fprintln(w, AnnotationCommand(annotation)); err != nil {
+				return err
+			}
+		}
+	}
+
+	annotationsFile := os.Getenv(AnnotationsFileEnv)
+	if annotationsFile == "" {
+		return nil
+	}
+	if annotations == nil {
+		annotations = []model.Annotation{}
+	}
+	content, err := json.MarshalIndent(annotations, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling annotations: %v", err)
+	}
+	if err := os.WriteFile(filepath.Clean(annotationsFile), content, 0o600); err != nil {
+		return fmt.Errorf("error writing annotations file %s: %v", annotationsFile, err)
+	}
+	return nil
+}
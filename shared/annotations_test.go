@@ -0,0 +1,95 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorAnnotation(t *testing.T) {
+	err := fmt.Errorf("error loading config: %w", NewFileError("config/config.yml", errors.New("folders.conversion_path is required")))
+	annotation, ok := ErrorAnnotation(err)
+	require.True(t, ok)
+	assert.Equal(t, model.Annotation{
+		File:    "config/config.yml",
+		Level:   model.AnnotationError,
+		Message: "error loading config: folders.conversion_path is required",
+	}, annotation)
+
+	// The line of YAML syntax errors is kept
+	annotation, ok = ErrorAnnotation(NewFileError("config.yml", errors.New("error unmarshalling config file: yaml: line 3: did not find expected key")))
+	require.True(t, ok)
+	assert.Equal(t, 3, annotation.Line)
+
+	_, ok = ErrorAnnotation(errors.New("connection refused"))
+	assert.False(t, ok)
+	assert.NoError(t, NewFileError("config.yml", nil))
+}
+
+func TestAnnotationCommand(t *testing.T) {
+	assert.Equal(t, "::error file=config.yml::folders.conversion_path is required", AnnotationCommand(model.Annotation{
+		File:    "config.yml",
+		Level:   model.AnnotationError,
+		Message: "folders.conversion_path is required",
+	}))
+	assert.Equal(t, "::warning file=conv/a%2Cb.json,line=3::100%25 of%0Athe rules", AnnotationCommand(model.Annotation{
+		File:    "conv/a,b.json",
+		Line:    3,
+		Level:   model.AnnotationWarning,
+		Message: "100% of\nthe rules",
+	}))
+}
+
+func TestWriteAnnotations(t *testing.T) {
+	annotations := []model.Annotation{
+		{File: "conv/conv_rule.json", Level: model.AnnotationError, Message: "conversion file conv/conv_rule.json has no conversion_name"},
+	}
+
+	t.Run("disabled outside GitHub Actions", func(t *testing.T) {
+		t.Setenv("GITHUB_ACTIONS", "")
+		t.Setenv(AnnotationsFileEnv, "")
+		var buf bytes.Buffer
+		require.NoError(t, WriteAnnotations(&buf, annotations))
+		assert.Empty(t, buf.String())
+	})
+
+	t.Run("workflow commands in GitHub Actions", func(t *testing.T) {
+		t.Setenv("GITHUB_ACTIONS", "true")
+		t.Setenv(AnnotationsFileEnv, "")
+		var buf bytes.Buffer
+		require.NoError(t, WriteAnnotations(&buf, annotations))
+		assert.Equal(t, "::error file=conv/conv_rule.json::conversion file conv/conv_rule.json has no conversion_name\n", buf.String())
+	})
+
+	t.Run("annotations file", func(t *testing.T) {
+		t.Chdir(t.TempDir())
+		t.Setenv("GITHUB_ACTIONS", "")
+		t.Setenv(AnnotationsFileEnv, "annotations.json")
+		var buf bytes.Buffer
+		require.NoError(t, WriteAnnotations(&buf, annotations))
+		assert.Empty(t, buf.String())
+
+		content, err := os.ReadFile("annotations.json")
+		require.NoError(t, err)
+		var written []map[string]any
+		require.NoError(t, json.Unmarshal(content, &written))
+		assert.Equal(t, []map[string]any{{
+			"file":    "conv/conv_rule.json",
+			"level":   "error",
+			"message": "conversion file conv/conv_rule.json has no conversion_name",
+		}}, written)
+
+		// An empty array is written when there's nothing to report
+		require.NoError(t, WriteAnnotations(&buf, nil))
+		content, err = os.ReadFile("annotations.json")
+		require.NoError(t, err)
+		assert.JSONEq(t, "[]", string(content))
+	})
+}
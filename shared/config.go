@@ -3,14 +3,44 @@ package shared
 
 import (
 	"fmt"
+	"net/url"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 
 	"github.com/grafana/sigma-rule-deployment/internal/model"
 	"gopkg.in/yaml.v3"
 )
 
+// IncludeTag is the custom YAML tag used to pull another local YAML fragment into the
+// configuration, e.g. `conversions: !include conversions/aws.yml`.
+const IncludeTag = "!include"
+
+// Environment variables overriding the Grafana instance, folder and organization set in the
+// configuration, so one configuration can be reused across Grafana instances
+const (
+	GrafanaInstanceEnv = "GRAFANA_INSTANCE"
+	FolderIDEnv        = "FOLDER_ID"
+	OrgIDEnv           = "ORG_ID"
+)
+
+// regexGrafanaID matches a valid Grafana folder UID
+var regexGrafanaID = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// regexGrafanaTime matches a time of a Grafana time range: a relative time such as now, now-1h or now-1d/d,
+// adding, subtracting and rounding to units from seconds to years, or a Unix timestamp in milliseconds
+var regexGrafanaTime = regexp.MustCompile(`^(now([+-][0-9]+[smhdwMy]|/[smhdwMy])*|[0-9]+)$`)
+
+// maxIncludeDepth bounds nested includes so an include cycle fails instead of recursing forever
+const maxIncludeDepth = 10
+
 // LoadConfigFromFile reads a YAML configuration file and unmarshals it into a Configuration struct.
 // The configPath is cleaned using filepath.Clean before reading.
+//
+// Anchors, aliases and merge keys (`<<`) are resolved by the YAML decoder. Values tagged with
+// !include are replaced by the contents of the referenced file, resolved relative to the file
+// containing the tag. An included list inside a list (such as `conversions`) is spliced into it.
 func LoadConfigFromFile(configPath string) (model.Configuration, error) {
 	configPath = filepath.Clean(configPath)
 
@@ -20,10 +50,134 @@ func LoadConfigFromFile(configPath string) (model.Configuration, error) {
 		return model.Configuration{}, fmt.Errorf("error reading config file: %w", err)
 	}
 
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(configContent), &root); err != nil {
+		return model.Configuration{}, fmt.Errorf("error unmarshalling config file: %w", err)
+	}
+
+	if err := resolveIncludes(&root, filepath.Dir(configPath), 0); err != nil {
+		return model.Configuration{}, fmt.Errorf("error resolving includes in config file: %w", err)
+	}
+
 	var config model.Configuration
-	if err := yaml.Unmarshal([]byte(configContent), &config); err != nil {
+	if err := root.Decode(&config); err != nil {
 		return model.Configuration{}, fmt.Errorf("error unmarshalling config file: %w", err)
 	}
 
 	return config, nil
 }
+
+// resolveIncludes walks the node tree and replaces every !include node with the root of the
+// referenced fragment. Alias nodes are left untouched, as their anchor is resolved in place.
+func resolveIncludes(node *yaml.Node, baseDir string, depth int) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.MappingNode:
+		for _, child := range node.Content {
+			if child.Tag == IncludeTag {
+				fragment, err := loadInclude(child, baseDir, depth)
+				if err != nil {
+					return err
+				}
+				*child = *fragment
+				continue
+			}
+			if err := resolveIncludes(child, baseDir, depth); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		content := make([]*yaml.Node, 0, len(node.Content))
+		for _, child := range node.Content {
+			if child.Tag != IncludeTag {
+				if err := resolveIncludes(child, baseDir, depth); err != nil {
+					return err
+				}
+				content = append(content, child)
+				continue
+			}
+			fragment, err := loadInclude(child, baseDir, depth)
+			if err != nil {
+				return err
+			}
+			if fragment.Kind == yaml.SequenceNode {
+				content = append(content, fragment.Content...)
+			} else {
+				content = append(content, fragment)
+			}
+		}
+		node.Content = content
+	}
+
+	return nil
+}
+
+// loadInclude reads and parses the fragment referenced by an !include node, resolving any
+// includes nested inside it relative to the fragment's own directory.
+func loadInclude(node *yaml.Node, baseDir string, depth int) (*yaml.Node, error) {
+	if node.Kind != yaml.ScalarNode || node.Value == "" {
+		return nil, fmt.Errorf("line %d: %s expects a file path", node.Line, IncludeTag)
+	}
+	if depth >= maxIncludeDepth {
+		return nil, fmt.Errorf("line %d: includes nested deeper than %d levels", node.Line, maxIncludeDepth)
+	}
+	// Ensure the included path stays within the directory of the including file
+	if !filepath.IsLocal(node.Value) {
+		return nil, fmt.Errorf("line %d: included path is not local: %s", node.Line, node.Value)
+	}
+
+	includePath := filepath.Join(baseDir, node.Value)
+	content, err := ReadLocalFile(includePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading included file %s: %w", includePath, err)
+	}
+
+	var fragment yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &fragment); err != nil {
+		return nil, fmt.Errorf("error unmarshalling included file %s: %w", includePath, err)
+	}
+	if fragment.Kind != yaml.DocumentNode || len(fragment.Content) == 0 {
+		return nil, fmt.Errorf("included file %s is empty", includePath)
+	}
+	if err := resolveIncludes(&fragment, filepath.Dir(includePath), depth+1); err != nil {
+		return nil, err
+	}
+
+	return fragment.Content[0], nil
+}
+
+// ApplyEnvOverrides replaces the Grafana instance, folder UID and organization ID of the configuration
+// with the values of the GRAFANA_INSTANCE, FOLDER_ID and ORG_ID environment variables, when set.
+// Overridden values are validated, as they bypass the configuration schema.
+func ApplyEnvOverrides(config *model.Configuration) error {
+	if instance := os.Getenv(GrafanaInstanceEnv); instance != "" {
+		parsed, err := url.Parse(instance)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid %s: %s is not an HTTP or HTTPS URL", GrafanaInstanceEnv, instance)
+		}
+		config.DeployerConfig.GrafanaInstance = instance
+	}
+	if folderID := os.Getenv(FolderIDEnv); folderID != "" {
+		if !regexGrafanaID.MatchString(folderID) {
+			return fmt.Errorf("invalid %s: %s is not a valid folder UID", FolderIDEnv, folderID)
+		}
+		config.IntegratorConfig.FolderID = folderID
+	}
+	if orgID := os.Getenv(OrgIDEnv); orgID != "" {
+		parsed, err := strconv.ParseInt(orgID, 10, 64)
+		if err != nil || parsed < 1 {
+			return fmt.Errorf("invalid %s: %s is not a positive integer", OrgIDEnv, orgID)
+		}
+		config.IntegratorConfig.OrgID = parsed
+	}
+	return nil
+}
+
+// ValidateTimeExpression checks a time of a Grafana time range, such as the from and to of query tests, so
+// a typo fails when loading the configuration rather than when Grafana rejects the queries. Empty values are
+// valid, as they fall back to a default.
+func ValidateTimeExpression(setting, value string) error {
+	if value == "" || regexGrafanaTime.MatchString(value) {
+		return nil
+	}
+	return fmt.Errorf("invalid %s %q: use a Grafana relative time such as now-1h, or a Unix timestamp in milliseconds", setting, value)
+}
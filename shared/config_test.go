@@ -0,0 +1,207 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfigFromFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		configPath string
+		expConfig  model.Configuration
+		wantError  bool
+	}{
+		{
+			name:       "anchors and merge keys",
+			configPath: "testdata/anchors.yml",
+			expConfig: model.Configuration{
+				Folders: model.FoldersConfig{
+					ConversionPath: "./conversions",
+					DeploymentPath: "./deployments",
+				},
+				ConversionDefaults: model.ConversionConfig{
+					Target:     "loki",
+					DataSource: "grafanacloud-logs",
+					RuleGroup:  "Every 5 Minutes",
+					TimeWindow: "5m",
+				},
+				Conversions: []model.ConversionConfig{
+					{
+						Name:       "aws_cloudtrail",
+						Target:     "loki",
+						DataSource: "grafanacloud-logs",
+						RuleGroup:  "Every 5 Minutes",
+						TimeWindow: "5m",
+					},
+					{
+						Name:       "okta_audit",
+						Target:     "loki",
+						DataSource: "okta-loki",
+						RuleGroup:  "Every 5 Minutes",
+						TimeWindow: "1h",
+					},
+				},
+				IntegratorConfig: model.IntegrationConfig{
+					FolderID: "XXXX",
+					OrgID:    1,
+				},
+				DeployerConfig: model.DeploymentConfig{
+					GrafanaInstance: "https://myinstance.grafana.com",
+				},
+			},
+		},
+		{
+			name:       "includes, with nested and spliced list fragments",
+			configPath: "testdata/include.yml",
+			expConfig: model.Configuration{
+				Folders: model.FoldersConfig{
+					ConversionPath: "./conversions",
+					DeploymentPath: "./deployments",
+				},
+				ConversionDefaults: model.ConversionConfig{
+					Target:     "loki",
+					DataSource: "grafanacloud-logs",
+				},
+				Conversions: []model.ConversionConfig{
+					{
+						Name:       "aws_cloudtrail",
+						RuleGroup:  "Every 5 Minutes",
+						TimeWindow: "5m",
+					},
+					{
+						Name:       "okta_audit",
+						DataSource: "okta-loki",
+					},
+					{
+						Name:       "gcp_k8s",
+						RuleGroup:  "Every 1 Hour",
+						TimeWindow: "1h",
+					},
+					{
+						Name: "github_audit",
+					},
+				},
+				IntegratorConfig: model.IntegrationConfig{
+					FolderID: "XXXX",
+					OrgID:    1,
+				},
+				DeployerConfig: model.DeploymentConfig{
+					GrafanaInstance: "https://myinstance.grafana.com",
+				},
+			},
+		},
+		{
+			name:       "included path is not local",
+			configPath: "testdata/include-non-local.yml",
+			wantError:  true,
+		},
+		{
+			name:       "include cycle",
+			configPath: "testdata/include-cycle.yml",
+			wantError:  true,
+		},
+		{
+			name:       "missing config file",
+			configPath: "testdata/missing.yml",
+			wantError:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := LoadConfigFromFile(tt.configPath)
+			if tt.wantError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expConfig, config)
+		})
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	fileConfig := model.Configuration{
+		IntegratorConfig: model.IntegrationConfig{
+			FolderID: "XXXX",
+			OrgID:    1,
+		},
+		DeployerConfig: model.DeploymentConfig{
+			GrafanaInstance: "https://myinstance.grafana.com",
+		},
+	}
+
+	tests := []struct {
+		name      string
+		env       map[string]string
+		expConfig model.Configuration
+		wantError bool
+	}{
+		{
+			name:      "no overrides",
+			expConfig: fileConfig,
+		},
+		{
+			name: "env overrides file values",
+			env: map[string]string{
+				GrafanaInstanceEnv: "https://staging.grafana.net",
+				FolderIDEnv:        "staging-folder",
+				OrgIDEnv:           "42",
+			},
+			expConfig: model.Configuration{
+				IntegratorConfig: model.IntegrationConfig{
+					FolderID: "staging-folder",
+					OrgID:    42,
+				},
+				DeployerConfig: model.DeploymentConfig{
+					GrafanaInstance: "https://staging.grafana.net",
+				},
+			},
+		},
+		{
+			name:      "invalid Grafana instance",
+			env:       map[string]string{GrafanaInstanceEnv: "ftp://staging.grafana.net"},
+			wantError: true,
+		},
+		{
+			name:      "invalid folder UID",
+			env:       map[string]string{FolderIDEnv: "../folder"},
+			wantError: true,
+		},
+		{
+			name:      "invalid org ID",
+			env:       map[string]string{OrgIDEnv: "0"},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			config := fileConfig
+			err := ApplyEnvOverrides(&config)
+			if tt.wantError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expConfig, config)
+		})
+	}
+}
+
+func TestValidateTimeExpression(t *testing.T) {
+	for _, value := range []string{"", "now", "now-1h", "now-7d", "now-1d/d", "now/w", "now+30m", "now-1M-2w", "1758615188601"} {
+		assert.NoError(t, ValidateTimeExpression("integration.from", value), value)
+	}
+	for _, value := range []string{"now-1hour", "now-", "now - 1h", "1h", "-1h", "yesterday", "2025-09-23T08:13:08Z", "now-1.5h"} {
+		assert.Error(t, ValidateTimeExpression("integration.from", value), value)
+	}
+	assert.EqualError(t, ValidateTimeExpression("integration.from", "now-1hour"),
+		`invalid integration.from "now-1hour": use a Grafana relative time such as now-1h, or a Unix timestamp in milliseconds`)
+}
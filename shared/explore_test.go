@@ -1,11 +1,10 @@
-package querytest
+package shared
 
 import (
 	"net/url"
 	"testing"
 
 	"github.com/grafana/sigma-rule-deployment/internal/model"
-	"github.com/grafana/sigma-rule-deployment/shared"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,7 +27,7 @@ func TestGenerateExploreLink(t *testing.T) {
 			name:           "Loki explore link generation",
 			query:          `{job="loki"} |= "error"`,
 			datasource:     "loki-uid-123",
-			datasourceType: shared.Loki,
+			datasourceType: Loki,
 			from:           "now-1h",
 			to:             "now",
 			orgID:          1,
@@ -60,7 +59,7 @@ func TestGenerateExploreLink(t *testing.T) {
 			name:           "Elasticsearch explore link generation",
 			query:          `type:log AND (level:(ERROR OR FATAL OR CRITICAL))`,
 			datasource:     "es-uid-456",
-			datasourceType: shared.Elasticsearch,
+			datasourceType: Elasticsearch,
 			from:           "now-2h",
 			to:             "now-1h",
 			orgID:          2,
@@ -125,7 +124,7 @@ func TestGenerateExploreLink(t *testing.T) {
 			name:           "Empty datasource should work fine",
 			query:          `{job="test"}`,
 			datasource:     "",
-			datasourceType: shared.Loki,
+			datasourceType: Loki,
 			from:           "now-1h",
 			to:             "now",
 			orgID:          1,
@@ -0,0 +1,29 @@
+//nolint:revive
+package shared
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GitHubRepository returns the server URL, the owner/repo name and the commit of the GitHub Actions run, from the
+// default environment variables of GitHub Actions. ok is false when any of them is missing, e.g. outside of GitHub.
+func GitHubRepository() (server, repository, sha string, ok bool) {
+	server = GetConfigValue(os.Getenv("GITHUB_SERVER_URL"), "https://github.com", "")
+	repository = os.Getenv("GITHUB_REPOSITORY")
+	sha = os.Getenv("GITHUB_SHA")
+	return strings.TrimSuffix(server, "/"), repository, sha, repository != "" && sha != ""
+}
+
+// GitHubBlobURL returns the URL of a file of the repository at the commit of the GitHub Actions run,
+// or an empty string outside of GitHub Actions
+func GitHubBlobURL(file string) string {
+	server, repository, sha, ok := GitHubRepository()
+	if !ok || file == "" {
+		return ""
+	}
+	path := (&url.URL{Path: filepath.ToSlash(filepath.Clean(file))}).EscapedPath()
+	return server + "/" + repository + "/blob/" + sha + "/" + path
+}
@@ -7,11 +7,25 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 )
 
+// debugHTTPOutput is where requests and responses are logged with DEBUG_HTTP, a variable so that tests can capture them
+var debugHTTPOutput io.Writer = os.Stderr
+
+// redacted replaces the secrets of logged requests and responses
+const redacted = "[REDACTED]"
+
+// secretFormField matches the token and password fields of form-encoded bodies, e.g. api_token=abc
+var secretFormField = regexp.MustCompile(`(?i)((^|&)[^=&]*(token|password)[^=&]*=)[^&]*`)
+
 // GrafanaClient provides a reusable HTTP client for Grafana API requests
 type GrafanaClient struct {
 	baseURL   string
@@ -19,6 +33,10 @@ type GrafanaClient struct {
 	timeout   time.Duration
 	userAgent string
 	client    *http.Client
+	// headers are additional headers sent with every request
+	headers map[string]string
+	// debug logs the requests and responses, with their secrets redacted
+	debug bool
 }
 
 // NewGrafanaClient creates a new Grafana HTTP client
@@ -36,7 +54,16 @@ func NewGrafanaClient(baseURL, apiKey, userAgent string, timeout time.Duration)
 		client: &http.Client{
 			Timeout: timeout,
 		},
+		debug: strings.ToLower(os.Getenv("DEBUG_HTTP")) == "true",
+	}
+}
+
+// SetHeader adds a header to every request made by the client
+func (c *GrafanaClient) SetHeader(key, value string) {
+	if c.headers == nil {
+		c.headers = map[string]string{}
 	}
+	c.headers[key] = value
 }
 
 // setHeaders sets common headers for Grafana API requests
@@ -47,6 +74,9 @@ func (c *GrafanaClient) setHeaders(req *http.Request) {
 	if c.userAgent != "" {
 		req.Header.Set("User-Agent", c.userAgent)
 	}
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
 }
 
 // newRequest creates a new HTTP request with context and common headers
@@ -75,14 +105,121 @@ func (c *GrafanaClient) Do(ctx context.Context, method, path string, body io.Rea
 		return nil, fmt.Errorf("request URL host %q does not match client base URL", req.URL.Host)
 	}
 
+	if c.debug {
+		if err := logRequest(req); err != nil {
+			return nil, err
+		}
+	}
+
 	resp, err := c.client.Do(req) //nolint:gosec // G704: req.URL.Hostname() validated to match client base URL above
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute request: %w", err)
 	}
 
+	if c.debug {
+		if err := logResponse(req, resp); err != nil {
+			return nil, err
+		}
+	}
 	return resp, nil
 }
 
+// logRequest logs the method, URL, headers and body of a request, with the Authorization header and the token
+// and password fields redacted. The body is read and replaced so that it can still be sent.
+func logRequest(req *http.Request) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return fmt.Errorf("failed to read request body: %w", err)
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	fmt.Fprintf(debugHTTPOutput, "HTTP request: %s %s\n", req.Method, redactURL(req.URL))
+	for _, key := range slices.Sorted(maps.Keys(req.Header)) {
+		value := strings.Join(req.Header.Values(key), ", ")
+		if key == "Authorization" {
+			value = redacted
+		}
+		fmt.Fprintf(debugHTTPOutput, "  %s: %s\n", key, value)
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(debugHTTPOutput, "  %s\n", redactBody(body))
+	}
+	return nil
+}
+
+// logResponse logs the status and body of the response to a request, with the token and password fields
+// redacted. The body is read and replaced so that it can still be read by the caller.
+func logResponse(req *http.Request, resp *http.Response) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	fmt.Fprintf(debugHTTPOutput, "HTTP response: %s %s: %s\n", req.Method, redactURL(req.URL), resp.Status)
+	if len(body) > 0 {
+		fmt.Fprintf(debugHTTPOutput, "  %s\n", redactBody(body))
+	}
+	return nil
+}
+
+// isSecretKey reports whether a field or parameter holds a secret, i.e. a token or password
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	return strings.Contains(key, "token") || strings.Contains(key, "password")
+}
+
+// redactURL returns the URL with the values of its token and password query parameters redacted
+func redactURL(u *url.URL) string {
+	query := u.Query()
+	redactedURL := *u
+	for key := range query {
+		if isSecretKey(key) {
+			query.Set(key, redacted)
+		}
+	}
+	if len(query) > 0 {
+		redactedURL.RawQuery = query.Encode()
+	}
+	return redactedURL.Redacted()
+}
+
+// redactBody returns the body with the values of its token and password fields redacted, at any depth of a JSON
+// body, or as parameters of a form-encoded one
+func redactBody(body []byte) string {
+	var content any
+	if err := json.Unmarshal(body, &content); err != nil {
+		return secretFormField.ReplaceAllString(string(body), "${1}"+redacted)
+	}
+	redactedBody, err := json.Marshal(redactJSON(content))
+	if err != nil {
+		return redacted
+	}
+	return string(redactedBody)
+}
+
+// redactJSON replaces the values of the token and password fields of decoded JSON
+func redactJSON(content any) any {
+	switch value := content.(type) {
+	case map[string]any:
+		for key, field := range value {
+			if isSecretKey(key) {
+				value[key] = redacted
+			} else {
+				value[key] = redactJSON(field)
+			}
+		}
+	case []any:
+		for index, item := range value {
+			value[index] = redactJSON(item)
+		}
+	}
+	return content
+}
+
 // Get performs a GET request
 func (c *GrafanaClient) Get(ctx context.Context, path string) (*http.Response, error) {
 	return c.Do(ctx, http.MethodGet, path, nil)
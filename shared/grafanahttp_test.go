@@ -0,0 +1,107 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrafanaClientDebugHTTP(t *testing.T) {
+	tests := []struct {
+		name        string
+		debug       string
+		path        string
+		body        string
+		wantLogged  []string
+		wantSecrets []string
+	}{
+		{
+			name:  "disabled by default",
+			path:  "api/ds/query",
+			body:  `{"queries":[]}`,
+			debug: "",
+		},
+		{
+			name:  "redacts JSON fields",
+			debug: "true",
+			path:  "api/serviceaccounts",
+			body:  `{"name":"deployer","apiToken":"glsa_request_secret","nested":{"password":"hunter2"},"items":[{"refresh_token":"refresh-secret"}]}`,
+			wantLogged: []string{
+				"HTTP request: POST ",
+				"/api/serviceaccounts",
+				"Authorization: [REDACTED]",
+				`"name":"deployer"`,
+				`"apiToken":"[REDACTED]"`,
+				`"password":"[REDACTED]"`,
+				`"refresh_token":"[REDACTED]"`,
+				"HTTP response: POST ",
+				"200 OK",
+				`"token":"[REDACTED]"`,
+			},
+			wantSecrets: []string{"glsa_request_secret", "hunter2", "refresh-secret", "glsa_response_secret"},
+		},
+		{
+			name:  "redacts form fields and query parameters",
+			debug: "TRUE",
+			path:  "api/login?user=admin&access_token=query-secret",
+			body:  "user=admin&password=form-secret&client_token=other-secret",
+			wantLogged: []string{
+				"user=admin",
+				"password=[REDACTED]",
+				"client_token=[REDACTED]",
+				"access_token=%5BREDACTED%5D",
+			},
+			wantSecrets: []string{"query-secret", "form-secret", "other-secret", "glsa_response_secret"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var err error
+				received, err = io.ReadAll(r.Body)
+				assert.NoError(t, err)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"token":"glsa_response_secret"}`))
+			}))
+			defer server.Close()
+
+			var output bytes.Buffer
+			debugHTTPOutput = &output
+			t.Cleanup(func() { debugHTTPOutput = os.Stderr })
+			t.Setenv("DEBUG_HTTP", tt.debug)
+
+			client := NewGrafanaClient(server.URL, "glsa_api_key_secret", "test", 5*time.Second)
+			resp, err := client.PostRaw(context.Background(), tt.path, []byte(tt.body))
+			require.NoError(t, err)
+			body, err := ReadResponseBody(resp)
+			require.NoError(t, err)
+
+			// The logged bodies are still sent and returned in full
+			assert.Equal(t, tt.body, string(received))
+			assert.Equal(t, `{"token":"glsa_response_secret"}`, string(body))
+
+			logged := output.String()
+			if tt.debug == "" {
+				assert.Empty(t, logged)
+				return
+			}
+			assert.NotContains(t, logged, "glsa_api_key_secret")
+			for _, want := range tt.wantLogged {
+				assert.Contains(t, logged, want)
+			}
+			for _, secret := range tt.wantSecrets {
+				assert.NotContains(t, logged, secret)
+			}
+		})
+	}
+}
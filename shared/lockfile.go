@@ -0,0 +1,121 @@
+//nolint:revive
+package shared
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+)
+
+// SourceDigestAnnotation is the annotation holding the digest of the alert file an alert rule was deployed from
+const SourceDigestAnnotation = "SourceDigest"
+
+// AlertFileDigest returns the digest of the content of an alert file. The digest is computed over the canonical
+// JSON of the file without its SourceDigest annotation, so reformatting the file or editing the annotation by hand
+// doesn't change it.
+func AlertFileDigest(content string) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(content)))
+	decoder.UseNumber()
+	rule := map[string]any{}
+	if err := decoder.Decode(&rule); err != nil {
+		return "", fmt.Errorf("error parsing alert file: %v", err)
+	}
+	if annotations, ok := rule["annotations"].(map[string]any); ok {
+		delete(annotations, SourceDigestAnnotation)
+	} else {
+		rule["annotations"] = map[string]any{}
+	}
+
+	canonical, err := json.Marshal(rule)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling alert file: %v", err)
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// LockAlerts lists the alert files of the deployment folder along with the digest of their content, sorted by file.
+// The conversion file of each alert rule is read from the conversionFileKey annotation, if set.
+func LockAlerts(deploymentPath, conversionFileKey string) (model.AlertLock, error) {
+	files, err := filepath.Glob(filepath.Join(deploymentPath, "*.json"))
+	if err != nil {
+		return model.AlertLock{}, fmt.Errorf("error listing alert files: %v", err)
+	}
+	lock := model.AlertLock{Alerts: make([]model.LockedAlert, 0, len(files))}
+	for _, file := range files {
+		content, err := ReadLocalFile(file)
+		if err != nil {
+			return model.AlertLock{}, err
+		}
+		rule := model.ProvisionedAlertRule{}
+		if err := json.Unmarshal([]byte(content), &rule); err != nil {
+			return model.AlertLock{}, fmt.Errorf("error parsing alert file %s: %v", file, err)
+		}
+		digest, err := AlertFileDigest(content)
+		if err != nil {
+			return model.AlertLock{}, fmt.Errorf("error computing the digest of %s: %v", file, err)
+		}
+		locked := model.LockedAlert{
+			File:         filepath.Base(file),
+			UID:          rule.UID,
+			Title:        rule.Title,
+			FolderUID:    rule.FolderUID,
+			RuleGroup:    rule.RuleGroup,
+			SourceDigest: digest,
+		}
+		if conversionFileKey != "" {
+			locked.ConversionFile = rule.Annotations[conversionFileKey]
+		}
+		lock.Alerts = append(lock.Alerts, locked)
+	}
+	slices.SortFunc(lock.Alerts, func(a, b model.LockedAlert) int {
+		return strings.Compare(a.File, b.File)
+	})
+	return lock, nil
+}
+
+// ReadAlertLock reads a lock file written by the integrator
+func ReadAlertLock(lockFile string) (model.AlertLock, error) {
+	content, err := ReadLocalFile(lockFile)
+	if err != nil {
+		return model.AlertLock{}, fmt.Errorf("error reading lock file %s: %v", lockFile, err)
+	}
+	lock := model.AlertLock{}
+	if err := json.Unmarshal([]byte(content), &lock); err != nil {
+		return model.AlertLock{}, fmt.Errorf("error parsing lock file %w", DescribeJSONError(lockFile, []byte(content), err))
+	}
+	return lock, nil
+}
+
+// CompareAlertLocks returns the differences between the locked alert rules and the current ones, by UID,
+// or nil when they match. The digests cover the title, folder and rule group of the alert rules.
+func CompareAlertLocks(locked, current model.AlertLock) []string {
+	currentAlerts := make(map[string]model.LockedAlert, len(current.Alerts))
+	for _, alert := range current.Alerts {
+		currentAlerts[alert.UID] = alert
+	}
+	var diffs []string
+	for _, lockedAlert := range locked.Alerts {
+		alert, ok := currentAlerts[lockedAlert.UID]
+		delete(currentAlerts, lockedAlert.UID)
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("alert rule %s (%s) is locked but missing", lockedAlert.UID, lockedAlert.File))
+		case alert.SourceDigest != lockedAlert.SourceDigest:
+			diffs = append(diffs, fmt.Sprintf("alert rule %s (%s) changed since it was locked", alert.UID, alert.File))
+		}
+	}
+	for _, alert := range current.Alerts {
+		if _, ok := currentAlerts[alert.UID]; ok {
+			diffs = append(diffs, fmt.Sprintf("alert rule %s (%s) is not locked", alert.UID, alert.File))
+		}
+	}
+	return diffs
+}
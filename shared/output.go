@@ -0,0 +1,61 @@
+//nolint:revive
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// OutputFormatJSON is the OUTPUT_FORMAT collecting the outputs set with SetOutput, for PrintOutputs to print
+// them as a single JSON object. Outputs are still written to GITHUB_OUTPUT when it is set.
+const OutputFormatJSON = "json"
+
+var (
+	outputsMu        sync.Mutex
+	collectedOutputs = map[string]string{}
+)
+
+// JSONOutputEnabled reports whether the outputs are collected to be printed as JSON
+func JSONOutputEnabled() bool {
+	return strings.ToLower(os.Getenv("OUTPUT_FORMAT")) == OutputFormatJSON
+}
+
+func collectOutput(output, value string) {
+	outputsMu.Lock()
+	defer outputsMu.Unlock()
+	collectedOutputs[output] = value
+}
+
+// Outputs returns the outputs collected so far. Values holding a JSON object or array, such as
+// test_query_results, are returned as JSON so they are embedded as is rather than as strings.
+func Outputs() map[string]any {
+	outputsMu.Lock()
+	defer outputsMu.Unlock()
+	outputs := make(map[string]any, len(collectedOutputs))
+	for output, value := range collectedOutputs {
+		trimmed := strings.TrimSpace(value)
+		if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+			outputs[output] = json.RawMessage(trimmed)
+		} else {
+			outputs[output] = value
+		}
+	}
+	return outputs
+}
+
+// PrintOutputs prints the outputs collected so far as a single JSON object, when the JSON output format is enabled
+func PrintOutputs(w io.Writer) error {
+	if !JSONOutputEnabled() {
+		return nil
+	}
+	outputs, err := json.Marshal(Outputs())
+	if err != nil {
+		return fmt.Errorf("error marshalling outputs: %v", err)
+	}
+	_, err = fmt.Fprintln(w, string(outputs))
+	return err
+}
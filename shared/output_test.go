@@ -0,0 +1,59 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintOutputs(t *testing.T) {
+	t.Cleanup(func() { collectedOutputs = map[string]string{} })
+
+	t.Run("disabled by default", func(t *testing.T) {
+		t.Setenv("OUTPUT_FORMAT", "")
+		t.Setenv("GITHUB_OUTPUT", "")
+		assert.Error(t, SetOutput("rules_integrated", "conv.json"))
+
+		var buf bytes.Buffer
+		require.NoError(t, PrintOutputs(&buf))
+		assert.Empty(t, buf.String())
+	})
+
+	t.Run("json without a GitHub output file", func(t *testing.T) {
+		t.Setenv("OUTPUT_FORMAT", "JSON")
+		t.Setenv("GITHUB_OUTPUT", "")
+		require.NoError(t, SetOutput("rules_integrated", "conversions/a.json conversions/b.json"))
+		require.NoError(t, SetOutput("test_query_results", `{"conversions/a.json":[{"datasource":"loki","stats":{"count":3}}]}`))
+		require.NoError(t, SetOutput("no_match_rules", ""))
+
+		var buf bytes.Buffer
+		require.NoError(t, PrintOutputs(&buf))
+		var outputs map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &outputs))
+		assert.Equal(t, "conversions/a.json conversions/b.json", outputs["rules_integrated"])
+		assert.Equal(t, "", outputs["no_match_rules"])
+		// JSON outputs are embedded as is
+		assert.Equal(t, map[string]any{
+			"conversions/a.json": []any{map[string]any{"datasource": "loki", "stats": map[string]any{"count": float64(3)}}},
+		}, outputs["test_query_results"])
+	})
+
+	t.Run("json along with a GitHub output file", func(t *testing.T) {
+		t.Chdir(t.TempDir())
+		t.Setenv("OUTPUT_FORMAT", "json")
+		t.Setenv("GITHUB_OUTPUT", "output")
+		require.NoError(t, SetOutput("alerts_created", "abc123"))
+
+		contents, err := os.ReadFile("output")
+		require.NoError(t, err)
+		assert.Equal(t, "alerts_created=abc123\n", string(contents))
+
+		var buf bytes.Buffer
+		require.NoError(t, PrintOutputs(&buf))
+		assert.Contains(t, buf.String(), `"alerts_created":"abc123"`)
+	})
+}
@@ -13,6 +13,8 @@ import (
 const (
 	Loki          = "loki"
 	Elasticsearch = "elasticsearch"
+	Prometheus    = "prometheus"
+	Graphite      = "graphite"
 )
 
 func GetInputOrDefault(name string, value string) string {
@@ -28,6 +30,13 @@ func GetInputOrDefault(name string, value string) string {
 
 func SetOutput(output, value string) error {
 	outputFile := os.Getenv("GITHUB_OUTPUT")
+	if JSONOutputEnabled() {
+		collectOutput(output, value)
+		// Outside GitHub Actions, the outputs are only printed as JSON
+		if outputFile == "" {
+			return nil
+		}
+	}
 	if outputFile == "" {
 		return errors.New("only output with a github output file supported. See https://github.blog/changelog/2022-10-11-github-actions-deprecating-save-state-and-set-output-commands/ for further details")
 	}
@@ -79,3 +88,31 @@ func GetConfigValue(config, defaultConf, def string) string {
 	}
 	return def
 }
+
+// jsonErrorContext is the number of bytes of the JSON shown on either side of a parse error
+const jsonErrorContext = 20
+
+// DescribeJSONError adds the file name to an error parsing its JSON content and, for syntax and type errors,
+// the line, column and byte offset of the error along with a snippet of the content around it. JSON files are
+// often edited by hand, and json.Unmarshal errors alone don't tell where a trailing comma or comment is.
+func DescribeJSONError(file string, content []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	// The offset is the number of bytes read when the error occurred, so the byte at fault is the one before
+	offset = min(max(offset-1, 0), int64(len(content)))
+
+	before := content[:offset]
+	line := strings.Count(string(before), "\n") + 1
+	column := int(offset) - strings.LastIndex(string(before), "\n")
+	snippet := content[max(offset-jsonErrorContext, 0):min(offset+jsonErrorContext, int64(len(content)))]
+	return fmt.Errorf("%s: invalid JSON at line %d, column %d (byte offset %d) near %q: %w", file, line, column, offset, snippet, err)
+}
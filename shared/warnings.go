@@ -0,0 +1,80 @@
+//nolint:revive
+package shared
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/grafana/sigma-rule-deployment/internal/model"
+)
+
+// Warnings collects the warnings raised during a run, so they can be reported together and,
+// in strict mode, turned into a failure. A nil *Warnings only prints the warnings. Warnings may be
+// added concurrently, e.g. by query tests.
+type Warnings struct {
+	mu       sync.Mutex
+	messages []string
+	// warnings located in a file, reported as annotations of the file
+	annotations []model.Annotation
+}
+
+// Add prints a warning and records it
+func (w *Warnings) Add(format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	fmt.Printf("Warning: %s\n", message)
+	if w != nil {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.messages = append(w.messages, message)
+	}
+}
+
+// AddForFile prints and records a warning caused by the content of a file, which is also reported
+// as an annotation of the file
+func (w *Warnings) AddForFile(file, format string, args ...any) {
+	w.Add(format, args...)
+	if w != nil {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.annotations = append(w.annotations, model.Annotation{
+			File:    filepath.ToSlash(file),
+			Level:   model.AnnotationWarning,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+}
+
+// Annotations returns the annotations of the warnings recorded so far which are located in a file
+func (w *Warnings) Annotations() []model.Annotation {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.annotations
+}
+
+// List returns the warnings recorded so far
+func (w *Warnings) List() []string {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.messages
+}
+
+// Err returns an error listing the recorded warnings, or nil if there were none
+func (w *Warnings) Err() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.messages) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d warning(s) raised in strict mode:\n%s", len(w.messages), strings.Join(w.messages, "\n"))
+}